@@ -0,0 +1,65 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2_test
+
+import (
+	"compress/bzip2"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/cosnicolaou/pbzip2"
+	"github.com/cosnicolaou/pbzip2/internal"
+)
+
+// BenchmarkParallelVsStdlib compares the throughput, in terms of
+// decompressed MB/s, of compress/bzip2 with that of pbzip2 at various
+// levels of concurrency for the larger fixtures and for a file of random
+// data generated at benchmark time. Fixtures that are not available,
+// including the generated one if bzip2 is not installed, are skipped.
+func BenchmarkParallelVsStdlib(b *testing.B) {
+	fixtures := map[string]string{}
+	for _, name := range []string{"800KB1", "900KB1", "900KB9", "1033KB4_Random"} {
+		if filename, ok := bzip2Files[name]; ok {
+			fixtures[name] = filename + ".bz2"
+		}
+	}
+	if internal.HaveBzip2() {
+		filename := filepath.Join(b.TempDir(), "4MB9_Random")
+		if err := internal.CreateBzipFile(filename, "-9", internal.GenReproducibleRandomData(4*1024*1024)); err != nil {
+			b.Fatal(err)
+		}
+		fixtures["4MB9_Random"] = filename + ".bz2"
+	}
+	concurrency := []int{1, 2, 4}
+	if n := runtime.GOMAXPROCS(-1); n > 4 {
+		concurrency = append(concurrency, n)
+	}
+	for _, name := range []string{"800KB1", "900KB1", "900KB9", "1033KB4_Random", "4MB9_Random"} {
+		compressed, err := os.ReadFile(fixtures[name])
+		if err != nil {
+			b.Run(name, func(b *testing.B) {
+				b.Skipf("fixture not available: %v", err)
+			})
+			continue
+		}
+		b.Run(name+"/stdlib", func(b *testing.B) {
+			internal.BenchmarkDecompression(b, compressed, bzip2.NewReader)
+		})
+		for _, n := range concurrency {
+			n := n
+			b.Run(fmt.Sprintf("%v/pbzip2-%v", name, n), func(b *testing.B) {
+				internal.BenchmarkDecompression(b, compressed, func(rd io.Reader) io.Reader {
+					return pbzip2.NewReader(context.Background(), rd,
+						pbzip2.DecompressionOptions(pbzip2.BZConcurrency(n)))
+				})
+			})
+		}
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import "context"
+
+// BlockBoundary describes the range of the decompressed output, from
+// DecompressedStart up to, but not including, DecompressedEnd, that was
+// obtained from a single compressed block. Order is the number of the
+// block, starting at 1, and CRC its CRC. The range of a block that was
+// merged with its successor following a false positive match of the
+// block magic number includes the output of both.
+type BlockBoundary struct {
+	Order             uint64
+	DecompressedStart int64
+	DecompressedEnd   int64
+	CRC               uint32
+}
+
+// BZBlockBoundaries sets the channel over which a BlockBoundary is sent
+// for each block as its output is reassembled, in order, thus allowing
+// offsets in the decompressed output to be mapped back to the compressed
+// blocks that they came from, eg. to build an index for seeking.
+// Boundaries are sent using blocking sends and hence decompression will
+// stall whilst the channel is full. They are not sent when BZUnordered
+// is used.
+func BZBlockBoundaries(ch chan<- BlockBoundary) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.boundaryCh = ch
+	}
+}
+
+// sendBoundary must be called before the totals are updated for block.
+func (dc *Decompressor) sendBoundary(ctx context.Context, block *blockDesc) {
+	if dc.boundaryCh == nil {
+		return
+	}
+	b := BlockBoundary{
+		Order:             block.order,
+		DecompressedStart: dc.totalDecompressed,
+		DecompressedEnd:   dc.totalDecompressed + int64(len(block.uncompressed)),
+		CRC:               block.CRC,
+	}
+	select {
+	case dc.boundaryCh <- b:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"cloudeng.io/cmdutil"
+	"github.com/cosnicolaou/pbzip2"
+)
+
+type concatFlags struct {
+	OutputFile   string `subcmd:"output,,'local output filepath, omit for stdout'"`
+	SingleStream bool   `subcmd:"single-stream,false,'combine the blocks of all of the input files into a single bzip2 stream'"`
+}
+
+func concat(ctx context.Context, values interface{}, args []string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	cmdutil.HandleSignals(cancel, os.Interrupt)
+	cl := values.(*concatFlags)
+	wr, writerCleanup, err := createFile(cl.OutputFile)
+	if err != nil {
+		return err
+	}
+	if cl.SingleStream {
+		err = concatSingleStream(ctx, wr, args)
+	} else {
+		err = concatFiles(ctx, wr, args)
+	}
+	if cerr := writerCleanup(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// concatFiles copies the input files to wr, the result is a valid bzip2
+// file consisting of multiple streams.
+func concatFiles(ctx context.Context, wr io.Writer, names []string) error {
+	for _, name := range names {
+		rd, _, readerCleanup, err := openFile(ctx, name)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(wr, rd)
+		readerCleanup()
+		if err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// concatSingleStream writes the blocks from all of the input files as a
+// single bzip2 stream whose level is the highest of any of the inputs.
+func concatSingleStream(ctx context.Context, wr io.Writer, names []string) error {
+	var (
+		blocks []pbzip2.CompressedBlock
+		level  pbzip2.BlockSizeLevel
+	)
+	for _, name := range names {
+		rd, _, readerCleanup, err := openFile(ctx, name)
+		if err != nil {
+			return err
+		}
+		sc := pbzip2.NewScanner(rd)
+		for sc.Scan(ctx) {
+			block := sc.Block()
+			if block.SizeInBits == 0 {
+				// Empty streams contain no blocks.
+				continue
+			}
+			if l := block.Level(); l > level {
+				level = l
+			}
+			blocks = append(blocks, block)
+		}
+		readerCleanup()
+		if err := sc.Err(); err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		}
+	}
+	if level == 0 {
+		// All of the inputs were empty.
+		level = 9
+	}
+	return pbzip2.WriteStream(wr, level, blocks)
+}
@@ -6,9 +6,13 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"cloudeng.io/cmdutil"
 	"cloudeng.io/errors"
@@ -16,16 +20,45 @@ import (
 	"github.com/cosnicolaou/pbzip2/internal/bzip2"
 )
 
-func scanFile(ctx context.Context, name string) error {
-	rd, _, readerCleanup, err := openFile(name)
+// fileBlockInfo is used for json output.
+type fileBlockInfo struct {
+	File string `json:"file"`
+	pbzip2.BlockInfo
+}
+
+func validateFormat(format string) error {
+	switch format {
+	case "text", "json":
+		return nil
+	}
+	return fmt.Errorf("unsupported format: %v", format)
+}
+
+func writeJSON(info []fileBlockInfo) error {
+	if info == nil {
+		info = []fileBlockInfo{}
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(info)
+}
+
+func scanFile(ctx context.Context, name string, info *[]fileBlockInfo) error {
+	rd, _, readerCleanup, err := openFile(ctx, name)
 	if err != nil {
 		return err
 	}
 	defer readerCleanup()
 	sc := pbzip2.NewScanner(rd)
+	n := 1
 	for sc.Scan(ctx) {
 		block := sc.Block()
-		fmt.Println(name, block.String())
+		if info != nil {
+			*info = append(*info, fileBlockInfo{File: name, BlockInfo: block.Info(n)})
+		} else {
+			fmt.Println(name, block.String())
+		}
+		n++
 	}
 	return sc.Err()
 }
@@ -33,15 +66,26 @@ func scanFile(ctx context.Context, name string) error {
 func scan(ctx context.Context, values interface{}, args []string) error {
 	ctx, cancel := context.WithCancel(ctx)
 	cmdutil.HandleSignals(cancel, os.Interrupt)
+	cl := values.(*formatFlags)
+	if err := validateFormat(cl.Format); err != nil {
+		return err
+	}
+	var info *[]fileBlockInfo
+	if cl.Format == "json" {
+		info = &[]fileBlockInfo{}
+	}
 	errs := errors.M{}
 	for _, arg := range args {
-		errs.Append(scanFile(ctx, arg))
+		errs.Append(scanFile(ctx, arg, info))
+	}
+	if info != nil {
+		errs.Append(writeJSON(*info))
 	}
 	return errs.Err()
 }
 
-func bz2StatsFile(ctx context.Context, name string) error {
-	rd, _, readerCleanup, err := openFile(name)
+func bz2StatsFile(ctx context.Context, name string, info *[]fileBlockInfo) error {
+	rd, _, readerCleanup, err := openFile(ctx, name)
 	if err != nil {
 		return err
 	}
@@ -58,19 +102,28 @@ func bz2StatsFile(ctx context.Context, name string) error {
 		return fmt.Errorf("failed to read: %v: %v", name, err)
 	}
 	stats := bzip2.StreamStats(bz2rd)
+	if info != nil {
+		// Note that the first entry in BlockCRCs is always zero.
+		sizes := stats.BlockSizes()
+		nblocks := len(sizes)
+		for i := 1; i <= nblocks; i++ {
+			bi := pbzip2.BlockInfo{
+				Block:      i,
+				SizeInBits: int(sizes[i-1]),
+				CRC:        stats.BlockCRCs[i],
+			}
+			if i == nblocks {
+				bi.EOS, bi.StreamCRC = true, stats.StreamCRC
+			}
+			*info = append(*info, fileBlockInfo{File: name, BlockInfo: bi})
+		}
+		return nil
+	}
 	fmt.Printf("=== %v ===\n", name)
 	fmt.Printf("Block, CRC, Size\n")
-	if len(stats.BlockStartOffsets) > 0 {
-		offsets := make([]uint, len(stats.BlockStartOffsets)+1)
-		for i := 0; i < len(offsets)-1; i++ {
-			offsets[i] = stats.BlockStartOffsets[i]
-		}
-		offsets[len(offsets)-1] = stats.EndOfStreamOffset
-		for i := 1; i < len(offsets); i++ {
-			size := offsets[i] - offsets[i-1] - 48
-			crc := stats.BlockCRCs[i]
-			fmt.Printf("% 12d   : % 12d - % 12d\n", i, crc, size)
-		}
+	for i, size := range stats.BlockSizes() {
+		crc := stats.BlockCRCs[i+1]
+		fmt.Printf("% 12d   : % 12d - % 12d\n", i+1, crc, size)
 	}
 	fmt.Printf("Stream/File CRC      : %v\n", stats.StreamCRC)
 	return nil
@@ -79,9 +132,91 @@ func bz2StatsFile(ctx context.Context, name string) error {
 func bz2stats(ctx context.Context, values interface{}, args []string) error {
 	ctx, cancel := context.WithCancel(ctx)
 	cmdutil.HandleSignals(cancel, os.Interrupt)
+	cl := values.(*formatFlags)
+	if err := validateFormat(cl.Format); err != nil {
+		return err
+	}
+	var info *[]fileBlockInfo
+	if cl.Format == "json" {
+		info = &[]fileBlockInfo{}
+	}
 	errs := errors.M{}
 	for _, arg := range args {
-		errs.Append(bz2StatsFile(ctx, arg))
+		errs.Append(bz2StatsFile(ctx, arg, info))
+	}
+	if info != nil {
+		errs.Append(writeJSON(*info))
 	}
 	return errs.Err()
 }
+
+// dumpedBlock is used for the metadata written by dump-block.
+type dumpedBlock struct {
+	File string `json:"file"`
+	pbzip2.BlockInfo
+	Offset          int64 `json:"offset"`
+	StreamBlockSize int   `json:"stream_block_size"`
+}
+
+func findBlock(ctx context.Context, name string, n int) (pbzip2.CompressedBlock, error) {
+	rd, _, readerCleanup, err := openFile(ctx, name)
+	if err != nil {
+		return pbzip2.CompressedBlock{}, err
+	}
+	defer readerCleanup()
+	sc := pbzip2.NewScanner(rd)
+	for i := 1; sc.Scan(ctx); i++ {
+		if i == n {
+			return sc.Block(), nil
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return pbzip2.CompressedBlock{}, err
+	}
+	return pbzip2.CompressedBlock{}, fmt.Errorf("%v: block %v not found", name, n)
+}
+
+func dumpBlock(ctx context.Context, values interface{}, args []string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	cmdutil.HandleSignals(cancel, os.Interrupt)
+	cl := values.(*dumpBlockFlags)
+	name := args[0]
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n < 1 {
+		return fmt.Errorf("invalid block number: %v", args[1])
+	}
+	prefix := cl.Prefix
+	if len(prefix) == 0 {
+		prefix = fmt.Sprintf("%v-block-%v", strings.TrimSuffix(filepath.Base(name), ".bz2"), n)
+	}
+	block, err := findBlock(ctx, name, n)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(prefix+".bz2block", block.Data, 0600); err != nil {
+		return err
+	}
+	metadata, err := json.MarshalIndent(dumpedBlock{
+		File:            name,
+		BlockInfo:       block.Info(n),
+		Offset:          block.Offset,
+		StreamBlockSize: block.StreamBlockSize,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(prefix+".json", metadata, 0600); err != nil {
+		return err
+	}
+	// Write out as much of the decompressed output as possible, even if
+	// the block is corrupt.
+	rd := bzip2.NewBlockReader(block.StreamBlockSize, block.Data, uint(block.BitOffset)) //#nosec G115 -- This is a false positive, block.BitOffset is always < 32.
+	out, rerr := io.ReadAll(rd)
+	if err := os.WriteFile(prefix+".out", out, 0600); err != nil {
+		return err
+	}
+	if rerr != nil {
+		return fmt.Errorf("%v: failed to decompress block %v: %v", name, n, rerr)
+	}
+	return nil
+}
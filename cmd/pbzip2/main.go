@@ -5,6 +5,7 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"io"
@@ -18,6 +19,7 @@ import (
 	"cloudeng.io/cmdutil/subcmd"
 	"cloudeng.io/errors"
 	"github.com/cosnicolaou/pbzip2"
+	_ "github.com/cosnicolaou/pbzip2/httpsource" // http and https inputs.
 	"github.com/schollz/progressbar/v2"
 	"golang.org/x/crypto/ssh/terminal"
 )
@@ -26,6 +28,7 @@ type CommonFlags struct {
 	Concurrency      int  `subcmd:"concurrency,4,'concurrency for the decompression'"`
 	MaxBlockOverhead int  `subcmd:"max-block-overhead,,'the max size of the per block coding tables'"`
 	Verbose          bool `subcmd:"verbose,false,verbose debug/trace information"`
+	Jobs             int  `subcmd:"jobs,1,'the number of files to decompress concurrently, the files share a pool of concurrency decompressors'"`
 }
 
 type catFlags struct {
@@ -36,9 +39,16 @@ type unzipFlags struct {
 	CommonFlags
 	ProgressBar bool   `subcmd:"progress,true,display a progress bar"`
 	OutputFile  string `subcmd:"output,,'local output filepath, omit for stdout'"`
+	WriteBuffer int    `subcmd:"write-buffer,0,'size in bytes of the buffer used to write the decompressed output, zero for unbuffered writes'"`
 }
 
-type noFlags struct{}
+type formatFlags struct {
+	Format string `subcmd:"format,text,'output format, text or json'"`
+}
+
+type dumpBlockFlags struct {
+	Prefix string `subcmd:"prefix,,'prefix for the output files, defaults to the input filename, without .bz2, followed by -block-<n>'"`
+}
 
 var cmdSet *subcmd.CommandSet
 
@@ -54,20 +64,35 @@ func init() {
 
 	unzipCmd := subcmd.NewCommand("unzip",
 		subcmd.MustRegisterFlagStruct(&unzipFlags{}, defaultConcurrency, nil),
-		unzip, subcmd.ExactlyNumArguments(1))
-	unzipCmd.Document(`decompress a bzip2 file.`)
+		unzip, subcmd.AtLeastNArguments(1))
+	unzipCmd.Document(`decompress one or more bzip2 files. If more than one file is specified then each is decompressed to a file of the same name with the .bz2 suffix removed.`)
 
 	scanCmd := subcmd.NewCommand("scan",
-		subcmd.MustRegisterFlagStruct(&noFlags{}, nil, nil),
+		subcmd.MustRegisterFlagStruct(&formatFlags{}, nil, nil),
 		scan, subcmd.AtLeastNArguments(1))
 	scanCmd.Document(`scan a bzip2 file using the pbzip2 package's scanner.`)
 
 	bz2Stats := subcmd.NewCommand("bz2-stats",
-		subcmd.MustRegisterFlagStruct(&noFlags{}, nil, nil),
+		subcmd.MustRegisterFlagStruct(&formatFlags{}, nil, nil),
 		bz2stats, subcmd.AtLeastNArguments(1))
 	bz2Stats.Document(`scan a bzip2 file to obtain bz2 stats on each block, the scan is serial and is intended purely for debugging purposes.`)
 
-	cmdSet = subcmd.NewCommandSet(bzcatCmd, unzipCmd, scanCmd, bz2Stats)
+	dumpBlockCmd := subcmd.NewCommand("dump-block",
+		subcmd.MustRegisterFlagStruct(&dumpBlockFlags{}, nil, nil),
+		dumpBlock, subcmd.ExactlyNumArguments(2))
+	dumpBlockCmd.Document(`extract the block, numbered from 1, specified by the second argument from the bzip2 file specified by the first. The raw compressed block, its metadata, including its bit offset, and its decompressed contents are written to <prefix>.bz2block, <prefix>.json and <prefix>.out respectively. It is intended purely for debugging purposes.`, "<file> <block>")
+
+	splitCmd := subcmd.NewCommand("split",
+		subcmd.MustRegisterFlagStruct(&splitFlags{}, nil, nil),
+		split, subcmd.ExactlyNumArguments(2))
+	splitCmd.Document(`split the bzip2 file specified by the first argument into the number of files specified by the second. Each file is a standalone bzip2 stream containing a contiguous run of the original's blocks, of roughly equal compressed size, such that decompressing the files in order yields the original's decompressed contents. The compressed blocks are copied verbatim. A new file is also started whenever the compression level of the input changes, and hence more files than requested may be written. The names of the files written are printed to stdout.`, "<file> <n>")
+
+	concatCmd := subcmd.NewCommand("concat",
+		subcmd.MustRegisterFlagStruct(&concatFlags{}, nil, nil),
+		concat, subcmd.AtLeastNArguments(1))
+	concatCmd.Document(`concatenate bzip2 files without recompressing them. By default the files are written end to end, which yields a valid bzip2 file containing multiple streams. With --single-stream the blocks of all of the files are instead combined into a single bzip2 stream with a recomputed stream CRC and the highest compression level of any of the files.`, "<file>...")
+
+	cmdSet = subcmd.NewCommandSet(bzcatCmd, unzipCmd, scanCmd, bz2Stats, dumpBlockCmd, splitCmd, concatCmd)
 	cmdSet.Document(`decompress and inspect bzip2 files. Files may be local, on S3 or a URL.`)
 
 }
@@ -81,35 +106,39 @@ func progressBar(ctx context.Context, progressBarWr io.Writer, ch chan pbzip2.Pr
 	bar.RenderBlank()
 	for {
 		select {
-		case p := <-ch:
-			if p.Block == 0 {
+		case p, ok := <-ch:
+			if !ok || p.Final {
 				fmt.Fprintf(progressBarWr, "\n")
 				return
 			}
 			bar.Add(p.Compressed)
-			if p.Block != next {
+			// Updates for several blocks may be coalesced into one.
+			if p.Block < next {
 				log.Fatalf("out of sequence block %#v\n", p)
 			}
-			next++
+			next = p.Block + 1
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func openFile(name string) (io.Reader, int64, func() error, error) {
-	if strings.HasPrefix(name, "http") {
-		return nil, 0, nil, fmt.Errorf("http urls not supported")
-	}
-	info, err := os.Stat(name)
+// openFile opens the named local file or URL, see pbzip2.NewSource.
+// The returned size is -1 if it cannot be determined.
+func openFile(ctx context.Context, name string) (io.Reader, int64, func() error, error) {
+	src, err := pbzip2.NewSource(name)
 	if err != nil {
 		return nil, 0, nil, err
 	}
-	file, err := os.Open(name)
+	rd, size, err := src.Open(ctx)
 	if err != nil {
 		return nil, 0, nil, err
 	}
-	return file, info.Size(), file.Close, nil
+	cleanup := func() error { return nil }
+	if c, ok := rd.(io.Closer); ok {
+		cleanup = c.Close
+	}
+	return rd, size, cleanup, nil
 }
 
 func createFile(name string) (io.Writer, func() error, error) {
@@ -127,6 +156,25 @@ func createFile(name string) (io.Writer, func() error, error) {
 	return file, file.Close, nil
 }
 
+// createBufferedFile is like createFile except that, for a size greater
+// than zero, the output is written via a buffer of that size so that the
+// OS sees large sequential writes whose sizes are a multiple of the buffer
+// size. The returned cleanup function flushes the buffer before closing
+// the file.
+func createBufferedFile(name string, size int) (io.Writer, func() error, error) {
+	wr, cleanup, err := createFile(name)
+	if err != nil || size <= 0 {
+		return wr, cleanup, err
+	}
+	bwr := bufio.NewWriterSize(wr, size)
+	return bwr, func() error {
+		errs := &errors.M{}
+		errs.Append(bwr.Flush())
+		errs.Append(cleanup())
+		return errs.Err()
+	}, nil
+}
+
 func main() {
 	cmdSet.MustDispatch(context.Background())
 }
@@ -144,9 +192,22 @@ func optsFromCommonFlags(cl *CommonFlags) (
 		scanOpts = append(scanOpts,
 			pbzip2.ScanBlockOverhead(cl.MaxBlockOverhead))
 	}
+	if cl.Jobs > 1 {
+		bzOpts = append(bzOpts,
+			pbzip2.BZConcurrencyPool(pbzip2.CreateConcurrencyPool(cl.Concurrency)))
+	}
 	return
 }
 
+// jobTokens returns a channel that can be used to limit the number of
+// files being processed concurrently.
+func jobTokens(jobs int) chan struct{} {
+	if jobs < 1 {
+		jobs = 1
+	}
+	return make(chan struct{}, jobs)
+}
+
 func cat(ctx context.Context, values interface{}, args []string) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -163,23 +224,62 @@ func cat(ctx context.Context, values interface{}, args []string) error {
 		return err
 	}
 
-	for _, inputFile := range args {
-		rd, _, readerCleanup, err := openFile(inputFile)
-		if err != nil {
-			return err
+	// Up to cl.Jobs files are opened and have their decompression started
+	// ahead of being copied, in order, to stdout.
+	type catInput struct {
+		name    string
+		rd      io.Reader
+		cleanup func() error
+		err     error
+	}
+	tokens := jobTokens(cl.Jobs)
+	inputs := make(chan catInput, len(args))
+	go func() {
+		defer close(inputs)
+		for _, inputFile := range args {
+			select {
+			case tokens <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			in := catInput{name: inputFile}
+			rd, _, readerCleanup, err := openFile(ctx, inputFile)
+			if err != nil {
+				in.err = err
+			} else {
+				in.cleanup = readerCleanup
+				in.rd = pbzip2.NewReader(ctx, rd,
+					pbzip2.DecompressionOptions(bzOpts...),
+					pbzip2.ScannerOptions(scanOpts...))
+			}
+			inputs <- in
 		}
-		defer readerCleanup()
-
-		dc := pbzip2.NewReader(ctx, rd,
-			pbzip2.DecompressionOptions(bzOpts...),
-			pbzip2.ScannerOptions(scanOpts...))
+	}()
 
-		_, err = io.Copy(os.Stdout, dc)
-		if err != nil {
-			return err
+	// Copying stops at the first error, rather than writing the output
+	// of the remaining files, and any files that were opened ahead of
+	// the failure are closed without being read.
+	errs := &errors.M{}
+	for in := range inputs {
+		<-tokens
+		if errs.Err() != nil {
+			if in.cleanup != nil {
+				errs.Append(in.cleanup())
+			}
+			continue
+		}
+		if in.err != nil {
+			errs.Append(in.err)
+		} else {
+			_, err := io.Copy(os.Stdout, in.rd)
+			errs.Append(err)
+			errs.Append(in.cleanup())
+		}
+		if errs.Err() != nil {
+			cancel()
 		}
 	}
-	return nil
+	return errs.Err()
 }
 
 func optsFromUnzipFlags(cl *unzipFlags) (
@@ -203,16 +303,19 @@ func unzip(ctx context.Context, values interface{}, args []string) error {
 	ctx, cancel := context.WithCancel(ctx)
 	cmdutil.HandleSignals(cancel, os.Interrupt)
 	cl := values.(*unzipFlags)
+	if len(args) > 1 {
+		return unzipFiles(ctx, cl, args)
+	}
 
 	bzOpts, scanOpts, progressBarCh, isTTY := optsFromUnzipFlags(cl)
 
-	rd, size, readerCleanup, err := openFile(args[0])
+	rd, size, readerCleanup, err := openFile(ctx, args[0])
 	if err != nil {
 		return err
 	}
 	defer readerCleanup()
 
-	wr, writerCleanup, err := createFile(cl.OutputFile)
+	wr, writerCleanup, err := createBufferedFile(cl.OutputFile, cl.WriteBuffer)
 	if err != nil {
 		return err
 	}
@@ -252,3 +355,55 @@ func unzip(ctx context.Context, values interface{}, args []string) error {
 
 	return errs.Err()
 }
+
+// unzipFiles decompresses each of the supplied files to a file of the same
+// name with the .bz2 suffix removed, with up to cl.Jobs files being
+// decompressed concurrently.
+func unzipFiles(ctx context.Context, cl *unzipFlags, args []string) error {
+	if len(cl.OutputFile) > 0 {
+		return fmt.Errorf("--output cannot be used with multiple files")
+	}
+	for _, inputFile := range args {
+		if !strings.HasSuffix(inputFile, ".bz2") {
+			return fmt.Errorf("%v: does not have a .bz2 suffix", inputFile)
+		}
+	}
+	bzOpts, scanOpts := optsFromCommonFlags(&cl.CommonFlags)
+	tokens := jobTokens(cl.Jobs)
+	errs := &errors.M{}
+	var wg sync.WaitGroup
+	wg.Add(len(args))
+	for _, inputFile := range args {
+		tokens <- struct{}{}
+		go func(inputFile string) {
+			err := unzipFile(ctx, inputFile, strings.TrimSuffix(inputFile, ".bz2"), cl.WriteBuffer, bzOpts, scanOpts)
+			if err != nil {
+				errs.Append(fmt.Errorf("%v: %v", inputFile, err))
+			}
+			<-tokens
+			wg.Done()
+		}(inputFile)
+	}
+	wg.Wait()
+	return errs.Err()
+}
+
+func unzipFile(ctx context.Context, inputFile, outputFile string, writeBuffer int, bzOpts []pbzip2.DecompressorOption, scanOpts []pbzip2.ScannerOption) error {
+	rd, _, readerCleanup, err := openFile(ctx, inputFile)
+	if err != nil {
+		return err
+	}
+	defer readerCleanup()
+	wr, writerCleanup, err := createBufferedFile(outputFile, writeBuffer)
+	if err != nil {
+		return err
+	}
+	dc := pbzip2.NewReader(ctx, rd,
+		pbzip2.DecompressionOptions(bzOpts...),
+		pbzip2.ScannerOptions(scanOpts...))
+	errs := &errors.M{}
+	_, err = io.Copy(wr, dc)
+	errs.Append(err)
+	errs.Append(writerCleanup())
+	return errs.Err()
+}
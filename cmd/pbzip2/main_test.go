@@ -5,13 +5,20 @@ package main_test
 
 import (
 	"bytes"
+	gobzip2 "compress/bzip2"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 	"testing"
 
+	"github.com/cosnicolaou/pbzip2"
 	"github.com/cosnicolaou/pbzip2/internal"
+	"github.com/cosnicolaou/pbzip2/internal/bzip2"
 )
 
 func pbzipCmd(filename string) ([]byte, string, error) {
@@ -59,7 +66,7 @@ func TestErrors(t *testing.T) {
 		t.Fatal(err)
 	}
 	_, out, err := pbzipCmd(empty)
-	if err == nil || !strings.Contains(out, "failed to read stream header: EOF") {
+	if err == nil || !strings.Contains(out, "stream header is too small: 0") {
 		t.Fatalf("missing or wrong error message: %v: %v", out, err)
 	}
 
@@ -85,3 +92,310 @@ func TestErrors(t *testing.T) {
 		t.Fatalf("missing or wrong error message: %v: %v", out, err)
 	}
 }
+
+func TestMultipleFiles(t *testing.T) {
+	tmpdir := t.TempDir()
+	var (
+		inputs   []string
+		expected [][]byte
+	)
+	for i, size := range []int{0, 100, 300 * 1024, 900 * 1024, 20} {
+		filename := filepath.Join(tmpdir, fmt.Sprintf("file%v", i))
+		data := internal.GenReproducibleRandomData(size)
+		if err := internal.CreateBzipFile(filename, "-1", data); err != nil {
+			t.Fatal(err)
+		}
+		inputs = append(inputs, filename+".bz2")
+		expected = append(expected, data)
+	}
+
+	args := append([]string{"run", ".", "unzip", "--jobs=3"}, inputs...)
+	if output, err := exec.Command("go", args...).CombinedOutput(); err != nil {
+		t.Fatalf("%s: %v", output, err)
+	}
+	for i, input := range inputs {
+		data, err := os.ReadFile(strings.TrimSuffix(input, ".bz2"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := data, expected[i]; !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v, want %v", input, internal.FirstN(20, got), internal.FirstN(20, want))
+		}
+	}
+
+	args = append([]string{"run", ".", "cat", "--jobs=2"}, inputs...)
+	output, err := exec.Command("go", args...).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := output, bytes.Join(expected, nil); !bytes.Equal(got, want) {
+		t.Errorf("got %v, want %v", internal.FirstN(20, got), internal.FirstN(20, want))
+	}
+
+	// cat stops at the first file that cannot be decompressed.
+	missing := filepath.Join(tmpdir, "missing.bz2")
+	args = []string{"run", ".", "cat", "--jobs=2"}
+	args = append(append(append(args, inputs[:2]...), missing), inputs[2:]...)
+	output, err = exec.Command("go", args...).Output()
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+	if got, want := output, bytes.Join(expected[:2], nil); !bytes.Equal(got, want) {
+		t.Errorf("got %v, want %v", internal.FirstN(20, got), internal.FirstN(20, want))
+	}
+
+	args = append([]string{"run", ".", "unzip", "--output=x"}, inputs...)
+	if output, err := exec.Command("go", args...).CombinedOutput(); err == nil ||
+		!strings.Contains(string(output), "--output cannot be used with multiple files") {
+		t.Errorf("missing or wrong error message: %s: %v", output, err)
+	}
+}
+
+type blockInfo struct {
+	File       string `json:"file"`
+	Block      int    `json:"block"`
+	BitOffset  int    `json:"bit_offset"`
+	SizeInBits int    `json:"size_in_bits"`
+	CRC        uint32 `json:"crc"`
+	EOS        bool   `json:"eos"`
+	StreamCRC  uint32 `json:"stream_crc"`
+}
+
+func TestWriteBuffer(t *testing.T) {
+	tmpdir := t.TempDir()
+	filename := filepath.Join(tmpdir, "large")
+	data := internal.GenReproducibleRandomData(4 * 1024 * 1024)
+	if err := internal.CreateBzipFile(filename, "-9", data); err != nil {
+		t.Fatal(err)
+	}
+	// A buffer larger than the output is only ever written out when it
+	// is flushed.
+	for _, size := range []int{4096, 1 << 20, 16 << 20} {
+		ofile := fmt.Sprintf("%v-%v.out", filename, size)
+		output, err := exec.Command("go", "run", ".", "unzip",
+			"--progress=false",
+			fmt.Sprintf("--write-buffer=%v", size),
+			"--output="+ofile, filename+".bz2").CombinedOutput()
+		if err != nil {
+			t.Fatalf("%v: %s: %v", size, output, err)
+		}
+		got, err := os.ReadFile(ofile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%v: got %v bytes, want %v bytes", size, len(got), len(data))
+		}
+	}
+
+	// The buffer is also flushed for each of multiple files.
+	input := filepath.Join(tmpdir, "copy")
+	if err := internal.CreateBzipFile(input, "-1", data[:1024]); err != nil {
+		t.Fatal(err)
+	}
+	if output, err := exec.Command("go", "run", ".", "unzip",
+		"--write-buffer=65536", filename+".bz2", input+".bz2").CombinedOutput(); err != nil {
+		t.Fatalf("%s: %v", output, err)
+	}
+	for name, want := range map[string][]byte{filename: data, input: data[:1024]} {
+		got, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v bytes, want %v bytes", name, len(got), len(want))
+		}
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	filename := filepath.Join("..", "..", "testdata", "300KB1.bz2")
+	// Values are taken from TestScan in the pbzip2 package.
+	crcs := []uint32{984137596, 1527206082, 1102975844, 2729642890}
+	sizes := []int{806206, 806273, 806182, 61754}
+	for _, cmd := range []string{"scan", "bz2-stats"} {
+		output, err := exec.Command("go", "run", ".", cmd, "--format=json", filename).Output()
+		if err != nil {
+			t.Fatalf("%v: %v", cmd, err)
+		}
+		var info []blockInfo
+		if err := json.Unmarshal(output, &info); err != nil {
+			t.Fatalf("%v: %v: %s", cmd, err, output)
+		}
+		if got, want := len(info), len(crcs); got != want {
+			t.Fatalf("%v: got %v, want %v", cmd, got, want)
+		}
+		for i, bi := range info {
+			if got, want := bi.Block, i+1; got != want {
+				t.Errorf("%v: got %v, want %v", cmd, got, want)
+			}
+			if got, want := bi.File, filename; got != want {
+				t.Errorf("%v: got %v, want %v", cmd, got, want)
+			}
+			if got, want := bi.CRC, crcs[i]; got != want {
+				t.Errorf("%v: block %v: got %v, want %v", cmd, i, got, want)
+			}
+			if got, want := bi.SizeInBits, sizes[i]; got != want {
+				t.Errorf("%v: block %v: got %v, want %v", cmd, i, got, want)
+			}
+			if got, want := bi.EOS, i == len(info)-1; got != want {
+				t.Errorf("%v: block %v: got %v, want %v", cmd, i, got, want)
+			}
+		}
+		if got, want := info[len(info)-1].StreamCRC, uint32(2560071082); got != want {
+			t.Errorf("%v: got %v, want %v", cmd, got, want)
+		}
+	}
+}
+
+func TestDumpBlock(t *testing.T) {
+	filename := filepath.Join("..", "..", "testdata", "300KB1.bz2")
+	prefix := filepath.Join(t.TempDir(), "block")
+	if output, err := exec.Command("go", "run", ".", "dump-block", "--prefix="+prefix, filename, "2").CombinedOutput(); err != nil {
+		t.Fatalf("%s: %v", output, err)
+	}
+	raw, err := os.ReadFile(prefix + ".bz2block")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := os.ReadFile(prefix + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := os.ReadFile(prefix + ".out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info struct {
+		blockInfo
+		StreamBlockSize int `json:"stream_block_size"`
+	}
+	if err := json.Unmarshal(metadata, &info); err != nil {
+		t.Fatalf("%v: %s", err, metadata)
+	}
+	// Values are taken from TestScan in the pbzip2 package.
+	if got, want := info.CRC, uint32(1527206082); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := info.SizeInBits, 806273; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Decompress the raw block independently of the command.
+	rd := bzip2.NewBlockReader(info.StreamBlockSize, raw, uint(info.BitOffset))
+	data, err := io.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := data, out; len(got) == 0 || !bytes.Equal(got, want) {
+		t.Errorf("got %v bytes, want %v bytes", len(got), len(want))
+	}
+	compressed, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := io.ReadAll(gobzip2.NewReader(bytes.NewReader(compressed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(all, data) || bytes.HasPrefix(all, data) {
+		t.Errorf("block 2 was not found at the expected position in the decompressed file")
+	}
+}
+
+func TestSplit(t *testing.T) {
+	filename := filepath.Join("..", "..", "testdata", "900KB1.bz2")
+	prefix := filepath.Join(t.TempDir(), "shard")
+	output, err := exec.Command("go", "run", ".", "split", "--prefix="+prefix, filename, "3").Output()
+	if err != nil {
+		t.Fatalf("%s: %v", output, err)
+	}
+	files := strings.Fields(string(output))
+	if got, want := len(files), 3; got != want {
+		t.Fatalf("got %v, want %v: %s", got, want, output)
+	}
+	var all []byte
+	for i, file := range files {
+		if got, want := file, fmt.Sprintf("%v-%v.bz2", prefix, i+1); got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		compressed, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Each file must be a valid, standalone, bzip2 stream.
+		data, err := io.ReadAll(gobzip2.NewReader(bytes.NewReader(compressed)))
+		if err != nil {
+			t.Fatalf("%v: %v", file, err)
+		}
+		if len(data) == 0 {
+			t.Errorf("%v: no data", file)
+		}
+		all = append(all, data...)
+	}
+	compressed, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := io.ReadAll(gobzip2.NewReader(bytes.NewReader(compressed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := all; !bytes.Equal(got, want) {
+		t.Errorf("got %v bytes, want %v bytes", len(got), len(want))
+	}
+}
+
+func TestConcat(t *testing.T) {
+	ctx := context.Background()
+	var (
+		files []string
+		want  []byte
+	)
+	for _, name := range []string{"300KB1", "hello", "empty", "900KB1"} {
+		filename := filepath.Join("..", "..", "testdata", name+".bz2")
+		compressed, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(gobzip2.NewReader(bytes.NewReader(compressed)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, filename)
+		want = append(want, data...)
+	}
+	for _, tc := range []struct {
+		flags   []string
+		streams int
+	}{
+		{nil, 4},
+		{[]string{"--single-stream"}, 1},
+	} {
+		output := filepath.Join(t.TempDir(), "concat.bz2")
+		args := append([]string{"run", ".", "concat", "--output=" + output}, tc.flags...)
+		if out, err := exec.Command("go", append(args, files...)...).CombinedOutput(); err != nil {
+			t.Fatalf("%v: %s: %v", tc.flags, out, err)
+		}
+		compressed, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(gobzip2.NewReader(bytes.NewReader(compressed)))
+		if err != nil {
+			t.Fatalf("%v: %v", tc.flags, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v bytes, want %v bytes", tc.flags, len(got), len(want))
+		}
+		sc := pbzip2.NewScanner(bytes.NewReader(compressed))
+		for sc.Scan(ctx) {
+		}
+		if err := sc.Err(); err != nil {
+			t.Fatalf("%v: %v", tc.flags, err)
+		}
+		if got, want := len(sc.StreamInfo()), tc.streams; got != want {
+			t.Errorf("%v: got %v, want %v", tc.flags, got, want)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"cloudeng.io/cmdutil"
+	"github.com/cosnicolaou/pbzip2"
+)
+
+type splitFlags struct {
+	Prefix string `subcmd:"prefix,,'prefix for the output files, defaults to the input filename, without .bz2, the output files are named <prefix>-<n>.bz2'"`
+}
+
+// shardWriter accumulates the blocks for a single output file.
+type shardWriter struct {
+	prefix string
+	shard  int
+	size   int64
+	blocks []pbzip2.CompressedBlock
+	files  []string
+}
+
+func (sw *shardWriter) add(block pbzip2.CompressedBlock) {
+	sw.blocks = append(sw.blocks, block)
+	sw.size += int64(len(block.Data))
+}
+
+func (sw *shardWriter) level() pbzip2.BlockSizeLevel {
+	if len(sw.blocks) == 0 {
+		return 0
+	}
+	return sw.blocks[0].Level()
+}
+
+// flush writes the accumulated blocks as a single bzip2 stream.
+func (sw *shardWriter) flush() error {
+	if len(sw.blocks) == 0 {
+		return nil
+	}
+	sw.shard++
+	filename := fmt.Sprintf("%v-%v.bz2", sw.prefix, sw.shard)
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := pbzip2.WriteStream(file, sw.level(), sw.blocks); err != nil {
+		file.Close()
+		return fmt.Errorf("%v: %v", filename, err)
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	sw.files = append(sw.files, filename)
+	sw.blocks, sw.size = nil, 0
+	return nil
+}
+
+func split(ctx context.Context, values interface{}, args []string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	cmdutil.HandleSignals(cancel, os.Interrupt)
+	cl := values.(*splitFlags)
+	name := args[0]
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n < 1 {
+		return fmt.Errorf("invalid number of files: %v", args[1])
+	}
+	prefix := cl.Prefix
+	if len(prefix) == 0 {
+		prefix = strings.TrimSuffix(filepath.Base(name), ".bz2")
+	}
+	rd, size, readerCleanup, err := openFile(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer readerCleanup()
+	if size < 0 {
+		return fmt.Errorf("%v: size is unknown", name)
+	}
+
+	target := size / int64(n)
+	sw := &shardWriter{prefix: prefix}
+	sc := pbzip2.NewScanner(rd)
+	for sc.Scan(ctx) {
+		block := sc.Block()
+		if block.SizeInBits == 0 {
+			// Empty streams contain no blocks.
+			continue
+		}
+		// Start a new file if the current one is closer to the target
+		// size without this block than with it. A stream has a single
+		// compression level and hence a new file must also be started
+		// if the level changes.
+		full := sw.shard < n-1 && sw.size+int64(len(block.Data))/2 > target
+		if len(sw.blocks) > 0 && (full || block.Level() != sw.level()) {
+			if err := sw.flush(); err != nil {
+				return err
+			}
+		}
+		sw.add(block)
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if err := sw.flush(); err != nil {
+		return err
+	}
+	for _, file := range sw.files {
+		fmt.Println(file)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	stdbzip2 "compress/bzip2"
+	"errors"
+	"io"
+
+	"github.com/cosnicolaou/pbzip2/internal/bzip2"
+)
+
+// ErrorCompat determines the errors returned for corrupt or truncated
+// input, see BZErrorCompat.
+type ErrorCompat string
+
+const (
+	// ErrorCompatNative returns pbzip2's own errors, which generally
+	// provide more detail than those of compress/bzip2 or bzip2.
+	ErrorCompatNative ErrorCompat = "pbzip2"
+	// ErrorCompatStdlib returns the same errors as compress/bzip2, that
+	// is, io.ErrUnexpectedEOF for truncated input and a
+	// compress/bzip2.StructuralError otherwise.
+	ErrorCompatStdlib ErrorCompat = "stdlib"
+	// ErrorCompatBzip2 returns errors whose messages are those printed
+	// by the bzip2 and bzcat commands, the original error is available
+	// via errors.Unwrap.
+	ErrorCompatBzip2 ErrorCompat = "bzip2"
+)
+
+// BZErrorCompat sets the errors returned, for corrupt or truncated input,
+// by the readers created by NewReader and related functions, and by
+// DecompressAll, so that they may be used as drop-in replacements for
+// compress/bzip2 or for the bzip2 and bzcat commands. The default is
+// ErrorCompatNative and unrecognised values are treated as such. Errors
+// that do not pertain to the input, such as a canceled context, are never
+// changed. Since bzip2 ignores any trailing garbage that follows the final
+// stream, ErrorCompatBzip2 also implies ScanIgnoreTrailingGarbage(true).
+func BZErrorCompat(kind ErrorCompat) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.errorCompat = kind
+	}
+}
+
+// errorKind classifies errors that pertain to corrupt or truncated input.
+type errorKind int
+
+const (
+	errKindUnknown errorKind = iota
+	errKindBadMagic
+	errKindBadVersion
+	errKindBadLevel
+	errKindTruncated
+	errKindBlockCRC
+	errKindStreamCRC
+	errKindTrailingGarbage
+	errKindCorrupt
+)
+
+// stdlibMessages are the compress/bzip2.StructuralError messages for each
+// kind of error, errKindCorrupt is used for structural errors whose
+// message is not otherwise known.
+var stdlibMessages = map[errorKind]string{
+	errKindBadMagic:        "bad magic value",
+	errKindBadVersion:      "non-Huffman entropy encoding",
+	errKindBadLevel:        "invalid compression level",
+	errKindBlockCRC:        "block checksum mismatch",
+	errKindStreamCRC:       "file checksum mismatch",
+	errKindTrailingGarbage: "bad magic value in continuation file",
+	errKindCorrupt:         "bad magic value found",
+}
+
+// bzip2Messages are the messages printed by the bzip2 and bzcat commands
+// for each kind of error. There is no entry for errKindTrailingGarbage
+// since bzip2 merely warns of, and ignores, trailing garbage, see
+// scannerOptions.
+var bzip2Messages = map[errorKind]string{
+	errKindBadMagic:   "bad magic number (file not created by bzip2)",
+	errKindBadVersion: "bad magic number (file not created by bzip2)",
+	errKindBadLevel:   "bad magic number (file not created by bzip2)",
+	errKindTruncated:  "compressed file ends unexpectedly",
+	errKindBlockCRC:   "data integrity error when decompressing",
+	errKindStreamCRC:  "data integrity error when decompressing",
+	errKindCorrupt:    "data integrity error when decompressing",
+}
+
+// classifiedError records the kind of an error whose message does not
+// otherwise identify it.
+type classifiedError struct {
+	kind errorKind
+	err  error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+// classify records the kind of err for use by BZErrorCompat, err's
+// message is unchanged.
+func classify(kind errorKind, err error) error {
+	return &classifiedError{kind: kind, err: err}
+}
+
+// compatError is returned for ErrorCompatBzip2.
+type compatError struct {
+	msg string
+	err error
+}
+
+func (e *compatError) Error() string {
+	return e.msg
+}
+
+func (e *compatError) Unwrap() error {
+	return e.err
+}
+
+// kindOf returns the kind of err along with the compress/bzip2 message
+// for it.
+func kindOf(err error) (errorKind, string) {
+	var ce *classifiedError
+	var se bzip2.StructuralError
+	switch {
+	case errors.Is(err, ErrTruncatedStream):
+		return errKindTruncated, ""
+	case errors.As(err, &ce):
+		return ce.kind, stdlibMessages[ce.kind]
+	case bzip2.BlockChecksumMismatch(err):
+		return errKindBlockCRC, stdlibMessages[errKindBlockCRC]
+	case errors.Is(err, ErrBlockSizeExceeded):
+		return errKindCorrupt, "data exceeds block size"
+	case errors.As(err, &se):
+		// internal/bzip2 is derived from compress/bzip2 and shares
+		// its messages.
+		return errKindCorrupt, string(se)
+	}
+	return errKindUnknown, ""
+}
+
+// format returns the error to be returned in place of err.
+func (kind ErrorCompat) format(err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+	if kind != ErrorCompatStdlib && kind != ErrorCompatBzip2 {
+		return err
+	}
+	ek, msg := kindOf(err)
+	switch {
+	case ek == errKindUnknown:
+		return err
+	case kind == ErrorCompatBzip2:
+		if _, ok := bzip2Messages[ek]; !ok {
+			return err
+		}
+		return &compatError{msg: bzip2Messages[ek], err: err}
+	case ek == errKindTruncated:
+		return io.ErrUnexpectedEOF
+	}
+	return stdbzip2.StructuralError(msg)
+}
+
+// scannerOptions returns opts extended with any scanner options implied
+// by kind, ie. bzip2 ignores trailing garbage rather than failing.
+func (kind ErrorCompat) scannerOptions(opts []ScannerOption) []ScannerOption {
+	if kind != ErrorCompatBzip2 {
+		return opts
+	}
+	return append(opts[:len(opts):len(opts)], ScanIgnoreTrailingGarbage(true))
+}
@@ -0,0 +1,127 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2_test
+
+import (
+	"bytes"
+	stdbzip2 "compress/bzip2"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/cosnicolaou/pbzip2"
+)
+
+func TestErrorCompat(t *testing.T) {
+	ctx := context.Background()
+	hello, _ := readFile(t, "hello")
+	kb300, _ := readFile(t, "300KB1")
+	modify := func(buf []byte, fn func([]byte)) []byte {
+		buf = append([]byte{}, buf...)
+		fn(buf)
+		return buf
+	}
+	for _, tc := range []struct {
+		name       string
+		compressed []byte
+		native     string
+		bzip2      string
+	}{
+		{"magic", modify(hello, func(b []byte) { b[0] = 'C' }),
+			"wrong file magic: 435a", "bad magic number (file not created by bzip2)"},
+		{"version", modify(hello, func(b []byte) { b[2] = 'x' }),
+			"wrong version: x", "bad magic number (file not created by bzip2)"},
+		{"bzip1", modify(hello, func(b []byte) { b[2] = '0' }),
+			"bzip2 data invalid: bzip1 format is not supported", "bad magic number (file not created by bzip2)"},
+		{"level", modify(hello, func(b []byte) { b[3] = 'x' }),
+			"bad block size: x", "bad magic number (file not created by bzip2)"},
+		{"empty", []byte{},
+			"stream header is too small: 0", "compressed file ends unexpectedly"},
+		{"truncated", kb300[:len(kb300)/2],
+			"failed to find trailer: truncated stream", "compressed file ends unexpectedly"},
+		{"block crc", modify(kb300, func(b []byte) { b[len(b)/4] ^= 0xff }),
+			"block checksum mismatch", "data integrity error when decompressing"},
+		{"stream crc", modify(hello, func(b []byte) { b[len(b)-2] ^= 0xff }),
+			"mismatched stream CRCs: calculated=0x4eece836 != stored=0x4eecf7d6", "data integrity error when decompressing"},
+		{"trailing garbage", append(append([]byte{}, hello...), "xx"...),
+			"failed to find trailer", ""},
+	} {
+		_, stdErr := io.ReadAll(stdbzip2.NewReader(bytes.NewReader(tc.compressed)))
+		if stdErr == nil {
+			t.Fatalf("%v: expected an error", tc.name)
+		}
+		for _, concurrency := range []int{1, 4} {
+			decompress := func(kind pbzip2.ErrorCompat) error {
+				_, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(tc.compressed),
+					pbzip2.DecompressionOptions(
+						pbzip2.BZConcurrency(concurrency),
+						pbzip2.BZErrorCompat(kind))))
+				return err
+			}
+			for _, kind := range []pbzip2.ErrorCompat{"", pbzip2.ErrorCompatNative} {
+				if err := decompress(kind); err == nil || err.Error() != tc.native {
+					t.Errorf("%v: %v: %q: got %v, want %v", tc.name, concurrency, kind, err, tc.native)
+				}
+			}
+
+			err := decompress(pbzip2.ErrorCompatStdlib)
+			if err == nil || err.Error() != stdErr.Error() {
+				t.Errorf("%v: %v: got %v, want %v", tc.name, concurrency, err, stdErr)
+			}
+			var se stdbzip2.StructuralError
+			if got, want := errors.As(err, &se), errors.As(stdErr, &se); got != want {
+				t.Errorf("%v: %v: got %v, want %v", tc.name, concurrency, got, want)
+			}
+			if got, want := err == io.ErrUnexpectedEOF, stdErr == io.ErrUnexpectedEOF; got != want {
+				t.Errorf("%v: %v: got %v, want %v", tc.name, concurrency, got, want)
+			}
+
+			err = decompress(pbzip2.ErrorCompatBzip2)
+			if tc.bzip2 == "" {
+				// bzip2 ignores trailing garbage.
+				if err != nil {
+					t.Errorf("%v: %v: unexpected error: %v", tc.name, concurrency, err)
+				}
+				continue
+			}
+			if err == nil || err.Error() != tc.bzip2 {
+				t.Errorf("%v: %v: got %v, want %v", tc.name, concurrency, err, tc.bzip2)
+			}
+			if err := errors.Unwrap(err); err == nil || err.Error() != tc.native {
+				t.Errorf("%v: %v: got %v, want %v", tc.name, concurrency, err, tc.native)
+			}
+		}
+
+		_, err := pbzip2.DecompressAll(ctx, bytes.NewReader(tc.compressed),
+			pbzip2.DecompressionOptions(pbzip2.BZErrorCompat(pbzip2.ErrorCompatStdlib)))
+		if err == nil || err.Error() != stdErr.Error() {
+			t.Errorf("%v: got %v, want %v", tc.name, err, stdErr)
+		}
+	}
+
+	// The output that precedes trailing garbage is returned without an
+	// error, as per bzip2.
+	garbage := append(append([]byte{}, kb300...), "trailing garbage"...)
+	out, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(garbage),
+		pbzip2.DecompressionOptions(pbzip2.BZErrorCompat(pbzip2.ErrorCompatBzip2))))
+	if err != nil || !bytes.Equal(out, bzip2Data["300KB1"]) {
+		t.Errorf("got %v bytes, %v, want %v bytes, nil", len(out), err, len(bzip2Data["300KB1"]))
+	}
+	out, err = pbzip2.DecompressAll(ctx, bytes.NewReader(garbage),
+		pbzip2.DecompressionOptions(pbzip2.BZErrorCompat(pbzip2.ErrorCompatBzip2)))
+	if err != nil || !bytes.Equal(out, bzip2Data["300KB1"]) {
+		t.Errorf("got %v bytes, %v, want %v bytes, nil", len(out), err, len(bzip2Data["300KB1"]))
+	}
+
+	// Errors that do not pertain to the input are unchanged.
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = io.ReadAll(pbzip2.NewReader(canceled, bytes.NewReader(kb300),
+		pbzip2.DecompressionOptions(pbzip2.BZErrorCompat(pbzip2.ErrorCompatBzip2))))
+	if !errors.Is(err, context.Canceled) || err.Error() != context.Canceled.Error() {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// BufferPool is a pool of buffers, a thin wrapper over sync.Pool, that is
+// used by CopyN to recycle the buffers that blocks are decompressed into
+// and the buffer used to copy the output. A single pool may be shared by
+// any number of concurrent calls to CopyN. The zero value is ready for use.
+type BufferPool struct {
+	pool sync.Pool
+}
+
+// Get returns an empty buffer with a capacity of at least size bytes.
+func (p *BufferPool) Get(size int) []byte {
+	if buf, ok := p.pool.Get().(*[]byte); ok && cap(*buf) >= size {
+		return (*buf)[:0]
+	}
+	return make([]byte, 0, size)
+}
+
+// Put returns buf to the pool, it must no longer be referenced by the
+// caller.
+func (p *BufferPool) Put(buf []byte) {
+	p.pool.Put(&buf)
+}
+
+// CopyN decompresses src, as per NewReader, and writes the decompressed
+// output to dst, returning the number of bytes written. The buffers that
+// blocks are decompressed into, and the buffer used to write to dst, are
+// obtained from pool and returned to it once they are no longer needed,
+// thus minimizing the allocations made by long running services that
+// decompress many inputs. If pool is nil, a pool private to the call is
+// used.
+func CopyN(ctx context.Context, dst io.Writer, src io.Reader, pool *BufferPool, opts ...ReaderOption) (int64, error) {
+	if pool == nil {
+		pool = &BufferPool{}
+	}
+	opts = append(opts[:len(opts):len(opts)], func(o *readerOpts) {
+		o.alloc, o.release = pool.Get, pool.Put
+	})
+	rd := newLazyReader(ctx, openReader(src), opts...)
+	defer rd.Close()
+	buf := pool.Get(copyBufferSize)[:copyBufferSize]
+	defer pool.Put(buf)
+	return rd.writeTo(dst, buf)
+}
@@ -0,0 +1,77 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/cosnicolaou/pbzip2"
+)
+
+func TestCopyN(t *testing.T) {
+	ctx := context.Background()
+	pool := &pbzip2.BufferPool{}
+	for _, names := range [][]string{
+		{"empty"},
+		{"hello"},
+		{"300KB1", "empty", "hello", "900KB9"},
+	} {
+		compressed, actual := concatFiles(t, names...)
+		for _, concurrency := range []int{1, 4} {
+			for _, p := range []*pbzip2.BufferPool{pool, nil} {
+				var out bytes.Buffer
+				n, err := pbzip2.CopyN(ctx, &out, bytes.NewReader(compressed), p,
+					pbzip2.DecompressionOptions(pbzip2.BZConcurrency(concurrency)))
+				if err != nil {
+					t.Fatalf("%v: %v: %v", names, concurrency, err)
+				}
+				if got, want := n, int64(len(actual)); got != want {
+					t.Errorf("%v: %v: got %v, want %v", names, concurrency, got, want)
+				}
+				if got, want := out.Bytes(), actual; !bytes.Equal(got, want) {
+					t.Errorf("%v: %v: got %v bytes, want %v bytes", names, concurrency, len(got), len(want))
+				}
+			}
+		}
+	}
+
+	compressed, _ := concatFiles(t, "300KB1", "hello")
+	_, err := pbzip2.CopyN(ctx, &errorWriter{}, bytes.NewReader(compressed), pool)
+	if err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+	_, err = pbzip2.CopyN(ctx, io.Discard, bytes.NewReader(compressed[:len(compressed)/2]), pool)
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestCopyNAllocs(t *testing.T) {
+	ctx := context.Background()
+	compressed, _ := readFile(t, "300KB1")
+	for _, concurrency := range []int{1, 4} {
+		opts := pbzip2.DecompressionOptions(pbzip2.BZConcurrency(concurrency))
+		pool := &pbzip2.BufferPool{}
+		pooled := testing.AllocsPerRun(20, func() {
+			if _, err := pbzip2.CopyN(ctx, io.Discard, bytes.NewReader(compressed), pool, opts); err != nil {
+				t.Fatal(err)
+			}
+		})
+		unpooled := testing.AllocsPerRun(20, func() {
+			rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts)
+			if _, err := io.Copy(io.Discard, rd); err != nil {
+				t.Fatal(err)
+			}
+		})
+		t.Logf("concurrency %v: allocs per run: pooled %v, unpooled %v", concurrency, pooled, unpooled)
+		if pooled >= unpooled {
+			t.Errorf("concurrency %v: got %v allocs per run, want fewer than %v", concurrency, pooled, unpooled)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"context"
+	"fmt"
+)
+
+const (
+	// DiagnosticSuperfluousHuffmanLevel is reported for a block that
+	// contains a Huffman tree with a superfluous level, which indicates
+	// a bug in the encoder that created it.
+	DiagnosticSuperfluousHuffmanLevel = "superfluous-huffman-level"
+	// DiagnosticMergedBlocks is reported for a block that had to be merged
+	// with its successor because of a false positive match of the block
+	// magic number within its compressed data.
+	DiagnosticMergedBlocks = "merged-blocks"
+	// DiagnosticEmptyStreams is reported for a block that was followed by
+	// one or more empty streams that were ignored.
+	DiagnosticEmptyStreams = "empty-streams"
+)
+
+// Diagnostic represents a recoverable anomaly encountered during
+// decompression. Block is the number of the block, starting at 1, that
+// the anomaly pertains to, Kind is one of the Diagnostic... constants and
+// Detail contains a human readable description of the anomaly.
+type Diagnostic struct {
+	Block  uint64
+	Kind   string
+	Detail string
+}
+
+// BZDiagnostics sets the channel over which diagnostics are sent as the
+// blocks that they pertain to are reassembled. Diagnostics are never
+// treated as errors. Diagnostics are sent using blocking sends and hence
+// decompression will stall whilst the channel is full, until the context
+// is canceled.
+func BZDiagnostics(ch chan<- Diagnostic) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.diagnosticsCh = ch
+	}
+}
+
+func (dc *Decompressor) sendDiagnostics(ctx context.Context, block *blockDesc, merged bool) {
+	if dc.diagnosticsCh == nil {
+		return
+	}
+	var diags []Diagnostic
+	for _, w := range block.warnings {
+		diags = append(diags, Diagnostic{
+			Block:  block.order,
+			Kind:   DiagnosticSuperfluousHuffmanLevel,
+			Detail: w,
+		})
+	}
+	if merged {
+		diags = append(diags, Diagnostic{
+			Block:  block.order,
+			Kind:   DiagnosticMergedBlocks,
+			Detail: fmt.Sprintf("merged with block %v following a false positive block magic match", block.order+1),
+		})
+	}
+	if n := block.emptyStreams; n > 0 {
+		diags = append(diags, Diagnostic{
+			Block:  block.order,
+			Kind:   DiagnosticEmptyStreams,
+			Detail: fmt.Sprintf("ignored %v empty stream(s)", n),
+		})
+	}
+	for _, d := range diags {
+		select {
+		case dc.diagnosticsCh <- d:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
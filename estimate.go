@@ -0,0 +1,65 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"context"
+	"io"
+	"os"
+)
+
+// DefaultExpansionFactor is the default ratio of decompressed to compressed
+// size used by EstimateDecompressedSize.
+const DefaultExpansionFactor = 4.0
+
+// ExpansionFactor sets the ratio of decompressed to compressed size that
+// EstimateDecompressedSize assumes for each block.
+func ExpansionFactor(f float64) ReaderOption {
+	return func(o *readerOpts) {
+		o.expansionFactor = f
+	}
+}
+
+// EstimateDecompressedSize returns the size of the decompressed data in rd.
+// If rd implements io.ReaderAt and its size can be determined, via either
+// a Size or Stat method, then rd is decompressed in parallel, discarding
+// the output, and the exact size is returned. Otherwise, rd is scanned and
+// the compressed size of each block is multiplied by an expansion factor
+// (see ExpansionFactor) to provide an estimate. The returned bool is true
+// if the size is exact.
+func EstimateDecompressedSize(ctx context.Context, rd io.Reader, opts ...ReaderOption) (int64, bool, error) {
+	rdOpts := &readerOpts{
+		expansionFactor: DefaultExpansionFactor,
+	}
+	for _, fn := range opts {
+		fn(rdOpts)
+	}
+	if ra, ok := rd.(io.ReaderAt); ok {
+		if size, ok := sizeOf(rd); ok {
+			n, err := io.Copy(io.Discard, NewParallelReaderAt(ctx, ra, size, opts...))
+			return n, err == nil, err
+		}
+	}
+	sc := NewScanner(rd, rdOpts.scanOpts...)
+	var estimate float64
+	for sc.Scan(ctx) {
+		estimate += float64(sc.Block().SizeInBits) / 8 * rdOpts.expansionFactor
+	}
+	return int64(estimate), false, sc.Err()
+}
+
+func sizeOf(rd io.Reader) (int64, bool) {
+	switch v := rd.(type) {
+	case interface{ Size() int64 }:
+		return v.Size(), true
+	case interface{ Stat() (os.FileInfo, error) }:
+		fi, err := v.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			return 0, false
+		}
+		return fi.Size(), true
+	}
+	return 0, false
+}
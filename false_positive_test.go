@@ -9,10 +9,13 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"reflect"
+	"sync"
 	"testing"
 
 	"github.com/cosnicolaou/pbzip2"
 	"github.com/cosnicolaou/pbzip2/internal/bitstream"
+	"github.com/cosnicolaou/pbzip2/internal/bzip2"
 )
 
 func TestHandlingFalsePositives(t *testing.T) {
@@ -59,12 +62,28 @@ func TestHandlingFalsePositives(t *testing.T) {
 			}
 
 			pbzip2.SetCustomBlockMagic(falsePositive)
-			brd := pbzip2.NewReader(ctx, bytes.NewBuffer(data))
+			diagCh := make(chan pbzip2.Diagnostic, 10)
+			merged := make(chan int)
+			go func() {
+				n := 0
+				for d := range diagCh {
+					if d.Kind == pbzip2.DiagnosticMergedBlocks {
+						n++
+					}
+				}
+				merged <- n
+			}()
+			brd := pbzip2.NewReader(ctx, bytes.NewBuffer(data),
+				pbzip2.DecompressionOptions(pbzip2.BZDiagnostics(diagCh)))
 			buf := bytes.NewBuffer(make([]byte, 0, 1000*1024))
 			_, err = io.Copy(buf, brd)
 			if err != nil {
 				t.Error(err)
 			}
+			close(diagCh)
+			if n := <-merged; n == 0 {
+				t.Errorf("%v: no merged blocks were reported", i)
+			}
 
 			if got, want := buf.Bytes(), godata; !bytes.Equal(got, want) {
 				if testing.Verbose() {
@@ -88,3 +107,181 @@ func prettyPrintBlock(block []byte) {
 	}
 	fmt.Println()
 }
+
+func TestConcurrentCustomBlockMagic(t *testing.T) {
+	ctx := context.Background()
+	filename := bzip2Files["300KB1"]
+	rd := openBzipFile(t, filename)
+	origData, err := io.ReadAll(rd)
+	rd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	godata := readBzipFile(t, filename)
+
+	// Both magic numbers occur naturally in the data and hence will
+	// lead to false positives that require the decompressor to merge
+	// blocks using the same custom magic number.
+	magics := [][6]byte{
+		{0x91, 0xff, 0x6b, 0x72, 0xb1, 0xa4},
+		{0xbb, 0x7a, 0x1b, 0xda, 0xf7, 0x27},
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, len(magics)*4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			magic := magics[i%len(magics)]
+			data := make([]byte, len(origData))
+			copy(data, origData)
+			// Block offsets in bits are from the output of gentestdata.go
+			for _, offset := range []int{32, 806286, 1612607, 2418837} {
+				bitstream.OverwriteAtBitOffset(data, offset, magic[:])
+			}
+			brd := pbzip2.NewReader(ctx, bytes.NewBuffer(data),
+				pbzip2.ScannerOptions(pbzip2.ScanBlockMagic(magic)),
+				pbzip2.DecompressionOptions(pbzip2.BZBlockMagic(magic)))
+			buf, err := io.ReadAll(brd)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			if !bytes.Equal(buf, godata) {
+				errs[i] = fmt.Errorf("%v: got %v bytes, want %v bytes", i, len(buf), len(godata))
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func decompressBlock(cb pbzip2.CompressedBlock) ([]byte, error) {
+	return io.ReadAll(bzip2.NewBlockReader(cb.StreamBlockSize, cb.Data, uint(cb.BitOffset)))
+}
+
+func TestMergeBlocks(t *testing.T) {
+	ctx := context.Background()
+	filename := bzip2Files["300KB1"]
+	rd := openBzipFile(t, filename)
+	origData, err := io.ReadAll(rd)
+	rd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	godata := readBzipFile(t, filename)
+
+	// Split the blocks artificially by using a magic number that occurs
+	// naturally in the data.
+	magic := [6]byte{0x91, 0xff, 0x6b, 0x72, 0xb1, 0xa4}
+	data := make([]byte, len(origData))
+	copy(data, origData)
+	// Block offsets in bits are from the output of gentestdata.go
+	for _, offset := range []int{32, 806286, 1612607, 2418837} {
+		bitstream.OverwriteAtBitOffset(data, offset, magic[:])
+	}
+	sc := pbzip2.NewScanner(bytes.NewReader(data), pbzip2.ScanBlockMagic(magic))
+	var blocks []pbzip2.CompressedBlock
+	for sc.Scan(ctx) {
+		blocks = append(blocks, sc.Block())
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	var out []byte
+	merges := 0
+	for i := 0; i < len(blocks); i++ {
+		block := blocks[i]
+		buf, err := decompressBlock(block)
+		for err != nil && i+1 < len(blocks) {
+			i++
+			prev := block
+			block, err = pbzip2.MergeBlocksWithMagic(magic, prev, blocks[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := block.SizeInBits, prev.SizeInBits+len(magic)*8+blocks[i].SizeInBits; got != want {
+				t.Errorf("block %v: got %v, want %v", i, got, want)
+			}
+			if got, want := block.EOS, blocks[i].EOS; got != want {
+				t.Errorf("block %v: got %v, want %v", i, got, want)
+			}
+			merges++
+			buf, err = decompressBlock(block)
+		}
+		if err != nil {
+			t.Fatalf("block %v: %v", i, err)
+		}
+		out = append(out, buf...)
+	}
+	if merges == 0 {
+		t.Errorf("no blocks were merged")
+	}
+	if got, want := out, godata; !bytes.Equal(got, want) {
+		t.Errorf("got %v bytes, want %v bytes", len(got), len(want))
+	}
+
+	// The last block ends the stream and hence cannot be merged with.
+	last := blocks[len(blocks)-1]
+	if _, err := pbzip2.MergeBlocks(last, blocks[0]); err == nil {
+		t.Errorf("expected an error merging with an EOS block")
+	}
+}
+
+func TestPrecomputeMagic(t *testing.T) {
+	ctx := context.Background()
+	compressed, _ := readFile(t, "300KB1")
+	magic := [6]byte{0x91, 0xff, 0x6b, 0x72, 0xb1, 0xa4}
+	custom := append([]byte{}, compressed...)
+	// Block offsets in bits are from the output of gentestdata.go
+	for _, offset := range []int{32, 806286, 1612607, 2418837} {
+		bitstream.OverwriteAtBitOffset(custom, offset, magic[:])
+	}
+
+	offsets := func(data []byte, opts ...pbzip2.ScannerOption) [][2]int64 {
+		var offsets [][2]int64
+		sc := pbzip2.NewScanner(bytes.NewReader(data), opts...)
+		for sc.Scan(ctx) {
+			block := sc.Block()
+			offsets = append(offsets, [2]int64{block.Offset, int64(block.BitOffset)})
+		}
+		if err := sc.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return offsets
+	}
+
+	tables := pbzip2.PrecomputeMagic(magic)
+	if got, want := tables.Magic(), magic; got != want {
+		t.Errorf("got %x, want %x", got, want)
+	}
+	// The tables may be shared by several scanners.
+	want := offsets(custom, pbzip2.ScanBlockMagic(magic))
+	for i := 0; i < 3; i++ {
+		if got := offsets(custom, pbzip2.ScanMagicTables(tables)); !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+	}
+	// The magic number also occurs naturally within one of the blocks.
+	if got, want := len(want), 5; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	want = offsets(compressed)
+	if got := offsets(compressed, pbzip2.ScanMagicTables(pbzip2.PrecomputeMagic(bzip2.BlockMagic))); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func BenchmarkPrecomputeMagic(b *testing.B) {
+	magic := [6]byte{0x91, 0xff, 0x6b, 0x72, 0xb1, 0xa4}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		pbzip2.PrecomputeMagic(magic)
+	}
+}
@@ -59,18 +59,6 @@ func main() {
 		fmt.Printf("Stream/File CRC      : %v\n", stats.StreamCRC)
 		fmt.Printf("Block Offsets        : %v\n", stats.BlockStartOffsets)
 		fmt.Printf("End of Stream Offset : %v\n", stats.EndOfStreamOffset)
-		var sizes []uint
-		if len(stats.BlockStartOffsets) > 0 {
-			offsets := make([]uint, len(stats.BlockStartOffsets)+1)
-			for i := 0; i < len(offsets)-1; i++ {
-				offsets[i] = stats.BlockStartOffsets[i]
-			}
-			offsets[len(offsets)-1] = stats.EndOfStreamOffset
-			sizes = make([]uint, len(stats.BlockStartOffsets))
-			for i := 0; i < len(sizes); i++ {
-				sizes[i] = offsets[i+1] - offsets[i] - 48 // subtract size of magic #
-			}
-		}
-		fmt.Printf("Block Sizes          : %v\n", sizes)
+		fmt.Printf("Block Sizes          : %v\n", stats.BlockSizes())
 	}
 }
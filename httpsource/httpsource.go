@@ -0,0 +1,154 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// Package httpsource provides a pbzip2.Source for http and https URLs.
+// It is a separate package so that users of pbzip2 that do not need to
+// read from URLs do not depend on net/http. Importing it registers New,
+// with http.DefaultClient, for the http and https schemes so that
+// pbzip2.NewSource supports URLs, eg.
+//
+//	import _ "github.com/cosnicolaou/pbzip2/httpsource"
+package httpsource
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/cosnicolaou/pbzip2"
+)
+
+func init() {
+	for _, scheme := range []string{"http", "https"} {
+		pbzip2.RegisterSource(scheme, func(name string) (pbzip2.Source, error) {
+			return New(name, nil), nil
+		})
+	}
+}
+
+// New returns a pbzip2.Source for the specified http or https URL using
+// client, or http.DefaultClient if client is nil. Open issues a HEAD
+// request to determine the size of the data and the reader it returns
+// implements io.ReaderAt, using range requests, if the server reports
+// that size and supports range requests. The data is otherwise read using
+// a single GET request that is issued by the first call to Read.
+func New(url string, client *http.Client) pbzip2.Source {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &httpSource{url: url, client: client}
+}
+
+type httpSource struct {
+	url    string
+	client *http.Client
+}
+
+// Open implements pbzip2.Source.
+func (hs *httpSource) Open(ctx context.Context) (io.Reader, int64, error) {
+	hr := &httpReader{ctx: ctx, httpSource: hs, size: -1}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, hs.url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := hs.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// Not all servers support HEAD requests, any other error will
+		// be returned by the GET request.
+		return hr, -1, nil
+	}
+	hr.size = resp.ContentLength
+	if hr.size >= 0 && resp.Header.Get("Accept-Ranges") == "bytes" {
+		return &httpReaderAt{hr}, hr.size, nil
+	}
+	return hr, hr.size, nil
+}
+
+// httpReader reads the data for an httpSource via a single GET request.
+type httpReader struct {
+	ctx context.Context
+	*httpSource
+	size int64
+	body io.ReadCloser
+	err  error
+}
+
+func (hr *httpReader) get(byteRange string, want int) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(hr.ctx, http.MethodGet, hr.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(byteRange) > 0 {
+		req.Header.Set("Range", byteRange)
+	}
+	resp, err := hr.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != want {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%v: unexpected status: %v", hr.url, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// Read implements io.Reader.
+func (hr *httpReader) Read(buf []byte) (int, error) {
+	if hr.body == nil {
+		if hr.err != nil {
+			return 0, hr.err
+		}
+		hr.body, hr.err = hr.get("", http.StatusOK)
+		if hr.err != nil {
+			return 0, hr.err
+		}
+	}
+	return hr.body.Read(buf)
+}
+
+// Close implements io.Closer.
+func (hr *httpReader) Close() error {
+	if hr.body == nil {
+		return nil
+	}
+	return hr.body.Close()
+}
+
+// httpReaderAt is an httpReader that also implements io.ReaderAt.
+type httpReaderAt struct {
+	*httpReader
+}
+
+// ReadAt implements io.ReaderAt, it issues a range request for each call
+// and may be called concurrently.
+func (hr *httpReaderAt) ReadAt(buf []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset: %v", off)
+	}
+	if off >= hr.size {
+		return 0, io.EOF
+	}
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	n := int64(len(buf))
+	if off+n > hr.size {
+		n = hr.size - off
+	}
+	body, err := hr.get(fmt.Sprintf("bytes=%d-%d", off, off+n-1), http.StatusPartialContent)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	read, err := io.ReadFull(body, buf[:n])
+	if err == nil && read < len(buf) {
+		err = io.EOF
+	}
+	return read, err
+}
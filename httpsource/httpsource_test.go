@@ -0,0 +1,121 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package httpsource_test
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cosnicolaou/pbzip2"
+	"github.com/cosnicolaou/pbzip2/httpsource"
+)
+
+func readSource(ctx context.Context, t *testing.T, src pbzip2.Source) ([]byte, error) {
+	t.Helper()
+	rd, err := pbzip2.NewReaderFromSource(ctx, src,
+		pbzip2.DecompressionOptions(pbzip2.BZConcurrency(2)))
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	return io.ReadAll(rd)
+}
+
+func TestHTTPSource(t *testing.T) {
+	ctx := context.Background()
+	compressed, err := os.ReadFile(filepath.Join("..", "testdata", "900KB1.bz2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := io.ReadAll(bzip2.NewReader(bytes.NewReader(compressed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// http.ServeContent supports HEAD and range requests.
+	ranges := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "900KB1.bz2", time.Time{}, bytes.NewReader(compressed))
+	}))
+	defer ranges.Close()
+
+	// A server that supports neither HEAD nor range requests.
+	var gets int32
+	streaming := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		atomic.AddInt32(&gets, 1)
+		w.Write(compressed)
+	}))
+	defer streaming.Close()
+
+	for _, tc := range []struct {
+		url      string
+		readerAt bool
+		size     int64
+	}{
+		{ranges.URL, true, int64(len(compressed))},
+		{streaming.URL, false, -1},
+	} {
+		src, err := pbzip2.NewSource(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rd, size, err := src.Open(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := rd.(io.ReaderAt); ok != tc.readerAt {
+			t.Errorf("%v: got %v, want %v", tc.url, ok, tc.readerAt)
+		}
+		if got, want := size, tc.size; got != want {
+			t.Errorf("%v: got %v, want %v", tc.url, got, want)
+		}
+		rd.(io.Closer).Close()
+
+		got, err := readSource(ctx, t, src)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.url, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v bytes, want %v bytes", tc.url, len(got), len(want))
+		}
+	}
+	// The GET request is only issued when the data is read.
+	if got, want := atomic.LoadInt32(&gets), int32(1); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	ra, _, err := httpsource.New(ranges.URL, nil).Open(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	n, err := ra.(io.ReaderAt).ReadAt(buf, int64(len(compressed)-10))
+	if n != 10 || err != io.EOF {
+		t.Errorf("got %v, %v", n, err)
+	}
+	if got, want := buf[:n], compressed[len(compressed)-10:]; !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+	_, err = readSource(ctx, t, httpsource.New(missing.URL, nil))
+	if err == nil || !strings.Contains(err.Error(), "unexpected status: 404") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+}
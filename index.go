@@ -0,0 +1,424 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"runtime"
+
+	"github.com/cosnicolaou/pbzip2/internal/bitstream"
+)
+
+// BlockLocation records the location and metadata of a single compressed
+// block within a bzip2 file. A slice of BlockLocations, as returned by
+// BuildIndex, forms an index of the file that can be used to read
+// individual blocks directly. The location of each block's decompressed
+// data is only known once the file has been decompressed and hence
+// UncompressedOffset and UncompressedSize are only set by
+// AddUncompressedSizes.
+type BlockLocation struct {
+	Offset          int64  // Offset of the first byte containing the block's compressed data.
+	Size            int    // Size is the number of bytes spanned by the compressed data.
+	BitOffset       int    // Compressed data starts at BitOffset in the first byte.
+	SizeInBits      int    // SizeInBits is the size of the compressed data.
+	CRC             uint32 // CRC for this block.
+	StreamBlockSize int    // StreamBlockSize is the 1..9 *100*1000 compression block size specified when the stream was created.
+	EOS             bool   // EOS is true for the last block in a stream.
+	StreamCRC       uint32 // StreamCRC is the CRC for the stream, valid only when EOS is true.
+	EmptyStreams    int    // EmptyStreams is the number of empty streams that followed the block.
+
+	UncompressedOffset int64 // UncompressedOffset is the offset of the block's data in the decompressed output.
+	UncompressedSize   int   // UncompressedSize is the size of the block's decompressed data.
+}
+
+func newBlockLocation(cb CompressedBlock) BlockLocation {
+	return BlockLocation{
+		Offset:          cb.Offset,
+		Size:            len(cb.Data),
+		BitOffset:       cb.BitOffset,
+		SizeInBits:      cb.SizeInBits,
+		CRC:             cb.CRC,
+		StreamBlockSize: cb.StreamBlockSize,
+		EOS:             cb.EOS,
+		StreamCRC:       cb.StreamCRC,
+		EmptyStreams:    cb.emptyStreams,
+	}
+}
+
+// ReadBlock reads the compressed block at loc from ra.
+func (loc BlockLocation) ReadBlock(ra io.ReaderAt) (CompressedBlock, error) {
+	cb := CompressedBlock{
+		Offset:          loc.Offset,
+		BitOffset:       loc.BitOffset,
+		SizeInBits:      loc.SizeInBits,
+		CRC:             loc.CRC,
+		StreamBlockSize: loc.StreamBlockSize,
+		EOS:             loc.EOS,
+		StreamCRC:       loc.StreamCRC,
+		emptyStreams:    loc.EmptyStreams,
+	}
+	if loc.Size == 0 {
+		return cb, nil
+	}
+	cb.Data = make([]byte, loc.Size)
+	if _, err := ra.ReadAt(cb.Data, loc.Offset); err != nil {
+		return CompressedBlock{}, fmt.Errorf("failed to read block at offset %v: %v", loc.Offset, err)
+	}
+	return cb, nil
+}
+
+// BuildIndex scans the supplied bzip2 stream and returns the location
+// of every block within it.
+func BuildIndex(ctx context.Context, rd io.Reader, opts ...ScannerOption) ([]BlockLocation, error) {
+	sc := NewScanner(rd, opts...)
+	var index []BlockLocation
+	for sc.Scan(ctx) {
+		index = append(index, newBlockLocation(sc.Block()))
+	}
+	return index, sc.Err()
+}
+
+// BlockIterator returns the blocks recorded in an index, see ScanFromIndex.
+// Its methods mirror those of Scanner so that it may be used in place of
+// one.
+type BlockIterator struct {
+	ra    io.ReaderAt
+	index []BlockLocation
+	next  int
+	block CompressedBlock
+	err   error
+}
+
+// ScanFromIndex returns a BlockIterator that returns the blocks in index,
+// which must have been returned by BuildIndex for ra. Each block is read
+// directly from its location in ra and hence, unlike Scanner, there is
+// no need to search for the block magic numbers. The blocks returned are
+// identical to those that would be returned by a Scanner for the same
+// input, including the number of empty streams that followed each block
+// as recorded in BlockLocation.EmptyStreams.
+func ScanFromIndex(ra io.ReaderAt, index []BlockLocation) *BlockIterator {
+	return &BlockIterator{ra: ra, index: index}
+}
+
+// Scan returns true if there is a block to be returned.
+func (it *BlockIterator) Scan(ctx context.Context) bool {
+	if it.err != nil || it.next >= len(it.index) {
+		return false
+	}
+	if err := ctx.Err(); err != nil {
+		it.err = err
+		return false
+	}
+	cb, err := it.index[it.next].ReadBlock(it.ra)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.block = cb
+	it.next++
+	return true
+}
+
+// Block returns the current block.
+func (it *BlockIterator) Block() CompressedBlock {
+	return it.block
+}
+
+// Err returns any error encountered by the iterator.
+func (it *BlockIterator) Err() error {
+	return it.err
+}
+
+// AddUncompressedSizes decompresses the blocks in index, which must have
+// been returned by BuildIndex for ra, and records the size and offset of
+// each block's decompressed data in index. A block that had to be merged
+// with its successor, because of a false positive match of the block
+// magic number, is recorded as containing the decompressed data for both
+// blocks with its successor having a size of zero.
+func AddUncompressedSizes(ctx context.Context, ra io.ReaderAt, index []BlockLocation, opts ...ReaderOption) error {
+	rdOpts := newParallelReaderOpts(opts)
+	ch := make(chan Progress, len(index)+1)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// The channel is large enough to never block and every update is
+	// required.
+	dc := NewDecompressor(ctx, append(rdOpts.decOpts, BZSendUpdates(ch), BZProgressBlocking(true))...)
+	rd := newReader(ctx, cancel, dc, func() error {
+		return fetchBlocks(ctx, ra, index, rdOpts.readAhead, dc)
+	})
+	if _, err := io.Copy(io.Discard, rd); err != nil {
+		return err
+	}
+	close(ch)
+	sizes := make([]int, len(index))
+	for p := range ch {
+		if !p.Final {
+			sizes[p.Block-1] = p.Size
+		}
+	}
+	offset := int64(0)
+	for i := range index {
+		index[i].UncompressedOffset = offset
+		index[i].UncompressedSize = sizes[i]
+		offset += int64(sizes[i])
+	}
+	return nil
+}
+
+// DecompressRange returns a reader for the bytes in the range [start, end)
+// of the decompressed output of ra. The index must have been returned by
+// BuildIndex for ra and subsequently passed to AddUncompressedSizes. Only
+// the blocks that overlap the requested range are read and decompressed.
+// Block CRCs are verified but, since a range will generally not span
+// entire streams, stream CRCs are not.
+func DecompressRange(ctx context.Context, ra io.ReaderAt, index []BlockLocation, start, end int64, opts ...ReaderOption) (io.Reader, error) {
+	var total int64
+	sized := false
+	for _, loc := range index {
+		total += int64(loc.UncompressedSize)
+		sized = sized || loc.UncompressedSize > 0 || loc.SizeInBits == 0
+	}
+	if len(index) > 0 && !sized {
+		return nil, fmt.Errorf("index does not contain uncompressed sizes, see AddUncompressedSizes")
+	}
+	if start < 0 || start > end || end > total {
+		return nil, fmt.Errorf("invalid range [%v, %v) for %v bytes of decompressed data", start, end, total)
+	}
+	first := 0
+	for first < len(index) && index[first].UncompressedOffset+int64(index[first].UncompressedSize) <= start {
+		first++
+	}
+	last := first
+	for last < len(index) && index[last].UncompressedOffset < end {
+		last++
+	}
+	// Include any successors that were merged with the last block.
+	for last < len(index) && index[last].UncompressedSize == 0 {
+		last++
+	}
+	blocks := make([]BlockLocation, last-first)
+	copy(blocks, index[first:last])
+	for i := range blocks {
+		blocks[i].EOS = false
+	}
+	rdOpts := newParallelReaderOpts(opts)
+	ctx, cancel := context.WithCancel(ctx)
+	dc := NewDecompressor(ctx, rdOpts.decOpts...)
+	rd := newReader(ctx, cancel, dc, func() error {
+		return fetchBlocks(ctx, ra, blocks, rdOpts.readAhead, dc)
+	})
+	skip := int64(0)
+	if len(blocks) > 0 {
+		skip = start - blocks[0].UncompressedOffset
+	}
+	return &limitedReader{rd: rd, skip: skip, n: end - start}, nil
+}
+
+// IndexValidation determines how thoroughly ValidateIndex checks an
+// index.
+type IndexValidation string
+
+const (
+	// ValidateFull checks every block in the index.
+	ValidateFull IndexValidation = "full"
+	// ValidateSampled checks the first and last blocks in the index and
+	// a sample of those in between, such that at most
+	// validationSampleSize blocks are checked.
+	ValidateSampled IndexValidation = "sampled"
+)
+
+// validationSampleSize is the maximum number of blocks checked by
+// ValidateSampled.
+const validationSampleSize = 16
+
+// ValidateIndex checks that the index, as returned by BuildIndex, matches
+// the bzip2 data in ra, eg. when an index is loaded from disk alongside a
+// file that may have since been modified. For each block that it checks,
+// according to mode, it reads the bytes that should contain the block's
+// magic number and CRC, and verifies that the former is present and that
+// the latter matches the index, as well as that ra contains all of the
+// block's data. The blocks are not decompressed.
+func ValidateIndex(ra io.ReaderAt, index []BlockLocation, mode IndexValidation) error {
+	var sample []int
+	switch mode {
+	case ValidateFull:
+		for i := range index {
+			sample = append(sample, i)
+		}
+	case ValidateSampled:
+		n := len(index)
+		if n <= validationSampleSize {
+			for i := range index {
+				sample = append(sample, i)
+			}
+			break
+		}
+		for i := 0; i < validationSampleSize; i++ {
+			sample = append(sample, i*(n-1)/(validationSampleSize-1))
+		}
+	default:
+		return fmt.Errorf("unsupported index validation mode: %v", mode)
+	}
+	for _, i := range sample {
+		if err := validateBlockLocation(ra, index[i]); err != nil {
+			return fmt.Errorf("block %v: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+func validateBlockLocation(ra io.ReaderAt, loc BlockLocation) error {
+	if loc.SizeInBits == 0 {
+		// The entry for an empty stream.
+		return nil
+	}
+	start := loc.Offset*8 + int64(loc.BitOffset) - int64(len(blockMagic))*8
+	if start < 0 {
+		return fmt.Errorf("invalid offset: %v", loc.Offset)
+	}
+	// The magic number and CRC span 80 bits, plus the bits preceding
+	// the magic number in its first byte.
+	shift := int(start % 8)
+	buf := make([]byte, 11)
+	n, err := ra.ReadAt(buf, start/8)
+	if n < (shift+80+7)/8 {
+		return fmt.Errorf("failed to read block header at offset %v: %v", start/8, err)
+	}
+	for i, b := range blockMagic {
+		if byte(bitsAt(buf, shift+i*8, 8)) != b {
+			return fmt.Errorf("offset %v, bit offset %v: block magic number not found", loc.Offset, loc.BitOffset)
+		}
+	}
+	if got, want := uint32(bitsAt(buf, shift+len(blockMagic)*8, 32)), loc.CRC; got != want { //#nosec G115 -- This is a false positive, bitsAt returns 32 bits.
+		return fmt.Errorf("offset %v, bit offset %v: mismatched block CRC: stream=0x%08x != index=0x%08x", loc.Offset, loc.BitOffset, got, want)
+	}
+	last := (loc.Offset*8 + int64(loc.BitOffset) + int64(loc.SizeInBits) - 1) / 8
+	if _, err := ra.ReadAt(buf[:1], last); err != nil {
+		return fmt.Errorf("failed to read end of block at offset %v: %v", last, err)
+	}
+	return nil
+}
+
+// bitsAt returns the n, at most 64, bits starting at the specified bit
+// offset in buf.
+func bitsAt(buf []byte, offset, n int) uint64 {
+	var v uint64
+	for i := offset; i < offset+n; i++ {
+		v = v<<1 | uint64(buf[i/8]>>(7-i%8)&1)
+	}
+	return v
+}
+
+// BZReadAhead sets the number of block fetches that may be outstanding
+// at any one time for NewParallelReaderAt. It defaults to
+// runtime.GOMAXPROCS.
+func BZReadAhead(n int) ReaderOption {
+	return func(o *readerOpts) {
+		o.readAhead = n
+	}
+}
+
+// NewParallelReaderAt returns an io.Reader that decompresses the bzip2 data
+// in ra. It first scans ra to build an index of its blocks (see BuildIndex)
+// and then reads those blocks using concurrent calls to ReadAt so as to
+// overlap I/O with decompression. This is most useful for sources where
+// each ReadAt incurs a significant latency, such as range requests to
+// cloud storage.
+func NewParallelReaderAt(ctx context.Context, ra io.ReaderAt, size int64, opts ...ReaderOption) io.Reader {
+	rdOpts := newParallelReaderOpts(opts)
+	ctx, cancel := context.WithCancel(ctx)
+	dc := NewDecompressor(ctx, rdOpts.decOpts...)
+	return newReader(ctx, cancel, dc, func() error {
+		index, err := BuildIndex(ctx, io.NewSectionReader(ra, 0, size), rdOpts.scanOpts...)
+		if err != nil {
+			return err
+		}
+		return fetchBlocks(ctx, ra, index, rdOpts.readAhead, dc)
+	})
+}
+
+func newParallelReaderOpts(opts []ReaderOption) *readerOpts {
+	rdOpts := &readerOpts{
+		readAhead: runtime.GOMAXPROCS(-1),
+	}
+	for _, fn := range opts {
+		fn(rdOpts)
+	}
+	if rdOpts.readAhead < 1 {
+		rdOpts.readAhead = 1
+	}
+	return rdOpts
+}
+
+type fetchedBlock struct {
+	block CompressedBlock
+	err   error
+}
+
+// fetchBlocks reads the blocks in index from ra, with at most readAhead
+// reads outstanding, and appends them, in order, to the decompressor.
+func fetchBlocks(ctx context.Context, ra io.ReaderAt, index []BlockLocation, readAhead int, dc *Decompressor) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// The consumer below holds one pending fetch, hence the channel
+	// is sized so that at most readAhead fetches are outstanding.
+	pending := make(chan chan fetchedBlock, readAhead-1)
+	go func() {
+		defer close(pending)
+		for _, loc := range index {
+			ch := make(chan fetchedBlock, 1)
+			select {
+			case pending <- ch:
+			case <-ctx.Done():
+				return
+			}
+			go func(loc BlockLocation) {
+				cb, err := loc.ReadBlock(ra)
+				ch <- fetchedBlock{block: cb, err: err}
+			}(loc)
+		}
+	}()
+	for ch := range pending {
+		var fetched fetchedBlock
+		select {
+		case fetched = <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if fetched.err != nil {
+			return fetched.err
+		}
+		if err := dc.Append(fetched.block); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// PeekStreamCRC returns the stream CRC stored in the trailer at the end
+// of the size bytes of bzip2 data in ra without decompressing, or even
+// scanning, it, only the last few bytes are read. For a file containing
+// multiple streams it returns the CRC of the last stream. The CRC is
+// read as is and hence is only verified when the data is decompressed.
+func PeekStreamCRC(ra io.ReaderAt, size int64) (uint32, error) {
+	// A stream consists of at least a 4 byte header and a 10 byte
+	// trailer, followed by up to 7 bits of padding.
+	if size < 14 {
+		return 0, fmt.Errorf("input is too small to contain a stream: %v bytes", size)
+	}
+	n := int64(11)
+	buf := make([]byte, n)
+	if _, err := ra.ReadAt(buf, size-n); err != nil {
+		return 0, fmt.Errorf("failed to read stream trailer at offset %v: %v", size-n, err)
+	}
+	crc, trailerSize, _ := bitstream.FindTrailingMagicAndCRC(buf, eosMagic[:])
+	if trailerSize != 10 {
+		return 0, fmt.Errorf("failed to find stream trailer")
+	}
+	return binary.BigEndian.Uint32(crc), nil
+}
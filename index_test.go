@@ -0,0 +1,356 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cosnicolaou/pbzip2"
+)
+
+func TestBuildIndex(t *testing.T) {
+	ctx := context.Background()
+	compressed, _ := concatFiles(t, "hello", "empty", "300KB1", "900KB9")
+	index, err := pbzip2.BuildIndex(ctx, bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := pbzip2.NewScanner(bytes.NewReader(compressed))
+	n := 0
+	for sc.Scan(ctx) {
+		block := sc.Block()
+		loc := index[n]
+		if got, want := compressed[loc.Offset:loc.Offset+int64(loc.Size)], block.Data; !bytes.Equal(got, want) {
+			t.Errorf("block %v: data at offset %v does not match", n, loc.Offset)
+		}
+		cb, err := loc.ReadBlock(bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatalf("block %v: %v", n, err)
+		}
+		if got, want := cb, block; !bytes.Equal(got.Data, want.Data) ||
+			got.BitOffset != want.BitOffset || got.SizeInBits != want.SizeInBits ||
+			got.CRC != want.CRC || got.EOS != want.EOS || got.StreamCRC != want.StreamCRC {
+			t.Errorf("block %v: got %v, want %v", n, got, want)
+		}
+		n++
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(index), n; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestScanFromIndex(t *testing.T) {
+	ctx := context.Background()
+	compressed, _ := readFile(t, "900KB1")
+	withEmpty, _ := concatFiles(t, "hello", "empty", "empty", "300KB1", "empty")
+	for _, input := range [][]byte{compressed, withEmpty} {
+		index, err := pbzip2.BuildIndex(ctx, bytes.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := pbzip2.NewScanner(bytes.NewReader(input))
+		it := pbzip2.ScanFromIndex(bytes.NewReader(input), index)
+		n := 0
+		for sc.Scan(ctx) {
+			if !it.Scan(ctx) {
+				t.Fatalf("block %v: iterator ended early: %v", n, it.Err())
+			}
+			// DeepEqual also compares the number of empty streams that
+			// followed each block.
+			if got, want := it.Block(), sc.Block(); !reflect.DeepEqual(got, want) {
+				t.Errorf("block %v: got %v, want %v", n, got, want)
+			}
+			n++
+		}
+		if err := sc.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if it.Scan(ctx) {
+			t.Errorf("iterator returned more than %v blocks", n)
+		}
+		if err := it.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if n < 2 {
+			t.Errorf("expected multiple blocks, got %v", n)
+		}
+	}
+
+	// Empty streams are reported for blocks read via the index.
+	index, err := pbzip2.BuildIndex(ctx, bytes.NewReader(withEmpty))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan pbzip2.Diagnostic, 10)
+	dc := pbzip2.NewDecompressor(ctx, pbzip2.BZDiagnostics(ch))
+	go func() {
+		_, _ = io.Copy(io.Discard, dc)
+	}()
+	it := pbzip2.ScanFromIndex(bytes.NewReader(withEmpty), index)
+	for it.Scan(ctx) {
+		if err := dc.Append(it.Block()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := dc.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+	var diags []pbzip2.Diagnostic
+	for d := range ch {
+		diags = append(diags, d)
+	}
+	if got, want := diags, []pbzip2.Diagnostic{
+		{Block: 1, Kind: pbzip2.DiagnosticEmptyStreams, Detail: "ignored 2 empty stream(s)"},
+		{Block: 5, Kind: pbzip2.DiagnosticEmptyStreams, Detail: "ignored 1 empty stream(s)"},
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Errors reading a block are reported by Err.
+	it = pbzip2.ScanFromIndex(bytes.NewReader(withEmpty[:len(withEmpty)/2]), index)
+	for it.Scan(ctx) {
+	}
+	if err := it.Err(); err == nil || !strings.Contains(err.Error(), "failed to read block") {
+		t.Errorf("missing or wrong error: %v", err)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	it = pbzip2.ScanFromIndex(bytes.NewReader(withEmpty), index)
+	if it.Scan(cctx) {
+		t.Errorf("expected Scan to fail for a canceled context")
+	}
+	if got, want := it.Err(), context.Canceled; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestParallelReaderAt(t *testing.T) {
+	ctx := context.Background()
+	for _, names := range [][]string{
+		{"hello"},
+		{"300KB1"},
+		{"900KB1"},
+		{"hello", "empty", "300KB2", "900KB9", "hello"},
+	} {
+		compressed, actual := concatFiles(t, names...)
+		for _, readAhead := range []int{1, 2, 8} {
+			rd := pbzip2.NewParallelReaderAt(ctx,
+				bytes.NewReader(compressed),
+				int64(len(compressed)),
+				pbzip2.BZReadAhead(readAhead),
+				pbzip2.DecompressionOptions(pbzip2.BZConcurrency(3)))
+			buf, err := io.ReadAll(rd)
+			if err != nil {
+				t.Fatalf("%v: %v", names, err)
+			}
+			if got, want := buf, actual; !bytes.Equal(got, want) {
+				t.Errorf("%v: read ahead %v: got %v bytes, want %v bytes", names, readAhead, len(got), len(want))
+			}
+		}
+	}
+}
+
+func TestParallelReaderAtErrors(t *testing.T) {
+	ctx := context.Background()
+	compressed, _ := readFile(t, "300KB1")
+	// Truncate the stream so that scanning fails.
+	compressed = compressed[:len(compressed)/2]
+	rd := pbzip2.NewParallelReaderAt(ctx, bytes.NewReader(compressed), int64(len(compressed)))
+	if _, err := io.ReadAll(rd); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestEstimateDecompressedSize(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range []string{"hello", "300KB1", "900KB9"} {
+		compressed, _ := readFile(t, name)
+		actual := int64(len(bzip2Data[name]))
+
+		// bytes.Reader implements io.ReaderAt and has a Size method.
+		size, exact, err := pbzip2.EstimateDecompressedSize(ctx, bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if got, want := size, actual; !exact || got != want {
+			t.Errorf("%v: got %v (exact %v), want %v", name, got, exact, want)
+		}
+
+		f, err := os.Open(bzip2Files[name] + ".bz2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		size, exact, err = pbzip2.EstimateDecompressedSize(ctx, f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if got, want := size, actual; !exact || got != want {
+			t.Errorf("%v: got %v (exact %v), want %v", name, got, exact, want)
+		}
+
+		// bytes.Buffer does not implement io.ReaderAt.
+		var compressedBits int64
+		index, err := pbzip2.BuildIndex(ctx, bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, loc := range index {
+			compressedBits += int64(loc.SizeInBits)
+		}
+		for _, factor := range []float64{1, pbzip2.DefaultExpansionFactor} {
+			var opts []pbzip2.ReaderOption
+			if factor != pbzip2.DefaultExpansionFactor {
+				opts = append(opts, pbzip2.ExpansionFactor(factor))
+			}
+			size, exact, err = pbzip2.EstimateDecompressedSize(ctx, bytes.NewBuffer(compressed), opts...)
+			if err != nil {
+				t.Fatalf("%v: %v", name, err)
+			}
+			want := int64(float64(compressedBits) / 8 * factor)
+			if exact || size < want-1 || size > want+1 {
+				t.Errorf("%v: factor %v: got %v (exact %v), want %v", name, factor, size, exact, want)
+			}
+		}
+	}
+}
+
+func TestDecompressRange(t *testing.T) {
+	ctx := context.Background()
+	compressed, actual := concatFiles(t, "hello", "empty", "900KB1", "300KB5")
+	ra := bytes.NewReader(compressed)
+	index, err := pbzip2.BuildIndex(ctx, ra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pbzip2.DecompressRange(ctx, ra, index, 0, 10); err == nil {
+		t.Errorf("expected an error for an index without sizes")
+	}
+	if err := pbzip2.AddUncompressedSizes(ctx, ra, index); err != nil {
+		t.Fatal(err)
+	}
+	last := index[len(index)-1]
+	if got, want := last.UncompressedOffset+int64(last.UncompressedSize), int64(len(actual)); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	blockSize := int64(index[2].UncompressedSize)
+	total := int64(len(actual))
+	for _, r := range [][2]int64{
+		{0, 0},
+		{0, 5},
+		{0, total},
+		{12, 12 + blockSize},
+		{500 * 1000, 500*1000 + 100}, // within a single block.
+		{12 + blockSize - 10, 12 + blockSize + 10}, // straddles two blocks.
+		{100, total - 100},
+		{total - 1, total},
+		{total, total},
+	} {
+		for _, readAhead := range []int{1, 4} {
+			rd, err := pbzip2.DecompressRange(ctx, ra, index, r[0], r[1], pbzip2.BZReadAhead(readAhead))
+			if err != nil {
+				t.Fatalf("%v: %v", r, err)
+			}
+			out, err := io.ReadAll(rd)
+			if err != nil {
+				t.Fatalf("%v: %v", r, err)
+			}
+			if got, want := out, actual[r[0]:r[1]]; !bytes.Equal(got, want) {
+				t.Errorf("%v: got %v bytes, want %v bytes", r, len(got), len(want))
+			}
+		}
+	}
+
+	for _, r := range [][2]int64{{-1, 10}, {10, 5}, {0, total + 1}} {
+		if _, err := pbzip2.DecompressRange(ctx, ra, index, r[0], r[1]); err == nil {
+			t.Errorf("%v: expected an error", r)
+		}
+	}
+}
+
+func TestPeekStreamCRC(t *testing.T) {
+	for _, name := range []string{"empty", "hello", "300KB1", "900KB9", "1033KB4_Random"} {
+		compressed, _ := readFile(t, name)
+		blocks := scanBlocks(t, compressed)
+		last := blocks[len(blocks)-1]
+		if !last.EOS {
+			t.Fatalf("%v: last block is not EOS", name)
+		}
+		crc, err := pbzip2.PeekStreamCRC(bytes.NewReader(compressed), int64(len(compressed)))
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if got, want := crc, last.StreamCRC; got != want {
+			t.Errorf("%v: got %08x, want %08x", name, got, want)
+		}
+	}
+
+	compressed, _ := readFile(t, "hello")
+	if crc, err := pbzip2.PeekStreamCRC(bytes.NewReader(compressed), int64(len(compressed))); err != nil || crc != 0x4eece836 {
+		t.Errorf("unexpected crc or error: %08x, %v", crc, err)
+	}
+	truncated := compressed[:len(compressed)-2]
+	if _, err := pbzip2.PeekStreamCRC(bytes.NewReader(truncated), int64(len(truncated))); err == nil || err.Error() != "failed to find stream trailer" {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+	if _, err := pbzip2.PeekStreamCRC(bytes.NewReader(compressed[:10]), 10); err == nil || err.Error() != "input is too small to contain a stream: 10 bytes" {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+}
+
+func TestValidateIndex(t *testing.T) {
+	ctx := context.Background()
+	compressed, _ := concatFiles(t, "300KB1", "empty", "hello", "900KB1", "900KB9")
+	index, err := pbzip2.BuildIndex(ctx, bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ra := bytes.NewReader(compressed)
+	for _, mode := range []pbzip2.IndexValidation{pbzip2.ValidateFull, pbzip2.ValidateSampled} {
+		if err := pbzip2.ValidateIndex(ra, index, mode); err != nil {
+			t.Errorf("%v: %v", mode, err)
+		}
+	}
+
+	last := len(index) - 1
+	for _, tc := range []struct {
+		block   int
+		corrupt func(*pbzip2.BlockLocation)
+		err     string
+	}{
+		{0, func(l *pbzip2.BlockLocation) { l.CRC++ }, "block 1: offset 10, bit offset 0: mismatched block CRC"},
+		{last, func(l *pbzip2.BlockLocation) { l.BitOffset++ }, "block magic number not found"},
+		{last, func(l *pbzip2.BlockLocation) { l.SizeInBits += 1024 }, "failed to read end of block"},
+		{0, func(l *pbzip2.BlockLocation) { l.Offset = 2 }, "block 1: invalid offset: 2"},
+	} {
+		corrupted := append([]pbzip2.BlockLocation{}, index...)
+		tc.corrupt(&corrupted[tc.block])
+		for _, mode := range []pbzip2.IndexValidation{pbzip2.ValidateFull, pbzip2.ValidateSampled} {
+			if err := pbzip2.ValidateIndex(ra, corrupted, mode); err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%v: %v: missing or unexpected error: %v", tc.block, mode, err)
+			}
+		}
+	}
+
+	// An index for a different file.
+	other, _ := readFile(t, "900KB1")
+	if err := pbzip2.ValidateIndex(bytes.NewReader(other), index, pbzip2.ValidateFull); err == nil {
+		t.Errorf("expected an error")
+	}
+	if err := pbzip2.ValidateIndex(ra, index, "partial"); err == nil || err.Error() != "unsupported index validation mode: partial" {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+}
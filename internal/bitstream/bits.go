@@ -264,6 +264,7 @@ func (bw *BitWriter) Append(data []byte, offsetBits, lenBits int) {
 		}
 		bw.buf = append(bw.buf, data...)
 		bw.lenInBits += lenBits
+		bw.trim()
 		return
 	}
 
@@ -283,6 +284,16 @@ func (bw *BitWriter) Append(data []byte, offsetBits, lenBits int) {
 	bw.buf[len(bw.buf)-1] = overlap
 	bw.buf = append(bw.buf, data[1:]...)
 	bw.lenInBits += lenBits
+	bw.trim()
+}
+
+// trim discards any bytes beyond those needed to hold the bitstream so
+// that the last byte always contains its trailing bits, the supplied data
+// may extend beyond the bits that were appended from it.
+func (bw *BitWriter) trim() {
+	if n := (bw.lenInBits + 7) / 8; len(bw.buf) > n {
+		bw.buf = bw.buf[:n]
+	}
 }
 
 func (bw *BitWriter) Data() ([]byte, int) {
@@ -333,6 +333,11 @@ func TestBitAppend(t *testing.T) {
 		{s(0xfe), 7, s(0x01), 7, 1, s(0xff), 8},
 		{s(0xe0), 3, s(0x01, 0xff), 7, 9, s(0xff, 0xf0), 12},
 		{s(0xe0), 1, s(0x01, 0xff), 7, 9, s(0xff, 0xc0), 10},
+
+		// source data that extends beyond the appended bits
+		{s(0xff), 8, s(0x7f, 0x00), 1, 7, s(0xff, 0xfe), 15},
+		{s(0xe0), 3, s(0xff, 0xaa), 0, 5, s(0xff), 8},
+		{nil, 0, s(0xff, 0xaa), 0, 4, s(0xff), 4},
 	} {
 		wr := &bitstream.BitWriter{}
 		wr.Init(tc.a, tc.al, 0)
@@ -90,6 +90,19 @@ func (br *bitReader) PrefetchBytes(n uint) {
 	}
 }
 
+// readByte reads a single byte from the underlying reader, bypassing any
+// bits already read, and accounts for it in the offsets reported by
+// bitsUsed. It must only be called when the reader is byte aligned.
+func (br *bitReader) readByte() (byte, error) {
+	b, err := br.r.ReadByte()
+	if err == nil {
+		br.bytesRead++
+	}
+	return b, err
+}
+
+// bitsUsed returns the number of bits consumed from the underlying reader,
+// it is used for the offsets reported via Stats.
 func (br *bitReader) bitsUsed() uint {
 	return (br.bytesRead * 8) - br.bits
 }
@@ -6,6 +6,8 @@ package bzip2
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 )
@@ -21,20 +23,36 @@ var (
 	EOSMagic = [6]byte{0x17, 0x72, 0x45, 0x38, 0x50, 0x90}
 )
 
+var errBlockChecksumMismatch = errors.New("block checksum mismatch")
+
+// BlockChecksumMismatch returns true if err indicates that the CRC of a
+// block read by a BlockReader does not match the one stored for it.
+func BlockChecksumMismatch(err error) bool {
+	return errors.Is(err, errBlockChecksumMismatch)
+}
+
 // BlockReader represents an io.Reader that can read a single bzip2 block.
 type BlockReader struct {
 	underlying *reader
 	first      bool
 	start      uint
+	skipCRC    bool
 	err        error
 }
 
-// NewBlockReader returns an io.Reader to read a single bzip2 block.
-func NewBlockReader(blockSize int, src []byte, start uint) io.Reader {
+// NewBlockReader returns a BlockReader to read a single bzip2 block.
+func NewBlockReader(blockSize int, src []byte, start uint) *BlockReader {
+	return NewBlockReaderContext(context.Background(), blockSize, src, start)
+}
+
+// NewBlockReaderContext is like NewBlockReader except that decoding
+// is abandoned, with ctx.Err() being returned, once ctx is done.
+func NewBlockReaderContext(ctx context.Context, blockSize int, src []byte, start uint) *BlockReader {
 	if len(src) == 0 {
 		return &BlockReader{err: io.EOF}
 	}
 	bz2 := new(reader)
+	bz2.ctx = ctx
 	// mirror initialization from reader.setup()
 	bz2.fileCRC = 0
 	bz2.setupDone = true
@@ -44,11 +62,41 @@ func NewBlockReader(blockSize int, src []byte, start uint) io.Reader {
 	return &BlockReader{underlying: bz2, first: true, start: start}
 }
 
+// DecodeBlockLen returns the decompressed length of the single bzip2
+// block that starts at bit offset start in src. bzip2 does not record
+// the decompressed length of a block and hence the block must be
+// decoded, but its output is discarded, via a fixed size buffer, rather
+// than retained. This allows for the cumulative decompressed sizes of
+// the blocks in a file to be determined without holding all of the
+// decompressed data in memory. The block's CRC is not verified.
+func DecodeBlockLen(blockSize int, src []byte, start int) (int, error) {
+	if start < 0 {
+		return 0, fmt.Errorf("invalid start offset: %v", start)
+	}
+	rd := NewBlockReader(blockSize, src, uint(start))
+	rd.SkipCRC()
+	var scratch [64 * 1024]byte
+	size := 0
+	for {
+		n, err := rd.Read(scratch[:])
+		size += n
+		if err == io.EOF {
+			return size, nil
+		}
+		if err != nil {
+			return size, err
+		}
+	}
+}
+
 // Read implements io.Reader.
 func (br *BlockReader) Read(buf []byte) (n int, err error) {
 	if br.err != nil {
 		return 0, br.err
 	}
+	if err := br.underlying.ctx.Err(); err != nil {
+		return 0, err
+	}
 	if br.first {
 		// skip to the start of the block.
 		br.underlying.br.ReadBits(br.start)
@@ -60,11 +108,46 @@ func (br *BlockReader) Read(buf []byte) (n int, err error) {
 	}
 	n = br.underlying.readFromBlock(buf)
 	if n > 0 || len(buf) == 0 {
-		br.underlying.blockCRC.update(buf[:n])
+		if !br.skipCRC {
+			br.underlying.blockCRC.update(buf[:n])
+		}
 		return n, nil
 	}
-	if br.underlying.blockCRC.val != br.underlying.wantBlockCRC {
-		return 0, fmt.Errorf("block checksum mismatch")
+	if !br.skipCRC && br.underlying.blockCRC.val != br.underlying.wantBlockCRC {
+		return 0, errBlockChecksumMismatch
 	}
 	return n, io.EOF
 }
+
+// SkipCRC disables the computation and verification of the block's CRC.
+// It must be called before the first call to Read.
+func (br *BlockReader) SkipCRC() {
+	br.skipCRC = true
+}
+
+// NoHuffmanShortcut disables the per Huffman tree tables used to decode
+// the first 8 bits of each symbol in a single lookup, thus reducing the
+// memory required to decode a block at the cost of decoding speed. It
+// must be called before the first call to Read.
+func (br *BlockReader) NoHuffmanShortcut() {
+	if br.underlying != nil {
+		br.underlying.noShortcut = true
+	}
+}
+
+// SetCRCImpl sets the implementation used to compute the block's CRC.
+// It must be called before the first call to Read.
+func (br *BlockReader) SetCRCImpl(impl CRCImpl) {
+	if br.underlying != nil {
+		br.underlying.crcImpl = impl
+	}
+}
+
+// Warnings returns any recoverable anomalies encountered whilst reading
+// the block, such as a Huffman tree with a superfluous level.
+func (br *BlockReader) Warnings() []string {
+	if br.underlying == nil {
+		return nil
+	}
+	return br.underlying.warnings
+}
@@ -6,6 +6,9 @@
 package bzip2
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"math"
 	"unsafe"
@@ -24,6 +27,17 @@ func (s StructuralError) Error() string {
 	return "bzip2 data invalid: " + string(s)
 }
 
+const (
+	errDataExceedsBlockSize  = StructuralError("data exceeds block size")
+	errRepeatsPastEndOfBlock = StructuralError("repeats past end of block")
+)
+
+// ExceedsBlockSize returns true if err indicates that the decompressed
+// data of a block exceeds the block size that it was decoded with.
+func ExceedsBlockSize(err error) bool {
+	return errors.Is(err, errDataExceedsBlockSize) || errors.Is(err, errRepeatsPastEndOfBlock)
+}
+
 // A reader decompresses bzip2 compressed data.
 type reader struct {
 	br           bitReader
@@ -45,6 +59,13 @@ type reader struct {
 
 	recordStats bool
 	stats       Stats
+
+	warnings []string // recoverable anomalies encountered whilst decoding.
+
+	noShortcut bool    // if set, Huffman trees are built without shortcut tables.
+	crcImpl    CRCImpl // the implementation used for block CRCs.
+
+	ctx context.Context // if non-nil, decoding is abandoned when ctx is done.
 }
 
 // Stats contains the offset and crc information for the decoded stream.
@@ -56,6 +77,24 @@ type Stats struct {
 	StreamCRC         uint32
 }
 
+// BlockSizes returns the size, in bits, of each block, excluding its
+// block magic number, as derived from BlockStartOffsets and
+// EndOfStreamOffset. It is only meaningful for a single stream.
+func (s Stats) BlockSizes() []uint {
+	if len(s.BlockStartOffsets) == 0 {
+		return nil
+	}
+	sizes := make([]uint, len(s.BlockStartOffsets))
+	for i, start := range s.BlockStartOffsets {
+		end := s.EndOfStreamOffset
+		if i < len(s.BlockStartOffsets)-1 {
+			end = s.BlockStartOffsets[i+1]
+		}
+		sizes[i] = end - start - 48 // subtract the size of the block magic.
+	}
+	return sizes
+}
+
 // NewReader returns an io.Reader which decompresses bzip2 data from r.
 // If r does not also implement io.ByteReader,
 // the decompressor may read more data than necessary from r.
@@ -97,6 +136,9 @@ func (bz2 *reader) setup(needMagic bool) error {
 	}
 
 	t := br.ReadBits(8)
+	if t == '0' {
+		return StructuralError("bzip1 format is not supported")
+	}
 	if t != 'h' {
 		return StructuralError("non-Huffman entropy encoding")
 	}
@@ -299,7 +341,7 @@ func (bz2 *reader) read(buf []byte) (int, error) {
 			if br.bits%8 != 0 {
 				br.ReadBits(br.bits % 8)
 			}
-			b, err := br.r.ReadByte()
+			b, err := br.readByte()
 			if err == io.EOF {
 				br.err = io.EOF
 				bz2.eof = true
@@ -309,7 +351,7 @@ func (bz2 *reader) read(buf []byte) (int, error) {
 				br.err = err
 				return 0, err
 			}
-			z, err := br.r.ReadByte()
+			z, err := br.readByte()
 			if err != nil {
 				if err == io.EOF {
 					err = io.ErrUnexpectedEOF
@@ -334,7 +376,7 @@ func (bz2 *reader) readBlock() (err error) {
 	br := &bz2.br
 	// skip checksum. TODO: check it if we can figure out what it is.
 	bz2.wantBlockCRC = uint32(br.ReadBits64(32)) //#nosec G115 -- This is a false positive, i is < math.MaxUint32.
-	bz2.blockCRC = crc{}
+	bz2.blockCRC = crc{impl: bz2.crcImpl}
 	bz2.fileCRC = (bz2.fileCRC<<1 | bz2.fileCRC>>31) ^ bz2.wantBlockCRC
 	randomized := br.ReadBits(1) //#nosec G115 -- This is a false positive, since ReadBits was called for 1 bit.
 	if randomized != 0 {
@@ -374,12 +416,23 @@ func (bz2 *reader) readBlock() (err error) {
 	// The Huffman tree can switch every 50 symbols so there's a list of
 	// tree indexes telling us which tree to use for each 50 symbol block.
 	numSelectors := br.ReadBits(15)
-	treeIndexes := make([]uint8, numSelectors)
+	if numSelectors == 0 {
+		return StructuralError("no tree selectors given")
+	}
+	// A block of blockSize symbols requires at most 2+blockSize/50
+	// selectors. Some encoders write more than this and the reference
+	// implementation accepts them, hence any excess selectors are read
+	// and validated but not stored so as to bound the allocation.
+	numStored := numSelectors
+	if maxSelectors := 2 + bz2.blockSize/50; numStored > maxSelectors {
+		numStored = maxSelectors
+	}
+	treeIndexes := make([]uint8, numStored)
 
 	// The tree indexes are move-to-front transformed and stored as unary
 	// numbers.
 	mtfTreeDecoder := newMTFDecoderWithRange(numHuffmanTrees)
-	for i := range treeIndexes {
+	for i := 0; i < numSelectors; i++ {
 		c := 0
 		for {
 			inc := br.ReadBits(1)
@@ -391,7 +444,10 @@ func (bz2 *reader) readBlock() (err error) {
 		if c >= numHuffmanTrees {
 			return StructuralError("tree index too large")
 		}
-		treeIndexes[i] = mtfTreeDecoder.Decode(c)
+		tree := mtfTreeDecoder.Decode(c)
+		if i < numStored {
+			treeIndexes[i] = tree
+		}
 	}
 
 	// The list of symbols for the move-to-front transform is taken from
@@ -430,16 +486,16 @@ func (bz2 *reader) readBlock() (err error) {
 			}
 			lengths[j] = uint8(length) //#nosec G115 -- This is a false positive, since ReadBits was called for 5 bits.
 		}
-		huffmanTrees[i], err = newHuffmanTree(lengths)
+		huffmanTrees[i], err = newHuffmanTree(lengths, !bz2.noShortcut)
 		if err != nil {
 			return err
 		}
+		if huffmanTrees[i].superfluous {
+			bz2.warnings = append(bz2.warnings, fmt.Sprintf("Huffman tree %v has a superfluous level", i))
+		}
 	}
 
 	selectorIndex := 1 // the next tree index to use
-	if len(treeIndexes) == 0 {
-		return StructuralError("no tree selectors given")
-	}
 	if int(treeIndexes[0]) >= len(huffmanTrees) {
 		return StructuralError("tree selector out of range")
 	}
@@ -460,7 +516,7 @@ func (bz2 *reader) readBlock() (err error) {
 	decoded := 0 // counts the number of symbols decoded by the current tree.
 	for {
 		if decoded == 50 {
-			if selectorIndex >= numSelectors {
+			if selectorIndex >= numStored {
 				return StructuralError("insufficient selector indices for number of symbols")
 			}
 			if int(treeIndexes[selectorIndex]) >= len(huffmanTrees) {
@@ -469,6 +525,12 @@ func (bz2 *reader) readBlock() (err error) {
 			currentHuffmanTree = huffmanTrees[treeIndexes[selectorIndex]]
 			selectorIndex++
 			decoded = 0
+			// Periodically check for cancelation.
+			if bz2.ctx != nil && selectorIndex%64 == 0 {
+				if err := bz2.ctx.Err(); err != nil {
+					return err
+				}
+			}
 		}
 
 		v := currentHuffmanTree.Decode(br)
@@ -494,7 +556,7 @@ func (bz2 *reader) readBlock() (err error) {
 			// We have decoded a complete run-length so we need to
 			// replicate the last output symbol.
 			if int64(repeat) > int64(bz2.blockSize)-bufIndex {
-				return StructuralError("repeats past end of block")
+				return errRepeatsPastEndOfBlock
 			}
 			c := bz2.c[:]
 			tt := bz2.tt[bufIndex : bufIndex+int64(repeat)]
@@ -522,7 +584,7 @@ func (bz2 *reader) readBlock() (err error) {
 		// line.
 		b := mtf.Decode(int(v - 1))
 		if bufIndex >= int64(bz2.blockSize) {
-			return StructuralError("data exceeds block size")
+			return errDataExceedsBlockSize
 		}
 		bz2.tt[bufIndex] = uint32(b)
 		bz2.c[b]++
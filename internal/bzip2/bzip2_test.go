@@ -8,9 +8,15 @@ import (
 	"bytes"
 	"encoding/hex"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"math/bits"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/cosnicolaou/pbzip2/internal"
 )
 
 func mustDecodeHex(s string) []byte {
@@ -122,6 +128,13 @@ func TestReader(t *testing.T) {
 			"bb9229c28481b6e2a998",
 		),
 		fail: true,
+	}, {
+		desc: "bzip1 header",
+		input: mustDecodeHex("" +
+			"425a30393141592653594eece83600000251800010400006449080200031064c" +
+			"4101a7a9a580bb9431f8bb9229c28482776741b0",
+		),
+		fail: true,
 	}, {
 		desc: "bad huffman delta",
 		input: mustDecodeHex("" +
@@ -218,7 +231,13 @@ var (
 	random = mustLoadFile("testdata/random.data.bz2")
 )
 
-func benchmarkDecode(b *testing.B, compressed []byte) {
+func newReader(compressed []byte, noShortcut bool) io.Reader {
+	rd := NewReader(bytes.NewReader(compressed))
+	rd.(*reader).noShortcut = noShortcut
+	return rd
+}
+
+func benchmarkDecode(b *testing.B, compressed []byte, noShortcut bool) {
 	// Determine the uncompressed size of testfile.
 	uncompressedSize, err := io.Copy(io.Discard, NewReader(bytes.NewReader(compressed)))
 	if err != nil {
@@ -230,11 +249,221 @@ func benchmarkDecode(b *testing.B, compressed []byte) {
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
-		r := bytes.NewReader(compressed)
-		io.Copy(io.Discard, NewReader(r))
+		io.Copy(io.Discard, newReader(compressed, noShortcut))
+	}
+}
+
+func BenchmarkDecodeDigits(b *testing.B) { benchmarkDecode(b, digits, false) }
+func BenchmarkDecodeNewton(b *testing.B) { benchmarkDecode(b, newton, false) }
+func BenchmarkDecodeRand(b *testing.B)   { benchmarkDecode(b, random, false) }
+
+func BenchmarkDecodeDigitsNoShortcut(b *testing.B) { benchmarkDecode(b, digits, true) }
+func BenchmarkDecodeNewtonNoShortcut(b *testing.B) { benchmarkDecode(b, newton, true) }
+func BenchmarkDecodeRandNoShortcut(b *testing.B)   { benchmarkDecode(b, random, true) }
+
+func TestNoShortcut(t *testing.T) {
+	for i, compressed := range [][]byte{
+		digits, newton, random,
+		mustLoadFile("testdata/pass-random1.bz2"),
+		mustLoadFile("testdata/pass-random2.bz2"),
+		mustLoadFile("testdata/pass-sawtooth.bz2"),
+	} {
+		want, err := io.ReadAll(newReader(compressed, false))
+		if err != nil {
+			t.Fatalf("%v: %v", i, err)
+		}
+		got, err := io.ReadAll(newReader(compressed, true))
+		if err != nil {
+			t.Fatalf("%v: %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%v: output differs: got %v bytes, want %v bytes", i, len(got), len(want))
+		}
+	}
+}
+
+// referenceCRC computes bzip2's CRC using hash/crc32 by reversing the
+// bits of each input byte via a scratch buffer, as crc.update used to.
+func referenceCRC(buf []byte) uint32 {
+	var scratch [256]byte
+	cval := uint32(0)
+	for len(buf) > 0 {
+		n := copy(scratch[:], buf)
+		buf = buf[n:]
+		for i, b := range scratch[:n] {
+			scratch[i] = bits.Reverse8(b)
+		}
+		cval = crc32.Update(cval, crc32.IEEETable, scratch[:n])
+	}
+	return bits.Reverse32(cval)
+}
+
+func TestCRC(t *testing.T) {
+	// The block CRC for testdata/hello.bz2 in the top level package.
+	var c crc
+	c.update([]byte("hello world\n"))
+	if got, want := c.val, uint32(1324148790); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	data := mustLoadFile("testdata/e.txt.bz2")
+	for _, impl := range []CRCImpl{CRCTable, CRCHash} {
+		for _, split := range []int{0, 1, 7, 255, 256, 257, 511, 512, 513, len(data)} {
+			c := crc{impl: impl}
+			c.update(data[:split])
+			c.update(data[split:])
+			if got, want := c.val, referenceCRC(data); got != want {
+				t.Errorf("%v: %v: got %v, want %v", impl, split, got, want)
+			}
+		}
+	}
+}
+
+func TestCRCImpl(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range files {
+		data := mustLoadFile(name)
+		table, hash := crc{impl: CRCTable}, crc{impl: CRCHash}
+		table.update(data)
+		hash.update(data)
+		if got, want := hash.val, table.val; got != want {
+			t.Errorf("%v: got %v, want %v", name, got, want)
+		}
+	}
+	// Decoding verifies each block's CRC and hence fails if the
+	// implementations differ.
+	for i, compressed := range [][]byte{digits, newton, random} {
+		rd := newReader(compressed, false)
+		rd.(*reader).crcImpl = CRCHash
+		want, err := io.ReadAll(newReader(compressed, false))
+		if err != nil {
+			t.Fatalf("%v: %v", i, err)
+		}
+		got, err := io.ReadAll(rd)
+		if err != nil {
+			t.Fatalf("%v: %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%v: output differs: got %v bytes, want %v bytes", i, len(got), len(want))
+		}
 	}
 }
 
-func BenchmarkDecodeDigits(b *testing.B) { benchmarkDecode(b, digits) }
-func BenchmarkDecodeNewton(b *testing.B) { benchmarkDecode(b, newton) }
-func BenchmarkDecodeRand(b *testing.B)   { benchmarkDecode(b, random) }
+func BenchmarkCRC(b *testing.B) {
+	data := mustLoadFile("testdata/e.txt.bz2")
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var c crc
+		c.update(data)
+	}
+}
+
+func BenchmarkCRCHash(b *testing.B) {
+	data := mustLoadFile("testdata/e.txt.bz2")
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c := crc{impl: CRCHash}
+		c.update(data)
+	}
+}
+
+func BenchmarkReferenceCRC(b *testing.B) {
+	data := mustLoadFile("testdata/e.txt.bz2")
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		referenceCRC(data)
+	}
+}
+
+func TestDecodeBlockLen(t *testing.T) {
+	for _, name := range []string{"e.txt.bz2", "Isaac.Newton-Opticks.txt.bz2", "random.data.bz2", "pass-random1.bz2", "pass-random2.bz2", "pass-sawtooth.bz2"} {
+		data := mustLoadFile(filepath.Join("testdata", name))
+		rd := NewReaderWithStats(bytes.NewReader(data))
+		all, err := io.ReadAll(rd)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		blockSize := int(data[3]-'0') * 100 * 1000
+		total := 0
+		for i, offset := range StreamStats(rd).BlockStartOffsets {
+			// Skip the block magic.
+			offset += 48
+			src, start := data[offset/8:], int(offset%8)
+			want, err := io.ReadAll(NewBlockReader(blockSize, src, uint(start)))
+			if err != nil {
+				t.Fatalf("%v: %v: %v", name, i, err)
+			}
+			got, err := DecodeBlockLen(blockSize, src, start)
+			if err != nil {
+				t.Fatalf("%v: %v: %v", name, i, err)
+			}
+			if got != len(want) {
+				t.Errorf("%v: %v: got %v, want %v", name, i, got, len(want))
+			}
+			total += got
+		}
+		if got, want := total, len(all); got != want {
+			t.Errorf("%v: got %v, want %v", name, got, want)
+		}
+	}
+	if _, err := DecodeBlockLen(100*1000, digits, -1); err == nil || !strings.Contains(err.Error(), "invalid start offset") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+}
+
+func FuzzBlockReader(f *testing.F) {
+	// Use the smaller test files since large inputs slow fuzzing down
+	// considerably.
+	for _, name := range []string{"pass-random1.bz2", "pass-random2.bz2", "pass-sawtooth.bz2", "fail-issue5747.bz2"} {
+		data := mustLoadFile(filepath.Join("testdata", name))
+		// Skip the stream header and block magic to position the reader
+		// at the start of the first block.
+		f.Add(data[10:], uint(0), int(data[3]-'0'))
+	}
+	f.Fuzz(func(t *testing.T, src []byte, start uint, level int) {
+		if level < 1 || level > 9 {
+			return
+		}
+		// The block reader starts at a bit offset within the first byte.
+		rd := NewBlockReader(level*100*1000, src, start%8)
+		io.Copy(io.Discard, rd)
+	})
+}
+
+func TestSelectorBounds(t *testing.T) {
+	lengths := [3]uint8{1, 2, 2}
+	for _, tc := range []struct {
+		level, selectors int
+		err              string
+	}{
+		{1, 0, "no tree selectors given"},
+		{1, 1, ""},
+		// More selectors than a block can use, these are accepted by the
+		// reference implementation, but are not stored.
+		{1, 2 + 100000/50 + 1, ""},
+		{1, 32767, ""},
+		{9, 32767, ""},
+	} {
+		compressed := internal.SingleByteStreamWithSelectors(tc.level, 'a', lengths, "0", "11", tc.selectors)
+		out, err := io.ReadAll(NewReader(bytes.NewReader(compressed)))
+		if len(tc.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%v: missing or unexpected error: %v", tc.selectors, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tc.selectors, err)
+			continue
+		}
+		if got, want := string(out), "a"; got != want {
+			t.Errorf("%v: got %v, want %v", tc.selectors, got, want)
+		}
+	}
+}
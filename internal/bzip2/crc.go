@@ -5,20 +5,70 @@ import (
 	"math/bits"
 )
 
+// bzip2 uses the CRC-32 polynomial, but in its non-reflected, ie. most
+// significant bit first, form. crcTable is indexed by the top byte of the
+// current CRC xor'ed with the next input byte, so no per-byte bit reversal
+// is required as would be the case when using hash/crc32.
+const crcPoly = 0x04c11db7
+
+var crcTable = makeCRCTable()
+
+func makeCRCTable() *[256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		c := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if c&0x80000000 != 0 {
+				c = c<<1 ^ crcPoly
+			} else {
+				c <<= 1
+			}
+		}
+		table[i] = c
+	}
+	return &table
+}
+
+// CRCImpl selects the implementation used to compute block CRCs.
+type CRCImpl int
+
+const (
+	// CRCTable uses a table indexed by the top byte of the current CRC.
+	CRCTable CRCImpl = iota
+	// CRCHash uses hash/crc32, which is hardware accelerated on some
+	// platforms, but requires that the bits of each input byte, and of
+	// the CRC, be reversed since hash/crc32 implements the reflected
+	// form of the polynomial.
+	CRCHash
+)
+
 type crc struct {
-	val uint32
-	buf [256]byte
+	val  uint32
+	impl CRCImpl
 }
 
 func (c *crc) update(buf []byte) {
+	if c.impl == CRCHash {
+		c.updateHash(buf)
+		return
+	}
+	cval := ^c.val
+	for _, b := range buf {
+		cval = cval<<8 ^ crcTable[byte(cval>>24)^b]
+	}
+	c.val = ^cval
+}
+
+func (c *crc) updateHash(buf []byte) {
+	var scratch [512]byte
 	cval := bits.Reverse32(c.val)
 	for len(buf) > 0 {
-		n := copy(c.buf[:], buf)
+		n := copy(scratch[:], buf)
 		buf = buf[n:]
-		for i, b := range c.buf[:n] {
-			c.buf[byte(i)] = bits.Reverse8(b)
+		for i, b := range scratch[:n] {
+			scratch[i] = bits.Reverse8(b)
 		}
-		cval = crc32.Update(cval, crc32.IEEETable, c.buf[:n])
+		cval = crc32.Update(cval, crc32.IEEETable, scratch[:n])
 	}
 	c.val = bits.Reverse32(cval)
 }
@@ -17,8 +17,11 @@ type huffmanTree struct {
 	// of nodes to use when the tree is being constructed.
 	nodes    []huffmanNode
 	nextNode int
-	// Precomputed table to skip tree traversal for the first 8-bit pattern
-	shortcut [256]shortcutEntry
+	// superfluous is set if the tree contained a superfluous level.
+	superfluous bool
+	// Precomputed table to skip tree traversal for the first 8-bit pattern,
+	// nil if the tree is to be traversed bit-by-bit to save memory.
+	shortcut *[256]shortcutEntry
 }
 
 // A huffmanNode is a node in the tree. left and right contain indexes into the
@@ -62,7 +65,7 @@ func (t *huffmanTree) Decode(br *bitReader) (v uint16) {
 	}
 
 	nodeIndex := uint16(0)
-	if br.bits >= 8 {
+	if t.shortcut != nil && br.bits >= 8 {
 		// Get the next 8 bits
 		b := (br.n >> ((br.bits - 8) & 63)) & 0xff
 		se := t.shortcut[b]
@@ -114,6 +117,7 @@ func (t *huffmanTree) Decode(br *bitReader) (v uint16) {
 }
 
 func (t *huffmanTree) buildShortcut() {
+	t.shortcut = new([256]shortcutEntry)
 	for b := range t.shortcut {
 		n := uint16(0) // 9 bit (0-258)
 		bi := b
@@ -140,8 +144,10 @@ func (t *huffmanTree) buildShortcut() {
 }
 
 // newHuffmanTree builds a Huffman tree from a slice containing the code
-// lengths of each symbol. The maximum code length is 32 bits.
-func newHuffmanTree(lengths []uint8) (huffmanTree, error) {
+// lengths of each symbol. The maximum code length is 32 bits. The shortcut
+// table used to decode the first 8 bits of each symbol is only built if
+// shortcut is set.
+func newHuffmanTree(lengths []uint8, shortcut bool) (huffmanTree, error) {
 	// There are many possible trees that assign the same code length to
 	// each symbol (consider reflecting a tree down the middle, for
 	// example). Since the code length assignments determine the
@@ -205,7 +211,9 @@ func newHuffmanTree(lengths []uint8) (huffmanTree, error) {
 
 	t.nodes = make([]huffmanNode, len(codes))
 	_, err := buildHuffmanNode(&t, codes, 0)
-	t.buildShortcut()
+	if shortcut {
+		t.buildShortcut()
+	}
 	return t, err
 }
 
@@ -268,6 +276,7 @@ func buildHuffmanNode(t *huffmanTree, codes []huffmanCode, level uint32) (nodeIn
 			return 0, StructuralError("equal symbols in Huffman tree")
 		}
 
+		t.superfluous = true
 		if len(left) == 0 {
 			return buildHuffmanNode(t, right, level+1)
 		}
@@ -0,0 +1,144 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package bzip2
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// realBlockLengths are the code lengths of the first Huffman tree of the
+// first block of testdata/Isaac.Newton-Opticks.txt.bz2.
+var realBlockLengths = []uint8{
+	3, 4, 3, 3, 4, 4, 4, 4, 4, 5, 5, 5, 5, 6, 6, 6, 6, 7, 7, 8, 8, 8, 9, 9,
+	9, 9, 9, 9, 10, 9, 10, 10, 10, 10, 10, 11, 10, 10, 10, 10, 11, 11, 11, 11, 11, 11,
+	11, 12, 11, 11, 11, 12, 11, 12, 12, 12, 12, 12, 12, 12, 12, 12, 13, 13, 12, 13, 12, 13,
+	13, 13, 13, 14, 14, 16, 14, 13, 14, 14, 14, 13, 15, 15, 14, 15, 14, 16, 14, 15, 15, 13,
+	15, 14, 15, 16, 16, 15, 15, 15, 16, 16, 16, 15, 14, 16, 15, 16, 16, 14, 16, 16, 16, 16,
+	16, 16, 16, 16, 15, 16, 16, 16, 16,
+}
+
+// mustNewHuffmanTree constructs a tree from explicit code lengths, as
+// would be read from a block, for use by tests and benchmarks that
+// exercise huffmanTree.Decode in isolation.
+func mustNewHuffmanTree(tb testing.TB, lengths []uint8, shortcut bool) *huffmanTree {
+	t, err := newHuffmanTree(lengths, shortcut)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return &t
+}
+
+// huffmanCodes returns the code, as a string of '0's and '1's, for each
+// of the symbols in t.
+func huffmanCodes(t *huffmanTree) map[uint16]string {
+	codes := map[uint16]string{}
+	var walk func(nodeIndex uint16, prefix string)
+	walk = func(nodeIndex uint16, prefix string) {
+		node := &t.nodes[nodeIndex]
+		// Decode follows left for a 1 bit and right for a 0 bit.
+		if node.left == invalidNodeValue {
+			codes[node.leftValue] = prefix + "1"
+		} else {
+			walk(node.left, prefix+"1")
+		}
+		if node.right == invalidNodeValue {
+			codes[node.rightValue] = prefix + "0"
+		} else {
+			walk(node.right, prefix+"0")
+		}
+	}
+	walk(0, "")
+	return codes
+}
+
+// encodeSymbols returns n symbols, chosen at random with the probability
+// of each being that implied by its code length, along with their
+// encoding using lengths.
+func encodeSymbols(t *huffmanTree, lengths []uint8, n int) ([]uint16, []byte) {
+	var weights []int
+	total := 0
+	for _, l := range lengths {
+		total += 1 << (32 - int(l))
+		weights = append(weights, total)
+	}
+	codes := huffmanCodes(t)
+	src := rand.New(rand.NewSource(0x1234)) //#nosec G404 -- reproducible test data.
+	symbols := make([]uint16, n)
+	var out []byte
+	var cur byte
+	nbits := 0
+	for i := range symbols {
+		r := src.Intn(total)
+		s := 0
+		for weights[s] <= r {
+			s++
+		}
+		symbols[i] = uint16(s)
+		for _, c := range codes[uint16(s)] {
+			cur <<= 1
+			if c == '1' {
+				cur |= 1
+			}
+			if nbits++; nbits == 8 {
+				out = append(out, cur)
+				cur, nbits = 0, 0
+			}
+		}
+	}
+	if nbits > 0 {
+		out = append(out, cur<<(8-nbits))
+	}
+	// Decode may prefetch up to 7 bytes beyond the final symbol.
+	out = append(out, make([]byte, 8)...)
+	return symbols, out
+}
+
+func TestHuffmanDecode(t *testing.T) {
+	for _, lengths := range [][]uint8{
+		{1, 2, 2},
+		{2, 2, 2, 3, 3},
+		realBlockLengths,
+	} {
+		for _, shortcut := range []bool{true, false} {
+			tree := mustNewHuffmanTree(t, lengths, shortcut)
+			symbols, stream := encodeSymbols(tree, lengths, 10000)
+			br := newBitReader(bytes.NewReader(stream))
+			for i, want := range symbols {
+				if got := tree.Decode(&br); got != want {
+					t.Fatalf("%v symbols: shortcut %v: symbol %v: got %v, want %v", len(lengths), shortcut, i, got, want)
+				}
+			}
+			if err := br.Err(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkHuffmanDecode isolates the Huffman decoding loop, which is
+// otherwise only exercised as part of decoding entire blocks.
+func BenchmarkHuffmanDecode(b *testing.B) {
+	const numSymbols = 64 * 1024
+	for _, shortcut := range []bool{true, false} {
+		b.Run(fmt.Sprintf("shortcut=%v", shortcut), func(b *testing.B) {
+			tree := mustNewHuffmanTree(b, realBlockLengths, shortcut)
+			_, stream := encodeSymbols(tree, realBlockLengths, numSymbols)
+			rd := bytes.NewReader(stream)
+			b.SetBytes(numSymbols)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				rd.Reset(stream)
+				br := newBitReader(rd)
+				for j := 0; j < numSymbols; j++ {
+					tree.Decode(&br)
+				}
+			}
+		})
+	}
+}
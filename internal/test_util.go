@@ -5,10 +5,15 @@
 package internal
 
 import (
+	"bytes"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"math/bits"
 	"math/rand"
 	"os"
 	"os/exec"
+	"testing"
 	"time"
 )
 
@@ -58,6 +63,30 @@ func CreateBzipFile(filename, blockSize string, data []byte) error {
 	return nil
 }
 
+// HaveBzip2 returns true if the bzip2 command used by CreateBzipFile
+// is available.
+func HaveBzip2() bool {
+	_, err := exec.LookPath("bzip2")
+	return err == nil
+}
+
+// BenchmarkDecompression benchmarks decompressing the supplied data
+// using readers returned by newReader, the throughput is reported in
+// terms of the decompressed size.
+func BenchmarkDecompression(b *testing.B, compressed []byte, newReader func(io.Reader) io.Reader) {
+	size, err := io.Copy(io.Discard, newReader(bytes.NewReader(compressed)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := io.Copy(io.Discard, newReader(bytes.NewReader(compressed))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 // FirstN returns at most the first n bytes of b.
 func FirstN(n int, b []byte) []byte {
 	if len(b) > n {
@@ -65,3 +94,101 @@ func FirstN(n int, b []byte) []byte {
 	}
 	return b
 }
+
+// BitBuffer accumulates a bitstream, most significant bit first, as used
+// by bzip2.
+type BitBuffer struct {
+	buf  []byte
+	nbit int
+}
+
+// WriteBits appends the low n bits of v to the buffer.
+func (b *BitBuffer) WriteBits(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if b.nbit%8 == 0 {
+			b.buf = append(b.buf, 0)
+		}
+		if v&(1<<uint(i)) != 0 {
+			b.buf[len(b.buf)-1] |= 0x80 >> uint(b.nbit%8)
+		}
+		b.nbit++
+	}
+}
+
+// WriteCode appends a code expressed as a string of '0's and '1's.
+func (b *BitBuffer) WriteCode(code string) {
+	for _, c := range code {
+		if c == '1' {
+			b.WriteBits(1, 1)
+		} else {
+			b.WriteBits(0, 1)
+		}
+	}
+}
+
+// Bytes returns the contents of the buffer, padded with zero bits to
+// a byte boundary.
+func (b *BitBuffer) Bytes() []byte {
+	return b.buf
+}
+
+// BlockCRC returns the bzip2 CRC for data.
+func BlockCRC(data []byte) uint32 {
+	reversed := make([]byte, len(data))
+	for i, c := range data {
+		reversed[i] = bits.Reverse8(c)
+	}
+	return bits.Reverse32(crc32.ChecksumIEEE(reversed))
+}
+
+// SingleByteStream returns a bzip2 stream, at the specified level, that
+// contains a single block encoding the single byte b. The block contains
+// two identical Huffman tables with the supplied code lengths for the
+// RUNA, RUNB and EOB symbols; runa and eob are the codes, as strings of
+// '0's and '1's, that the decoder will derive for RUNA and EOB from those
+// lengths. This allows for streams with unusual Huffman tables to be
+// created for tests.
+func SingleByteStream(level int, b byte, lengths [3]uint8, runa, eob string) []byte {
+	return SingleByteStreamWithSelectors(level, b, lengths, runa, eob, 1)
+}
+
+// SingleByteStreamWithSelectors is like SingleByteStream except that the
+// block contains the specified number of selectors, all of which select
+// the first tree.
+func SingleByteStreamWithSelectors(level int, b byte, lengths [3]uint8, runa, eob string, selectors int) []byte {
+	crc := BlockCRC([]byte{b})
+	bw := &BitBuffer{}
+	bw.WriteBits(uint64('B'), 8)
+	bw.WriteBits(uint64('Z'), 8)
+	bw.WriteBits(uint64('h'), 8)
+	bw.WriteBits(uint64('0'+level), 8)
+	bw.WriteBits(0x314159265359, 48) // block magic
+	bw.WriteBits(uint64(crc), 32)
+	bw.WriteBits(0, 1)                   // not randomized
+	bw.WriteBits(0, 24)                  // origPtr
+	bw.WriteBits(1<<(15-uint(b/16)), 16) // symbol range bitmap
+	bw.WriteBits(1<<(15-uint(b%16)), 16) // symbols within the range
+	bw.WriteBits(2, 3)                   // number of Huffman trees
+	bw.WriteBits(uint64(selectors), 15)  // number of selectors
+	for i := 0; i < selectors; i++ {
+		bw.WriteBits(0, 1) // selector, mtf encoded in unary
+	}
+	for tree := 0; tree < 2; tree++ {
+		bw.WriteBits(uint64(lengths[0]), 5)
+		prev := lengths[0]
+		for _, l := range lengths {
+			for ; prev < l; prev++ {
+				bw.WriteCode("10")
+			}
+			for ; prev > l; prev-- {
+				bw.WriteCode("11")
+			}
+			bw.WriteBits(0, 1)
+		}
+	}
+	bw.WriteCode(runa)
+	bw.WriteCode(eob)
+	bw.WriteBits(0x177245385090, 48) // end of stream magic
+	bw.WriteBits(uint64(crc), 32)    // the stream CRC for a single block.
+	return bw.Bytes()
+}
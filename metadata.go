@@ -0,0 +1,96 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Format represents the format used by Scanner.WriteMetadata.
+type Format string
+
+const (
+	// FormatCSV writes a header line followed by one comma separated
+	// line per block with the fields named in MetadataCSVHeader.
+	FormatCSV Format = "csv"
+	// FormatJSON writes one JSON encoded BlockMetadata per line.
+	FormatJSON Format = "json"
+)
+
+// MetadataCSVHeader is the header line written for FormatCSV.
+var MetadataCSVHeader = []string{"block", "offset", "bit_offset", "size_in_bits", "crc", "stream_block_size", "eos", "stream_crc"}
+
+// BlockMetadata is the record written by Scanner.WriteMetadata for each
+// block. Offset and StreamBlockSize are as for CompressedBlock.
+type BlockMetadata struct {
+	BlockInfo
+	Offset          int64 `json:"offset"`
+	StreamBlockSize int   `json:"stream_block_size"`
+}
+
+func (m BlockMetadata) csv() []string {
+	return []string{
+		strconv.Itoa(m.Block),
+		strconv.FormatInt(m.Offset, 10),
+		strconv.Itoa(m.BitOffset),
+		strconv.Itoa(m.SizeInBits),
+		strconv.FormatUint(uint64(m.CRC), 10),
+		strconv.Itoa(m.StreamBlockSize),
+		strconv.FormatBool(m.EOS),
+		strconv.FormatUint(uint64(m.StreamCRC), 10),
+	}
+}
+
+// WriteMetadata scans the remainder of the scanner's input and writes a
+// record, in the specified format, to w for each block as it is found.
+// Blocks are numbered from 1 and the records are not buffered, hence
+// WriteMetadata is suitable for piping block metadata into another
+// process. It returns the first error encountered by either the scanner
+// or w.
+func (sc *Scanner) WriteMetadata(ctx context.Context, w io.Writer, format Format) error {
+	var write func(BlockMetadata) error
+	switch format {
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		writeLine := func(line []string) error {
+			if err := cw.Write(line); err != nil {
+				return err
+			}
+			cw.Flush()
+			return cw.Error()
+		}
+		write = func(m BlockMetadata) error {
+			return writeLine(m.csv())
+		}
+		if err := writeLine(MetadataCSVHeader); err != nil {
+			return err
+		}
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		write = func(m BlockMetadata) error {
+			return enc.Encode(m)
+		}
+	default:
+		return fmt.Errorf("unsupported format: %v", format)
+	}
+	n := 1
+	for sc.Scan(ctx) {
+		block := sc.Block()
+		if err := write(BlockMetadata{
+			BlockInfo:       block.Info(n),
+			Offset:          block.Offset,
+			StreamBlockSize: block.StreamBlockSize,
+		}); err != nil {
+			return err
+		}
+		n++
+	}
+	return sc.Err()
+}
@@ -0,0 +1,113 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/cosnicolaou/pbzip2"
+)
+
+func parseCSVMetadata(t *testing.T, out []byte) []pbzip2.CompressedBlock {
+	records, err := csv.NewReader(bytes.NewReader(out)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := records[0], pbzip2.MetadataCSVHeader; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	var blocks []pbzip2.CompressedBlock
+	for i, r := range records[1:] {
+		fields := make([]int64, len(r))
+		for j, f := range r {
+			if f == "true" || f == "false" {
+				continue
+			}
+			v, err := strconv.ParseInt(f, 10, 64)
+			if err != nil {
+				t.Fatalf("%v: %v: %v", i, j, err)
+			}
+			fields[j] = v
+		}
+		if got, want := fields[0], int64(i+1); got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		blocks = append(blocks, pbzip2.CompressedBlock{
+			Offset:          fields[1],
+			BitOffset:       int(fields[2]),
+			SizeInBits:      int(fields[3]),
+			CRC:             uint32(fields[4]),
+			StreamBlockSize: int(fields[5]),
+			EOS:             r[6] == "true",
+			StreamCRC:       uint32(fields[7]),
+		})
+	}
+	return blocks
+}
+
+func parseJSONMetadata(t *testing.T, out []byte) []pbzip2.CompressedBlock {
+	var blocks []pbzip2.CompressedBlock
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		var m pbzip2.BlockMetadata
+		if err := json.Unmarshal(sc.Bytes(), &m); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := m.Block, len(blocks)+1; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		blocks = append(blocks, pbzip2.CompressedBlock{
+			Offset:          m.Offset,
+			BitOffset:       m.BitOffset,
+			SizeInBits:      m.SizeInBits,
+			CRC:             m.CRC,
+			StreamBlockSize: m.StreamBlockSize,
+			EOS:             m.EOS,
+			StreamCRC:       m.StreamCRC,
+		})
+	}
+	return blocks
+}
+
+func TestWriteMetadata(t *testing.T) {
+	ctx := context.Background()
+	compressed, _ := concatFiles(t, "300KB1", "empty", "hello", "900KB9")
+	want := scanBlocks(t, compressed)
+	for _, tc := range []struct {
+		format pbzip2.Format
+		parse  func(*testing.T, []byte) []pbzip2.CompressedBlock
+	}{
+		{pbzip2.FormatCSV, parseCSVMetadata},
+		{pbzip2.FormatJSON, parseJSONMetadata},
+	} {
+		var out bytes.Buffer
+		sc := pbzip2.NewScanner(bytes.NewReader(compressed))
+		if err := sc.WriteMetadata(ctx, &out, tc.format); err != nil {
+			t.Fatalf("%v: %v", tc.format, err)
+		}
+		got := tc.parse(t, out.Bytes())
+		if len(got) != len(want) {
+			t.Fatalf("%v: got %v, want %v", tc.format, len(got), len(want))
+		}
+		for i := range got {
+			g, w := got[i], want[i]
+			if g.Offset != w.Offset || g.BitOffset != w.BitOffset || g.SizeInBits != w.SizeInBits || g.CRC != w.CRC || g.StreamBlockSize != w.StreamBlockSize || g.EOS != w.EOS || g.StreamCRC != w.StreamCRC {
+				t.Errorf("%v: %v: got %v, want %v", tc.format, i, g, w)
+			}
+		}
+	}
+
+	sc := pbzip2.NewScanner(bytes.NewReader(compressed))
+	if err := sc.WriteMetadata(ctx, &bytes.Buffer{}, "xml"); err == nil || err.Error() != "unsupported format: xml" {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+}
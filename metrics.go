@@ -0,0 +1,135 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Metrics accumulates statistics on the behaviour of a Decompressor that
+// can be used to tune its concurrency. A high PoolWaitTime indicates that
+// a shared concurrency pool (see BZConcurrencyPool) is the bottleneck,
+// whereas a high IdleTime indicates that the workers are waiting for
+// blocks, ie. that scanning is the bottleneck, and a high AppendWaitTime
+// indicates that blocks are being appended faster than the workers can
+// decompress them, ie. that decompression is the bottleneck. MaxHeapDepth
+// is the largest number of decompressed blocks that were held back
+// waiting for an earlier block to complete.
+//
+// A Metrics value may be shared by multiple decompressors and is safe
+// for concurrent use.
+type Metrics struct {
+	// The int64 fields must be first to ensure word alignment for
+	// atomic access.
+	blocks         int64
+	idleTime       int64
+	poolWaitTime   int64
+	maxHeapDepth   int64
+	appendWaitTime int64
+}
+
+// Blocks returns the total number of blocks decompressed.
+func (m *Metrics) Blocks() int64 {
+	return atomic.LoadInt64(&m.blocks)
+}
+
+// IdleTime returns the total time that workers spent waiting for
+// blocks to decompress.
+func (m *Metrics) IdleTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&m.idleTime))
+}
+
+// PoolWaitTime returns the total time that workers spent waiting
+// for a token from the concurrency pool.
+func (m *Metrics) PoolWaitTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&m.poolWaitTime))
+}
+
+// AppendWaitTime returns the total time that Append spent waiting for
+// a worker to accept a block.
+func (m *Metrics) AppendWaitTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&m.appendWaitTime))
+}
+
+// MaxHeapDepth returns the largest number of decompressed blocks
+// that were buffered awaiting reassembly.
+func (m *Metrics) MaxHeapDepth() int {
+	return int(atomic.LoadInt64(&m.maxHeapDepth))
+}
+
+func (m *Metrics) addBlock() {
+	atomic.AddInt64(&m.blocks, 1)
+}
+
+func (m *Metrics) addIdle(d time.Duration) {
+	atomic.AddInt64(&m.idleTime, int64(d))
+}
+
+func (m *Metrics) addPoolWait(d time.Duration) {
+	atomic.AddInt64(&m.poolWaitTime, int64(d))
+}
+
+func (m *Metrics) addAppendWait(d time.Duration) {
+	atomic.AddInt64(&m.appendWaitTime, int64(d))
+}
+
+func (m *Metrics) updateHeapDepth(depth int) {
+	for {
+		cur := atomic.LoadInt64(&m.maxHeapDepth)
+		if int64(depth) <= cur {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&m.maxHeapDepth, cur, int64(depth)) {
+			return
+		}
+	}
+}
+
+// Backpressure summarizes where a decompressor has spent its time waiting
+// so as to determine whether its throughput is limited by scanning, ie.
+// the rate at which its input can be read and scanned, or by
+// decompression, ie. the number of CPUs available to it.
+type Backpressure struct {
+	// Elapsed is the time since decompression started.
+	Elapsed time.Duration
+	// AppendWait is the total time that the scanner spent waiting for a
+	// worker to accept a block, see Metrics.AppendWaitTime.
+	AppendWait time.Duration
+	// WorkerIdle is the total time that the workers spent waiting for
+	// a block, see Metrics.IdleTime.
+	WorkerIdle time.Duration
+	// Workers is the number of workers, see BZConcurrency and
+	// BZAdaptiveConcurrency.
+	Workers int
+}
+
+// ScannerBlocked returns the fraction of the elapsed time that the
+// scanner spent waiting for the workers. A value close to one indicates
+// that increasing the concurrency may improve throughput.
+func (b Backpressure) ScannerBlocked() float64 {
+	if b.Elapsed <= 0 {
+		return 0
+	}
+	return float64(b.AppendWait) / float64(b.Elapsed)
+}
+
+// WorkersIdle returns the fraction of the workers' elapsed time that they
+// spent waiting for blocks. A value close to one indicates that reading
+// or scanning the input is the bottleneck.
+func (b Backpressure) WorkersIdle() float64 {
+	if b.Elapsed <= 0 || b.Workers <= 0 {
+		return 0
+	}
+	return float64(b.WorkerIdle) / (float64(b.Elapsed) * float64(b.Workers))
+}
+
+// BZMetrics sets the Metrics value to be used to accumulate statistics
+// for the decompressor.
+func BZMetrics(m *Metrics) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.metrics = m
+	}
+}
@@ -3,10 +3,15 @@ package pbzip2_test
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/cosnicolaou/pbzip2"
+	"github.com/cosnicolaou/pbzip2/internal"
 	"github.com/cosnicolaou/pbzip2/internal/bzip2"
 )
 
@@ -133,3 +138,624 @@ func TestMultipleStreamErrors(t *testing.T) {
 		}
 	}
 }
+
+func TestTrailingGarbage(t *testing.T) {
+	ctx := context.Background()
+	garbage := internal.GenPredictableRandomData(1024)
+	largeGarbage := internal.GenPredictableRandomData(256 * 1024)
+	for i, tc := range []struct {
+		names   []string
+		garbage []byte
+	}{
+		{[]string{"hello"}, garbage},
+		{[]string{"hello"}, []byte{0x0}},
+		{[]string{"hello", "empty"}, garbage},
+		{[]string{"300KB1", "hello"}, garbage},
+		{[]string{"900KB9"}, largeGarbage},
+	} {
+		compressed, actual := concatFiles(t, tc.names...)
+		compressed = append(compressed, tc.garbage...)
+
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed))
+		if _, err := io.ReadAll(rd); err == nil {
+			t.Errorf("%v: expected an error", i)
+		}
+
+		rd = pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+			pbzip2.ScannerOptions(pbzip2.ScanIgnoreTrailingGarbage(true)))
+		out, err := io.ReadAll(rd)
+		if err != nil {
+			t.Errorf("%v: %v", i, err)
+			continue
+		}
+		if got, want := out, actual; !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v bytes, want %v bytes", i, len(got), len(want))
+		}
+	}
+
+	// Make sure that well formed streams are unaffected by the option.
+	compressed, actual := concatFiles(t, "hello", "empty", "300KB1", "empty")
+	rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+		pbzip2.ScannerOptions(pbzip2.ScanIgnoreTrailingGarbage(true)))
+	out, err := io.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out, actual; !bytes.Equal(got, want) {
+		t.Errorf("got %v bytes, want %v bytes", len(got), len(want))
+	}
+}
+
+func TestMultipleStreamsDifferentLevels(t *testing.T) {
+	ctx := context.Background()
+	names := []string{"900KB9", "300KB1", "300KB5", "hello", "900KB9"}
+	compressed, actual := concatFiles(t, names...)
+
+	// Values are taken from TestScan.
+	streamCRCs := bc(37440935, 2560071082, 1100438121, 1324148790, 37440935)
+	streamLevels := bci(9, 1, 5, 9, 9)
+	streamBlocks := bci(2, 4, 1, 1, 2)
+
+	sc := pbzip2.NewScanner(bytes.NewReader(compressed))
+	var nstream, nblock int
+	var out []byte
+	for sc.Scan(ctx) {
+		block := sc.Block()
+		if got, want := block.StreamBlockSize, 100*1000*streamLevels[nstream]; got != want {
+			t.Errorf("stream %v: block %v: got %v, want %v", nstream, nblock, got, want)
+		}
+		//#nosec G115 -- This is a false positive, block.BitOffset is always < 32.
+		rd := bzip2.NewBlockReader(block.StreamBlockSize, block.Data, uint(block.BitOffset))
+		buf, err := io.ReadAll(rd)
+		if err != nil {
+			t.Fatalf("stream %v: block %v: %v", nstream, nblock, err)
+		}
+		out = append(out, buf...)
+		nblock++
+		if block.EOS {
+			if got, want := block.StreamCRC, streamCRCs[nstream]; got != want {
+				t.Errorf("stream %v: got %v, want %v", nstream, got, want)
+			}
+			if got, want := nblock, streamBlocks[nstream]; got != want {
+				t.Errorf("stream %v: got %v, want %v", nstream, got, want)
+			}
+			nstream++
+			nblock = 0
+		}
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := nstream, len(names); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := out, actual; !bytes.Equal(got, want) {
+		t.Errorf("got %v bytes, want %v bytes", len(got), len(want))
+	}
+
+	rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed))
+	out, err := io.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out, actual; !bytes.Equal(got, want) {
+		t.Errorf("got %v bytes, want %v bytes", len(got), len(want))
+	}
+	levels := rd.(interface {
+		Levels() []pbzip2.BlockSizeLevel
+	}).Levels()
+	if got, want := len(levels), len(streamLevels); got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i, level := range levels {
+		if got, want := int(level), streamLevels[i]; got != want {
+			t.Errorf("stream %v: got %v, want %v", i, got, want)
+		}
+	}
+
+	// A single block stream is decompressed inline.
+	compressed, _ = readFile(t, "hello")
+	rd = pbzip2.NewReader(ctx, bytes.NewReader(compressed))
+	if _, err := io.ReadAll(rd); err != nil {
+		t.Fatal(err)
+	}
+	levels = rd.(interface {
+		Levels() []pbzip2.BlockSizeLevel
+	}).Levels()
+	if got, want := levels, []pbzip2.BlockSizeLevel{9}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestRejectEmptyStreams(t *testing.T) {
+	ctx := context.Background()
+	garbage := internal.GenPredictableRandomData(1024)
+	for i, tc := range []struct {
+		names   []string
+		garbage []byte
+		err     string
+	}{
+		{[]string{"empty"}, nil, ""},
+		{[]string{"hello", "300KB1"}, nil, ""},
+		{[]string{"hello", "empty"}, nil, "found 1 empty stream(s) following the block at offset 10"},
+		{[]string{"hello", "empty", "empty", "300KB1"}, nil, "found 2 empty stream(s) following the block at offset 10"},
+		{[]string{"empty", "hello"}, nil, "found an empty stream at offset 4"},
+		{[]string{"empty", "empty"}, nil, "found 1 empty stream(s) following the block at offset 4"},
+		{[]string{"hello", "empty"}, garbage, "found 1 empty stream(s) following the block at offset 10"},
+	} {
+		compressed, actual := concatFiles(t, tc.names...)
+		compressed = append(compressed, tc.garbage...)
+		opts := pbzip2.ScannerOptions(pbzip2.ScanIgnoreTrailingGarbage(tc.garbage != nil))
+
+		// Empty streams are ignored by default.
+		out, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts))
+		if err != nil {
+			t.Errorf("%v: %v", i, err)
+		}
+		if got, want := out, actual; !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v bytes, want %v bytes", i, len(got), len(want))
+		}
+
+		_, err = io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts,
+			pbzip2.ScannerOptions(pbzip2.ScanRejectEmptyStreams(true))))
+		if len(tc.err) == 0 {
+			if err != nil {
+				t.Errorf("%v: %v", i, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tc.err {
+			t.Errorf("%v: missing or unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestStreamInfo(t *testing.T) {
+	ctx := context.Background()
+	compressed, _ := concatFiles(t,
+		"empty", "hello", "900KB9", "empty", "empty", "300KB1", "300KB2", "300KB5", "hello", "empty")
+	// Values are taken from TestScan.
+	want := []pbzip2.StreamInfo{
+		{},
+		{Level: 9, BlockCount: 1, CRC: 1324148790},
+		{Level: 9, BlockCount: 2, CRC: 37440935},
+		{},
+		{},
+		{Level: 1, BlockCount: 4, CRC: 2560071082},
+		{Level: 2, BlockCount: 2, CRC: 2500044168},
+		{Level: 5, BlockCount: 1, CRC: 1100438121},
+		{Level: 9, BlockCount: 1, CRC: 1324148790},
+		{},
+	}
+	sc := pbzip2.NewScanner(bytes.NewReader(compressed))
+	if got := sc.StreamInfo(); len(got) != 0 {
+		t.Errorf("got %v, want an empty slice", got)
+	}
+	nblocks := 0
+	for sc.Scan(ctx) {
+		nblocks++
+		if nblocks == 3 {
+			// Part way through the third stream.
+			if got, want := sc.StreamInfo(), []pbzip2.StreamInfo{want[0], want[1], {Level: 9, BlockCount: 1}}; !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got := sc.StreamInfo(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMultiStreamReader(t *testing.T) {
+	ctx := context.Background()
+	names := []string{"300KB1", "hello", "empty", "900KB9", "hello"}
+	readers := func(shards [][]byte) []io.Reader {
+		rds := make([]io.Reader, len(shards))
+		for i, shard := range shards {
+			rds[i] = bytes.NewReader(shard)
+		}
+		return rds
+	}
+	var shards [][]byte
+	for _, name := range names {
+		compressed, _ := readFile(t, name)
+		shards = append(shards, compressed)
+	}
+	_, actual := concatFiles(t, names...)
+	for _, concurrency := range []int{1, 4} {
+		rd := pbzip2.NewMultiStreamReader(ctx, readers(shards),
+			pbzip2.DecompressionOptions(pbzip2.BZConcurrency(concurrency)))
+		out, err := io.ReadAll(rd)
+		if err != nil {
+			t.Fatalf("%v: %v", concurrency, err)
+		}
+		if got, want := out, actual; !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v bytes, want %v bytes", concurrency, len(got), len(want))
+		}
+	}
+
+	out, err := io.ReadAll(pbzip2.NewMultiStreamReader(ctx, nil))
+	if err != nil || len(out) != 0 {
+		t.Errorf("unexpected output or error: %v: %v", len(out), err)
+	}
+
+	// Errors must identify the reader that they pertain to.
+	corruptHeader := append([]byte{}, shards[3]...)
+	corruptHeader[2] = 'x'
+	corruptCRC := append([]byte{}, shards[3]...)
+	corruptCRC[len(corruptCRC)-2] ^= 0xff
+	corruptData := append([]byte{}, shards[3]...)
+	corruptData[len(corruptData)/2] ^= 0xff
+	for _, tc := range []struct {
+		shard []byte
+		err   string
+	}{
+		{corruptHeader, "stream reader 3: wrong version: x"},
+		{corruptCRC, "stream reader 3: mismatched stream CRCs"},
+		{corruptData, "stream reader 3: "},
+	} {
+		corrupted := append([][]byte{}, shards...)
+		corrupted[3] = tc.shard
+		_, err := io.ReadAll(pbzip2.NewMultiStreamReader(ctx, readers(corrupted)))
+		if err == nil || !strings.HasPrefix(err.Error(), tc.err) {
+			t.Errorf("missing or unexpected error: %v", err)
+		}
+	}
+}
+
+func TestInterleavedStreamOrdering(t *testing.T) {
+	ctx := context.Background()
+	var names []string
+	for i := 0; i < 8; i++ {
+		names = append(names, "hello", "300KB1", "hello", "300KB5", "300KB2")
+	}
+	compressed, _ := concatFiles(t, names...)
+
+	var (
+		blocks     []pbzip2.CompressedBlock
+		streamCRCs []uint32
+		levels     []pbzip2.BlockSizeLevel
+		streamCRC  uint32
+	)
+	sc := pbzip2.NewScanner(bytes.NewReader(compressed))
+	for sc.Scan(ctx) {
+		block := sc.Block()
+		blocks = append(blocks, block)
+		streamCRC = (streamCRC<<1 | streamCRC>>31) ^ block.CRC
+		if block.EOS {
+			if got, want := streamCRC, block.StreamCRC; got != want {
+				t.Fatalf("stream %v: got %v, want %v", len(streamCRCs), got, want)
+			}
+			streamCRCs = append(streamCRCs, block.StreamCRC)
+			levels = append(levels, block.Level())
+			streamCRC = 0
+		}
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(streamCRCs), len(names); got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	// Append the blocks in reverse order so that every block, and in
+	// particular every block that ends a stream, has to be reordered.
+	dc := pbzip2.NewDecompressor(ctx, pbzip2.BZConcurrency(4))
+	errCh := make(chan error, 1)
+	go func() {
+		for i := len(blocks) - 1; i >= 0; i-- {
+			if err := dc.AppendOrdered(uint64(i+1), blocks[i]); err != nil {
+				errCh <- err
+				return
+			}
+		}
+		errCh <- dc.Finish()
+	}()
+
+	// Read the output one stream at a time to verify both the output
+	// of each stream and the stream CRC that applies at its end.
+	for i, name := range names {
+		want := bzip2Data[name]
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(dc, got); err != nil {
+			t.Fatalf("stream %v: %v: %v", i, name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("stream %v: %v: output differs", i, name)
+		}
+		if got, want := dc.StreamCRC(), streamCRCs[i]; got != want {
+			t.Errorf("stream %v: %v: got %v, want %v", i, name, got, want)
+		}
+	}
+	if n, err := dc.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("got %v, %v, want 0, EOF", n, err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if got, want := dc.Levels(), levels; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestOrderInvariant(t *testing.T) {
+	ctx := context.Background()
+	compressed, _ := concatFiles(t, "hello", "hello", "hello")
+	blocks := scanBlocks(t, compressed)
+
+	for _, tc := range []struct {
+		verbose bool
+		err     string
+	}{
+		{true, "block 1: appended more than once or out of sequence: expected block"},
+		{false, "blocks were not appended in sequence"},
+	} {
+		dc := pbzip2.NewDecompressor(ctx,
+			pbzip2.BZVerbose(tc.verbose),
+			pbzip2.BZLogger(func(string, ...interface{}) {}))
+		go func() {
+			for _, order := range []uint64{1, 2, 1, 3} {
+				if err := dc.AppendOrdered(order, blocks[order-1]); err != nil {
+					break
+				}
+			}
+			dc.Finish()
+		}()
+		_, err := io.ReadAll(dc)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("verbose %v: unexpected or missing error: %v", tc.verbose, err)
+		}
+	}
+}
+
+// TestStreamTransitionAtWindowEdge tests scanning streams whose final
+// block is large enough that the scanner's lookahead ends within the
+// trailer of that stream, any empty streams that follow it, or the
+// header and first block magic number of the next stream.
+func TestStreamTransitionAtWindowEdge(t *testing.T) {
+	ctx := context.Background()
+	// A level 1 stream whose final block is random data and hence whose
+	// compressed size exceeds the 100KB block size.
+	full, _ := readFile(t, "300KB1")
+	var stream bytes.Buffer
+	if err := pbzip2.WriteStream(&stream, 1, scanBlocks(t, full)[:3]); err != nil {
+		t.Fatal(err)
+	}
+	streamData, err := io.ReadAll(bzip2.NewReader(bytes.NewReader(stream.Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello, _ := readFile(t, "hello")
+	empty, _ := readFile(t, "empty")
+	b900, _ := readFile(t, "900KB9")
+
+	for _, tc := range []struct {
+		name   string
+		next   [][]byte
+		actual []byte
+	}{
+		{"hello", [][]byte{hello}, bzip2Data["hello"]},
+		{"empty+hello", [][]byte{empty, empty, hello}, bzip2Data["hello"]},
+		{"900KB9", [][]byte{b900}, bzip2Data["900KB9"]},
+		{"level1", [][]byte{stream.Bytes()}, streamData},
+	} {
+		compressed := append([]byte{}, stream.Bytes()...)
+		for _, n := range tc.next {
+			compressed = append(compressed, n...)
+		}
+		actual := append(append([]byte{}, streamData...), tc.actual...)
+		want := scanBlocks(t, compressed)
+		last := want[2]
+		if !last.EOS || last.Level() != 1 {
+			t.Fatalf("%v: unexpected final block for the first stream: %v", tc.name, last)
+		}
+		// The size of the region, following the data for the final block,
+		// that contains the trailer, any empty streams, the header and
+		// the first block magic of the next stream.
+		transition := len(stream.Bytes()) - int(last.Offset) - len(last.Data) + 4 + 6
+		for _, n := range tc.next[:len(tc.next)-1] {
+			transition += len(n)
+		}
+		// Sweep the end of the scanner's initial lookahead across the
+		// data of the final block and the transition region.
+		for edge := len(last.Data) - 8; edge <= len(last.Data)+transition+8; edge++ {
+			overhead := edge - last.StreamBlockSize
+			sc := pbzip2.NewScanner(bytes.NewReader(compressed), pbzip2.ScanBlockOverhead(overhead))
+			var got []pbzip2.CompressedBlock
+			for sc.Scan(ctx) {
+				got = append(got, sc.Block())
+			}
+			if err := sc.Err(); err != nil {
+				t.Fatalf("%v: edge %v: %v", tc.name, edge, err)
+			}
+			if len(got) != len(want) {
+				t.Fatalf("%v: edge %v: got %v blocks, want %v", tc.name, edge, len(got), len(want))
+			}
+			for i := range got {
+				g, w := got[i], want[i]
+				if g.BitOffset != w.BitOffset || g.SizeInBits != w.SizeInBits || g.CRC != w.CRC || g.EOS != w.EOS || g.StreamCRC != w.StreamCRC || g.StreamBlockSize != w.StreamBlockSize || g.Offset != w.Offset {
+					t.Errorf("%v: edge %v: block %v: got %v, want %v", tc.name, edge, i, g, w)
+				}
+			}
+		}
+		dc := pbzip2.NewDecompressor(ctx)
+		go func() {
+			for _, b := range want {
+				if err := dc.Append(b); err != nil {
+					break
+				}
+			}
+			dc.Finish()
+		}()
+		out, err := io.ReadAll(dc)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.name, err)
+		}
+		if !bytes.Equal(out, actual) {
+			t.Errorf("%v: got %v bytes, want %v bytes", tc.name, len(out), len(actual))
+		}
+	}
+}
+
+func TestLevelMismatchWithinStream(t *testing.T) {
+	ctx := context.Background()
+	// A level 1 stream whose trailer has been lost, as might be the case
+	// for a corrupt concatenation, such that the header and first block
+	// of the next stream immediately follow the data of its first block.
+	full, _ := readFile(t, "300KB1")
+	first := scanBlocks(t, full)[0]
+	var stream bytes.Buffer
+	if err := pbzip2.WriteStream(&stream, 1, []pbzip2.CompressedBlock{first}); err != nil {
+		t.Fatal(err)
+	}
+	truncated := stream.Bytes()[:(4*8+6*8+first.SizeInBits+7)/8]
+
+	b900, _ := readFile(t, "900KB9")
+	compressed := append(append([]byte{}, truncated...), b900...)
+	want := fmt.Sprintf("stream header at offset %v specifies level 9 within a stream of level 1", len(truncated))
+	assertMismatch := func(msg string, err error) {
+		t.Helper()
+		if !errors.Is(err, pbzip2.ErrLevelMismatch) {
+			t.Errorf("%v: missing or unexpected error: %v", msg, err)
+			return
+		}
+		if got := err.Error(); !strings.Contains(got, want) {
+			t.Errorf("%v: got %v, want %v", msg, got, want)
+		}
+	}
+
+	// The level 9 block that follows the header exceeds the lookahead
+	// used for a level 1 stream and hence the scanner reports the
+	// mismatch.
+	sc := pbzip2.NewScanner(bytes.NewReader(compressed))
+	for sc.Scan(ctx) {
+	}
+	assertMismatch("scanner", sc.Err())
+
+	// The scanner cannot distinguish such a header from the same byte
+	// sequence occurring within a block's compressed data and hence, if
+	// it can find the block that follows it, leaves it to the
+	// decompressor to report the mismatch should that block fail to
+	// decompress.
+	sc = pbzip2.NewScanner(bytes.NewReader(compressed), pbzip2.ScanMaxBuffer(len(compressed)))
+	for sc.Scan(ctx) {
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, concurrency := range []int{1, 4} {
+		_, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+			pbzip2.ScannerOptions(pbzip2.ScanMaxBuffer(len(compressed))),
+			pbzip2.DecompressionOptions(pbzip2.BZConcurrency(concurrency))))
+		assertMismatch(fmt.Sprintf("concurrency %v", concurrency), err)
+	}
+
+	// A header for the same level is not detected by the scanner, but
+	// by the block and stream CRCs.
+	compressed = append(append([]byte{}, truncated...), full...)
+	sc = pbzip2.NewScanner(bytes.NewReader(compressed))
+	for sc.Scan(ctx) {
+	}
+	if err := sc.Err(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestSerialParallelParity(t *testing.T) {
+	ctx := context.Background()
+	for i, tc := range []struct {
+		names   []string
+		garbage []byte
+	}{
+		{[]string{"empty"}, nil},
+		{[]string{"empty", "empty"}, nil},
+		{[]string{"empty", "hello"}, nil},
+		{[]string{"hello", "empty"}, nil},
+		{[]string{"hello", "empty", "hello"}, nil},
+		{[]string{"300KB1", "empty", "empty", "300KB2"}, nil},
+		{[]string{"900KB9", "300KB1"}, nil},
+		{[]string{"300KB1", "300KB5", "hello", "900KB9"}, nil},
+		{[]string{"empty", "900KB1", "empty", "300KB5", "empty"}, nil},
+		{[]string{"hello"}, []byte("xx")},
+		{[]string{"hello"}, []byte("B")},
+		{[]string{"hello"}, []byte("BZ")},
+		{[]string{"hello"}, []byte("BZh")},
+		{[]string{"hello", "empty"}, []byte("BZx9")},
+		{[]string{"300KB1", "empty"}, []byte{0}},
+	} {
+		compressed, actual := concatFiles(t, tc.names...)
+		compressed = append(compressed, tc.garbage...)
+		serial, serialErr := io.ReadAll(bzip2.NewReader(bytes.NewReader(compressed)))
+		for _, concurrency := range []int{1, 4} {
+			parallel, parallelErr := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+				pbzip2.DecompressionOptions(pbzip2.BZConcurrency(concurrency))))
+			if got, want := parallelErr != nil, serialErr != nil; got != want {
+				t.Errorf("%v: %v: %v: error mismatch: parallel: %v, serial: %v", i, tc.names, concurrency, parallelErr, serialErr)
+				continue
+			}
+			if serialErr != nil {
+				continue
+			}
+			if got, want := parallel, serial; !bytes.Equal(got, want) {
+				t.Errorf("%v: %v: %v: got %v bytes, want %v bytes", i, tc.names, concurrency, len(got), len(want))
+			}
+			if got, want := parallel, actual; !bytes.Equal(got, want) {
+				t.Errorf("%v: %v: %v: got %v bytes, want %v bytes", i, tc.names, concurrency, len(got), len(want))
+			}
+		}
+	}
+}
+
+func TestMaxStreams(t *testing.T) {
+	ctx := context.Background()
+	names := []string{"hello"}
+	for i := 0; i < 1000; i++ {
+		names = append(names, "empty")
+	}
+	names = append(names, "300KB1", "empty", "hello")
+	compressed, actual := concatFiles(t, names...)
+	for i, tc := range []struct {
+		max int
+		err bool
+	}{
+		{0, false},
+		{len(names), false},
+		{len(names) - 1, true},
+		{10, true},
+		{1, true},
+	} {
+		opts := pbzip2.ScannerOptions(pbzip2.ScanMaxStreams(tc.max))
+		sc := pbzip2.NewScanner(bytes.NewReader(compressed), pbzip2.ScanMaxStreams(tc.max))
+		for sc.Scan(ctx) {
+		}
+		err := sc.Err()
+		if got, want := len(sc.StreamInfo()), len(names); !tc.err && got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+		if got, want := errors.Is(err, pbzip2.ErrTooManyStreams), tc.err; got != want {
+			t.Errorf("%v: missing or unexpected error: %v", i, err)
+		}
+		out, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts))
+		if tc.err {
+			if !errors.Is(err, pbzip2.ErrTooManyStreams) {
+				t.Errorf("%v: missing or unexpected error: %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", i, err)
+		}
+		if got, want := out, actual; !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v bytes, want %v bytes", i, len(got), len(want))
+		}
+	}
+	sc := pbzip2.NewScanner(bytes.NewReader(compressed), pbzip2.ScanMaxStreams(10))
+	for sc.Scan(ctx) {
+	}
+	if got, want := sc.Err().Error(), "input contains more than 10 streams: too many streams"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -5,9 +5,12 @@
 package pbzip2
 
 import (
+	"bytes"
 	"container/heap"
 	"context"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"runtime"
@@ -27,10 +30,36 @@ func updateStreamCRC(streamCRC, blockCRC uint32) uint32 {
 }
 
 type decompressorOpts struct {
-	verbose     bool
-	concurrency int
-	progressCh  chan<- Progress
-	pool        chan struct{}
+	verbose       bool
+	logger        func(format string, args ...interface{})
+	concurrency   int
+	minWorkers    int
+	maxWorkers    int
+	progressCh    chan<- Progress
+	progressBlock bool
+	pool          chan struct{}
+	metrics       *Metrics
+	diagnosticsCh chan<- Diagnostic
+	boundaryCh    chan<- BlockBoundary
+	maxReorder    int
+	heapHint      int
+	collectAll    bool
+	failFast      bool
+	blockMagic    *[6]byte
+	blockTimeout  time.Duration
+	skipCRC       bool
+	noShortcut    bool
+	crcImpl       CRCImpl
+	errorCompat   ErrorCompat
+	padTo         int
+	padByte       byte
+	pipeBuffer    int
+	mirror        io.Writer
+	hash          hash.Hash
+	unordered     bool
+	dispatch      DispatchStrategy
+	blockFilter   func(CompressedBlock) bool
+	noSequential  bool // used by tests to bypass the sequential path.
 }
 
 type DecompressorOption func(*decompressorOpts)
@@ -42,6 +71,15 @@ func BZVerbose(v bool) DecompressorOption {
 	}
 }
 
+// BZLogger sets the function used for the verbose logging enabled via
+// BZVerbose, in place of the standard library's log.Printf, so that
+// embedding applications can direct it to their own logger.
+func BZLogger(fn func(format string, args ...interface{})) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.logger = fn
+	}
+}
+
 // BZConcurrency sets the degree of concurrency to use, that is,
 // the number of threads used for decompression.
 func BZConcurrency(n int) DecompressorOption {
@@ -50,6 +88,25 @@ func BZConcurrency(n int) DecompressorOption {
 	}
 }
 
+// BZAdaptiveConcurrency sets the number of workers used for decompression
+// to vary between min and max, in place of the fixed number set via
+// BZConcurrency. Decompression starts with min workers and an additional
+// worker is started, up to max, whenever a block is appended while the
+// queue of blocks awaiting decompression is full and fewer decompressed
+// blocks than there are workers are awaiting reassembly, that is, when the
+// existing workers are unable to keep up with the blocks being appended.
+// Blocks whose compressed size is less than 64KB, as is typically the case
+// for inputs that consist of many small streams, never lead to additional
+// workers being started since the overhead of decompressing them
+// concurrently outweighs the benefit. It has no effect with
+// DispatchStriped. See Decompressor.Workers for the number of workers
+// started.
+func BZAdaptiveConcurrency(min, max int) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.minWorkers, o.maxWorkers = min, max
+	}
+}
+
 // BZConcurrencyPool will add a thread safe pool to control concurrency.
 // This can be used to limit the total number of active goroutines decompressing concurrently.
 // Use CreateConcurrencyPool to create a pool of a certain size that can be shared across several decompressors.
@@ -76,76 +133,679 @@ func CreateConcurrencyPool(maxConcurrent int) chan struct{} {
 	return ch
 }
 
+// BZMaxReorderBuffer limits the number of blocks that may be outstanding,
+// that is, appended but not yet reassembled into the decompressor's output,
+// to n.
+// Since blocks are written out in order, this bounds the number of
+// decompressed blocks that can be buffered awaiting the completion of an
+// earlier block. A small value reduces the latency with which output is
+// available and the memory used, at the cost of throughput since Append
+// will block until an earlier block has been written out. The default,
+// zero, places no limit.
+func BZMaxReorderBuffer(n int) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.maxReorder = n
+	}
+}
+
+// BZHeapHint sets the initial capacity of the heap used to reassemble
+// blocks that complete out of order, typically to the concurrency, so
+// that it need not be grown as such blocks accumulate. The default,
+// zero, starts with an empty heap.
+func BZHeapHint(n int) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.heapHint = n
+	}
+}
+
+// BZCollectAll is intended for debugging and testing only. It causes
+// all of the decompressed blocks to be collected in the heap used for
+// reassembly before any of them are written out, so that the order in
+// which they are written out depends solely on the heap's ordering and
+// not on the order in which they complete. Since all of the decompressed
+// output is held in memory, it should not be used in production. Any
+// limit set via BZMaxReorderBuffer is ignored since it would otherwise
+// lead to deadlock, and it has no effect with BZUnordered or for the
+// synchronous decompression used by NewReader.
+func BZCollectAll(v bool) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.collectAll = v
+	}
+}
+
+// BZFailFast causes the first error encountered when decompressing a
+// block to be returned by the next call to Read, rather than once all of
+// the output that precedes that block has been read. Any such output that
+// has yet to be read, including that of blocks that were decompressed
+// successfully and are buffered awaiting reassembly, is discarded, hence
+// it is intended for validating inputs rather than for recovering as much
+// of their output as possible. Note too that no attempt is made to recover
+// from a block that was split by a false positive match of the block
+// magic number, see MergeBlocks, and that it has no effect with
+// BZUnordered or for the synchronous decompression used by NewReader.
+func BZFailFast(v bool) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.failFast = v
+	}
+}
+
+// BZBlockMagic sets the block magic number used when merging blocks that
+// were split by a false positive match of the block magic number, it is
+// intended for testing and should be the same value as used for the
+// scanner via ScanBlockMagic.
+func BZBlockMagic(magic [6]byte) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.blockMagic = &magic
+	}
+}
+
+// BZBlockTimeout sets a limit on the time taken to decompress any single
+// block. A block that exceeds this limit fails with an error that wraps
+// context.DeadlineExceeded. The default, zero, places no limit.
+func BZBlockTimeout(d time.Duration) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.blockTimeout = d
+	}
+}
+
+// BZSkipCRC disables the verification of both block and stream CRCs in
+// order to maximise throughput. It should only be used for trusted inputs
+// since corrupted data will no longer be detected unless it also fails to
+// decode. For the same reason, a block that is split by a false positive
+// match of the block magic number is less likely to be detected and
+// merged with its successor.
+func BZSkipCRC(v bool) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.skipCRC = v
+	}
+}
+
+// BZSkipHuffmanShortcut disables the 256 entry tables that are built for
+// each of the, up to 6, Huffman trees in a block in order to decode the
+// first 8 bits of each symbol with a single lookup. It is intended for
+// memory constrained environments with many concurrent decompressions
+// and trades decompression speed for reduced memory use per block.
+func BZSkipHuffmanShortcut(v bool) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.noShortcut = v
+	}
+}
+
+// CRCImpl determines how block CRCs are computed, see BZCRCImpl.
+type CRCImpl string
+
+const (
+	// CRCTable uses a 256 entry table for the non-reflected, ie. most
+	// significant bit first, form of the CRC-32 polynomial used by bzip2.
+	CRCTable CRCImpl = "table"
+	// CRCHash uses hash/crc32, which is hardware accelerated on some
+	// platforms, but which implements the reflected form of the
+	// polynomial and hence requires that the bits of every input byte
+	// be reversed.
+	CRCHash CRCImpl = "hash"
+)
+
+// BZCRCImpl sets the implementation used to compute block CRCs, the
+// default being CRCTable. Both produce identical CRCs, the choice is
+// purely one of performance, which varies by platform, and hence should
+// be guided by benchmarks. Unrecognised implementations are treated as
+// CRCTable.
+func BZCRCImpl(kind CRCImpl) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.crcImpl = kind
+	}
+}
+
+// BZPadTo pads the decompressed output of each block, using the pad
+// byte, to a multiple of n bytes, for consumers that require the output
+// of each block to be aligned to fixed boundaries. The padding is only
+// added to the output returned by Read, it is not included in the
+// output written via BZAdditionalWriter or BZHash, in the sizes and
+// offsets reported via BZSendUpdates and BZBlockBoundaries, or in the
+// computation of CRCs. It has no effect for BZUnordered and is disabled
+// by default, or if n is less than 2.
+func BZPadTo(n int, pad byte) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.padTo, o.padByte = n, pad
+	}
+}
+
+// BZPipeBuffer sets the size, in bytes, of the buffer used between the
+// goroutine that reassembles the decompressed blocks and the reader of the
+// decompressor's output. By default the two are connected by an unbuffered
+// io.Pipe and hence reassembly proceeds in lockstep with the reader,
+// a buffer allows reassembly to stay ahead of a slow reader by up to
+// the specified number of bytes.
+func BZPipeBuffer(bytes int) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.pipeBuffer = bytes
+	}
+}
+
+// BZAdditionalWriter sets a writer to which all of the decompressed output
+// is written, in order, as it is reassembled and before it is made
+// available to the decompressor's reader. It is intended for computing
+// checksums, such as a SHA of the entire file, without an additional copy
+// via io.TeeReader. An error returned by w is treated as a decompression
+// error.
+func BZAdditionalWriter(w io.Writer) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.mirror = w
+	}
+}
+
+// BZHash sets a hash to which all of the decompressed output is written,
+// in the same manner as for BZAdditionalWriter. The digest of the output
+// may be obtained from the Sum method of a reader returned by NewReader
+// once all of its output has been read.
+func BZHash(h hash.Hash) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.hash = h
+	}
+}
+
+// BZUnordered configures the decompressor to deliver decompressed blocks
+// in the order that their decompression completes, via ReadUnordered,
+// rather than reassembling them in order for Read. It is intended for
+// consumers that can render, or otherwise process, blocks out of order
+// and are prepared to reassemble the output themselves. Since stream
+// CRCs can only be computed over ordered output they are not verified,
+// blocks split by a false positive match of the block magic number are
+// not merged, and BZAdditionalWriter, BZHash, BZSendUpdates and
+// BZBlockBoundaries have no effect. Block CRCs are verified as usual.
+func BZUnordered(v bool) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.unordered = v
+	}
+}
+
+// DispatchStrategy determines how appended blocks are distributed among
+// the decompressor's worker goroutines, see BZDispatch.
+type DispatchStrategy string
+
+const (
+	// DispatchShared has all of the workers take blocks from a single
+	// shared queue, so that each block is decompressed by whichever
+	// worker is idle.
+	DispatchShared DispatchStrategy = "shared"
+	// DispatchStriped assigns block N to worker N modulo the
+	// concurrency, each worker having its own queue.
+	DispatchStriped DispatchStrategy = "striped"
+)
+
+// BZDispatch sets the strategy used to distribute blocks among the
+// decompressor's workers, the default being DispatchShared. Striping
+// keeps the order in which blocks complete closer to the order in which
+// they were appended when blocks take similar amounts of time to
+// decompress, thus reducing the churn of the heap used to reassemble
+// them, but a slow block will delay those that follow it on the same
+// worker even if other workers are idle. Unrecognised strategies are
+// treated as DispatchShared.
+func BZDispatch(strategy DispatchStrategy) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.dispatch = strategy
+	}
+}
+
+// BZBlockFilter sets a predicate that determines which blocks are
+// decompressed, blocks for which it returns false are skipped, that is,
+// they are not decoded and contribute nothing to the output. It is
+// intended for deduplication or targeted extraction, eg. when the caller
+// already has the blocks with a given set of CRCs. The CRC of a skipped
+// block, as recorded in the compressed data, is still used to compute
+// the stream CRC and hence the stream CRCs are verified as usual. The
+// predicate may be called concurrently.
+func BZBlockFilter(fn func(CompressedBlock) bool) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.blockFilter = fn
+	}
+}
+
 // BZSendUpdates sets the channel for sending progress updates over.
+// Updates are sent without blocking so that a slow consumer cannot
+// throttle decompression: an update that cannot be sent immediately is
+// coalesced with the next one. The final report, preceded by any update
+// that has yet to be sent, is always delivered, blocking until it is
+// received or the context is canceled. Use BZProgressBlocking to receive
+// every update.
 func BZSendUpdates(ch chan<- Progress) DecompressorOption {
 	return func(o *decompressorOpts) {
 		o.progressCh = ch
 	}
 }
 
+// BZProgressBlocking controls whether progress updates are sent using
+// blocking sends, in which case every update, including the final one,
+// is delivered, but decompression will stall whilst the channel set via
+// BZSendUpdates is full.
+func BZProgressBlocking(v bool) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.progressBlock = v
+	}
+}
+
 // Decompressor represents a concurrent decompressor for pbzip streams. The
 // decompressor is designed to work in conjunction with Scanner and its
 // Decompress method must be called with the values returned by the scanner's
 // Block method. Each block is then decompressed in parallel and reassembled
 // in the original order.
 type Decompressor struct {
-	order      uint64 // Must be the first field in a struct to ensure word alignment.
-	ctx        context.Context
-	workWg     sync.WaitGroup
-	doneWg     sync.WaitGroup
-	workCh     chan *blockDesc
-	doneCh     chan *blockDesc
-	progressCh chan<- Progress
-	prd        *io.PipeReader
-	pwr        *io.PipeWriter
-	heap       *blockHeap
-	streamCRC  uint32
-	verbose    bool
+	order         uint64 // Must be the first field in a struct to ensure word alignment.
+	inFlight      int64  // Must follow order to ensure word alignment.
+	workers       int64  // Must follow inFlight to ensure word alignment.
+	heapDepth     int64  // Must follow workers to ensure word alignment.
+	ctx           context.Context
+	workWg        sync.WaitGroup
+	doneWg        sync.WaitGroup
+	workCh        chan *blockDesc
+	workChs       []chan *blockDesc // per-worker queues for DispatchStriped.
+	doneCh        chan *blockDesc
+	progressCh    chan<- Progress
+	progressBlock bool
+	prd           io.Reader
+	pwr           pipeWriter
+	heap          *blockHeap
+	streamCRC     uint32
+	verbose       bool
+	logger        func(format string, args ...interface{})
+	concurrency   int
+	minWorkers    int
+	maxWorkers    int
+	pool          chan struct{}
+	metrics       *Metrics
+	diagnosticsCh chan<- Diagnostic
+	boundaryCh    chan<- BlockBoundary
+	maxReorder    int
+	heapHint      int
+	collectAll    bool
+	failFast      bool
+	reorderTokens chan struct{}
+	blockMagic    [6]byte
+	blockTimeout  time.Duration
+	skipCRC       bool
+	noShortcut    bool
+	crcImpl       bzip2.CRCImpl
+	errorCompat   ErrorCompat
+	padTo         int
+	padByte       byte
+	pad           []byte
+	pipeBuffer    int
+	dispatch      DispatchStrategy
+	blockFilter   func(CompressedBlock) bool
+	noSequential  bool
+	mirror        io.Writer
+	hash          hash.Hash
+	alloc         func(sizeHint int) []byte
+	finished      bool
+	finishErr     error // the error returned by Finish, see Reset.
+
+	// release, if set, is called with the buffer that a block was
+	// decompressed into once its contents have been written to the
+	// output, see CopyN.
+	release func([]byte)
+
+	// closeOnce and closedCh are used to signal that the output has
+	// been closed via Close.
+	closeOnce *sync.Once
+	closedCh  chan struct{}
+
+	// The following are used when BZUnordered is set.
+	unordered   bool
+	unorderedCh chan *blockDesc
+	cancelOnce  *sync.Once
+	cancelCh    chan struct{}
+	cancelErr   error
+
+	// failErr is the first error encountered by a worker when
+	// BZFailFast is set.
+	failMu  sync.Mutex
+	failErr error
+
+	// annotate, if set, is used to add context to errors that pertain
+	// to a specific block.
+	annotate func(order uint64, err error) error
+
+	// sink, if set, receives the decompressed output in place of a pipe,
+	// in which case Read must not be used.
+	sink pipeWriter
+
+	// The following are used for the final progress report.
+	started           time.Time
+	totalCompressed   int64
+	totalDecompressed int64
+
+	// pendingProgress is an update that could not be sent without
+	// blocking and which will be coalesced with the next one.
+	pendingProgress *Progress
+
+	// The following are used to track the stream CRC of the output
+	// that has been read.
+	written        int64
+	crcMu          sync.Mutex
+	crcCheckpoints []crcCheckpoint
+	read           int64
+	readCRC        uint32
+
+	levelsMu sync.Mutex
+	levels   []BlockSizeLevel
+}
+
+// crcCheckpoint records the stream CRC that applies once the output
+// up to offset has been read.
+type crcCheckpoint struct {
+	offset int64
+	crc    uint32
 }
 
 // Progress is used to report the progress of decompression. Each report pertains
-// to a correctly ordered decompression event.
+// to a correctly ordered decompression event. Once all blocks have been
+// successfully decompressed and reassembled a final report is sent with
+// Final set to true, Duration set to the elapsed time for the entire
+// decompression and TotalCompressed and TotalDecompressed set to the
+// total number of compressed and decompressed bytes. Consumers should use
+// Final, rather than a zero Block value, to detect the end of the reports.
+// Unless BZProgressBlocking is used, a report may cover several blocks
+// that could not be reported individually, in which case Block and CRC
+// pertain to the most recent of them and Duration, Compressed and Size
+// are the totals for all of them. Throughput is the number of
+// decompressed bytes per second, that is, Size divided by Duration, or,
+// for the final report, TotalDecompressed divided by Duration.
 type Progress struct {
 	Duration         time.Duration
 	Block            uint64
 	CRC              uint32
 	Compressed, Size int
+	Throughput       float64
+
+	Final             bool
+	TotalCompressed   int64
+	TotalDecompressed int64
 }
 
-// NewDecompressor creates a new parallel decompressor.
+// NewDecompressor creates a new parallel decompressor. Invalid options,
+// such as a non-positive concurrency, are replaced by their defaults, use
+// NewDecompressorE to have them reported as errors instead.
 func NewDecompressor(ctx context.Context, opts ...DecompressorOption) *Decompressor {
+	dc, _ := newDecompressor(opts...)
+	dc.start(ctx)
+	return dc
+}
+
+// NewDecompressorE is like NewDecompressor except that it returns an
+// error for invalid options rather than replacing them by their defaults.
+func NewDecompressorE(ctx context.Context, opts ...DecompressorOption) (*Decompressor, error) {
+	dc, err := newDecompressor(opts...)
+	if err != nil {
+		return nil, err
+	}
+	dc.start(ctx)
+	return dc, nil
+}
+
+// validate replaces any invalid options with their defaults and returns
+// an error that describes the first such option, if any.
+func (o *decompressorOpts) validate() error {
+	var err error
+	invalid := func(format string, args ...interface{}) {
+		if err == nil {
+			err = fmt.Errorf(format, args...)
+		}
+	}
+	if o.concurrency <= 0 {
+		invalid("invalid concurrency: %v", o.concurrency)
+		o.concurrency = runtime.GOMAXPROCS(-1)
+	}
+	if o.minWorkers != 0 || o.maxWorkers != 0 {
+		if o.minWorkers <= 0 || o.maxWorkers < o.minWorkers {
+			invalid("invalid adaptive concurrency: min %v, max %v", o.minWorkers, o.maxWorkers)
+			o.minWorkers, o.maxWorkers = 0, 0
+		}
+	}
+	if o.maxReorder < 0 {
+		invalid("invalid max reorder buffer: %v", o.maxReorder)
+		o.maxReorder = 0
+	}
+	if o.padTo < 0 {
+		invalid("invalid padding size: %v", o.padTo)
+		o.padTo = 0
+	}
+	if o.heapHint < 0 {
+		invalid("invalid heap hint: %v", o.heapHint)
+		o.heapHint = 0
+	}
+	if o.blockTimeout < 0 {
+		invalid("invalid block timeout: %v", o.blockTimeout)
+		o.blockTimeout = 0
+	}
+	if o.pipeBuffer < 0 {
+		invalid("invalid pipe buffer size: %v", o.pipeBuffer)
+		o.pipeBuffer = 0
+	}
+	return err
+}
+
+// internalCRCImpl maps kind to its internal/bzip2 equivalent.
+func internalCRCImpl(kind CRCImpl) bzip2.CRCImpl {
+	if kind == CRCHash {
+		return bzip2.CRCHash
+	}
+	return bzip2.CRCTable
+}
+
+// newDecompressor creates a decompressor without starting any of its
+// goroutines. The decompressor is usable, with any invalid options
+// replaced by their defaults, even if an error is returned.
+func newDecompressor(opts ...DecompressorOption) (*Decompressor, error) {
 	o := decompressorOpts{
 		concurrency: runtime.GOMAXPROCS(-1),
 	}
 	for _, fn := range opts {
 		fn(&o)
 	}
+	err := o.validate()
 	dc := &Decompressor{
-		ctx:        ctx,
-		doneCh:     make(chan *blockDesc, o.concurrency),
-		workCh:     make(chan *blockDesc, o.concurrency),
-		progressCh: o.progressCh,
-		heap:       &blockHeap{},
+		progressCh:    o.progressCh,
+		progressBlock: o.progressBlock,
+		verbose:       o.verbose,
+		logger:        o.logger,
+		concurrency:   o.concurrency,
+		pool:          o.pool,
+		metrics:       o.metrics,
+		diagnosticsCh: o.diagnosticsCh,
+		boundaryCh:    o.boundaryCh,
+		maxReorder:    o.maxReorder,
+		heapHint:      o.heapHint,
+		collectAll:    o.collectAll,
+		failFast:      o.failFast,
+		blockMagic:    blockMagic,
+		blockTimeout:  o.blockTimeout,
+		skipCRC:       o.skipCRC,
+		noShortcut:    o.noShortcut,
+		crcImpl:       internalCRCImpl(o.crcImpl),
+		errorCompat:   o.errorCompat,
+		padTo:         o.padTo,
+		padByte:       o.padByte,
+		pipeBuffer:    o.pipeBuffer,
+		mirror:        o.mirror,
+		hash:          o.hash,
+		unordered:     o.unordered,
+		dispatch:      o.dispatch,
+		blockFilter:   o.blockFilter,
+		noSequential:  o.noSequential,
+	}
+	if o.maxWorkers > 0 && o.dispatch != DispatchStriped {
+		// See BZAdaptiveConcurrency, the channels are sized for the
+		// maximum number of workers.
+		dc.concurrency = o.maxWorkers
+		dc.minWorkers, dc.maxWorkers = o.minWorkers, o.maxWorkers
+	}
+	if o.blockMagic != nil {
+		dc.blockMagic = *o.blockMagic
+	}
+	if dc.padTo > 1 {
+		dc.pad = bytes.Repeat([]byte{dc.padByte}, dc.padTo)
+	}
+	if dc.logger == nil {
+		dc.logger = log.Printf
+	}
+	if dc.metrics == nil {
+		dc.metrics = &Metrics{}
+	}
+	return dc, err
+}
+
+// start initializes the per-stream state of the decompressor and starts
+// its worker and assemble goroutines.
+func (dc *Decompressor) start(ctx context.Context) {
+	dc.ctx = ctx
+	dc.order = 0
+	atomic.StoreInt64(&dc.inFlight, 0)
+	dc.streamCRC = 0
+	dc.finished, dc.finishErr = false, nil
+	dc.started = time.Now()
+	dc.totalCompressed, dc.totalDecompressed = 0, 0
+	dc.pendingProgress = nil
+	dc.written = 0
+	dc.crcMu.Lock()
+	dc.crcCheckpoints, dc.read, dc.readCRC = nil, 0, 0
+	dc.crcMu.Unlock()
+	dc.levelsMu.Lock()
+	dc.levels = nil
+	dc.levelsMu.Unlock()
+	dc.failMu.Lock()
+	dc.failErr = nil
+	dc.failMu.Unlock()
+	dc.doneCh = make(chan *blockDesc, dc.concurrency)
+	dc.workCh, dc.workChs = nil, nil
+	if dc.dispatch == DispatchStriped {
+		dc.workChs = make([]chan *blockDesc, dc.concurrency)
+		for i := range dc.workChs {
+			dc.workChs[i] = make(chan *blockDesc, 1)
+		}
+	} else {
+		dc.workCh = make(chan *blockDesc, dc.concurrency)
+	}
+	h := make(blockHeap, 0, dc.heapHint)
+	dc.heap = &h
+	dc.reorderTokens = nil
+	if dc.maxReorder > 0 && !dc.collectAll {
+		dc.reorderTokens = make(chan struct{}, dc.maxReorder)
+	}
+	switch {
+	case dc.sink != nil:
+		dc.prd, dc.pwr = nil, dc.sink
+	case dc.pipeBuffer > 0:
+		pipe := newBufferedPipe(dc.pipeBuffer)
+		dc.prd, dc.pwr = pipe, pipe
+	default:
+		dc.prd, dc.pwr = io.Pipe()
 	}
-	dc.prd, dc.pwr = io.Pipe()
 	heap.Init(dc.heap)
-	dc.workWg.Add(o.concurrency)
+	dc.closeOnce, dc.closedCh = &sync.Once{}, make(chan struct{})
+	if dc.unordered {
+		dc.unorderedCh = make(chan *blockDesc)
+		dc.cancelOnce, dc.cancelCh, dc.cancelErr = &sync.Once{}, make(chan struct{}), nil
+	}
+	workers := dc.concurrency
+	if dc.maxWorkers > 0 {
+		workers = dc.minWorkers
+	}
+	atomic.StoreInt64(&dc.workers, int64(workers))
+	atomic.StoreInt64(&dc.heapDepth, 0)
 	dc.doneWg.Add(1)
-	for i := 0; i < o.concurrency; i++ {
-		go func() {
-			atomic.AddInt64(&numDecompressionGoRoutines, 1)
-			dc.worker(ctx, dc.workCh, dc.doneCh, o.pool)
-			atomic.AddInt64(&numDecompressionGoRoutines, -1)
-			dc.workWg.Done()
-		}()
+	for i := 0; i < workers; i++ {
+		in := dc.workCh
+		if dc.workChs != nil {
+			in = dc.workChs[i]
+		}
+		dc.startWorker(ctx, in)
 	}
 	go func() {
 		atomic.AddInt64(&numDecompressionGoRoutines, 1)
-		dc.assemble(ctx, dc.doneCh)
+		if dc.unordered {
+			dc.forwardUnordered(ctx, dc.doneCh)
+		} else {
+			dc.assemble(ctx, dc.doneCh)
+		}
 		atomic.AddInt64(&numDecompressionGoRoutines, -1)
 		dc.doneWg.Done()
 	}()
-	return dc
+}
+
+// startWorker starts a worker goroutine that decompresses the blocks
+// received on in.
+func (dc *Decompressor) startWorker(ctx context.Context, in chan *blockDesc) {
+	dc.workWg.Add(1)
+	go func() {
+		atomic.AddInt64(&numDecompressionGoRoutines, 1)
+		dc.worker(ctx, in, dc.doneCh, dc.pool)
+		atomic.AddInt64(&numDecompressionGoRoutines, -1)
+		dc.workWg.Done()
+	}()
+}
+
+// adaptiveMinBlockSize is the compressed size of the smallest block that
+// can lead to an additional worker being started, see
+// BZAdaptiveConcurrency.
+const adaptiveMinBlockSize = 64 * 1024
+
+// maybeStartWorker starts an additional worker, see
+// BZAdaptiveConcurrency, if cb is about to be sent on a full channel, ch,
+// and fewer decompressed blocks than there are workers are awaiting
+// reassembly.
+func (dc *Decompressor) maybeStartWorker(ch chan *blockDesc, cb CompressedBlock) {
+	if dc.maxWorkers == 0 || len(cb.Data) < adaptiveMinBlockSize || len(ch) < cap(ch) {
+		return
+	}
+	workers := atomic.LoadInt64(&dc.workers)
+	if workers >= int64(dc.maxWorkers) || atomic.LoadInt64(&dc.heapDepth) >= workers {
+		return
+	}
+	// Append may be called concurrently.
+	if !atomic.CompareAndSwapInt64(&dc.workers, workers, workers+1) {
+		return
+	}
+	dc.trace("starting worker %v of at most %v", workers+1, dc.maxWorkers)
+	dc.startWorker(dc.ctx, ch)
+}
+
+// Workers returns the number of worker goroutines used for decompression,
+// which is fixed, see BZConcurrency, unless BZAdaptiveConcurrency is used.
+func (dc *Decompressor) Workers() int {
+	return int(atomic.LoadInt64(&dc.workers))
+}
+
+// SetBufferAllocator sets the function used to allocate the buffer that
+// each block is decompressed into, in place of letting the buffer grow
+// as the block is decompressed. It allows callers to supply buffers from
+// their own pool in order to avoid an allocation per block. The size hint
+// is the maximum size of a block at the block size level of its stream,
+// ie. its StreamBlockSize, and a buffer whose capacity is smaller than
+// the decompressed block will be reallocated. The decompressor does not
+// retain a buffer once its contents have been written to its output, which
+// copies them, and hence a buffer may be recycled once the output of its
+// block has been read. Blocks delivered by ReadUnordered are owned by the
+// caller. SetBufferAllocator must be called before the first call to
+// Append.
+func (dc *Decompressor) SetBufferAllocator(alloc func(sizeHint int) []byte) {
+	dc.alloc = alloc
+}
+
+// Reset prepares the decompressor for use with a new stream, restarting
+// its worker goroutines with the options it was originally created with.
+// It must only be called after Finish has returned without an error and
+// the output of the previous stream has been read. In particular, it
+// returns an error if Finish failed, eg. because the decompressor's
+// context was canceled.
+func (dc *Decompressor) Reset(ctx context.Context) error {
+	if !dc.finished {
+		return fmt.Errorf("Reset called before Finish")
+	}
+	if dc.finishErr != nil {
+		return fmt.Errorf("Reset called after Finish failed: %w", dc.finishErr)
+	}
+	dc.start(ctx)
+	return nil
 }
 
 type blockDesc struct {
@@ -154,6 +814,7 @@ type blockDesc struct {
 	err          error
 	uncompressed []byte
 	duration     time.Duration
+	warnings     []string
 }
 
 func (b *blockDesc) String() string {
@@ -167,35 +828,122 @@ func (b *blockDesc) String() string {
 
 func (dc *Decompressor) trace(format string, args ...interface{}) {
 	if dc.verbose {
-		log.Printf(format, args...)
+		dc.logger(format, args...)
 	}
 }
 
-func (b *blockDesc) decompress() {
+func (b *blockDesc) decompress(ctx context.Context, skipCRC, noShortcut bool, crcImpl bzip2.CRCImpl, alloc func(int) []byte) {
 	start := time.Now()
-	rd := bzip2.NewBlockReader(b.StreamBlockSize, b.Data, uint(b.BitOffset)) //#nosec G115 -- This is a false positive, b.BitOffset is always < 32.
-	b.uncompressed, b.err = io.ReadAll(rd)
+	rd := bzip2.NewBlockReaderContext(ctx, b.StreamBlockSize, b.Data, uint(b.BitOffset)) //#nosec G115 -- This is a false positive, b.BitOffset is always < 32.
+	if skipCRC {
+		rd.SkipCRC()
+	}
+	if noShortcut {
+		rd.NoHuffmanShortcut()
+	}
+	rd.SetCRCImpl(crcImpl)
+	if alloc == nil {
+		b.uncompressed, b.err = io.ReadAll(rd)
+	} else {
+		b.uncompressed, b.err = readAllInto(rd, alloc(b.StreamBlockSize)[:0])
+	}
+	b.warnings = rd.Warnings()
 	b.duration = time.Since(start)
 }
 
+// readAllInto is like io.ReadAll except that it appends to buf, which
+// is only reallocated if its capacity is exhausted.
+func readAllInto(rd io.Reader, buf []byte) ([]byte, error) {
+	for {
+		if len(buf) == cap(buf) {
+			buf = append(buf, 0)[:len(buf)]
+		}
+		n, err := rd.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return buf, err
+		}
+	}
+}
+
+// decompress decompresses the supplied block subject to any filter set
+// via BZBlockFilter, any timeout set via BZBlockTimeout and to the block
+// size declared for its stream.
+func (dc *Decompressor) decompress(ctx context.Context, block *blockDesc) {
+	if dc.blockFilter != nil && !dc.blockFilter(block.CompressedBlock) {
+		// See BZBlockFilter.
+		return
+	}
+	if dc.blockTimeout <= 0 {
+		block.decompress(context.Background(), dc.skipCRC, dc.noShortcut, dc.crcImpl, dc.alloc)
+		checkBlockSize(block)
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, dc.blockTimeout)
+	defer cancel()
+	block.decompress(ctx, dc.skipCRC, dc.noShortcut, dc.crcImpl, dc.alloc)
+	checkBlockSize(block)
+	if errors.Is(block.err, context.DeadlineExceeded) {
+		block.err = fmt.Errorf("block %v: decompression took longer than %v: %w", block.order, dc.blockTimeout, block.err)
+	}
+}
+
+// levelMismatch returns err, for a block that could not be decompressed,
+// wrapped by any level mismatch that the scanner detected with a stream
+// header adjacent to that block since that is the most likely cause of
+// the failure.
+func levelMismatch(block *blockDesc, err error) error {
+	if block.levelMismatch == nil {
+		return err
+	}
+	return fmt.Errorf("%w: %v", block.levelMismatch, err)
+}
+
+// checkBlockSize replaces the error for a block whose decompressed data
+// exceeds the block size declared for its stream with one that identifies
+// the block and that wraps ErrBlockSizeExceeded.
+func checkBlockSize(block *blockDesc) {
+	if bzip2.ExceedsBlockSize(block.err) {
+		block.err = fmt.Errorf("block %v: %w of %v bytes (level %v)", block.order, ErrBlockSizeExceeded, block.StreamBlockSize, block.Level())
+	}
+}
+
 func (dc *Decompressor) worker(ctx context.Context, in <-chan *blockDesc, out chan<- *blockDesc, pool chan struct{}) {
 	for {
+		idle := time.Now()
 		select {
 		// Always wait for a block or for the channel to be closed.
 		case block := <-in:
+			dc.metrics.addIdle(time.Since(idle))
 			if block == nil {
 				return
 			}
 			if pool != nil {
 				// Wait for a token from the pool.
+				wait := time.Now()
 				select {
 				case <-pool:
 				case <-ctx.Done():
 					return
 				}
+				dc.metrics.addPoolWait(time.Since(wait))
+			}
+			select {
+			case <-dc.closedCh:
+				// The output has been closed and hence there is no
+				// point in decompressing the block.
+				block.err = io.ErrClosedPipe
+			default:
+				dc.trace("decompressing: %s", block)
+				dc.decompress(ctx, block)
+				dc.metrics.addBlock()
+				if block.err != nil && dc.failFast && !dc.unordered {
+					dc.fail(dc.annotateError(block.order, block.err))
+				}
 			}
-			dc.trace("decompressing: %s", block)
-			block.decompress()
 			dc.trace("decompressed: %s (%v), ch %v/%v", block, block.err, len(out), cap(out))
 			if pool != nil {
 				pool <- struct{}{}
@@ -212,45 +960,217 @@ func (dc *Decompressor) worker(ctx context.Context, in <-chan *blockDesc, out ch
 
 // Append adds the supplied bzip2 block to the set to be decompressed in parallel
 // with the results of that decompression being appended to the previously
-// appended blocks.
+// appended blocks. Append may be called concurrently, but the blocks will then
+// be reassembled in whatever order the calls happen to be serialized in, use
+// AppendOrdered to control the order explicitly.
 func (dc *Decompressor) Append(cb CompressedBlock) error {
-	order := atomic.AddUint64(&dc.order, 1)
+	return dc.append(0, cb)
+}
+
+// AppendOrdered is like Append except that the position of the block in
+// the decompressed output is specified explicitly, starting at 1, rather
+// than being determined by the order of the calls to Append. This allows
+// for blocks to be appended out of order, and concurrently, by multiple
+// goroutines. Every position from 1 up to the last one must be appended
+// exactly once before Finish is called and AppendOrdered must not be
+// mixed with Append. When used with BZMaxReorderBuffer the earliest
+// outstanding block must be appended before the buffer fills, otherwise
+// AppendOrdered will block indefinitely.
+func (dc *Decompressor) AppendOrdered(order uint64, cb CompressedBlock) error {
+	if order == 0 {
+		return fmt.Errorf("block order must start at 1")
+	}
+	return dc.append(order, cb)
+}
+
+func (dc *Decompressor) append(order uint64, cb CompressedBlock) error {
+	if err := dc.failed(); err != nil {
+		return err
+	}
+	if dc.reorderTokens != nil {
+		// Note that the token must be acquired before the order is
+		// assigned to ensure that the earliest outstanding block
+		// always holds a token.
+		select {
+		case dc.reorderTokens <- struct{}{}:
+		case <-dc.ctx.Done():
+			return dc.ctx.Err()
+		}
+	}
+	if order == 0 {
+		order = atomic.AddUint64(&dc.order, 1)
+	}
+	wait := time.Now()
+	defer func() {
+		dc.metrics.addAppendWait(time.Since(wait))
+	}()
+	ch := dc.workCh
+	if dc.workChs != nil {
+		ch = dc.workChs[(order-1)%uint64(len(dc.workChs))]
+	}
+	dc.maybeStartWorker(ch, cb)
+	atomic.AddInt64(&dc.inFlight, 1)
+	select {
+	case <-dc.closedCh:
+		atomic.AddInt64(&dc.inFlight, -1)
+		return io.ErrClosedPipe
+	default:
+	}
 	select {
-	case dc.workCh <- &blockDesc{
+	case ch <- &blockDesc{
 		order:           order,
 		CompressedBlock: cb,
 	}:
 	case <-dc.ctx.Done():
+		atomic.AddInt64(&dc.inFlight, -1)
 		return dc.ctx.Err()
 	}
 	return nil
 }
 
+// InFlight returns the number of blocks that have been appended but not
+// yet written out, or discarded following an error. It may be used by
+// producers that scan faster than the blocks can be decompressed to
+// throttle scanning and hence bound the memory used. It is zero once
+// Finish has returned.
+func (dc *Decompressor) InFlight() int {
+	return int(atomic.LoadInt64(&dc.inFlight))
+}
+
 // Cancel can be called to unblock any readers that are reading from
 // this decompressor and/or the Finish method.
 func (dc *Decompressor) Cancel(err error) {
 	dc.pwr.CloseWithError(err)
+	if dc.unordered {
+		dc.cancelOnce.Do(func() {
+			if err == nil {
+				err = io.EOF
+			}
+			dc.cancelErr = err
+			close(dc.cancelCh)
+		})
+	}
+}
+
+// fail records err as the first error encountered by a worker, see
+// BZFailFast, and closes the output with it so that any reassembly that
+// is blocked writing to the output is abandoned.
+func (dc *Decompressor) fail(err error) {
+	dc.failMu.Lock()
+	defer dc.failMu.Unlock()
+	if dc.failErr != nil {
+		return
+	}
+	dc.failErr = err
+	dc.pwr.CloseWithError(err)
+}
+
+// failed returns the error recorded by fail, if any.
+func (dc *Decompressor) failed() error {
+	dc.failMu.Lock()
+	defer dc.failMu.Unlock()
+	return dc.failErr
+}
+
+// Close closes the read side of the decompressor's output for consumers
+// that stop reading before all of the output has been read. Subsequent
+// calls to Read, and to Append, return io.ErrClosedPipe, blocks that
+// have already been appended are discarded without being decompressed,
+// and any reassembly that is blocked waiting for the output to be read
+// is abandoned. Finish must still be called, and will return promptly,
+// to wait for the decompressor's goroutines to exit.
+func (dc *Decompressor) Close() error {
+	dc.closeOnce.Do(func() {
+		close(dc.closedCh)
+	})
+	switch prd := dc.prd.(type) {
+	case *io.PipeReader:
+		return prd.Close()
+	case *bufferedPipe:
+		return prd.CloseRead()
+	}
+	return nil
 }
 
 // Finish must be called to wait for all of the currently outstanding
 // decompression processes to finish and their output to be reassembled.
 // It should be called exactly once.
 func (dc *Decompressor) Finish() error {
+	err := dc.closeWork()
+	dc.wait()
+	dc.finish(err)
+	return err
+}
+
+// FinishWithTimeout is like Finish except that it gives up waiting for
+// the decompressor's goroutines to exit after d and returns an error that
+// wraps context.DeadlineExceeded, for example when a worker is stuck
+// decompressing a pathological block for which no BZBlockTimeout was set.
+// When this happens the output is closed with the returned error so that
+// any readers are unblocked, the goroutines are left to exit in the
+// background once their current blocks complete, and the decompressor
+// must not be used again; in particular, Reset will fail since Finish is
+// considered not to have returned. A d of zero or less is equivalent to
+// Finish.
+func (dc *Decompressor) FinishWithTimeout(d time.Duration) error {
+	if d <= 0 {
+		return dc.Finish()
+	}
+	err := dc.closeWork()
+	doneCh := make(chan struct{})
+	go func() {
+		dc.wait()
+		close(doneCh)
+	}()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-doneCh:
+		dc.finish(err)
+		return err
+	case <-timer.C:
+	}
+	err = fmt.Errorf("decompressor failed to finish within %v: %w", d, context.DeadlineExceeded)
+	dc.Cancel(err)
+	return err
+}
+
+// closeWork closes the channels used to send blocks to the workers and
+// returns the context's error, if any.
+func (dc *Decompressor) closeWork() error {
 	var err error
 	select {
 	case <-dc.ctx.Done():
 		err = dc.ctx.Err()
 	default:
 	}
+	if dc.workChs != nil {
+		for _, ch := range dc.workChs {
+			close(ch)
+		}
+	} else {
+		close(dc.workCh)
+	}
+	return err
+}
+
+// wait waits for the workers and then the assemble goroutine to exit.
+func (dc *Decompressor) wait() {
 	// NOTE, that the the assemble method must read all of the output
 	// produced by the workers, even in the event of an error. Otherwise
 	// a deadlock will occur with the workers trying to write blocks to
 	// the channel that the assemble method is no longer reading from.
-	close(dc.workCh)
 	dc.workWg.Wait()
 	close(dc.doneCh)
 	dc.doneWg.Wait()
-	return err
+}
+
+// finish records that Finish has returned err.
+func (dc *Decompressor) finish(err error) {
+	// Blocks that were abandoned when the context was canceled are no
+	// longer in flight.
+	atomic.StoreInt64(&dc.inFlight, 0)
+	dc.finished, dc.finishErr = true, err
 }
 
 type blockHeap []*blockDesc
@@ -273,6 +1193,38 @@ func (h *blockHeap) Pop() interface{} {
 	return x
 }
 
+// MergeBlocks merges two adjacent blocks, a and b, that were split by a
+// false positive match of the block magic number within the compressed
+// data of a single block. The returned block contains the data of a,
+// the block magic number and the data of b, and hence a bit-for-bit copy
+// of the original, unsplit, block. Since a block magic number cannot
+// follow the end of a stream, a must not be an EOS block, whereas the
+// EOS status, if any, of b is carried over to the merged block.
+func MergeBlocks(a, b CompressedBlock) (CompressedBlock, error) {
+	return mergeBlocks(blockMagic, a, b)
+}
+
+func mergeBlocks(magic [6]byte, a, b CompressedBlock) (CompressedBlock, error) {
+	if a.EOS {
+		return CompressedBlock{}, fmt.Errorf("cannot merge with a block that ends a stream")
+	}
+	if a.StreamBlockSize != b.StreamBlockSize {
+		return CompressedBlock{}, fmt.Errorf("cannot merge blocks with different block sizes: %v != %v", a.StreamBlockSize, b.StreamBlockSize)
+	}
+	bwr := &bitstream.BitWriter{}
+	// Note that the first block has an offset in the first byte and a size in
+	// bits and hence need the sum of those to accurately reflect the size of
+	// the first block in terms of appending to it.
+	bwr.Init(a.Data, a.SizeInBits+a.BitOffset, len(a.Data)+len(b.Data)+len(magic)+1)
+	bwr.Append(magic[:], 0, len(magic)*8)
+	bwr.Append(b.Data, b.BitOffset, b.SizeInBits)
+	merged := a
+	data, sizeInBits := bwr.Data()
+	merged.Data, merged.SizeInBits = data, sizeInBits-a.BitOffset
+	merged.EOS, merged.StreamCRC, merged.emptyStreams = b.EOS, b.StreamCRC, b.emptyStreams
+	return merged, nil
+}
+
 // tryMergeBlocks attempts to merge two consecutive blocks in the hope that
 // they were split because of a false positive detection of the block magic
 // byte sequence in the payload of a block. This may happen when processing
@@ -293,6 +1245,7 @@ func (dc *Decompressor) tryMergeBlocks(ctx context.Context, ch <-chan *blockDesc
 					return false
 				}
 				heap.Push(dc.heap, block)
+				dc.updateHeapDepth()
 			case <-ctx.Done():
 				err := ctx.Err()
 				dc.trace("tryMergeBlocks: %v", err)
@@ -317,36 +1270,69 @@ func (dc *Decompressor) tryMergeBlocks(ctx context.Context, ch <-chan *blockDesc
 			return false
 		} else {
 			heap.Push(dc.heap, block)
+			dc.updateHeapDepth()
 		}
 	}
 
 	next := (*dc.heap)[0]
-	bwr := &bitstream.BitWriter{}
-	// Note that the first block has an offset in the first byte and a size in
-	// bits and hence need the sum of those to accurately reflect the size of
-	// the first block in terms of appending to it.
-	bwr.Init(min.Data, min.SizeInBits+min.BitOffset, len(min.Data)+len(next.Data)+len(blockMagic)+1)
-	bwr.Append(blockMagic[:], 0, len(blockMagic)*8)
-	bwr.Append(next.Data, next.BitOffset, next.SizeInBits)
-	min.Data, min.SizeInBits = bwr.Data()
+	merged, err := mergeBlocks(dc.blockMagic, min.CompressedBlock, next.CompressedBlock)
+	if err != nil {
+		return false
+	}
+	min.CompressedBlock = merged
 
-	min.decompress()
+	dc.decompress(ctx, min)
 	if min.err != nil {
 		return false
 	}
-	// The merge succeeded, remove the block that was merged from the heap.
+	// The merge succeeded, remove the block that was merged from the heap,
+	// it remains in flight until the output of the merged block is written.
 	heap.Remove(dc.heap, 0)
+	dc.updateHeapDepth()
+	dc.releaseReorderTokens(1)
 	return true
 
 }
 
+// updateHeapDepth must be called after every change to the heap so that
+// maybeStartWorker sees its current depth.
+func (dc *Decompressor) updateHeapDepth() {
+	dc.metrics.updateHeapDepth(len(*dc.heap))
+	atomic.StoreInt64(&dc.heapDepth, int64(len(*dc.heap)))
+}
+
+func (dc *Decompressor) annotateError(order uint64, err error) error {
+	if dc.annotate == nil {
+		return err
+	}
+	return dc.annotate(order, err)
+}
+
+// writeMirror writes the output of the supplied block to the writer set
+// via BZAdditionalWriter and the hash set via BZHash, if any.
+func (dc *Decompressor) writeMirror(block *blockDesc) error {
+	if dc.hash != nil {
+		dc.hash.Write(block.uncompressed)
+	}
+	if dc.mirror == nil {
+		return nil
+	}
+	if _, err := dc.mirror.Write(block.uncompressed); err != nil {
+		return fmt.Errorf("block %v: additional writer: %w", block.order, err)
+	}
+	return nil
+}
+
 func (dc *Decompressor) handlePossibleEOS(min *blockDesc) error {
 	dc.streamCRC = updateStreamCRC(dc.streamCRC, min.CRC)
 	if min.EOS {
-		if got, want := dc.streamCRC, min.StreamCRC; got != want {
-			return fmt.Errorf("mismatched stream CRCs: calculated=0x%08x != stored=0x%08x", got, want)
+		if got, want := dc.streamCRC, min.StreamCRC; got != want && !dc.skipCRC {
+			return classify(errKindStreamCRC, fmt.Errorf("mismatched stream CRCs: calculated=0x%08x != stored=0x%08x", got, want))
 		}
 		dc.streamCRC = 0
+		dc.levelsMu.Lock()
+		dc.levels = append(dc.levels, min.Level())
+		dc.levelsMu.Unlock()
 	}
 	return nil
 }
@@ -355,18 +1341,57 @@ func (dc *Decompressor) handlePossibleEOS(min *blockDesc) error {
 // completed. In the case of a decompression error, assemble drain that channel
 // to prevent a deadlock.
 func (dc *Decompressor) waitForChannelToClose(ctx context.Context, ch <-chan *blockDesc) {
+	// Release any blocks held in the heap, and drained from ch, so that
+	// Append cannot block waiting for them to be written out.
+	dc.releaseBlocks(len(*dc.heap))
+	*dc.heap = (*dc.heap)[:0]
+	dc.updateHeapDepth()
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case _, ok := <-ch:
+		case block, ok := <-ch:
 			if !ok {
 				return
 			}
+			if block != nil {
+				dc.releaseBlocks(1)
+			}
 		}
 	}
 }
 
+// releaseBlocks is called when n blocks have been written out, or
+// discarded, to remove them from the in-flight count and to release the
+// tokens acquired for them by Append when BZMaxReorderBuffer is used.
+func (dc *Decompressor) releaseBlocks(n int) {
+	atomic.AddInt64(&dc.inFlight, -int64(n))
+	dc.releaseReorderTokens(n)
+}
+
+// releaseReorderTokens releases the tokens acquired by Append for n
+// blocks, see BZMaxReorderBuffer, without changing the in-flight count.
+func (dc *Decompressor) releaseReorderTokens(n int) {
+	if dc.reorderTokens == nil {
+		return
+	}
+	for i := 0; i < n; i++ {
+		<-dc.reorderTokens
+	}
+}
+
+// checkOrder verifies, in verbose mode, the invariant that assemble relies
+// on, namely that the next expected block is never skipped because every
+// block that has yet to be written out follows it. A block that precedes
+// it must have been appended more than once and would otherwise remain in
+// the heap indefinitely.
+func (dc *Decompressor) checkOrder(min *blockDesc, expected uint64) error {
+	if !dc.verbose || min.order >= expected {
+		return nil
+	}
+	return fmt.Errorf("block %v: appended more than once or out of sequence: expected block %v", min.order, expected)
+}
+
 func (dc *Decompressor) assemble(ctx context.Context, ch <-chan *blockDesc) {
 	expected := uint64(1)
 	for {
@@ -376,45 +1401,101 @@ func (dc *Decompressor) assemble(ctx context.Context, ch <-chan *blockDesc) {
 			dc.trace("assemble: %v", block)
 			if block != nil {
 				heap.Push(dc.heap, block)
+				dc.updateHeapDepth()
+				if dc.collectAll {
+					// See BZCollectAll, the blocks are written out once
+					// ch is closed.
+					continue
+				}
 			}
 			for len(*dc.heap) > 0 {
 				min := (*dc.heap)[0]
+				if err := dc.checkOrder(min, expected); err != nil {
+					dc.pwr.CloseWithError(err)
+					dc.waitForChannelToClose(ctx, ch)
+					return
+				}
 				if min.order != expected {
 					break
 				}
 				heap.Remove(dc.heap, 0)
+				dc.updateHeapDepth()
+				// The reorder token is released now, rather than once
+				// the output is written, since a merge requires the
+				// successor block to be appended. The block remains in
+				// flight until its output is written.
+				dc.releaseReorderTokens(1)
 				expected++
+				merged := false
 				if err := min.err; err != nil {
-					if !dc.tryMergeBlocks(ctx, ch, min) {
-						dc.pwr.CloseWithError(err)
+					// A block that timed out is not the result of a false
+					// positive and hence no attempt is made to merge it.
+					if errors.Is(err, context.DeadlineExceeded) || !dc.tryMergeBlocks(ctx, ch, min) {
+						dc.pwr.CloseWithError(dc.annotateError(min.order, levelMismatch(min, err)))
 						dc.waitForChannelToClose(ctx, ch)
 						return
 					}
 					// merge was successful, so bump up the next
 					// expected block number.
 					expected++
+					merged = true
 				}
-				if _, err := dc.pwr.Write(min.uncompressed); err != nil {
+				if err := dc.writeMirror(min); err != nil {
 					dc.pwr.CloseWithError(err)
 					dc.waitForChannelToClose(ctx, ch)
 					return
 				}
-				if err := dc.handlePossibleEOS(min); err != nil {
+				if err := ctx.Err(); err != nil {
+					// Stop promptly, even if the remaining blocks have
+					// already been decompressed, since a sink, unlike a
+					// pipe, will never block the write below.
 					dc.pwr.CloseWithError(err)
 					dc.waitForChannelToClose(ctx, ch)
 					return
 				}
-				if dc.progressCh != nil && ctx.Err() == nil {
-					dc.progressCh <- Progress{
-						Duration:   min.duration,
-						Block:      min.order,
-						CRC:        min.CRC,
-						Compressed: len(min.Data),
-						Size:       len(min.uncompressed),
-					}
+				dc.addCRCCheckpoint(min)
+				if err := dc.writeOutput(min); err != nil {
+					dc.pwr.CloseWithError(err)
+					dc.waitForChannelToClose(ctx, ch)
+					return
+				}
+				written := int64(1)
+				if merged {
+					// The successor that was merged into min.
+					written++
 				}
+				atomic.AddInt64(&dc.inFlight, -written)
+				if err := dc.handlePossibleEOS(min); err != nil {
+					dc.pwr.CloseWithError(dc.annotateError(min.order, err))
+					dc.waitForChannelToClose(ctx, ch)
+					return
+				}
+				dc.sendBoundary(ctx, min)
+				dc.totalCompressed += int64(len(min.Data))
+				dc.totalDecompressed += int64(len(min.uncompressed))
+				dc.sendDiagnostics(ctx, min, merged)
+				dc.sendProgress(ctx, Progress{
+					Duration:   min.duration,
+					Block:      min.order,
+					CRC:        min.CRC,
+					Compressed: len(min.Data),
+					Size:       len(min.uncompressed),
+				})
+				// The output has been emitted, drop the reference to
+				// it so that its buffer may be recycled.
+				dc.releaseBuffer(min.uncompressed)
+				min.uncompressed = nil
+			}
+			if block == nil && len(*dc.heap) > 0 {
+				// Only possible if AppendOrdered was called with a
+				// non-contiguous sequence of blocks.
+				err := fmt.Errorf("blocks were not appended in sequence: expected block %v, next block is %v", expected, (*dc.heap)[0].order)
+				dc.pwr.CloseWithError(err)
+				dc.waitForChannelToClose(ctx, ch)
+				return
 			}
 			if block == nil && len(*dc.heap) == 0 {
+				dc.sendFinalProgress(ctx)
 				dc.pwr.Close()
 				dc.waitForChannelToClose(ctx, ch)
 				return
@@ -428,7 +1509,216 @@ func (dc *Decompressor) assemble(ctx context.Context, ch <-chan *blockDesc) {
 	}
 }
 
+// sendProgress sends the supplied progress report, if progress reports
+// were requested, see BZSendUpdates and BZProgressBlocking.
+func (dc *Decompressor) sendProgress(ctx context.Context, p Progress) {
+	if dc.progressCh == nil || ctx.Err() != nil {
+		return
+	}
+	if dc.progressBlock {
+		p.Throughput = p.throughput()
+		dc.sendProgressBlocking(ctx, p)
+		return
+	}
+	if p.Final {
+		// The final report is always delivered, preceded by any update
+		// that has yet to be sent, so that the per block sizes add up
+		// to the totals.
+		if pending := dc.pendingProgress; pending != nil {
+			dc.pendingProgress = nil
+			dc.sendProgressBlocking(ctx, *pending)
+		}
+		p.Throughput = p.throughput()
+		dc.sendProgressBlocking(ctx, p)
+		return
+	}
+	if pending := dc.pendingProgress; pending != nil {
+		p.Duration += pending.Duration
+		p.Compressed += pending.Compressed
+		p.Size += pending.Size
+	}
+	p.Throughput = p.throughput()
+	select {
+	case dc.progressCh <- p:
+		dc.pendingProgress = nil
+	default:
+		dc.pendingProgress = &p
+	}
+}
+
+// sendProgressBlocking sends p unless the context is canceled first.
+func (dc *Decompressor) sendProgressBlocking(ctx context.Context, p Progress) {
+	select {
+	case dc.progressCh <- p:
+	case <-ctx.Done():
+	}
+}
+
+// throughput returns the number of decompressed bytes per second
+// covered by the report.
+func (p Progress) throughput() float64 {
+	if p.Duration <= 0 {
+		return 0
+	}
+	size := float64(p.Size)
+	if p.Final {
+		size = float64(p.TotalDecompressed)
+	}
+	return size / p.Duration.Seconds()
+}
+
+// sendFinalProgress sends the final progress report.
+func (dc *Decompressor) sendFinalProgress(ctx context.Context) {
+	dc.sendProgress(ctx, Progress{
+		Duration:          time.Since(dc.started),
+		Final:             true,
+		TotalCompressed:   dc.totalCompressed,
+		TotalDecompressed: dc.totalDecompressed,
+	})
+}
+
+// padding returns the padding, if any, required to follow size bytes of
+// decompressed output, see BZPadTo.
+func (dc *Decompressor) padding(size int) []byte {
+	if dc.padTo < 2 || size%dc.padTo == 0 {
+		return nil
+	}
+	return dc.pad[:dc.padTo-size%dc.padTo]
+}
+
+// writeOutput writes the decompressed output of the supplied block,
+// followed by any padding, to the decompressor's pipe.
+func (dc *Decompressor) writeOutput(block *blockDesc) error {
+	if _, err := dc.pwr.Write(block.uncompressed); err != nil {
+		return err
+	}
+	if pad := dc.padding(len(block.uncompressed)); len(pad) > 0 {
+		if _, err := dc.pwr.Write(pad); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseBuffer recycles the buffer that a block was decompressed into
+// once its contents have been written out, see CopyN. Writes to the output
+// copy the data written, or, for an io.Pipe, block until it has been
+// read, hence the buffer is no longer referenced.
+func (dc *Decompressor) releaseBuffer(buf []byte) {
+	if dc.release != nil && buf != nil {
+		dc.release(buf)
+	}
+}
+
+// addCRCCheckpoint records the stream CRC that will apply once the
+// supplied block has been read in its entirety.
+func (dc *Decompressor) addCRCCheckpoint(block *blockDesc) {
+	dc.written += int64(len(block.uncompressed) + len(dc.padding(len(block.uncompressed))))
+	dc.crcMu.Lock()
+	defer dc.crcMu.Unlock()
+	dc.crcCheckpoints = append(dc.crcCheckpoints, crcCheckpoint{
+		offset: dc.written,
+		crc:    updateStreamCRC(dc.streamCRC, block.CRC),
+	})
+}
+
+// StreamCRC returns the combined CRC of the blocks of the current stream
+// that have been read in their entirety via Read. Once the last block of
+// a stream has been read it returns the CRC for that entire stream, which
+// will be the same as the CRC stored in the stream, until the first block
+// of the next stream has been read. It may be used to record a verifiable
+// position within the decompressed output without having to hash it.
+func (dc *Decompressor) StreamCRC() uint32 {
+	dc.crcMu.Lock()
+	defer dc.crcMu.Unlock()
+	return dc.readCRC
+}
+
+// errUnordered is returned by Read when BZUnordered is set.
+var errUnordered = errors.New("Read cannot be used with BZUnordered, use ReadUnordered")
+
 // Read implements io.Reader on the decompressed stream.
 func (dc *Decompressor) Read(buf []byte) (int, error) {
-	return dc.prd.Read(buf)
+	if dc.unordered {
+		return 0, errUnordered
+	}
+	if err := dc.failed(); err != nil {
+		// See BZFailFast.
+		return 0, err
+	}
+	n, err := dc.prd.Read(buf)
+	dc.crcMu.Lock()
+	defer dc.crcMu.Unlock()
+	dc.read += int64(n)
+	for len(dc.crcCheckpoints) > 0 && dc.crcCheckpoints[0].offset <= dc.read {
+		dc.readCRC = dc.crcCheckpoints[0].crc
+		dc.crcCheckpoints = dc.crcCheckpoints[1:]
+	}
+	return n, err
+}
+
+// ReadUnordered returns the next block to be decompressed, in the order
+// that decompression completes, along with its position, starting at 1,
+// in the decompressed output. It requires that BZUnordered be set. An
+// error pertaining to a specific block is returned along with the
+// position of that block. It returns io.EOF once Finish has been called
+// and all of the blocks have been returned.
+func (dc *Decompressor) ReadUnordered() (block uint64, data []byte, err error) {
+	if !dc.unordered {
+		return 0, nil, fmt.Errorf("ReadUnordered requires BZUnordered")
+	}
+	select {
+	case b, ok := <-dc.unorderedCh:
+		if !ok {
+			return 0, nil, io.EOF
+		}
+		if b.err != nil {
+			return b.order, nil, dc.annotateError(b.order, b.err)
+		}
+		return b.order, b.uncompressed, nil
+	case <-dc.cancelCh:
+		return 0, nil, dc.cancelErr
+	case <-dc.ctx.Done():
+		return 0, nil, dc.ctx.Err()
+	}
+}
+
+// forwardUnordered is used in place of assemble when BZUnordered is set,
+// it forwards decompressed blocks to ReadUnordered as they complete.
+func (dc *Decompressor) forwardUnordered(ctx context.Context, ch <-chan *blockDesc) {
+	defer close(dc.unorderedCh)
+	for {
+		select {
+		case block, ok := <-ch:
+			if !ok {
+				return
+			}
+			dc.releaseBlocks(1)
+			if block.err == nil {
+				dc.sendDiagnostics(ctx, block, false)
+			}
+			select {
+			case dc.unorderedCh <- block:
+			case <-dc.cancelCh:
+				dc.waitForChannelToClose(ctx, ch)
+				return
+			case <-ctx.Done():
+				return
+			}
+		case <-dc.cancelCh:
+			dc.waitForChannelToClose(ctx, ch)
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Levels returns the compression level of each stream that has been
+// decompressed so far, in the order that the streams were encountered.
+// Empty streams are not included.
+func (dc *Decompressor) Levels() []BlockSizeLevel {
+	dc.levelsMu.Lock()
+	defer dc.levelsMu.Unlock()
+	return append([]BlockSizeLevel(nil), dc.levels...)
 }
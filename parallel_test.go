@@ -0,0 +1,1855 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2_test
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/cosnicolaou/pbzip2"
+	"github.com/cosnicolaou/pbzip2/internal"
+	"github.com/cosnicolaou/pbzip2/internal/bitstream"
+)
+
+// decompressWith scans the named file and decompresses it using the
+// supplied decompressor, returning the decompressed data.
+func decompressWith(ctx context.Context, t *testing.T, dc *pbzip2.Decompressor, name string) []byte {
+	rd := openBzipFile(t, bzip2Files[name])
+	defer rd.Close()
+	var (
+		wg   sync.WaitGroup
+		out  []byte
+		rerr error
+	)
+	wg.Add(1)
+	go func() {
+		out, rerr = io.ReadAll(dc)
+		wg.Done()
+	}()
+	sc := pbzip2.NewScanner(rd)
+	for sc.Scan(ctx) {
+		if err := dc.Append(sc.Block()); err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatalf("%v: %v", name, err)
+	}
+	if err := dc.Finish(); err != nil {
+		t.Fatalf("%v: %v", name, err)
+	}
+	wg.Wait()
+	if rerr != nil {
+		t.Fatalf("%v: %v", name, rerr)
+	}
+	return out
+}
+
+func TestDecompressorReset(t *testing.T) {
+	ctx := context.Background()
+	dc := pbzip2.NewDecompressor(ctx, pbzip2.BZConcurrency(2))
+	if err := dc.Reset(ctx); err == nil {
+		t.Errorf("expected an error from Reset before Finish")
+	}
+	for i, name := range []string{"hello", "300KB1", "900KB9"} {
+		if i > 0 {
+			if err := dc.Reset(ctx); err != nil {
+				t.Fatalf("%v: %v", name, err)
+			}
+		}
+		got := decompressWith(ctx, t, dc, name)
+		if want := bzip2Data[name]; !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v bytes, want %v bytes", name, len(got), len(want))
+		}
+	}
+
+	// Reset is not allowed after a Finish that failed.
+	cctx, cancel := context.WithCancel(ctx)
+	dc = pbzip2.NewDecompressor(cctx, pbzip2.BZConcurrency(2))
+	cancel()
+	if err := dc.Finish(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("missing or unexpected error: %v", err)
+	}
+	err := dc.Reset(ctx)
+	if !errors.Is(err, context.Canceled) || !strings.Contains(err.Error(), "Reset called after Finish failed") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+}
+
+func TestDecompressorMetrics(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name   string
+		blocks int64
+	}{
+		{"hello", 1},
+		{"300KB1", 4},
+		{"900KB1", 10},
+	} {
+		metrics := &pbzip2.Metrics{}
+		dc := pbzip2.NewDecompressor(ctx,
+			pbzip2.BZConcurrency(3),
+			pbzip2.BZConcurrencyPool(pbzip2.CreateConcurrencyPool(2)),
+			pbzip2.BZMetrics(metrics))
+		got := decompressWith(ctx, t, dc, tc.name)
+		if want := bzip2Data[tc.name]; !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v bytes, want %v bytes", tc.name, len(got), len(want))
+		}
+		if got, want := metrics.Blocks(), tc.blocks; got != want {
+			t.Errorf("%v: got %v, want %v", tc.name, got, want)
+		}
+		if got, want := metrics.MaxHeapDepth(), 1; got < want {
+			t.Errorf("%v: got %v, want >= %v", tc.name, got, want)
+		}
+		if metrics.IdleTime() <= 0 {
+			t.Errorf("%v: expected a non-zero idle time", tc.name)
+		}
+	}
+}
+
+func TestLogger(t *testing.T) {
+	ctx := context.Background()
+	var (
+		mu    sync.Mutex
+		lines []string
+	)
+	logger := func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	for _, verbose := range []bool{false, true} {
+		lines = nil
+		dc := pbzip2.NewDecompressor(ctx,
+			pbzip2.BZVerbose(verbose),
+			pbzip2.BZLogger(logger))
+		got := decompressWith(ctx, t, dc, "300KB1")
+		if want := bzip2Data["300KB1"]; !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v bytes, want %v bytes", verbose, len(got), len(want))
+		}
+		mu.Lock()
+		n := len(lines)
+		found := false
+		for _, l := range lines {
+			if strings.HasPrefix(l, "decompressed: order: 4") {
+				found = true
+			}
+		}
+		mu.Unlock()
+		if !verbose {
+			if n != 0 {
+				t.Errorf("unexpected output when not verbose: %v", lines)
+			}
+			continue
+		}
+		if !found {
+			t.Errorf("missing output for the final block: %v", lines)
+		}
+	}
+}
+
+func TestBufferAllocator(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name   string
+		blocks int
+		hint   int
+	}{
+		{"hello", 1, 900 * 1000},
+		{"300KB1", 4, 100 * 1000},
+		{"900KB9", 2, 900 * 1000},
+	} {
+		var (
+			mu    sync.Mutex
+			calls int
+			hints []int
+		)
+		dc := pbzip2.NewDecompressor(ctx, pbzip2.BZConcurrency(3))
+		dc.SetBufferAllocator(func(sizeHint int) []byte {
+			mu.Lock()
+			defer mu.Unlock()
+			calls++
+			hints = append(hints, sizeHint)
+			return make([]byte, 0, sizeHint)
+		})
+		got := decompressWith(ctx, t, dc, tc.name)
+		if want := bzip2Data[tc.name]; !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v bytes, want %v bytes", tc.name, len(got), len(want))
+		}
+		if got, want := calls, tc.blocks; got != want {
+			t.Errorf("%v: got %v, want %v", tc.name, got, want)
+		}
+		for _, hint := range hints {
+			if got, want := hint, tc.hint; got != want {
+				t.Errorf("%v: got %v, want %v", tc.name, got, want)
+			}
+		}
+	}
+}
+
+func TestBackpressure(t *testing.T) {
+	ctx := context.Background()
+	compressed, actual := concatFiles(t, "900KB1", "900KB9", "300KB1")
+	rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+		pbzip2.DecompressionOptions(pbzip2.BZConcurrency(2)))
+	bper := rd.(interface{ Backpressure() pbzip2.Backpressure })
+	if got, want := bper.Backpressure(), (pbzip2.Backpressure{}); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	out, err := io.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out, actual; !bytes.Equal(got, want) {
+		t.Errorf("got %v bytes, want %v bytes", len(got), len(want))
+	}
+	bp := bper.Backpressure()
+	if got, want := bp.Workers, 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The input is read from memory and hence the scanner must have had
+	// to wait for the workers.
+	if bp.Elapsed <= 0 || bp.AppendWait <= 0 || bp.WorkerIdle <= 0 {
+		t.Errorf("counters were not populated: %+v", bp)
+	}
+	if bp.AppendWait > bp.Elapsed || bp.WorkerIdle > bp.Elapsed*time.Duration(bp.Workers) {
+		t.Errorf("inconsistent counters: %+v", bp)
+	}
+	for _, f := range []float64{bp.ScannerBlocked(), bp.WorkersIdle()} {
+		if f <= 0 || f > 1 {
+			t.Errorf("fraction out of range: %v: %+v", f, bp)
+		}
+	}
+
+	rd = pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+		pbzip2.DecompressionOptions(pbzip2.BZConcurrency(1)))
+	if _, err := io.ReadAll(rd); err != nil {
+		t.Fatal(err)
+	}
+	bp = rd.(interface{ Backpressure() pbzip2.Backpressure }).Backpressure()
+	if bp.Workers != 0 || bp.AppendWait != 0 || bp.ScannerBlocked() != 0 {
+		t.Errorf("unexpected backpressure for synchronous decompression: %+v", bp)
+	}
+}
+
+func diagnose(ctx context.Context, t *testing.T, compressed []byte) ([]byte, []pbzip2.Diagnostic) {
+	ch := make(chan pbzip2.Diagnostic, 10)
+	var diags []pbzip2.Diagnostic
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		for d := range ch {
+			diags = append(diags, d)
+		}
+		wg.Done()
+	}()
+	rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+		pbzip2.DecompressionOptions(pbzip2.BZDiagnostics(ch)))
+	out, err := io.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+	wg.Wait()
+	return out, diags
+}
+
+func TestDiagnostics(t *testing.T) {
+	ctx := context.Background()
+	// The two streams below encode the same Huffman codes, but the
+	// code lengths of the first one contain a superfluous level.
+	superfluous := internal.SingleByteStream(9, 'a', [3]uint8{3, 3, 3}, "0", "11")
+	wellformed := internal.SingleByteStream(9, 'a', [3]uint8{1, 2, 2}, "0", "11")
+	for _, compressed := range [][]byte{superfluous, wellformed} {
+		out, err := io.ReadAll(bzip2.NewReader(bytes.NewReader(compressed)))
+		if err != nil || string(out) != "a" {
+			t.Fatalf("invalid test stream: %q: %v", out, err)
+		}
+	}
+
+	out, diags := diagnose(ctx, t, superfluous)
+	if got, want := string(out), "a"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := diags, []pbzip2.Diagnostic{
+		{Block: 1, Kind: pbzip2.DiagnosticSuperfluousHuffmanLevel, Detail: "Huffman tree 0 has a superfluous level"},
+		{Block: 1, Kind: pbzip2.DiagnosticSuperfluousHuffmanLevel, Detail: "Huffman tree 1 has a superfluous level"},
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	out, diags = diagnose(ctx, t, wellformed)
+	if got, want := string(out), "a"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if len(diags) != 0 {
+		t.Errorf("unexpected diagnostics: %v", diags)
+	}
+
+	compressed, actual := concatFiles(t, "hello", "empty", "empty", "300KB1", "empty")
+	out, diags = diagnose(ctx, t, compressed)
+	if got, want := out, actual; !bytes.Equal(got, want) {
+		t.Errorf("got %v bytes, want %v bytes", len(got), len(want))
+	}
+	if got, want := diags, []pbzip2.Diagnostic{
+		{Block: 1, Kind: pbzip2.DiagnosticEmptyStreams, Detail: "ignored 2 empty stream(s)"},
+		{Block: 5, Kind: pbzip2.DiagnosticEmptyStreams, Detail: "ignored 1 empty stream(s)"},
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestDiagnosticsCanceled(t *testing.T) {
+	// The stream results in two diagnostics, the first fills the
+	// channel and the send of the second blocks since nothing reads
+	// from the channel, canceling the context must unblock it.
+	compressed := internal.SingleByteStream(9, 'a', [3]uint8{3, 3, 3}, "0", "11")
+	blocks := scanBlocks(t, compressed)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan pbzip2.Diagnostic, 1)
+	dc := pbzip2.NewDecompressor(ctx, pbzip2.BZConcurrency(2), pbzip2.BZDiagnostics(ch))
+	for _, block := range blocks {
+		if err := dc.Append(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go func() {
+		_, _ = io.Copy(io.Discard, dc)
+	}()
+	deadline := time.Now().Add(time.Minute)
+	for len(ch) != cap(ch) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the first diagnostic")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := dc.FinishWithTimeout(time.Minute); !errors.Is(err, context.Canceled) {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+}
+
+func TestBlockBoundaries(t *testing.T) {
+	ctx := context.Background()
+	compressed, _ := concatFiles(t, "300KB1", "hello", "900KB9")
+	want := scanBlocks(t, compressed)
+	for _, concurrency := range []int{1, 4} {
+		ch := make(chan pbzip2.BlockBoundary)
+		var (
+			wg         sync.WaitGroup
+			boundaries []pbzip2.BlockBoundary
+		)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range ch {
+				boundaries = append(boundaries, b)
+			}
+		}()
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+			pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency),
+				pbzip2.BZBlockBoundaries(ch)))
+		out, err := io.ReadAll(rd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		close(ch)
+		wg.Wait()
+		if got, want := len(boundaries), len(want); got != want {
+			t.Fatalf("%v: got %v, want %v", concurrency, got, want)
+		}
+		offset := int64(0)
+		for i, b := range boundaries {
+			if got, want := b.Order, uint64(i+1); got != want {
+				t.Errorf("%v: %v: got %v, want %v", concurrency, i, got, want)
+			}
+			if got, want := b.CRC, want[i].CRC; got != want {
+				t.Errorf("%v: %v: got %v, want %v", concurrency, i, got, want)
+			}
+			if got, want := b.DecompressedStart, offset; got != want {
+				t.Errorf("%v: %v: got %v, want %v", concurrency, i, got, want)
+			}
+			if b.DecompressedEnd <= b.DecompressedStart {
+				t.Errorf("%v: %v: empty or inverted range: %+v", concurrency, i, b)
+			}
+			offset = b.DecompressedEnd
+		}
+		if got, want := offset, int64(len(out)); got != want {
+			t.Errorf("%v: got %v, want %v", concurrency, got, want)
+		}
+	}
+}
+
+func TestPadTo(t *testing.T) {
+	ctx := context.Background()
+	compressed, actual := concatFiles(t, "300KB1", "hello")
+	for _, concurrency := range []int{1, 4} {
+		ch := make(chan pbzip2.BlockBoundary, 10)
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+			pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency),
+				pbzip2.BZBlockBoundaries(ch),
+				pbzip2.BZPadTo(4096, 0xff)))
+		out, err := io.ReadAll(rd)
+		if err != nil {
+			t.Fatalf("%v: %v", concurrency, err)
+		}
+		close(ch)
+		var want []byte
+		for b := range ch {
+			want = append(want, actual[b.DecompressedStart:b.DecompressedEnd]...)
+			for len(want)%4096 != 0 {
+				want = append(want, 0xff)
+			}
+		}
+		// 3 blocks of 99981 bytes, 1 of 7257 and 1 of 12.
+		if got := len(want); got != (3*25+2+1)*4096 {
+			t.Fatalf("%v: unexpected padded size: %v", concurrency, got)
+		}
+		if !bytes.Equal(out, want) {
+			t.Errorf("%v: got %v bytes, want %v bytes", concurrency, len(out), len(want))
+		}
+
+		for _, n := range []int{0, 1} {
+			rd = pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+				pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(concurrency),
+					pbzip2.BZPadTo(n, 0xff)))
+			out, err = io.ReadAll(rd)
+			if err != nil {
+				t.Fatalf("%v: %v", concurrency, err)
+			}
+			if !bytes.Equal(out, actual) {
+				t.Errorf("%v: %v: got %v bytes, want %v bytes", concurrency, n, len(out), len(actual))
+			}
+		}
+	}
+}
+
+func TestProgressFinal(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range []string{"empty", "hello", "900KB1"} {
+		ch := make(chan pbzip2.Progress, 1)
+		var (
+			wg     sync.WaitGroup
+			finals []pbzip2.Progress
+			blocks int
+			total  int64
+		)
+		wg.Add(1)
+		go func() {
+			for p := range ch {
+				if p.Final {
+					finals = append(finals, p)
+					continue
+				}
+				blocks++
+				total += int64(p.Compressed)
+			}
+			wg.Done()
+		}()
+		compressed, _ := readFile(t, name)
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+			pbzip2.DecompressionOptions(pbzip2.BZSendUpdates(ch), pbzip2.BZProgressBlocking(true)))
+		if _, err := io.ReadAll(rd); err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		close(ch)
+		wg.Wait()
+		if got, want := len(finals), 1; got != want {
+			t.Fatalf("%v: got %v, want %v", name, got, want)
+		}
+		final := finals[0]
+		if got, want := final.TotalDecompressed, int64(len(bzip2Data[name])); got != want {
+			t.Errorf("%v: got %v, want %v", name, got, want)
+		}
+		if got, want := final.TotalCompressed, total; got != want {
+			t.Errorf("%v: got %v, want %v", name, got, want)
+		}
+		if final.Duration <= 0 {
+			t.Errorf("%v: expected a non-zero duration", name)
+		}
+	}
+}
+
+func TestProgressFinalNonBlocking(t *testing.T) {
+	ctx := context.Background()
+	compressed, actual := concatFiles(t, "300KB1", "hello", "900KB1", "300KB2")
+	for _, concurrency := range []int{1, 4} {
+		// A slow consumer results in updates being coalesced, but the
+		// final report is still delivered, exactly once, and the sizes
+		// of the updates that precede it add up to its totals.
+		ch := make(chan pbzip2.Progress, 1)
+		var (
+			wg     sync.WaitGroup
+			finals int
+			size   int64
+			final  pbzip2.Progress
+		)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range ch {
+				if p.Final {
+					finals++
+					final = p
+					continue
+				}
+				size += int64(p.Size)
+				time.Sleep(10 * time.Millisecond)
+			}
+		}()
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+			pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency),
+				pbzip2.BZSendUpdates(ch)))
+		if _, err := io.ReadAll(rd); err != nil {
+			t.Fatalf("%v: %v", concurrency, err)
+		}
+		close(ch)
+		wg.Wait()
+		if got, want := finals, 1; got != want {
+			t.Fatalf("%v: got %v, want %v", concurrency, got, want)
+		}
+		if got, want := final.TotalDecompressed, int64(len(actual)); got != want {
+			t.Errorf("%v: got %v, want %v", concurrency, got, want)
+		}
+		if got, want := size, final.TotalDecompressed; got != want {
+			t.Errorf("%v: got %v, want %v", concurrency, got, want)
+		}
+	}
+}
+
+func TestProgressBlockingCanceled(t *testing.T) {
+	// A consumer that stops reading must not prevent the decompressor
+	// from finishing once its context is canceled.
+	compressed, _ := readFile(t, "300KB1")
+	blocks := scanBlocks(t, compressed)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan pbzip2.Progress)
+	dc := pbzip2.NewDecompressor(ctx,
+		pbzip2.BZConcurrency(2),
+		pbzip2.BZSendUpdates(ch),
+		pbzip2.BZProgressBlocking(true))
+	for _, block := range blocks {
+		if err := dc.Append(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go func() {
+		_, _ = io.Copy(io.Discard, dc)
+	}()
+	<-ch
+	cancel()
+	if err := dc.FinishWithTimeout(time.Minute); !errors.Is(err, context.Canceled) {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+}
+
+func TestProgressThroughput(t *testing.T) {
+	ctx := context.Background()
+	for _, concurrency := range []int{1, 2} {
+		ch := make(chan pbzip2.Progress, 1)
+		var (
+			wg      sync.WaitGroup
+			reports []pbzip2.Progress
+		)
+		wg.Add(1)
+		go func() {
+			for p := range ch {
+				reports = append(reports, p)
+			}
+			wg.Done()
+		}()
+		compressed, _ := readFile(t, "900KB1")
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+			pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency),
+				pbzip2.BZSendUpdates(ch),
+				pbzip2.BZProgressBlocking(true)))
+		if _, err := io.ReadAll(rd); err != nil {
+			t.Fatal(err)
+		}
+		close(ch)
+		wg.Wait()
+		if got, want := len(reports), 11; got != want {
+			t.Fatalf("%v: got %v, want %v", concurrency, got, want)
+		}
+		for _, p := range reports {
+			size := float64(p.Size)
+			if p.Final {
+				size = float64(p.TotalDecompressed)
+			}
+			if p.Duration <= 0 {
+				t.Fatalf("%v: %v: expected a non-zero duration", concurrency, p.Block)
+			}
+			if got, want := p.Throughput, size/p.Duration.Seconds(); got != want {
+				t.Errorf("%v: %v: got %v, want %v", concurrency, p.Block, got, want)
+			}
+		}
+	}
+}
+
+func TestProgressNonBlocking(t *testing.T) {
+	ctx := context.Background()
+	compressed, actual := concatFiles(t, "hello", "300KB1", "900KB9")
+	for _, concurrency := range []int{1, 4} {
+		// Updates that cannot be sent immediately must not prevent
+		// decompression from completing, here the channel is not read
+		// until all of the output has been written. Only the final
+		// report is sent using a blocking send.
+		ch := make(chan pbzip2.Progress)
+		written := &notifyWriter{want: len(actual), done: make(chan struct{})}
+		var (
+			wg     sync.WaitGroup
+			finals int
+		)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-written.done
+			for p := range ch {
+				if p.Final {
+					finals++
+				}
+			}
+		}()
+		done := make(chan struct{})
+		var (
+			out []byte
+			err error
+		)
+		go func() {
+			out, err = io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+				pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(concurrency),
+					pbzip2.BZSendUpdates(ch),
+					pbzip2.BZAdditionalWriter(written))))
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Minute):
+			t.Fatalf("%v: decompression blocked on an unread progress channel", concurrency)
+		}
+		close(ch)
+		wg.Wait()
+		if err != nil {
+			t.Fatalf("%v: %v", concurrency, err)
+		}
+		if got, want := out, actual; !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v bytes, want %v bytes", concurrency, len(got), len(want))
+		}
+		if got, want := finals, 1; got != want {
+			t.Errorf("%v: got %v, want %v", concurrency, got, want)
+		}
+	}
+
+	// Updates that are not read promptly are coalesced.
+	ch := make(chan pbzip2.Progress, 1)
+	var (
+		wg      sync.WaitGroup
+		reports []pbzip2.Progress
+	)
+	wg.Add(1)
+	go func() {
+		for p := range ch {
+			reports = append(reports, p)
+			time.Sleep(10 * time.Millisecond)
+		}
+		wg.Done()
+	}()
+	rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+		pbzip2.DecompressionOptions(pbzip2.BZConcurrency(4), pbzip2.BZSendUpdates(ch)))
+	if _, err := io.ReadAll(rd); err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+	wg.Wait()
+	prev, size := uint64(0), 0
+	for _, p := range reports {
+		if p.Final {
+			continue
+		}
+		if p.Block <= prev {
+			t.Errorf("out of sequence report: %v after %v", p.Block, prev)
+		}
+		prev = p.Block
+		size += p.Size
+	}
+	// Any coalesced update is sent before the final report.
+	if got, want := size, len(actual); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// notifyWriter closes done once want bytes have been written to it.
+type notifyWriter struct {
+	want    int
+	written int
+	done    chan struct{}
+}
+
+func (nw *notifyWriter) Write(buf []byte) (int, error) {
+	nw.written += len(buf)
+	if nw.written >= nw.want && nw.written-len(buf) < nw.want {
+		close(nw.done)
+	}
+	return len(buf), nil
+}
+
+func TestMaxReorderBuffer(t *testing.T) {
+	ctx := context.Background()
+	compressed, actual := concatFiles(t, "900KB1", "300KB1", "hello")
+	timeToFirstByte := func(opts ...pbzip2.DecompressorOption) ([]byte, time.Duration) {
+		start := time.Now()
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+			pbzip2.DecompressionOptions(opts...))
+		buf := make([]byte, 1)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			t.Fatal(err)
+		}
+		ttfb := time.Since(start)
+		rest, err := io.ReadAll(rd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(buf, rest...), ttfb
+	}
+
+	out, unbounded := timeToFirstByte(pbzip2.BZConcurrency(4))
+	if got, want := out, actual; !bytes.Equal(got, want) {
+		t.Errorf("got %v bytes, want %v bytes", len(got), len(want))
+	}
+	for _, n := range []int{1, 2, 3} {
+		metrics := &pbzip2.Metrics{}
+		out, bounded := timeToFirstByte(
+			pbzip2.BZConcurrency(4),
+			pbzip2.BZMaxReorderBuffer(n),
+			pbzip2.BZMetrics(metrics))
+		if got, want := out, actual; !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v bytes, want %v bytes", n, len(got), len(want))
+		}
+		if got, want := metrics.MaxHeapDepth(), n; got > want {
+			t.Errorf("%v: got %v, want <= %v", n, got, want)
+		}
+		t.Logf("time to first byte: reorder buffer of %v: %v, unbounded: %v", n, bounded, unbounded)
+	}
+
+	// Make sure that errors do not lead to a deadlock.
+	corrupted := append([]byte{}, compressed...)
+	corrupted[len(corrupted)/4] ^= 0xff
+	rd := pbzip2.NewReader(ctx, bytes.NewReader(corrupted),
+		pbzip2.DecompressionOptions(
+			pbzip2.BZConcurrency(4),
+			pbzip2.BZMaxReorderBuffer(1)))
+	if _, err := io.ReadAll(rd); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestHeapHint(t *testing.T) {
+	ctx := context.Background()
+	compressed, _ := readFile(t, "900KB1")
+	for _, hint := range []int{0, 1, 4, 64} {
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+			pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(4),
+				pbzip2.BZHeapHint(hint)))
+		out, err := io.ReadAll(rd)
+		if err != nil {
+			t.Fatalf("%v: %v", hint, err)
+		}
+		if got, want := out, bzip2Data["900KB1"]; !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v bytes, want %v bytes", hint, len(got), len(want))
+		}
+	}
+}
+
+func BenchmarkHeapHint(b *testing.B) {
+	input, err := os.ReadFile("testdata/900KB1.bz2")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, hint := range []int{0, 4} {
+		b.Run(fmt.Sprintf("hint=%v", hint), func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				rd := pbzip2.NewReader(context.Background(), bytes.NewReader(input),
+					pbzip2.DecompressionOptions(
+						pbzip2.BZConcurrency(4),
+						pbzip2.BZHeapHint(hint)))
+				if _, err := io.Copy(io.Discard, rd); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestInFlight(t *testing.T) {
+	compressed, _ := readFile(t, "300KB1")
+	actual := bzip2Data["300KB1"]
+	blocks := scanBlocks(t, compressed)
+	if got, want := len(blocks), 4; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	waitFor := func(dc *pbzip2.Decompressor, n int) {
+		deadline := time.Now().Add(time.Minute)
+		for dc.InFlight() != n {
+			if time.Now().After(deadline) {
+				t.Fatalf("got %v, want %v", dc.InFlight(), n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Nothing is read from the decompressor until all of the blocks have
+	// been appended, hence all of them, including the first, which is
+	// being written out, remain in flight.
+	ctx := context.Background()
+	dc := pbzip2.NewDecompressor(ctx, pbzip2.BZConcurrency(2))
+	if got, want := dc.InFlight(), 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, block := range blocks {
+		if err := dc.Append(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(dc, len(blocks))
+	time.Sleep(10 * time.Millisecond)
+	if got, want := dc.InFlight(), len(blocks); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The first block is no longer in flight once its output has been
+	// read.
+	first, err := decompressBlock(blocks[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(first))
+	if _, err := io.ReadFull(dc, got); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(dc, len(blocks)-1)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- dc.Finish()
+	}()
+	rest, err := io.ReadAll(dc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := append(got, rest...); !bytes.Equal(got, actual) {
+		t.Errorf("got %v bytes, want %v bytes", len(got), len(actual))
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if got, want := dc.InFlight(), 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// The count is also zero after Finish when the decompressor is
+	// canceled with blocks in flight.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dc = pbzip2.NewDecompressor(ctx, pbzip2.BZConcurrency(2))
+	for _, block := range blocks {
+		if err := dc.Append(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(dc, len(blocks))
+	cancel()
+	dc.Cancel(ctx.Err())
+	if err := dc.Finish(); !errors.Is(err, context.Canceled) {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+	if got, want := dc.InFlight(), 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestNonPositiveConcurrency(t *testing.T) {
+	ctx := context.Background()
+	compressed, _ := readFile(t, "900KB1")
+	want := bzip2Data["900KB1"]
+	for _, n := range []int{0, -1} {
+		for _, dispatch := range []pbzip2.DispatchStrategy{pbzip2.DispatchShared, pbzip2.DispatchStriped} {
+			opts := []pbzip2.DecompressorOption{pbzip2.BZConcurrency(n), pbzip2.BZDispatch(dispatch)}
+			// t.Fatal may only be called from the test's goroutine,
+			// hence the decompression runs on it and a watchdog catches
+			// any deadlock.
+			watchdog := time.AfterFunc(time.Minute, func() {
+				panic(fmt.Sprintf("%v: %v: decompression deadlocked", n, dispatch))
+			})
+			dc := pbzip2.NewDecompressor(ctx, opts...)
+			if got := decompressWith(ctx, t, dc, "900KB1"); !bytes.Equal(got, want) {
+				t.Errorf("%v: %v: got %v bytes, want %v bytes", n, dispatch, len(got), len(want))
+			}
+			rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed), pbzip2.DecompressionOptions(opts...))
+			got, err := io.ReadAll(rd)
+			if err != nil || !bytes.Equal(got, want) {
+				t.Errorf("%v: %v: got %v bytes, want %v bytes: %v", n, dispatch, len(got), len(want), err)
+			}
+			watchdog.Stop()
+		}
+	}
+}
+
+func TestDecompressorClose(t *testing.T) {
+	ctx := context.Background()
+	compressed, _ := readFile(t, "900KB1")
+	blocks := scanBlocks(t, compressed)
+	baseline := runtime.NumGoroutine()
+	for _, pipeBuffer := range []int{0, 64 * 1024} {
+		dc := pbzip2.NewDecompressor(ctx, pbzip2.BZConcurrency(4), pbzip2.BZPipeBuffer(pipeBuffer))
+		errCh := make(chan error, 1)
+		go func() {
+			for _, b := range blocks {
+				if err := dc.Append(b); err != nil {
+					break
+				}
+			}
+			errCh <- dc.Finish()
+		}()
+		// Read the output of the first block only.
+		buf := make([]byte, 99981)
+		if _, err := io.ReadFull(dc, buf); err != nil {
+			t.Fatalf("%v: %v", pipeBuffer, err)
+		}
+		if got, want := buf, bzip2Data["900KB1"][:len(buf)]; !bytes.Equal(got, want) {
+			t.Errorf("%v: output differs", pipeBuffer)
+		}
+		if err := dc.Close(); err != nil {
+			t.Fatalf("%v: %v", pipeBuffer, err)
+		}
+		select {
+		case err := <-errCh:
+			if err != nil {
+				t.Errorf("%v: %v", pipeBuffer, err)
+			}
+		case <-time.After(time.Minute):
+			t.Fatalf("%v: Finish failed to return after Close", pipeBuffer)
+		}
+		if _, err := dc.Read(buf); err != io.ErrClosedPipe {
+			t.Errorf("%v: missing or unexpected error: %v", pipeBuffer, err)
+		}
+		if err := dc.Append(blocks[0]); err != io.ErrClosedPipe {
+			t.Errorf("%v: missing or unexpected error: %v", pipeBuffer, err)
+		}
+		if got, want := pbzip2.GetNumDecompressionGoRoutines(), int64(0); got != want {
+			t.Errorf("%v: got %v, want %v", pipeBuffer, got, want)
+		}
+		if got, want := dc.InFlight(), 0; got != want {
+			t.Errorf("%v: got %v, want %v", pipeBuffer, got, want)
+		}
+	}
+	for i := 0; i < 100 && runtime.NumGoroutine() > baseline; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got, want := runtime.NumGoroutine(), baseline; got > want {
+		t.Errorf("goroutines leaked: got %v, want %v", got, want)
+	}
+}
+
+func TestBlockFilter(t *testing.T) {
+	ctx := context.Background()
+	compressed, last := readFile(t, "300KB1")
+	blocks := scanBlocks(t, compressed)
+	if got, want := len(blocks), 4; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	var want []byte
+	for i, block := range blocks {
+		if i == 1 {
+			continue
+		}
+		data, err := decompressBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, data...)
+	}
+	skip := blocks[1].CRC
+	filter := func(cb pbzip2.CompressedBlock) bool {
+		return cb.CRC != skip
+	}
+	for _, concurrency := range []int{1, 4} {
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+			pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency),
+				pbzip2.BZBlockFilter(filter)))
+		got, err := io.ReadAll(rd)
+		if err != nil {
+			t.Fatalf("%v: %v", concurrency, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v bytes, want %v bytes", concurrency, len(got), len(want))
+		}
+
+		// Skipping every block yields no output.
+		rd = pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+			pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency),
+				pbzip2.BZBlockFilter(func(pbzip2.CompressedBlock) bool { return false })))
+		got, err = io.ReadAll(rd)
+		if err != nil || len(got) != 0 {
+			t.Errorf("%v: got %v bytes, %v, want 0 bytes, nil", concurrency, len(got), err)
+		}
+
+		// The stream CRC is still verified.
+		corrupted := append([]byte{}, compressed...)
+		corrupted[last] ^= 0xff
+		rd = pbzip2.NewReader(ctx, bytes.NewReader(corrupted),
+			pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency),
+				pbzip2.BZBlockFilter(filter)))
+		if _, err := io.ReadAll(rd); err == nil || !strings.Contains(err.Error(), "mismatched stream CRCs") {
+			t.Errorf("%v: missing or unexpected error: %v", concurrency, err)
+		}
+	}
+}
+
+func TestBlockSizeExceeded(t *testing.T) {
+	ctx := context.Background()
+	// 300KB5 consists of a single block of 300KB, declaring the stream
+	// to be level 1 results in a block whose decompressed data exceeds
+	// the stream's block size. The block overhead is increased so that
+	// the scanner can still find the block.
+	compressed, _ := readFile(t, "300KB5")
+	compressed = append([]byte{}, compressed...)
+	compressed[3] = '1'
+	for _, concurrency := range []int{1, 4} {
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+			pbzip2.ScannerOptions(pbzip2.ScanBlockOverhead(500*1024)),
+			pbzip2.DecompressionOptions(pbzip2.BZConcurrency(concurrency)))
+		_, err := io.ReadAll(rd)
+		if !errors.Is(err, pbzip2.ErrBlockSizeExceeded) {
+			t.Fatalf("%v: missing or unexpected error: %v", concurrency, err)
+		}
+		if got, want := err.Error(), "block 1: decompressed data exceeds the stream's block size of 100000 bytes (level 1)"; !strings.Contains(got, want) {
+			t.Errorf("%v: got %v, want %v", concurrency, got, want)
+		}
+	}
+}
+
+func TestBlockTimeout(t *testing.T) {
+	ctx := context.Background()
+	// A large run of zeros compresses to a very small block that takes
+	// a relatively long time to decompress.
+	filename := filepath.Join(t.TempDir(), "zeros")
+	zeros := make([]byte, 32*1024*1024)
+	if err := internal.CreateBzipFile(filename, "-9", zeros); err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := os.ReadFile(filename + ".bz2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+		pbzip2.DecompressionOptions(pbzip2.BZBlockTimeout(time.Millisecond)))
+	_, err = io.ReadAll(rd)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("missing or unexpected error: %v", err)
+	}
+	if !strings.Contains(err.Error(), "decompression took longer than 1ms") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	rd = pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+		pbzip2.DecompressionOptions(pbzip2.BZBlockTimeout(time.Minute)))
+	out, err := io.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out, zeros; !bytes.Equal(got, want) {
+		t.Errorf("got %v bytes, want %v bytes", len(got), len(want))
+	}
+}
+
+func TestFinishWithTimeout(t *testing.T) {
+	ctx := context.Background()
+	compressed, _ := readFile(t, "300KB1")
+	want := bzip2Data["300KB1"]
+	blocks := scanBlocks(t, compressed)
+
+	// The filter simulates a block that takes too long to decompress by
+	// blocking the worker that decompresses it until unblock is closed.
+	unblock := make(chan struct{})
+	slow := blocks[1].CRC
+	dc := pbzip2.NewDecompressor(ctx,
+		pbzip2.BZConcurrency(2),
+		pbzip2.BZBlockFilter(func(cb pbzip2.CompressedBlock) bool {
+			if cb.CRC == slow {
+				<-unblock
+			}
+			return true
+		}))
+	for _, block := range blocks {
+		if err := dc.Append(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readErrCh := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, dc)
+		readErrCh <- err
+	}()
+	err := dc.FinishWithTimeout(10 * time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("missing or unexpected error: %v", err)
+	}
+	if got, want := err.Error(), "decompressor failed to finish within 10ms"; !strings.Contains(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Readers are unblocked with the same error.
+	if err := <-readErrCh; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+	// The decompressor cannot be reused.
+	if err := dc.Reset(ctx); err == nil || err.Error() != "Reset called before Finish" {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+	close(unblock)
+
+	// Finishing within the timeout is the same as Finish.
+	dc = pbzip2.NewDecompressor(ctx, pbzip2.BZConcurrency(2))
+	for _, block := range blocks {
+		if err := dc.Append(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- dc.FinishWithTimeout(time.Minute)
+	}()
+	got, err := io.ReadAll(dc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %v bytes, want %v bytes", len(got), len(want))
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.Reset(ctx); err != nil {
+		t.Fatalf("Reset: %v", err)
+	}
+	if err := dc.Finish(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamCRC(t *testing.T) {
+	ctx := context.Background()
+	// Stream CRCs are from the output of TestScan.
+	streams := []struct {
+		name string
+		crc  uint32
+	}{
+		{"hello", 1324148790},
+		{"300KB1", 2560071082},
+		{"900KB9", 37440935},
+		{"300KB5", 1100438121},
+	}
+	names := make([]string, len(streams))
+	for i, s := range streams {
+		names[i] = s.name
+	}
+	compressed, _ := concatFiles(t, names...)
+	dc := pbzip2.NewDecompressor(ctx, pbzip2.BZConcurrency(3))
+	errCh := make(chan error, 1)
+	go func() {
+		sc := pbzip2.NewScanner(bytes.NewReader(compressed))
+		for sc.Scan(ctx) {
+			if err := dc.Append(sc.Block()); err != nil {
+				errCh <- err
+				return
+			}
+		}
+		if err := sc.Err(); err != nil {
+			errCh <- err
+			return
+		}
+		errCh <- dc.Finish()
+	}()
+
+	if got, want := dc.StreamCRC(), uint32(0); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, s := range streams {
+		want := bzip2Data[s.name]
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(dc, got); err != nil {
+			t.Fatalf("%v: %v", s.name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%v: mismatched data", s.name)
+		}
+		if got, want := dc.StreamCRC(), s.crc; got != want {
+			t.Errorf("%v: got %v, want %v", s.name, got, want)
+		}
+	}
+	if _, err := io.ReadAll(dc); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSkipCRC(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name   string
+		offset int // bit offset of a block CRC.
+	}{
+		// Block offsets in bits are from the output of gentestdata.go, the
+		// block CRC immediately follows the block magic.
+		{"hello", 32 + 48},
+		{"300KB1", 806286 + 48},
+	} {
+		compressed, _ := readFile(t, tc.name)
+		corrupted := append([]byte{}, compressed...)
+		crc := make([]byte, 4)
+		bitstream.OverwriteAtBitOffset(corrupted, tc.offset, crc)
+
+		_, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(corrupted)))
+		if err == nil || !strings.Contains(err.Error(), "block checksum mismatch") {
+			t.Errorf("%v: missing or unexpected error: %v", tc.name, err)
+		}
+
+		out, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(corrupted),
+			pbzip2.DecompressionOptions(pbzip2.BZSkipCRC(true))))
+		if err != nil {
+			t.Errorf("%v: %v", tc.name, err)
+		}
+		if got, want := out, bzip2Data[tc.name]; !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v bytes, want %v bytes", tc.name, len(got), len(want))
+		}
+	}
+}
+
+func BenchmarkSkipCRC(b *testing.B) {
+	input, err := os.ReadFile("testdata/900KB9.bz2")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, skip := range []bool{false, true} {
+		b.Run(fmt.Sprintf("skip=%v", skip), func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			for i := 0; i < b.N; i++ {
+				rd := pbzip2.NewReader(context.Background(), bytes.NewReader(input),
+					pbzip2.DecompressionOptions(pbzip2.BZSkipCRC(skip)))
+				if _, err := io.Copy(io.Discard, rd); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestSkipHuffmanShortcut(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range []string{"hello", "300KB1", "900KB9", "1033KB4_Random"} {
+		compressed, _ := readFile(t, name)
+		out, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+			pbzip2.DecompressionOptions(pbzip2.BZSkipHuffmanShortcut(true))))
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+		}
+		if got, want := out, bzip2Data[name]; !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v bytes, want %v bytes", name, len(got), len(want))
+		}
+	}
+}
+
+func TestCRCImpl(t *testing.T) {
+	ctx := context.Background()
+	// Block CRCs are verified as each block is decompressed, hence the
+	// decompression of every fixture will fail if the implementations
+	// differ.
+	for name := range bzip2Files {
+		compressed, _ := readFile(t, name)
+		for _, kind := range []pbzip2.CRCImpl{pbzip2.CRCTable, pbzip2.CRCHash, "unknown"} {
+			got, err := pbzip2.DecompressAll(ctx, bytes.NewReader(compressed),
+				pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(2),
+					pbzip2.BZCRCImpl(kind)))
+			if err != nil {
+				t.Errorf("%v: %v: %v", name, kind, err)
+				continue
+			}
+			if want := bzip2Data[name]; !bytes.Equal(got, want) {
+				t.Errorf("%v: %v: got %v bytes, want %v bytes", name, kind, len(got), len(want))
+			}
+		}
+	}
+}
+
+func TestCollectAll(t *testing.T) {
+	ctx := context.Background()
+	name := "900KB1"
+	compressed, _ := readFile(t, name)
+	blocks := scanBlocks(t, compressed)
+	for _, maxReorder := range []int{0, 2} {
+		metrics := &pbzip2.Metrics{}
+		ch := make(chan pbzip2.BlockBoundary)
+		var (
+			wg    sync.WaitGroup
+			order []uint64
+			out   []byte
+			rerr  error
+		)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for b := range ch {
+				order = append(order, b.Order)
+			}
+		}()
+		dc := pbzip2.NewDecompressor(ctx,
+			pbzip2.BZConcurrency(4),
+			pbzip2.BZCollectAll(true),
+			pbzip2.BZMaxReorderBuffer(maxReorder),
+			pbzip2.BZMetrics(metrics),
+			pbzip2.BZBlockBoundaries(ch))
+		go func() {
+			defer wg.Done()
+			out, rerr = io.ReadAll(dc)
+			close(ch)
+		}()
+		// Append the blocks in reverse order to exercise the heap.
+		for i := len(blocks) - 1; i >= 0; i-- {
+			if err := dc.AppendOrdered(uint64(i+1), blocks[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := dc.Finish(); err != nil {
+			t.Fatal(err)
+		}
+		wg.Wait()
+		if rerr != nil {
+			t.Fatal(rerr)
+		}
+		if got, want := out, bzip2Data[name]; !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v bytes, want %v bytes", maxReorder, len(got), len(want))
+		}
+		// All of the blocks are held in the heap before any are written.
+		if got, want := metrics.MaxHeapDepth(), len(blocks); got != want {
+			t.Errorf("%v: got %v, want %v", maxReorder, got, want)
+		}
+		if got, want := len(order), len(blocks); got != want {
+			t.Fatalf("%v: got %v, want %v", maxReorder, got, want)
+		}
+		for i, o := range order {
+			if got, want := o, uint64(i+1); got != want {
+				t.Errorf("%v: %v: got %v, want %v", maxReorder, i, got, want)
+			}
+		}
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	ctx := context.Background()
+	for _, strategy := range []pbzip2.DispatchStrategy{pbzip2.DispatchShared, pbzip2.DispatchStriped, "unknown"} {
+		for _, concurrency := range []int{1, 3, 4} {
+			for _, name := range []string{"hello", "300KB1", "900KB1", "900KB9"} {
+				metrics := &pbzip2.Metrics{}
+				dc := pbzip2.NewDecompressor(ctx,
+					pbzip2.BZConcurrency(concurrency),
+					pbzip2.BZDispatch(strategy),
+					pbzip2.BZMetrics(metrics))
+				got := decompressWith(ctx, t, dc, name)
+				if want := bzip2Data[name]; !bytes.Equal(got, want) {
+					t.Errorf("%v: %v: %v: got %v bytes, want %v bytes", strategy, concurrency, name, len(got), len(want))
+				}
+				if metrics.Blocks() == 0 {
+					t.Errorf("%v: %v: %v: no blocks were decompressed", strategy, concurrency, name)
+				}
+			}
+		}
+	}
+
+	// Striping must also respect the explicit order of AppendOrdered.
+	compressed, actual := concatFiles(t, "900KB1", "hello", "300KB1")
+	blocks := scanBlocks(t, compressed)
+	dc := pbzip2.NewDecompressor(ctx,
+		pbzip2.BZConcurrency(3),
+		pbzip2.BZDispatch(pbzip2.DispatchStriped))
+	errCh := make(chan error, 1)
+	go func() {
+		for i := len(blocks) - 1; i >= 0; i-- {
+			if err := dc.AppendOrdered(uint64(i+1), blocks[i]); err != nil {
+				errCh <- err
+				return
+			}
+		}
+		errCh <- dc.Finish()
+	}()
+	got, err := io.ReadAll(dc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, actual) {
+		t.Errorf("got %v bytes, want %v bytes", len(got), len(actual))
+	}
+}
+
+func BenchmarkDispatch(b *testing.B) {
+	input, err := os.ReadFile("testdata/900KB1.bz2")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, strategy := range []pbzip2.DispatchStrategy{pbzip2.DispatchShared, pbzip2.DispatchStriped} {
+		b.Run(string(strategy), func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			for i := 0; i < b.N; i++ {
+				rd := pbzip2.NewReader(context.Background(), bytes.NewReader(input),
+					pbzip2.DecompressionOptions(
+						pbzip2.BZConcurrency(4),
+						pbzip2.BZDispatch(strategy)))
+				if _, err := io.Copy(io.Discard, rd); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestAppendOrdered(t *testing.T) {
+	ctx := context.Background()
+	compressed, actual := concatFiles(t, "900KB1", "hello", "300KB1")
+	var blocks []pbzip2.CompressedBlock
+	sc := pbzip2.NewScanner(bytes.NewReader(compressed))
+	for sc.Scan(ctx) {
+		blocks = append(blocks, sc.Block())
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	decompress := func(blocks []pbzip2.CompressedBlock, orders []uint64, producers int) ([]byte, error) {
+		dc := pbzip2.NewDecompressor(ctx, pbzip2.BZConcurrency(4))
+		var wg sync.WaitGroup
+		wg.Add(producers)
+		for p := 0; p < producers; p++ {
+			go func(p int) {
+				defer wg.Done()
+				// Append the blocks in reverse order.
+				for i := len(orders) - 1 - p; i >= 0; i -= producers {
+					if err := dc.AppendOrdered(orders[i], blocks[i]); err != nil {
+						t.Error(err)
+					}
+				}
+			}(p)
+		}
+		var (
+			out  []byte
+			rerr error
+			rwg  sync.WaitGroup
+		)
+		rwg.Add(1)
+		go func() {
+			out, rerr = io.ReadAll(dc)
+			rwg.Done()
+		}()
+		wg.Wait()
+		if err := dc.Finish(); err != nil {
+			return nil, err
+		}
+		rwg.Wait()
+		return out, rerr
+	}
+
+	orders := make([]uint64, len(blocks))
+	for i := range orders {
+		orders[i] = uint64(i + 1)
+	}
+	for _, producers := range []int{1, 3, len(blocks)} {
+		out, err := decompress(blocks, orders, producers)
+		if err != nil {
+			t.Fatalf("%v: %v", producers, err)
+		}
+		if got, want := out, actual; !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v bytes, want %v bytes", producers, len(got), len(want))
+		}
+	}
+
+	// A missing block must lead to an error rather than a hang.
+	_, err := decompress(blocks[1:], orders[1:], 2)
+	if err == nil || !strings.Contains(err.Error(), "expected block 1, next block is 2") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+
+	dc := pbzip2.NewDecompressor(ctx)
+	if err := dc.AppendOrdered(0, blocks[0]); err == nil {
+		t.Errorf("expected an error for a block order of zero")
+	}
+	dc.Finish()
+}
+
+func TestReadUnordered(t *testing.T) {
+	ctx := context.Background()
+	compressed, actual := concatFiles(t, "900KB1", "hello", "empty", "300KB1")
+	decompress := func(compressed []byte) (map[uint64][]byte, error) {
+		dc := pbzip2.NewDecompressor(ctx, pbzip2.BZConcurrency(4), pbzip2.BZUnordered(true))
+		if _, err := dc.Read(make([]byte, 1)); err == nil {
+			t.Errorf("expected an error from Read")
+		}
+		errCh := make(chan error, 1)
+		go func() {
+			sc := pbzip2.NewScanner(bytes.NewReader(compressed))
+			for sc.Scan(ctx) {
+				if err := dc.Append(sc.Block()); err != nil {
+					errCh <- err
+					return
+				}
+			}
+			if err := sc.Err(); err != nil {
+				errCh <- err
+				return
+			}
+			errCh <- dc.Finish()
+		}()
+		blocks := map[uint64][]byte{}
+		for {
+			block, data, err := dc.ReadUnordered()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				dc.Cancel(err)
+				<-errCh
+				return blocks, fmt.Errorf("block %v: %w", block, err)
+			}
+			if _, ok := blocks[block]; ok {
+				t.Errorf("block %v returned more than once", block)
+			}
+			blocks[block] = data
+		}
+		return blocks, <-errCh
+	}
+
+	blocks, err := decompress(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orders := make([]uint64, 0, len(blocks))
+	for order := range blocks {
+		orders = append(orders, order)
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i] < orders[j] })
+	var out []byte
+	for i, order := range orders {
+		if got, want := order, uint64(i+1); got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		out = append(out, blocks[order]...)
+	}
+	if got, want := out, actual; !bytes.Equal(got, want) {
+		t.Errorf("got %v bytes, want %v bytes", len(got), len(want))
+	}
+
+	// Errors identify the block that they pertain to, the offset is that
+	// of the CRC of the second block.
+	corrupted, _ := readFile(t, "300KB1")
+	bitstream.OverwriteAtBitOffset(corrupted, 806286+48, make([]byte, 4))
+	_, err = decompress(corrupted)
+	if err == nil || !strings.Contains(err.Error(), "block 2: ") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+
+	dc := pbzip2.NewDecompressor(ctx)
+	if _, _, err := dc.ReadUnordered(); err == nil {
+		t.Errorf("expected an error without BZUnordered")
+	}
+	dc.Finish()
+}
+
+func TestPipeBuffer(t *testing.T) {
+	ctx := context.Background()
+	compressed, actual := concatFiles(t, "hello", "300KB1", "900KB9")
+	for _, size := range []int{1, 4096, len(actual) + 1} {
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+			pbzip2.DecompressionOptions(pbzip2.BZPipeBuffer(size)))
+		out, err := io.ReadAll(iotest.HalfReader(rd))
+		if err != nil {
+			t.Fatalf("%v: %v", size, err)
+		}
+		if got, want := out, actual; !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v bytes, want %v bytes", size, len(got), len(want))
+		}
+	}
+
+	// Errors must be returned after any data that preceded them.
+	// Corrupt the middle of the final stream.
+	last, _ := readFile(t, "900KB9")
+	corrupted := append([]byte{}, compressed...)
+	corrupted[len(corrupted)-len(last)/2] ^= 0xff
+	rd := pbzip2.NewReader(ctx, bytes.NewReader(corrupted),
+		pbzip2.DecompressionOptions(pbzip2.BZPipeBuffer(len(actual))))
+	out, err := io.ReadAll(rd)
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+	if !bytes.HasPrefix(actual, out) || len(out) < len(bzip2Data["hello"])+len(bzip2Data["300KB1"]) {
+		t.Errorf("got %v bytes, which is not a prefix of the expected output", len(out))
+	}
+}
+
+func TestPipeBufferAhead(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range []string{"hello", "300KB1"} {
+		want := bzip2Data[name]
+		dc := pbzip2.NewDecompressor(ctx, pbzip2.BZPipeBuffer(len(want)))
+		compressed, _ := readFile(t, name)
+		sc := pbzip2.NewScanner(bytes.NewReader(compressed))
+		for sc.Scan(ctx) {
+			if err := dc.Append(sc.Block()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := sc.Err(); err != nil {
+			t.Fatal(err)
+		}
+		// With a large enough buffer, Finish must return before any
+		// of the output has been read.
+		done := make(chan error, 1)
+		go func() {
+			done <- dc.Finish()
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Minute):
+			t.Fatalf("%v: Finish blocked on an unread buffer", name)
+		}
+		got, err := io.ReadAll(dc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v bytes, want %v bytes", name, len(got), len(want))
+		}
+	}
+}
+
+func BenchmarkPipeBuffer(b *testing.B) {
+	input, err := os.ReadFile("testdata/900KB9.bz2")
+	if err != nil {
+		b.Fatal(err)
+	}
+	// A slow consumer that takes a fixed amount of time to process
+	// every read.
+	slowCopy := func(rd io.Reader) error {
+		buf := make([]byte, 64*1024)
+		for {
+			_, err := rd.Read(buf)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	for _, size := range []int{0, 1 << 20, 16 << 20} {
+		b.Run(fmt.Sprintf("buffer=%v", size), func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			for i := 0; i < b.N; i++ {
+				rd := pbzip2.NewReader(context.Background(), bytes.NewReader(input),
+					pbzip2.DecompressionOptions(pbzip2.BZPipeBuffer(size)))
+				if err := slowCopy(rd); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestFailFast(t *testing.T) {
+	ctx := context.Background()
+	compressed, actual := concatFiles(t, "hello", "300KB1", "900KB9")
+	// Corrupt the middle of the final stream.
+	last, _ := readFile(t, "900KB9")
+	corrupted := append([]byte{}, compressed...)
+	corrupted[len(corrupted)-len(last)/2] ^= 0xff
+
+	// With a pipe buffer large enough for all of the output, all of the
+	// blocks preceding the corrupt one are buffered once Finish returns.
+	decompress := func(opts ...pbzip2.DecompressorOption) ([]byte, error) {
+		opts = append(opts,
+			pbzip2.BZConcurrency(4),
+			pbzip2.BZMaxReorderBuffer(100),
+			pbzip2.BZPipeBuffer(len(actual)))
+		dc := pbzip2.NewDecompressor(ctx, opts...)
+		sc := pbzip2.NewScanner(bytes.NewReader(corrupted))
+		for sc.Scan(ctx) {
+			if err := dc.Append(sc.Block()); err != nil {
+				if got, want := err.Error(), "block checksum mismatch"; got != want {
+					t.Errorf("got %v, want %v", got, want)
+				}
+				break
+			}
+		}
+		if err := sc.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if err := dc.Finish(); err != nil {
+			t.Fatal(err)
+		}
+		return io.ReadAll(dc)
+	}
+
+	out, err := decompress()
+	if err == nil || err.Error() != "block checksum mismatch" {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+	if !bytes.HasPrefix(actual, out) || len(out) < len(bzip2Data["hello"])+len(bzip2Data["300KB1"]) {
+		t.Errorf("got %v bytes, which is not a prefix of the expected output", len(out))
+	}
+
+	// The error is reported before any of the buffered output.
+	out, err = decompress(pbzip2.BZFailFast(true))
+	if err == nil || err.Error() != "block checksum mismatch" {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+	if got, want := len(out), 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Well formed input is unaffected.
+	rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+		pbzip2.DecompressionOptions(pbzip2.BZFailFast(true)))
+	out, err = io.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out, actual; !bytes.Equal(got, want) {
+		t.Errorf("got %v bytes, want %v bytes", len(got), len(want))
+	}
+
+	// The error is returned by the reader, however much of the output
+	// was read beforehand.
+	rd = pbzip2.NewReader(ctx, bytes.NewReader(corrupted),
+		pbzip2.DecompressionOptions(
+			pbzip2.BZFailFast(true),
+			pbzip2.BZMaxReorderBuffer(100)))
+	out, err = io.ReadAll(rd)
+	if err == nil || !strings.Contains(err.Error(), "block checksum mismatch") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+	if !bytes.HasPrefix(actual, out) {
+		t.Errorf("got %v bytes, which is not a prefix of the expected output", len(out))
+	}
+}
+
+func TestAdaptiveConcurrency(t *testing.T) {
+	ctx := context.Background()
+	decompress := func(compressed []byte, opts ...pbzip2.DecompressorOption) ([]byte, int) {
+		dc := pbzip2.NewDecompressor(ctx, opts...)
+		sc := pbzip2.NewScanner(bytes.NewReader(compressed))
+		errCh := make(chan error, 1)
+		go func() {
+			for sc.Scan(ctx) {
+				if err := dc.Append(sc.Block()); err != nil {
+					errCh <- err
+					return
+				}
+			}
+			errCh <- sc.Err()
+		}()
+		var out []byte
+		var readErr error
+		done := make(chan struct{})
+		go func() {
+			out, readErr = io.ReadAll(dc)
+			close(done)
+		}()
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+		if err := dc.Finish(); err != nil {
+			t.Fatal(err)
+		}
+		<-done
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		return out, dc.Workers()
+	}
+
+	// Large blocks, which take much longer to decompress than to scan.
+	large, actual := concatFiles(t, "900KB1", "900KB1", "900KB1")
+	out, workers := decompress(large, pbzip2.BZAdaptiveConcurrency(1, 4))
+	if got, want := out, actual; !bytes.Equal(got, want) {
+		t.Errorf("got %v bytes, want %v bytes", len(got), len(want))
+	}
+	if workers <= 1 || workers > 4 {
+		t.Errorf("got %v workers, want 2..4", workers)
+	}
+
+	// Many tiny streams.
+	names := make([]string, 500)
+	for i := range names {
+		names[i] = "hello"
+	}
+	tiny, actual := concatFiles(t, names...)
+	out, workers = decompress(tiny, pbzip2.BZAdaptiveConcurrency(1, 4))
+	if got, want := out, actual; !bytes.Equal(got, want) {
+		t.Errorf("got %v bytes, want %v bytes", len(got), len(want))
+	}
+	if got, want := workers, 1; got != want {
+		t.Errorf("got %v workers, want %v", got, want)
+	}
+
+	// The number of workers is fixed otherwise.
+	_, workers = decompress(large, pbzip2.BZConcurrency(3))
+	if got, want := workers, 3; got != want {
+		t.Errorf("got %v workers, want %v", got, want)
+	}
+
+	// Via NewReader.
+	rd := pbzip2.NewReader(ctx, bytes.NewReader(large),
+		pbzip2.DecompressionOptions(pbzip2.BZAdaptiveConcurrency(2, 4)))
+	out, err := io.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out, bzip2Data["900KB1"]; !bytes.Equal(got[:len(want)], want) || len(got) != 3*len(want) {
+		t.Errorf("got %v bytes, want %v bytes", len(got), 3*len(want))
+	}
+}
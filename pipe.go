@@ -0,0 +1,167 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"io"
+	"sync"
+)
+
+// pipeWriter is the subset of io.PipeWriter used by the decompressor.
+type pipeWriter interface {
+	io.WriteCloser
+	CloseWithError(err error) error
+}
+
+// sliceWriter is a pipeWriter that accumulates all of the data written to
+// it in a single slice, it is used when the entire output is required.
+type sliceWriter struct {
+	mu  sync.Mutex
+	buf []byte
+	err error
+}
+
+// Write implements io.Writer.
+func (sw *sliceWriter) Write(buf []byte) (int, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.err != nil {
+		return 0, io.ErrClosedPipe
+	}
+	sw.buf = append(sw.buf, buf...)
+	return len(buf), nil
+}
+
+// Close implements io.Closer.
+func (sw *sliceWriter) Close() error {
+	return sw.CloseWithError(nil)
+}
+
+// CloseWithError records the first error that it is called with, or
+// io.EOF if that error is nil.
+func (sw *sliceWriter) CloseWithError(err error) error {
+	if err == nil {
+		err = io.EOF
+	}
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.err == nil {
+		sw.err = err
+	}
+	return nil
+}
+
+// result returns the accumulated data and the error, if any, that the
+// writer was closed with.
+func (sw *sliceWriter) result() ([]byte, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.err == io.EOF {
+		return sw.buf, nil
+	}
+	return sw.buf, sw.err
+}
+
+// bufferedPipe is a synchronous in-memory pipe, like io.Pipe, except that
+// writes return as soon as their data has been copied to a buffer of
+// bounded size rather than when it has been read. Data written before the
+// pipe is closed is returned to readers before the error the pipe was
+// closed with.
+type bufferedPipe struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  []byte
+	off  int
+	size int
+	err  error
+}
+
+func newBufferedPipe(size int) *bufferedPipe {
+	p := &bufferedPipe{size: size}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// Write implements io.Writer, it blocks whilst the buffer is full.
+func (p *bufferedPipe) Write(buf []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	written := 0
+	for len(buf) > 0 {
+		for len(p.buf)-p.off >= p.size && p.err == nil {
+			p.cond.Wait()
+		}
+		if p.err != nil {
+			return written, io.ErrClosedPipe
+		}
+		if p.off > 0 {
+			p.buf = p.buf[:copy(p.buf, p.buf[p.off:])]
+			p.off = 0
+		}
+		n := p.size - len(p.buf)
+		if n > len(buf) {
+			n = len(buf)
+		}
+		p.buf = append(p.buf, buf[:n]...)
+		buf = buf[n:]
+		written += n
+		p.cond.Broadcast()
+	}
+	return written, nil
+}
+
+// Read implements io.Reader, it blocks whilst the buffer is empty and
+// the pipe has not been closed.
+func (p *bufferedPipe) Read(buf []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.off == len(p.buf) && p.err == nil {
+		p.cond.Wait()
+	}
+	if p.off == len(p.buf) {
+		return 0, p.err
+	}
+	n := copy(buf, p.buf[p.off:])
+	p.off += n
+	if p.off == len(p.buf) {
+		p.buf, p.off = p.buf[:0], 0
+	}
+	p.cond.Broadcast()
+	return n, nil
+}
+
+// Close closes the pipe, readers will receive io.EOF once they have
+// read any buffered data.
+func (p *bufferedPipe) Close() error {
+	return p.CloseWithError(nil)
+}
+
+// CloseWithError closes the pipe, readers will receive err, or io.EOF if
+// err is nil, once they have read any buffered data. Any subsequent, or
+// blocked, writes will return io.ErrClosedPipe. As for io.PipeWriter,
+// only the first error is retained.
+func (p *bufferedPipe) CloseWithError(err error) error {
+	if err == nil {
+		err = io.EOF
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.cond.Broadcast()
+	return nil
+}
+
+// CloseRead closes the read side of the pipe, discarding any buffered
+// data. Subsequent, or blocked, reads and writes return io.ErrClosedPipe.
+func (p *bufferedPipe) CloseRead() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.buf, p.off = nil, 0
+	p.err = io.ErrClosedPipe
+	p.cond.Broadcast()
+	return nil
+}
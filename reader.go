@@ -5,14 +5,29 @@
 package pbzip2
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cosnicolaou/pbzip2/internal/bzip2"
 )
 
 type readerOpts struct {
-	decOpts  []DecompressorOption
-	scanOpts []ScannerOption
+	decOpts         []DecompressorOption
+	scanOpts        []ScannerOption
+	readAhead       int
+	expansionFactor float64
+
+	// alloc and release, if set, are used to allocate, and recycle, the
+	// buffers that blocks are decompressed into, see CopyN.
+	alloc   func(sizeHint int) []byte
+	release func([]byte)
 }
 
 // ReaderOption represents an option to NewReader.
@@ -35,43 +50,317 @@ func DecompressionOptions(opts ...DecompressorOption) ReaderOption {
 }
 
 type reader struct {
-	ctx   context.Context
-	errCh chan error
-	wg    *sync.WaitGroup
-	dc    *Decompressor
+	ctx    context.Context
+	cancel context.CancelFunc
+	errCh  chan error
+	wg     *sync.WaitGroup
+	dc     *Decompressor
+
+	// start, if non-nil, is called by the first call to Read.
+	start func() error
+	err   error
+	// seq is used for input that is decompressed synchronously.
+	seq *sequential
+	// closer, if non-nil, is closed by Close.
+	closer io.Closer
+	// eof is set once Read has returned io.EOF.
+	eof bool
+	// compat determines the errors returned by Read, see BZErrorCompat.
+	compat ErrorCompat
 }
 
+// errReaderClosed is returned by Read once Close has been called.
+var errReaderClosed = errors.New("read on a closed reader")
+
 // NewReader returns an io.Reader that uses a scanner and decompressor to decompress
-// bzip2 data concurrently.
+// bzip2 data concurrently. Input that consists of a single block, and that
+// fits within the scanner's initial lookahead, or that is to be decompressed
+// with a concurrency of one (see BZConcurrency), is decompressed
+// synchronously by calls to Read without starting any goroutines.
+// The returned reader also implements io.Closer, and Close should be called
+// to stop scanning and decompression if the output is not going to be read
+// in its entirety.
+// It also implements Levels, Sum and Backpressure methods, see
+// Decompressor.Levels, BZHash and Backpressure.
 func NewReader(ctx context.Context, rd io.Reader, opts ...ReaderOption) io.Reader {
+	return newLazyReader(ctx, openReader(rd), opts...)
+}
+
+// NewReaderE is like NewReader except that it returns an error for
+// invalid scanner or decompressor options, such as a non-positive
+// concurrency or a negative block overhead, rather than replacing them
+// by their defaults.
+func NewReaderE(ctx context.Context, rd io.Reader, opts ...ReaderOption) (io.Reader, error) {
+	if err := validateReaderOpts(opts...); err != nil {
+		return nil, err
+	}
+	return NewReader(ctx, rd, opts...), nil
+}
+
+// validateReaderOpts returns an error for the first invalid scanner or
+// decompressor option, if any.
+func validateReaderOpts(opts ...ReaderOption) error {
+	rdOpts := &readerOpts{}
+	for _, fn := range opts {
+		fn(rdOpts)
+	}
+	if _, err := newScanner(nil, rdOpts.scanOpts...); err != nil {
+		return err
+	}
+	_, err := newDecompressor(rdOpts.decOpts...)
+	return err
+}
+
+// NewReaderStdlib has the same signature as compress/bzip2's NewReader
+// so that it can be used as a drop-in replacement for it. It is
+// equivalent to calling NewReader with a background context and the
+// default options.
+//
+// Caveat: unlike compress/bzip2, the returned reader decompresses its
+// input concurrently using goroutines that run until all of the output
+// has been read or an error is encountered. Since the reader cannot be
+// canceled, and no finalizer can be relied on to stop these goroutines,
+// a reader whose output is abandoned before io.EOF or an error is
+// returned will leak them. Either read all of the output, or use NewReader
+// and its Close method or context for such cases.
+func NewReaderStdlib(r io.Reader) io.Reader {
+	return NewReader(context.Background(), r)
+}
+
+// NewLimitedReader is like NewReader except that the returned reader
+// returns at most n bytes of decompressed data, after which it stops
+// scanning and decompressing and returns io.EOF. It is intended for
+// previewing the contents of large files.
+func NewLimitedReader(ctx context.Context, rd io.Reader, n int64, opts ...ReaderOption) io.ReadCloser {
+	return &limitedReader{rd: newLazyReader(ctx, openReader(rd), opts...), n: n}
+}
+
+// NewReaderAtOffset is like NewReader except that it decompresses the
+// length bytes of bzip2 data that start at offset within ra, as is the
+// case for a bzip2 payload embedded within a larger file or container
+// format. The payload is read in place, via an io.SectionReader, rather
+// than having to be copied out first.
+func NewReaderAtOffset(ctx context.Context, ra io.ReaderAt, offset, length int64, opts ...ReaderOption) io.Reader {
+	return NewReader(ctx, io.NewSectionReader(ra, offset, length), opts...)
+}
+
+func openReader(rd io.Reader) func() (io.Reader, error) {
+	return func() (io.Reader, error) {
+		return rd, nil
+	}
+}
+
+func newLazyReader(ctx context.Context, open func() (io.Reader, error), opts ...ReaderOption) *reader {
+	rdOpts := &readerOpts{}
+	for _, fn := range opts {
+		fn(rdOpts)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	drd := &reader{ctx: ctx, cancel: cancel}
+	drd.start = func() error {
+		rd, err := open()
+		if err != nil {
+			return err
+		}
+		dc, _ := newDecompressor(rdOpts.decOpts...)
+		dc.alloc, dc.release = rdOpts.alloc, rdOpts.release
+		drd.compat = dc.errorCompat
+		return drd.scanFirst(ctx, NewScanner(rd, dc.errorCompat.scannerOptions(rdOpts.scanOpts)...), dc)
+	}
+	return drd
+}
+
+// NewReaderFromFunc is like NewReader except that the input is obtained
+// by calling open when Read is first called rather than when the reader
+// is created. This allows for inputs that are expensive to open, or that
+// need to be unwrapped from another container format, to be opened only
+// when needed. Any error returned by open is returned by Read. If the
+// io.Reader returned by open also implements io.Closer it is closed by
+// the returned reader's Close method.
+func NewReaderFromFunc(ctx context.Context, open func() (io.Reader, error), opts ...ReaderOption) io.ReadCloser {
+	var drd *reader
+	drd = newLazyReader(ctx, func() (io.Reader, error) {
+		rd, err := open()
+		if err != nil {
+			return nil, err
+		}
+		drd.closer, _ = rd.(io.Closer)
+		return rd, nil
+	}, opts...)
+	return drd
+}
+
+// DecompressAll decompresses all of rd and returns the decompressed data.
+// It decompresses the blocks concurrently, as they are scanned, and
+// assembles their output directly into a single buffer, that grows with
+// the output, rather than via a pipe. It is intended for inputs whose
+// output is required in its entirety and is small enough to be held in
+// memory. As for NewReader, the output of any blocks that precede an
+// error, such as ErrTruncatedStream, is returned along with that error.
+// No output is returned for any other error encountered whilst scanning.
+func DecompressAll(ctx context.Context, rd io.Reader, opts ...ReaderOption) ([]byte, error) {
 	rdOpts := &readerOpts{}
 	for _, fn := range opts {
 		fn(rdOpts)
 	}
-	sc := NewScanner(rd, rdOpts.scanOpts...)
-	dc := NewDecompressor(ctx, rdOpts.decOpts...)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	dc, _ := newDecompressor(rdOpts.decOpts...)
+	sc := NewScanner(rd, dc.errorCompat.scannerOptions(rdOpts.scanOpts)...)
+	sw := &sliceWriter{}
+	dc.sink = sw
+	dc.start(ctx)
+	var scanErr error
+	err := decompress(dc, func() error {
+		if err := scan(ctx, sc, dc); err != nil {
+			scanErr = sc.Err()
+			return err
+		}
+		return nil
+	})
+	if scanErr != nil && !errors.Is(scanErr, ErrTruncatedStream) {
+		return nil, dc.errorCompat.format(scanErr)
+	}
+	out, werr := sw.result()
+	if werr != nil {
+		return out, dc.errorCompat.format(werr)
+	}
+	return out, dc.errorCompat.format(err)
+}
 
+// NewMultiStreamReader returns an io.Reader that decompresses each of the
+// supplied readers, each of which must contain one or more complete bzip2
+// streams, and returns the concatenation of their decompressed output in
+// the order given. Unlike an io.MultiReader of readers returned by
+// NewReader, a single scanner buffer and set of decompression goroutines
+// are shared by all of the readers. Errors identify the reader, by its
+// index, that they pertain to.
+func NewMultiStreamReader(ctx context.Context, readers []io.Reader, opts ...ReaderOption) io.Reader {
+	rdOpts := &readerOpts{}
+	for _, fn := range opts {
+		fn(rdOpts)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	dc, _ := newDecompressor(rdOpts.decOpts...)
+	var (
+		mu     sync.Mutex
+		starts []uint64 // the order of the first block of each reader.
+	)
+	dc.annotate = func(order uint64, err error) error {
+		mu.Lock()
+		defer mu.Unlock()
+		i := sort.Search(len(starts), func(i int) bool { return starts[i] > order }) - 1
+		return fmt.Errorf("stream reader %v: %w", i, err)
+	}
+	dc.start(ctx)
+	return newReader(ctx, cancel, dc, func() error {
+		var sc *Scanner
+		order := uint64(0)
+		for i, rd := range readers {
+			if sc == nil {
+				sc = NewScanner(rd, dc.errorCompat.scannerOptions(rdOpts.scanOpts)...)
+			} else {
+				sc.Reset(rd)
+			}
+			mu.Lock()
+			starts = append(starts, order+1)
+			mu.Unlock()
+			for sc.Scan(ctx) {
+				if err := dc.Append(sc.Block()); err != nil {
+					return err
+				}
+				order++
+			}
+			if err := sc.Err(); err != nil {
+				return fmt.Errorf("stream reader %v: %w", i, err)
+			}
+		}
+		return nil
+	})
+}
+
+// newReader returns a reader for the output of the supplied decompressor,
+// with the decompressor being fed blocks by the supplied producer function
+// which is run in its own goroutine.
+func newReader(ctx context.Context, cancel context.CancelFunc, dc *Decompressor, producer func() error) *reader {
+	rd := &reader{ctx: ctx, cancel: cancel, compat: dc.errorCompat}
+	rd.run(dc, producer)
+	return rd
+}
+
+// numActiveReaders is the number of readers whose internal goroutine,
+// see run, has yet to exit.
+var numActiveReaders int64
+
+func (rd *reader) run(dc *Decompressor, producer func() error) {
 	errCh := make(chan error, 1)
 	wg := new(sync.WaitGroup)
 	wg.Add(1)
+	atomic.AddInt64(&numActiveReaders, 1)
 	go func() {
-		errCh <- decompress(ctx, sc, dc)
+		errCh <- decompress(dc, producer)
 		close(errCh)
+		atomic.AddInt64(&numActiveReaders, -1)
 		wg.Done()
 	}()
-	return &reader{
-		ctx:   ctx,
-		errCh: errCh,
-		dc:    dc,
-		wg:    wg,
+	rd.errCh, rd.wg, rd.dc = errCh, wg, dc
+}
+
+// scanFirst scans the first block of the input. If that block is the only
+// one, or the concurrency is one, the input is decompressed synchronously,
+// otherwise the decompressor is started and the remainder of the input is
+// scanned concurrently.
+func (rd *reader) scanFirst(ctx context.Context, sc *Scanner, dc *Decompressor) error {
+	if !sc.Scan(ctx) {
+		if err := sc.Err(); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+	first := sc.Block()
+	if !dc.noSequential && (sc.done || dc.concurrency == 1) {
+		rd.seq, rd.dc = newSequential(sc, dc, first), dc
+		return nil
 	}
+	dc.start(ctx)
+	rd.run(dc, func() error {
+		if err := dc.Append(first); err != nil {
+			return err
+		}
+		return scan(ctx, sc, dc)
+	})
+	return nil
+}
+
+// NewAutoReader returns a reader that decompresses rd, as per NewReader, if
+// it starts with the bzip2 file magic number and otherwise returns a reader
+// that returns the contents of rd unchanged. Any bytes read from rd in
+// order to determine if it contains bzip2 data are returned by the reader.
+func NewAutoReader(ctx context.Context, rd io.Reader, opts ...ReaderOption) (io.Reader, error) {
+	magic := make([]byte, len(bzip2.FileMagic))
+	n, err := io.ReadFull(rd, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	rd = io.MultiReader(bytes.NewReader(magic[:n]), rd)
+	if !bytes.Equal(magic[:n], bzip2.FileMagic) {
+		return rd, nil
+	}
+	return NewReader(ctx, rd, opts...), nil
 }
 
 // decompress guarantees that it Finish will have been called on the
 // decompressor. Any non-nil error it returns should be returned by the
-// final call to Read.
-func decompress(ctx context.Context, sc *Scanner, dc *Decompressor) error {
-	if err := scan(ctx, sc, dc); err != nil {
+// final call to Read. For a truncated stream, the blocks that precede
+// the truncated one are decompressed before the error is returned.
+func decompress(dc *Decompressor, producer func() error) error {
+	if err := producer(); err != nil {
+		if errors.Is(err, ErrTruncatedStream) {
+			if ferr := dc.Finish(); ferr != nil {
+				return ferr
+			}
+			return err
+		}
 		dc.Cancel(err)
 		dc.Finish()
 		return err
@@ -106,6 +395,25 @@ func (rd *reader) handleErrorOrCancel() error {
 
 // Read implements io.Reader.
 func (rd *reader) Read(buf []byte) (int, error) {
+	n, err := rd.read(buf)
+	if err == io.EOF {
+		rd.eof = true
+	}
+	return n, rd.compat.format(err)
+}
+
+func (rd *reader) read(buf []byte) (int, error) {
+	if rd.start != nil {
+		start := rd.start
+		rd.start = nil
+		rd.err = start()
+	}
+	if rd.err != nil {
+		return 0, rd.err
+	}
+	if rd.seq != nil {
+		return rd.seq.Read(rd.ctx, buf)
+	}
 	// test for any errors prior to calling Read which may block
 	// if we don't handle context cancelation here and in particular
 	// call Cancel on the decompressor.
@@ -135,3 +443,135 @@ func (rd *reader) Read(buf []byte) (int, error) {
 	}
 	return n, err
 }
+
+// WriteTo implements io.WriterTo.
+func (rd *reader) WriteTo(w io.Writer) (int64, error) {
+	return rd.writeTo(w, make([]byte, copyBufferSize))
+}
+
+// copyBufferSize is the size of the buffer used by WriteTo and CopyN.
+const copyBufferSize = 64 * 1024
+
+// writeTo writes all of the decompressed output to w using buf.
+func (rd *reader) writeTo(w io.Writer, buf []byte) (int64, error) {
+	var written int64
+	for {
+		n, err := rd.Read(buf)
+		if n > 0 {
+			nw, werr := w.Write(buf[:n])
+			written += int64(nw)
+			if werr != nil {
+				return written, werr
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// Levels returns the compression level of each stream that has been
+// decompressed so far, see Decompressor.Levels.
+func (rd *reader) Levels() []BlockSizeLevel {
+	if rd.dc == nil {
+		return nil
+	}
+	return rd.dc.Levels()
+}
+
+// Backpressure returns a summary of the time spent waiting by the scanner
+// and the decompression workers, see Backpressure. It is computed from
+// the decompressor's Metrics and hence will include the activity of other
+// decompressors that share the same Metrics, see BZMetrics. It returns a
+// zero value until Read has been called. Input that is decompressed
+// synchronously, see NewReader, never waits.
+func (rd *reader) Backpressure() Backpressure {
+	if rd.dc == nil {
+		return Backpressure{}
+	}
+	m := rd.dc.metrics
+	bp := Backpressure{
+		Elapsed:    time.Since(rd.dc.started),
+		AppendWait: m.AppendWaitTime(),
+		WorkerIdle: m.IdleTime(),
+	}
+	if rd.seq == nil {
+		bp.Workers = rd.dc.Workers()
+	}
+	return bp
+}
+
+// Sum returns the digest of the hash set via BZHash once all of the
+// output has been read, ie. once Read has returned io.EOF. It returns nil
+// if no hash was set or if the output has not been read in its entirety.
+func (rd *reader) Sum() []byte {
+	if !rd.eof || rd.dc == nil || rd.dc.hash == nil {
+		return nil
+	}
+	return rd.dc.hash.Sum(nil)
+}
+
+// Close implements io.Closer. It stops any scanning and decompression that
+// is still in progress and waits for the goroutines used to do so to
+// finish.
+func (rd *reader) Close() error {
+	rd.start = nil
+	if rd.err == nil {
+		rd.err = errReaderClosed
+	}
+	rd.cancel()
+	if rd.wg != nil {
+		rd.dc.Cancel(errReaderClosed)
+		rd.wg.Wait()
+	}
+	if closer := rd.closer; closer != nil {
+		rd.closer = nil
+		return closer.Close()
+	}
+	return nil
+}
+
+// limitedReader discards the first skip bytes of its underlying reader
+// and then returns at most n bytes.
+type limitedReader struct {
+	rd   *reader
+	skip int64
+	n    int64
+}
+
+// Read implements io.Reader.
+func (lr *limitedReader) Read(buf []byte) (int, error) {
+	if lr.skip > 0 {
+		n, err := io.CopyN(io.Discard, lr.rd, lr.skip)
+		lr.skip -= n
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+	}
+	if lr.n <= 0 {
+		lr.rd.Close()
+		return 0, io.EOF
+	}
+	if int64(len(buf)) > lr.n {
+		buf = buf[:lr.n]
+	}
+	n, err := lr.rd.Read(buf)
+	lr.n -= int64(n)
+	if lr.n <= 0 {
+		// Stop all work as soon as the limit is reached.
+		lr.rd.Close()
+		err = nil
+	}
+	return n, err
+}
+
+// Close implements io.Closer.
+func (lr *limitedReader) Close() error {
+	return lr.rd.Close()
+}
@@ -7,17 +7,24 @@ package pbzip2_test
 import (
 	"bytes"
 	"compress/bzip2"
+	"compress/gzip"
 	"context"
+	"crypto/md5"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
 
 	"github.com/cosnicolaou/pbzip2"
 	"github.com/cosnicolaou/pbzip2/internal"
+	"github.com/cosnicolaou/pbzip2/internal/bitstream"
 	ibzip2 "github.com/cosnicolaou/pbzip2/internal/bzip2"
 )
 
@@ -31,6 +38,16 @@ func ExampleReader() {
 	// hello world
 }
 
+func ExampleNewReaderStdlib() {
+	input, err := os.Open(filepath.Join("testdata", "hello_world.bz2"))
+	if err != nil {
+		panic(err)
+	}
+	io.Copy(os.Stdout, pbzip2.NewReaderStdlib(input))
+	// Output:
+	// hello world
+}
+
 // readAllSample is like os.ReadAll except that it samples the number of
 // goroutines that are currently being used for decompression.
 func readAllSample(r io.Reader) ([]byte, int64, error) {
@@ -58,7 +75,11 @@ func readAllSample(r io.Reader) ([]byte, int64, error) {
 
 func validateGoRoutines(t *testing.T, start, stop, max int64, concurrency int) {
 	_, _, line, _ := runtime.Caller(1)
-	if max <= start {
+	switch {
+	case concurrency == 1 && max != start:
+		// A concurrency of 1 decompresses synchronously.
+		t.Errorf("line %v: concurrency: %v, unexpected goroutines: %v %v", line, concurrency, max, start)
+	case concurrency != 1 && max <= start:
 		t.Errorf("line %v: concurrency: %v, suspicious go routine accounting", line, concurrency)
 	}
 	t.Logf("max goroutines: %v", max)
@@ -73,7 +94,9 @@ func TestIOReader(t *testing.T) {
 
 	testIOReader(t, func(rd io.Reader) ([]byte, error) {
 		n, max, err := readAllSample(rd)
-		maxDecGoroutines = max
+		if max > maxDecGoroutines {
+			maxDecGoroutines = max
+		}
 		return n, err
 	})
 
@@ -94,10 +117,17 @@ func testIOReader(t *testing.T, readAll func(io.Reader) ([]byte, error)) {
 		filename := bzip2Files[name]
 		stdlibData := readBzipFile(t, filename)
 
-		for _, concurrency := range []int{1, 2, runtime.GOMAXPROCS(-1)} {
+		for _, dcOpts := range [][]pbzip2.DecompressorOption{
+			{pbzip2.BZConcurrency(1)},
+			// A single worker for the Decompressor rather than the
+			// sequential path.
+			{pbzip2.BZConcurrency(1), pbzip2.BZNoSequential()},
+			{pbzip2.BZConcurrency(2)},
+			{pbzip2.BZConcurrency(runtime.GOMAXPROCS(-1))},
+		} {
 			rd := openBzipFile(t, filename)
 			drd := pbzip2.NewReader(ctx, rd,
-				pbzip2.DecompressionOptions(pbzip2.BZConcurrency(concurrency), pbzip2.BZConcurrencyPool(pool)))
+				pbzip2.DecompressionOptions(append(dcOpts, pbzip2.BZConcurrencyPool(pool))...))
 			data, err := readAll(drd)
 			if err != nil {
 				t.Errorf("%v: readAll failed: %v", name, err)
@@ -159,9 +189,24 @@ func TestCancelation(t *testing.T) {
 
 	ngs := pbzip2.GetNumDecompressionGoRoutines()
 
-	// Test with different levels of concurrency.
-	for _, concurrency := range []int{1, 2, runtime.GOMAXPROCS(-1)} {
-		dcOpts := pbzip2.DecompressionOptions(pbzip2.BZConcurrency(concurrency))
+	// Test with different levels of concurrency, including a single
+	// worker for the Decompressor rather than the sequential path.
+	for _, tc := range []struct {
+		concurrency  int
+		noSequential bool
+	}{
+		{1, false},
+		{1, true},
+		{2, false},
+		{runtime.GOMAXPROCS(-1), false},
+	} {
+		dcOpts := pbzip2.DecompressionOptions(pbzip2.BZConcurrency(tc.concurrency))
+		expected := tc.concurrency
+		if tc.noSequential {
+			dcOpts = pbzip2.DecompressionOptions(pbzip2.BZConcurrency(tc.concurrency), pbzip2.BZNoSequential())
+			// Goroutines are used for decompression.
+			expected = -1
+		}
 
 		for i := range []int{1, 77, 100} {
 			rd := openBzipFile(t, filename)
@@ -174,7 +219,7 @@ func TestCancelation(t *testing.T) {
 				ngs,
 				pbzip2.GetNumDecompressionGoRoutines(),
 				max,
-				concurrency)
+				expected)
 
 			if err == nil || err.Error() != "context canceled" {
 				t.Errorf("expected an error or different error to the one received: %v", err)
@@ -228,7 +273,7 @@ func TestReaderErrors(t *testing.T) {
 	rd := bytes.NewBuffer(nil)
 	drd := pbzip2.NewReader(ctx, rd)
 	_, err := io.ReadAll(drd)
-	if err == nil || err.Error() != "failed to read stream header: EOF" {
+	if err == nil || err.Error() != "stream header is too small: 0" {
 		t.Errorf("expected an error or different error to the one received: %v", err)
 	}
 
@@ -271,11 +316,19 @@ func TestReaderErrors(t *testing.T) {
 	buf[3] = 0x1
 	testError(buf, "bad block size")
 
+	buf, _ = readFile(t, "hello")
+	buf[3] = '0'
+	testError(buf, "bad block size")
+
+	buf, _ = readFile(t, "hello")
+	buf[2] = '0'
+	testError(buf, "bzip2 data invalid: bzip1 format is not supported")
+
 	buf, _ = readFile(t, "300KB1")
 	corrupted := buf[:9000]
 	corrupted = append(corrupted, ibzip2.BlockMagic[:]...)
 	corrupted = append(corrupted, buf[9000:]...)
-	testError(corrupted, "bzip2 data invalid: data exceeds block size")
+	testError(corrupted, "decompressed data exceeds the stream's block size")
 }
 
 type errorReader struct{}
@@ -283,3 +336,784 @@ type errorReader struct{}
 func (er *errorReader) Read(buf []byte) (int, error) {
 	return 1, fmt.Errorf("oops")
 }
+
+func TestAutoReader(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range []string{"hello", "300KB1"} {
+		compressed, _ := readFile(t, name)
+		// Use iotest.OneByteReader to ensure that short reads are handled.
+		for _, rd := range []io.Reader{
+			bytes.NewBuffer(compressed),
+			iotest.OneByteReader(bytes.NewBuffer(compressed)),
+		} {
+			ard, err := pbzip2.NewAutoReader(ctx, rd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf, err := io.ReadAll(ard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := buf, bzip2Data[name]; !bytes.Equal(got, want) {
+				t.Errorf("%v: got %v, want %v", name, internal.FirstN(10, got), internal.FirstN(10, want))
+			}
+		}
+	}
+
+	for _, plain := range []string{"", "B", "BA", "hello world\n", "AZh9 is not bzip2"} {
+		for _, rd := range []io.Reader{
+			bytes.NewBufferString(plain),
+			iotest.OneByteReader(bytes.NewBufferString(plain)),
+		} {
+			ard, err := pbzip2.NewAutoReader(ctx, rd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf, err := io.ReadAll(ard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := string(buf), plain; got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		}
+	}
+
+	if _, err := pbzip2.NewAutoReader(ctx, &errorReader{}); err == nil || err.Error() != "oops" {
+		t.Errorf("expected an error or different error to the one received: %v", err)
+	}
+}
+
+func TestTruncatedStream(t *testing.T) {
+	ctx := context.Background()
+	compressed, _ := readFile(t, "300KB1")
+	godata := bzip2Data["300KB1"]
+
+	// Determine the size of each decompressed block.
+	var sizes []int
+	sc := pbzip2.NewScanner(bytes.NewReader(compressed))
+	for sc.Scan(ctx) {
+		buf, err := decompressBlock(sc.Block())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, len(buf))
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	// Block offsets in bits are from the output of gentestdata.go, a block
+	// is intact if the block magic that follows it is intact.
+	magicOffsets := []int{806286, 1612607, 2418837}
+
+	for _, offset := range []int{2, 10, 1000, 100790, 100800, 200000, 300000, 305000, len(compressed) - 5, len(compressed) - 1} {
+		truncated := compressed[:offset]
+		intact := 0
+		for i, mo := range magicOffsets {
+			if mo+48 <= offset*8 {
+				intact += sizes[i]
+			}
+		}
+		out, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(truncated)))
+		if offset > 4 && !errors.Is(err, pbzip2.ErrTruncatedStream) {
+			t.Errorf("%v: missing or unexpected error: %v", offset, err)
+		}
+		if offset <= 4 && err == nil {
+			t.Errorf("%v: expected an error", offset)
+		}
+		if got, want := out, godata[:intact]; !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v bytes, want %v bytes", offset, len(got), len(want))
+		}
+		stdout, _ := io.ReadAll(bzip2.NewReader(bytes.NewReader(truncated)))
+		if !bytes.HasPrefix(stdout, out) {
+			t.Errorf("%v: output is not a prefix of the stdlib output", offset)
+		}
+	}
+
+	// Trailing garbage is not the same as truncation.
+	garbage := append(append([]byte{}, compressed...), 0x00, 0x01, 0x02)
+	_, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(garbage)))
+	if err == nil || errors.Is(err, pbzip2.ErrTruncatedStream) {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+}
+
+func TestSingleBlockInline(t *testing.T) {
+	ctx := context.Background()
+	ngs := pbzip2.GetNumDecompressionGoRoutines()
+	for _, name := range []string{"empty", "hello"} {
+		compressed, _ := readFile(t, name)
+		out, max, err := readAllSample(pbzip2.NewReader(ctx, bytes.NewReader(compressed)))
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if got, want := out, bzip2Data[name]; !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v bytes, want %v bytes", name, len(got), len(want))
+		}
+		if got, want := max, ngs; got != want {
+			t.Errorf("%v: got %v decompression goroutines, want %v", name, got, want)
+		}
+	}
+
+	// Errors must still be reported for a single block.
+	compressed, l := readFile(t, "hello")
+	compressed[l] = 0x1
+	_, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(compressed)))
+	if err == nil || !strings.Contains(err.Error(), "mismatched stream CRCs") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+	_, err = io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+		pbzip2.DecompressionOptions(pbzip2.BZSkipCRC(true))))
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLimitedReader(t *testing.T) {
+	ctx := context.Background()
+	ngs := pbzip2.GetNumDecompressionGoRoutines()
+	data := bzip2Data["900KB1"]
+	for _, n := range []int64{0, 1, 100, int64(len(data)), int64(len(data)) + 10} {
+		rd := openBzipFile(t, bzip2Files["900KB1"])
+		lrd := pbzip2.NewLimitedReader(ctx, rd, n,
+			pbzip2.DecompressionOptions(pbzip2.BZConcurrency(4)))
+		out, err := io.ReadAll(lrd)
+		if err != nil {
+			t.Fatalf("%v: %v", n, err)
+		}
+		want := data
+		if n < int64(len(want)) {
+			want = want[:n]
+		}
+		if got := out; !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v bytes, want %v bytes", n, len(got), len(want))
+		}
+		if err := lrd.Close(); err != nil {
+			t.Errorf("%v: %v", n, err)
+		}
+		if got, want := pbzip2.GetNumDecompressionGoRoutines(), ngs; got != want {
+			t.Errorf("%v: goroutine leak: got %v, want %v", n, got, want)
+		}
+		rd.Close()
+	}
+
+	// Close may be called before the output is read in its entirety.
+	rd := openBzipFile(t, bzip2Files["900KB1"])
+	defer rd.Close()
+	drd := pbzip2.NewReader(ctx, rd)
+	if _, err := io.ReadFull(drd, make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := drd.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := pbzip2.GetNumDecompressionGoRoutines(), ngs; got != want {
+		t.Errorf("goroutine leak: got %v, want %v", got, want)
+	}
+	if _, err := drd.Read(make([]byte, 1)); err == nil {
+		t.Errorf("expected an error from Read after Close")
+	}
+}
+
+func TestReaderAtOffset(t *testing.T) {
+	ctx := context.Background()
+	garbage := internal.GenPredictableRandomData(4096)
+	for _, names := range [][]string{
+		{"hello"},
+		{"300KB1", "empty", "hello"},
+	} {
+		compressed, actual := concatFiles(t, names...)
+		var container []byte
+		container = append(container, garbage[:1000]...)
+		container = append(container, compressed...)
+		container = append(container, garbage...)
+		rd := pbzip2.NewReaderAtOffset(ctx, bytes.NewReader(container), 1000, int64(len(compressed)),
+			pbzip2.DecompressionOptions(pbzip2.BZConcurrency(4)))
+		out, err := io.ReadAll(rd)
+		if err != nil {
+			t.Fatalf("%v: %v", names, err)
+		}
+		if got, want := out, actual; !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v bytes, want %v bytes", names, len(got), len(want))
+		}
+	}
+
+	// The payload is bounded by length.
+	compressed, _ := readFile(t, "hello")
+	container := append(append([]byte{}, garbage[:10]...), compressed...)
+	container = append(container, garbage...)
+	rd := pbzip2.NewReaderAtOffset(ctx, bytes.NewReader(container), 10, int64(len(compressed))-1)
+	if _, err := io.ReadAll(rd); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+// closeRecorder records whether it has been closed.
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (cr *closeRecorder) Close() error {
+	cr.closed = true
+	return nil
+}
+
+func TestReaderTeardown(t *testing.T) {
+	ctx := context.Background()
+	compressed, _ := readFile(t, "900KB1")
+	ngs := pbzip2.GetNumDecompressionGoRoutines()
+	if got, want := pbzip2.DebugActiveReaders(), 0; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	// Mimic a consumer, such as a tar extractor, that reads none, some
+	// or all of the output of many readers before closing them.
+	for i := 0; i < 10; i++ {
+		for _, n := range []int64{0, 1, 64 * 1024, -1} {
+			rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+				pbzip2.DecompressionOptions(pbzip2.BZConcurrency(4)))
+			var err error
+			switch n {
+			case -1:
+				_, err = io.Copy(io.Discard, rd)
+			case 0:
+			default:
+				_, err = io.CopyN(io.Discard, rd, n)
+				if got, want := pbzip2.DebugActiveReaders(), 1; got != want {
+					t.Errorf("%v: %v: got %v, want %v", i, n, got, want)
+				}
+			}
+			if err != nil {
+				t.Fatalf("%v: %v: %v", i, n, err)
+			}
+			if err := rd.(io.Closer).Close(); err != nil {
+				t.Fatalf("%v: %v: %v", i, n, err)
+			}
+			if got, want := pbzip2.DebugActiveReaders(), 0; got != want {
+				t.Fatalf("%v: %v: got %v, want %v", i, n, got, want)
+			}
+		}
+	}
+	if got, want := pbzip2.GetNumDecompressionGoRoutines(), ngs; got != want {
+		t.Errorf("goroutine leak: %v %v", got, want)
+	}
+}
+
+func TestReaderFromFunc(t *testing.T) {
+	ctx := context.Background()
+	compressed, _ := readFile(t, "300KB1")
+	opened := 0
+	input := &closeRecorder{Reader: bytes.NewReader(compressed)}
+	rd := pbzip2.NewReaderFromFunc(ctx, func() (io.Reader, error) {
+		opened++
+		return input, nil
+	})
+	if got, want := opened, 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	out, err := io.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out, bzip2Data["300KB1"]; !bytes.Equal(got, want) {
+		t.Errorf("got %v bytes, want %v bytes", len(got), len(want))
+	}
+	if got, want := opened, 1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := rd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !input.closed {
+		t.Errorf("input was not closed")
+	}
+
+	openErr := errors.New("open failed")
+	rd = pbzip2.NewReaderFromFunc(ctx, func() (io.Reader, error) {
+		return nil, openErr
+	})
+	for i := 0; i < 2; i++ {
+		if _, err := rd.Read(make([]byte, 1)); !errors.Is(err, openErr) {
+			t.Errorf("%v: missing or unexpected error: %v", i, err)
+		}
+	}
+	if err := rd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The input is never opened if Close is called before Read.
+	opened = 0
+	rd = pbzip2.NewReaderFromFunc(ctx, func() (io.Reader, error) {
+		opened++
+		return input, nil
+	})
+	rd.Close()
+	if _, err := rd.Read(make([]byte, 1)); err == nil {
+		t.Errorf("expected an error from Read after Close")
+	}
+	if got, want := opened, 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func ExampleNewReaderFromFunc() {
+	// Create a gzip compressed copy of a bzip2 file.
+	compressed, err := os.ReadFile(filepath.Join("testdata", "hello_world.bz2"))
+	if err != nil {
+		panic(err)
+	}
+	wrapped := &bytes.Buffer{}
+	gzw := gzip.NewWriter(wrapped)
+	gzw.Write(compressed)
+	gzw.Close()
+
+	rd := pbzip2.NewReaderFromFunc(context.Background(), func() (io.Reader, error) {
+		return gzip.NewReader(wrapped)
+	})
+	defer rd.Close()
+	io.Copy(os.Stdout, rd)
+	// Output:
+	// hello world
+}
+
+func TestAdditionalWriter(t *testing.T) {
+	ctx := context.Background()
+	for _, names := range [][]string{
+		{"empty"},
+		{"hello"},
+		{"300KB1", "hello", "900KB9"},
+	} {
+		compressed, actual := concatFiles(t, names...)
+		var mirror bytes.Buffer
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+			pbzip2.DecompressionOptions(pbzip2.BZAdditionalWriter(&mirror)))
+		var out bytes.Buffer
+		if _, err := io.Copy(&out, rd); err != nil {
+			t.Fatalf("%v: %v", names, err)
+		}
+		if got, want := out.Bytes(), actual; !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v bytes, want %v bytes", names, len(got), len(want))
+		}
+		if got, want := mirror.Bytes(), out.Bytes(); !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v bytes, want %v bytes", names, len(got), len(want))
+		}
+	}
+
+	// Errors from the additional writer are returned by Read.
+	compressed, _ := concatFiles(t, "300KB1", "hello")
+	rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+		pbzip2.DecompressionOptions(pbzip2.BZAdditionalWriter(&errorWriter{})))
+	_, err := io.ReadAll(rd)
+	if err == nil || !strings.Contains(err.Error(), "additional writer: oops") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+}
+
+type errorWriter struct{}
+
+func (ew *errorWriter) Write(buf []byte) (int, error) {
+	return 0, fmt.Errorf("oops")
+}
+
+func TestTeeCompressed(t *testing.T) {
+	ctx := context.Background()
+	for _, names := range [][]string{
+		{"empty"},
+		{"hello"},
+		{"900KB1"},
+		{"300KB1", "empty", "hello", "900KB9", "empty"},
+	} {
+		compressed, actual := concatFiles(t, names...)
+		for _, concurrency := range []int{1, 4} {
+			var tee bytes.Buffer
+			rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+				pbzip2.DecompressionOptions(pbzip2.BZConcurrency(concurrency)),
+				pbzip2.ScannerOptions(pbzip2.ScanTeeCompressed(&tee)))
+			out, err := io.ReadAll(rd)
+			if err != nil {
+				t.Fatalf("%v: %v: %v", names, concurrency, err)
+			}
+			if got, want := out, actual; !bytes.Equal(got, want) {
+				t.Errorf("%v: %v: got %v bytes, want %v bytes", names, concurrency, len(got), len(want))
+			}
+			if got, want := tee.Bytes(), compressed; !bytes.Equal(got, want) {
+				t.Errorf("%v: %v: got %v bytes, want %v bytes", names, concurrency, len(got), len(want))
+			}
+			out, err = io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(tee.Bytes())))
+			if err != nil {
+				t.Fatalf("%v: %v: %v", names, concurrency, err)
+			}
+			if got, want := out, actual; !bytes.Equal(got, want) {
+				t.Errorf("%v: %v: got %v bytes, want %v bytes", names, concurrency, len(got), len(want))
+			}
+		}
+	}
+
+	// Trailing garbage is not written.
+	compressed, _ := concatFiles(t, "hello")
+	var tee bytes.Buffer
+	rd := pbzip2.NewReader(ctx, bytes.NewReader(append(append([]byte{}, compressed...), "garbage"...)),
+		pbzip2.ScannerOptions(
+			pbzip2.ScanIgnoreTrailingGarbage(true),
+			pbzip2.ScanTeeCompressed(&tee)))
+	if _, err := io.ReadAll(rd); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tee.Bytes(), compressed; !bytes.Equal(got, want) {
+		t.Errorf("got %v bytes, want %v bytes", len(got), len(want))
+	}
+
+	// Errors from the writer are returned by Read.
+	compressed, _ = concatFiles(t, "300KB1", "hello")
+	rd = pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+		pbzip2.ScannerOptions(pbzip2.ScanTeeCompressed(&errorWriter{})))
+	_, err := io.ReadAll(rd)
+	if err == nil || !strings.Contains(err.Error(), "failed to write compressed data: oops") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+}
+
+func TestHash(t *testing.T) {
+	ctx := context.Background()
+	compressed, _ := readFile(t, "800KB1")
+	for _, concurrency := range []int{1, 4} {
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+			pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency),
+				pbzip2.BZHash(md5.New())))
+		summer := rd.(interface{ Sum() []byte })
+		if got := summer.Sum(); got != nil {
+			t.Errorf("%v: unexpected digest before EOF: %x", concurrency, got)
+		}
+		out, err := io.ReadAll(rd)
+		if err != nil {
+			t.Fatalf("%v: %v", concurrency, err)
+		}
+		if got, want := out, bzip2Data["800KB1"]; !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v bytes, want %v bytes", concurrency, len(got), len(want))
+		}
+		want := md5.Sum(out)
+		if got := summer.Sum(); !bytes.Equal(got, want[:]) {
+			t.Errorf("%v: got %x, want %x", concurrency, got, want)
+		}
+	}
+
+	rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed))
+	if _, err := io.ReadAll(rd); err != nil {
+		t.Fatal(err)
+	}
+	if got := rd.(interface{ Sum() []byte }).Sum(); got != nil {
+		t.Errorf("unexpected digest without a hash: %x", got)
+	}
+}
+
+// decompressAndReport decompresses the supplied data and returns its
+// output, error, diagnostics and progress reports, less their durations.
+func decompressAndReport(ctx context.Context, compressed []byte, opts ...pbzip2.ReaderOption) ([]byte, error, []pbzip2.Diagnostic, []pbzip2.Progress) {
+	diagCh := make(chan pbzip2.Diagnostic, 10)
+	progressCh := make(chan pbzip2.Progress, 10)
+	var (
+		wg       sync.WaitGroup
+		diags    []pbzip2.Diagnostic
+		progress []pbzip2.Progress
+	)
+	wg.Add(2)
+	go func() {
+		for d := range diagCh {
+			diags = append(diags, d)
+		}
+		wg.Done()
+	}()
+	go func() {
+		for p := range progressCh {
+			p.Duration, p.Throughput = 0, 0
+			progress = append(progress, p)
+		}
+		wg.Done()
+	}()
+	opts = append(opts, pbzip2.DecompressionOptions(
+		pbzip2.BZDiagnostics(diagCh), pbzip2.BZSendUpdates(progressCh), pbzip2.BZProgressBlocking(true)))
+	out, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...))
+	close(diagCh)
+	close(progressCh)
+	wg.Wait()
+	return out, err, diags, progress
+}
+
+func TestSequentialParity(t *testing.T) {
+	ctx := context.Background()
+	compressed, actual := concatFiles(t, "hello", "empty", "empty", "300KB1", "900KB9", "empty")
+
+	// Both magic numbers occur naturally in the data and hence will
+	// lead to false positives that require blocks to be merged.
+	magic := [6]byte{0x91, 0xff, 0x6b, 0x72, 0xb1, 0xa4}
+	falsePositives, _ := readFile(t, "300KB1")
+	for _, offset := range []int{32, 806286, 1612607, 2418837} {
+		bitstream.OverwriteAtBitOffset(falsePositives, offset, magic[:])
+	}
+	magicOpts := []pbzip2.ReaderOption{
+		pbzip2.ScannerOptions(pbzip2.ScanBlockMagic(magic)),
+		pbzip2.DecompressionOptions(pbzip2.BZBlockMagic(magic)),
+	}
+
+	corrupted := append([]byte{}, compressed...)
+	corrupted[len(corrupted)-20] ^= 0xff
+
+	truncated := compressed[:len(compressed)-1000]
+
+	for i, tc := range []struct {
+		compressed []byte
+		opts       []pbzip2.ReaderOption
+	}{
+		{compressed, nil},
+		{falsePositives, magicOpts},
+		{corrupted, nil},
+		{truncated, nil},
+	} {
+		out1, err1, diags1, progress1 := decompressAndReport(ctx, tc.compressed,
+			append(tc.opts, pbzip2.DecompressionOptions(pbzip2.BZConcurrency(1)))...)
+		out4, err4, diags4, progress4 := decompressAndReport(ctx, tc.compressed,
+			append(tc.opts, pbzip2.DecompressionOptions(pbzip2.BZConcurrency(4)))...)
+		if i == 0 && !bytes.Equal(out1, actual) {
+			t.Errorf("%v: got %v bytes, want %v bytes", i, len(out1), len(actual))
+		}
+		if !bytes.Equal(out1, out4) {
+			t.Errorf("%v: got %v bytes, want %v bytes", i, len(out1), len(out4))
+		}
+		if fmt.Sprint(err1) != fmt.Sprint(err4) {
+			t.Errorf("%v: got %v, want %v", i, err1, err4)
+		}
+		if !reflect.DeepEqual(diags1, diags4) {
+			t.Errorf("%v: got %v, want %v", i, diags1, diags4)
+		}
+		if !reflect.DeepEqual(progress1, progress4) {
+			t.Errorf("%v: got %v, want %v", i, progress1, progress4)
+		}
+	}
+}
+
+func BenchmarkSmallStreams(b *testing.B) {
+	hello, err := os.ReadFile("testdata/hello.bz2")
+	if err != nil {
+		b.Fatal(err)
+	}
+	var input []byte
+	for i := 0; i < 100; i++ {
+		input = append(input, hello...)
+	}
+	for _, concurrency := range []int{1, 2} {
+		b.Run(fmt.Sprintf("concurrency=%v", concurrency), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(input)))
+			for i := 0; i < b.N; i++ {
+				rd := pbzip2.NewReader(context.Background(), bytes.NewReader(input),
+					pbzip2.DecompressionOptions(pbzip2.BZConcurrency(concurrency)))
+				if _, err := io.Copy(io.Discard, rd); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestDecompressAll(t *testing.T) {
+	ctx := context.Background()
+	for name, filename := range bzip2Files {
+		want, err := stdlibBzip2(filename + ".bz2")
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		compressed, _ := readFile(t, name)
+		for _, concurrency := range []int{1, 4} {
+			got, err := pbzip2.DecompressAll(ctx, bytes.NewReader(compressed),
+				pbzip2.DecompressionOptions(pbzip2.BZConcurrency(concurrency)))
+			if err != nil {
+				t.Fatalf("%v: %v: %v", name, concurrency, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%v: %v: got %v bytes, want %v bytes", name, concurrency, len(got), len(want))
+			}
+		}
+	}
+
+	compressed, actual := concatFiles(t, "hello", "empty", "300KB1", "900KB9")
+	got, err := pbzip2.DecompressAll(ctx, bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := actual; !bytes.Equal(got, want) {
+		t.Errorf("got %v bytes, want %v bytes", len(got), len(want))
+	}
+
+	// The output of the intact blocks is returned with a truncation error.
+	got, err = pbzip2.DecompressAll(ctx, bytes.NewReader(compressed[:len(compressed)-1000]))
+	if !errors.Is(err, pbzip2.ErrTruncatedStream) {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+	if len(got) == 0 || !bytes.HasPrefix(actual, got) {
+		t.Errorf("got %v bytes, which is not a prefix of the expected output", len(got))
+	}
+
+	corrupted := append([]byte{}, compressed...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	if _, err := pbzip2.DecompressAll(ctx, bytes.NewReader(corrupted)); err == nil {
+		t.Errorf("expected an error")
+	}
+	if _, err := pbzip2.DecompressAll(ctx, bytes.NewReader(nil)); err == nil {
+		t.Errorf("expected an error")
+	}
+
+	// Many tiny level 9 streams must not lead to the output buffer being
+	// sized from their 900KB block sizes.
+	tiny := internal.SingleByteStream(9, 'a', [3]uint8{1, 2, 2}, "0", "11")
+	many := bytes.Repeat(tiny, 1000)
+	got, err = pbzip2.DecompressAll(ctx, bytes.NewReader(many))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := bytes.Repeat([]byte{'a'}, 1000); !bytes.Equal(got, want) {
+		t.Errorf("got %v bytes, want %v bytes", len(got), len(want))
+	}
+	if got, limit := cap(got), 1024*1024; got > limit {
+		t.Errorf("output buffer too large: %v > %v", got, limit)
+	}
+}
+
+// cancelWriter cancels a context when the specified write is made to it
+// and records the maximum number of decompression goroutines seen.
+type cancelWriter struct {
+	cancel func()
+	when   int
+	writes int
+	max    int64
+}
+
+func (cw *cancelWriter) Write(buf []byte) (int, error) {
+	cw.writes++
+	if n := pbzip2.GetNumDecompressionGoRoutines(); n > cw.max {
+		cw.max = n
+	}
+	if cw.writes == cw.when {
+		cw.cancel()
+	}
+	return len(buf), nil
+}
+
+func TestDecompressAllCancelation(t *testing.T) {
+	compressed, _ := readFile(t, "1033KB4_Random")
+	ngs := pbzip2.GetNumDecompressionGoRoutines()
+	for _, concurrency := range []int{1, 2, runtime.GOMAXPROCS(-1)} {
+		// The input consists of three blocks, cancel before any
+		// decompression and as the output of each block is assembled.
+		for _, when := range []int{0, 1, 2, 3} {
+			ctx, cancel := context.WithCancel(context.Background())
+			if when == 0 {
+				cancel()
+			}
+			cw := &cancelWriter{cancel: cancel, when: when}
+			out, err := pbzip2.DecompressAll(ctx, bytes.NewReader(compressed),
+				pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(concurrency),
+					pbzip2.BZAdditionalWriter(cw)))
+			cancel()
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("%v: %v: missing or unexpected error: %v", concurrency, when, err)
+			}
+			if when > 0 && cw.max <= ngs {
+				t.Errorf("%v: %v: suspicious go routine accounting", concurrency, when)
+			}
+			if got, want := pbzip2.GetNumDecompressionGoRoutines(), ngs; got != want {
+				t.Errorf("%v: %v: goroutine leak: %v %v", concurrency, when, got, want)
+			}
+			if !bytes.HasPrefix(bzip2Data["1033KB4_Random"], out) {
+				t.Errorf("%v: %v: got %v bytes, which is not a prefix of the expected output", concurrency, when, len(out))
+			}
+		}
+	}
+}
+
+func BenchmarkDecompressAll(b *testing.B) {
+	var input []byte
+	for _, name := range []string{"900KB1", "900KB9", "800KB1"} {
+		buf, err := os.ReadFile(filepath.Join("testdata", name+".bz2"))
+		if err != nil {
+			b.Fatal(err)
+		}
+		input = append(input, buf...)
+	}
+	ctx := context.Background()
+	b.Run("DecompressAll", func(b *testing.B) {
+		b.SetBytes(int64(len(input)))
+		for i := 0; i < b.N; i++ {
+			if _, err := pbzip2.DecompressAll(ctx, bytes.NewReader(input)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("ReadAll", func(b *testing.B) {
+		b.SetBytes(int64(len(input)))
+		for i := 0; i < b.N; i++ {
+			if _, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(input))); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestSelfTest(t *testing.T) {
+	if err := pbzip2.SelfTest(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOptionValidation(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		opts []pbzip2.ReaderOption
+		err  string
+	}{
+		{[]pbzip2.ReaderOption{pbzip2.DecompressionOptions(pbzip2.BZConcurrency(0))}, "invalid concurrency: 0"},
+		{[]pbzip2.ReaderOption{pbzip2.DecompressionOptions(pbzip2.BZConcurrency(-1))}, "invalid concurrency: -1"},
+		{[]pbzip2.ReaderOption{pbzip2.DecompressionOptions(pbzip2.BZAdaptiveConcurrency(0, 4))}, "invalid adaptive concurrency: min 0, max 4"},
+		{[]pbzip2.ReaderOption{pbzip2.DecompressionOptions(pbzip2.BZAdaptiveConcurrency(4, 2))}, "invalid adaptive concurrency: min 4, max 2"},
+		{[]pbzip2.ReaderOption{pbzip2.DecompressionOptions(pbzip2.BZMaxReorderBuffer(-1))}, "invalid max reorder buffer: -1"},
+		{[]pbzip2.ReaderOption{pbzip2.DecompressionOptions(pbzip2.BZHeapHint(-1))}, "invalid heap hint: -1"},
+		{[]pbzip2.ReaderOption{pbzip2.DecompressionOptions(pbzip2.BZPadTo(-1, 0))}, "invalid padding size: -1"},
+		{[]pbzip2.ReaderOption{pbzip2.DecompressionOptions(pbzip2.BZPipeBuffer(-1))}, "invalid pipe buffer size: -1"},
+		{[]pbzip2.ReaderOption{pbzip2.ScannerOptions(pbzip2.ScanBlockOverhead(-1))}, "invalid block overhead: -1"},
+		{[]pbzip2.ReaderOption{pbzip2.ScannerOptions(pbzip2.ScanMaxBuffer(-1))}, "invalid max buffer size: -1"},
+		{[]pbzip2.ReaderOption{pbzip2.ScannerOptions(pbzip2.ScanReadSize(-1))}, "invalid read size: -1"},
+		{[]pbzip2.ReaderOption{pbzip2.ScannerOptions(pbzip2.ScanMaxStreams(-1))}, "invalid max streams: -1"},
+	} {
+		compressed, _ := readFile(t, "300KB1")
+		rd, err := pbzip2.NewReaderE(ctx, bytes.NewReader(compressed), tc.opts...)
+		if rd != nil || err == nil || err.Error() != tc.err {
+			t.Errorf("missing or unexpected error: %v, want %v", err, tc.err)
+		}
+		// The non-E version replaces the invalid option with its default.
+		out, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(compressed), tc.opts...))
+		if err != nil {
+			t.Errorf("%v: %v", tc.err, err)
+		}
+		if got, want := out, bzip2Data["300KB1"]; !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v bytes, want %v bytes", tc.err, len(got), len(want))
+		}
+	}
+
+	compressed, _ := readFile(t, "hello")
+	rd, err := pbzip2.NewReaderE(ctx, bytes.NewReader(compressed), pbzip2.DecompressionOptions(pbzip2.BZConcurrency(2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := io.ReadAll(rd); err != nil || !bytes.Equal(out, bzip2Data["hello"]) {
+		t.Errorf("unexpected output or error: %q, %v", out, err)
+	}
+
+	if dc, err := pbzip2.NewDecompressorE(ctx, pbzip2.BZConcurrency(0)); dc != nil || err == nil || err.Error() != "invalid concurrency: 0" {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+	dc := pbzip2.NewDecompressor(ctx, pbzip2.BZConcurrency(0))
+	if got, want := decompressWith(ctx, t, dc, "900KB1"), bzip2Data["900KB1"]; !bytes.Equal(got, want) {
+		t.Errorf("got %v bytes, want %v bytes", len(got), len(want))
+	}
+}
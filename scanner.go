@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
@@ -16,8 +17,44 @@ import (
 	"github.com/cosnicolaou/pbzip2/internal/bzip2"
 )
 
+// ErrTruncatedStream is returned, wrapped, when the input ends part way
+// through the final block of a stream, rather than being corrupted. All of
+// the complete blocks that precede the truncated one will have been
+// returned by the scanner, or decompressed and returned by a reader,
+// before this error is returned.
+var ErrTruncatedStream = errors.New("truncated stream")
+
+// ErrBlockSizeExceeded is returned, wrapped, when the decompressed data of
+// a block exceeds the block size declared by the header of its stream, as
+// may be the case for a corrupt header or a maliciously crafted stream.
+var ErrBlockSizeExceeded = errors.New("decompressed data exceeds the stream's block size")
+
+// ErrLevelMismatch is returned, wrapped, when a block that is immediately
+// preceded by a stream header, without an intervening end of stream
+// marker, fails to decompress and that header specifies a different block
+// size level to that of the current stream, as may be the case for a
+// corrupt concatenation of streams. All of the blocks in a stream share
+// the level declared by its header, hence such a block cannot be
+// decompressed correctly. The header alone is not treated as an error
+// since the same byte sequence may occur within the compressed data of a
+// block, in which case the block magic that follows it is a false
+// positive and the blocks either side of it will be merged.
+var ErrLevelMismatch = errors.New("block size level changed within a stream")
+
+// ErrTooManyStreams is returned, wrapped, when the input contains more
+// streams, including empty ones, than allowed by ScanMaxStreams.
+var ErrTooManyStreams = errors.New("too many streams")
+
 type scannerOpts struct {
-	maxPreamble int
+	maxPreamble           int
+	maxBuffer             int
+	ignoreTrailingGarbage bool
+	rejectEmptyStreams    bool
+	magic                 *MagicTables
+	readSize              int
+	headerlessLevel       BlockSizeLevel
+	tee                   io.Writer
+	maxStreams            int
 }
 
 // ScannerOption represenst an option to NewBZ2BlockScanner.
@@ -26,13 +63,151 @@ type ScannerOption func(*scannerOpts)
 // ScanBlockOverhead sets the size of the overhead, in bytes, that
 // the scanner assumes is sufficient to capture all of the bzip2 per block
 // data structures. It should only ever be needed if the scanner is unable to
-// find a magic number.
+// find a magic number. The scanner will grow its lookahead, up to the limit
+// set by ScanMaxBuffer or twice its initial size, if the next magic number
+// cannot be found within it.
 func ScanBlockOverhead(b int) ScannerOption {
 	return func(o *scannerOpts) {
 		o.maxPreamble = b
 	}
 }
 
+// ScanMaxBuffer sets an upper bound, in bytes, on the size of the buffer
+// used by the scanner to find the next block. By default the buffer is sized
+// to be the block size declared in the stream header plus the block overhead
+// (see ScanBlockOverhead). The scanner will return an error if the bound
+// is smaller than the block size declared by the stream being scanned.
+func ScanMaxBuffer(n int) ScannerOption {
+	return func(o *scannerOpts) {
+		o.maxBuffer = n
+	}
+}
+
+// ScanReadSize sets a lower bound, in bytes, on the size of the buffer
+// used by the scanner to read from its input. By default the buffer is
+// only as large as is required to find the next block and a larger buffer
+// allows for each read of the input to return more data, thus reducing
+// the number of reads, or system calls, required to scan it. The buffer
+// is never larger than the bound set by ScanMaxBuffer.
+func ScanReadSize(n int) ScannerOption {
+	return func(o *scannerOpts) {
+		o.readSize = n
+	}
+}
+
+// ScanIgnoreTrailingGarbage controls whether any bytes that follow the
+// final stream trailer, and which do not start a new stream, are ignored
+// rather than being treated as a corrupt stream. The default is to treat
+// them as an error.
+func ScanIgnoreTrailingGarbage(v bool) ScannerOption {
+	return func(o *scannerOpts) {
+		o.ignoreTrailingGarbage = v
+	}
+}
+
+// ScanRejectEmptyStreams controls whether empty streams, that is, streams
+// that contain no blocks, within a concatenated input are treated as an
+// error rather than being silently ignored. An input that consists of a
+// single empty stream is never treated as an error.
+func ScanRejectEmptyStreams(v bool) ScannerOption {
+	return func(o *scannerOpts) {
+		o.rejectEmptyStreams = v
+	}
+}
+
+// ScanBlockMagic sets the block magic number that the scanner searches
+// for, it is intended for testing and the Decompressor should be
+// configured to use the same value via BZBlockMagic. The lookup tables for
+// magic are constructed each time the option is used, see ScanMagicTables
+// for reusing them.
+func ScanBlockMagic(magic [6]byte) ScannerOption {
+	return func(o *scannerOpts) {
+		o.magic = PrecomputeMagic(magic)
+	}
+}
+
+// ScanMagicTables is like ScanBlockMagic except that it uses the supplied,
+// precomputed, lookup tables, see PrecomputeMagic.
+func ScanMagicTables(tables *MagicTables) ScannerOption {
+	return func(o *scannerOpts) {
+		o.magic = tables
+	}
+}
+
+// ScanTeeCompressed writes the compressed input to w as it is consumed by
+// the scanner, that is, the stream headers, blocks, trailers and any
+// empty streams, so that w receives a byte for byte copy of the input as
+// it is scanned, and decompressed, without the input having to be
+// buffered in its entirety. Any trailing garbage ignored via
+// ScanIgnoreTrailingGarbage is not written to w. An error returned by w
+// is returned as the scanner's error once the current block has been
+// returned.
+func ScanTeeCompressed(w io.Writer) ScannerOption {
+	return func(o *scannerOpts) {
+		o.tee = w
+	}
+}
+
+// ScanMaxStreams sets an upper bound on the number of concatenated
+// streams, including empty ones, that the scanner will process. The
+// scanner returns an error that wraps ErrTooManyStreams once the input is
+// found to contain more than n streams, thus bounding the work performed
+// for adversarial inputs, such as those that consist of millions of
+// concatenated empty streams. The default, zero, is no limit.
+func ScanMaxStreams(n int) ScannerOption {
+	return func(o *scannerOpts) {
+		o.maxStreams = n
+	}
+}
+
+// ScanHeaderless configures the scanner to expect input that starts at
+// a block boundary, ie. with a block magic number, rather than with a
+// stream header, as is the case for a stream whose header has been
+// stripped or for a raw sequence of blocks. The header is neither read
+// nor validated and the block size level of the first stream is taken
+// to be level. Any subsequent streams in the input must have headers.
+func ScanHeaderless(level BlockSizeLevel) ScannerOption {
+	return func(o *scannerOpts) {
+		o.headerlessLevel = level
+	}
+}
+
+// MagicTables contains a block magic number and the lookup tables used
+// to search for it. The tables are never modified once constructed and
+// may be shared by any number of concurrently used scanners.
+type MagicTables struct {
+	magic                     [6]byte
+	pretest                   [256]bool
+	firstLookup, secondLookup map[uint32]uint8
+}
+
+// PrecomputeMagic constructs the lookup tables for the specified block
+// magic number. Constructing the tables is relatively expensive and
+// hence applications that use the same custom magic numbers repeatedly
+// should construct them once and use ScanMagicTables.
+func PrecomputeMagic(magic [6]byte) *MagicTables {
+	t := &MagicTables{magic: magic}
+	t.pretest, t.firstLookup, t.secondLookup = bitstream.Init(magic)
+	return t
+}
+
+// Magic returns the block magic number that the tables were constructed
+// for, as required by BZBlockMagic.
+func (t *MagicTables) Magic() [6]byte {
+	return t.magic
+}
+
+// defaultBlockMagicTables returns the tables for the package level
+// block magic number.
+func defaultBlockMagicTables() *MagicTables {
+	return &MagicTables{
+		magic:        blockMagic,
+		pretest:      pretestBlockMagicLookup,
+		firstLookup:  firstBlockMagicLookup,
+		secondLookup: secondBlockMagicLookup,
+	}
+}
+
 // See https://en.wikipedia.org/wiki/Bzip2 for an explanation of the file
 // format.
 var (
@@ -40,10 +215,13 @@ var (
 	firstBlockMagicLookup, secondBlockMagicLookup map[uint32]uint8
 	blockMagic                                    [6]byte
 	eosMagic                                      [6]byte
+	pretestEOSMagicLookup                         [256]bool
+	firstEOSMagicLookup, secondEOSMagicLookup     map[uint32]uint8
 )
 
 func init() {
 	pretestBlockMagicLookup, firstBlockMagicLookup, secondBlockMagicLookup = bitstream.Init(bzip2.BlockMagic)
+	pretestEOSMagicLookup, firstEOSMagicLookup, secondEOSMagicLookup = bitstream.Init(bzip2.EOSMagic)
 	copy(blockMagic[:], bzip2.BlockMagic[:])
 	copy(eosMagic[:], bzip2.EOSMagic[:])
 }
@@ -66,25 +244,107 @@ type Scanner struct {
 	prevBitOffset          int
 	first, done            bool
 	maxPreamble            int
+	maxBuffer              int
+	ignoreTrailingGarbage  bool
+	rejectEmptyStreams     bool
+	magic                  *MagicTables
+	readSize               int
+	headerlessLevel        BlockSizeLevel
+	tee                    io.Writer
+	maxStreams             int
 	currentStreamBlockSize int
+	consumed               int64
+	streams                []StreamInfo
+	newStream              bool
+	trailingPadding        int
+	levelMismatch          error // see CompressedBlock.levelMismatch.
 }
 
-// NewScanner returns a new instance of Scanner.
+// defaultMaxPreamble allows enough overhead for the bzip block overhead of
+// the coding tables before the content stats.
+const defaultMaxPreamble = 30 * 1024
+
+// validate replaces any invalid options with their defaults and returns
+// an error that describes the first such option, if any.
+func (o *scannerOpts) validate() error {
+	var err error
+	invalid := func(format string, args ...interface{}) {
+		if err == nil {
+			err = fmt.Errorf(format, args...)
+		}
+	}
+	if o.maxPreamble < 0 {
+		invalid("invalid block overhead: %v", o.maxPreamble)
+		o.maxPreamble = defaultMaxPreamble
+	}
+	if o.maxBuffer < 0 {
+		invalid("invalid max buffer size: %v", o.maxBuffer)
+		o.maxBuffer = 0
+	}
+	if o.readSize < 0 {
+		invalid("invalid read size: %v", o.readSize)
+		o.readSize = 0
+	}
+	if o.maxStreams < 0 {
+		invalid("invalid max streams: %v", o.maxStreams)
+		o.maxStreams = 0
+	}
+	return err
+}
+
+// NewScanner returns a new instance of Scanner. Invalid options, such as a
+// negative block overhead, are replaced by their defaults.
 func NewScanner(rd io.Reader, opts ...ScannerOption) *Scanner {
+	sc, _ := newScanner(rd, opts...)
+	return sc
+}
+
+// newScanner creates a scanner and returns an error for any invalid
+// options, the scanner is usable, with those options replaced by their
+// defaults, even if an error is returned.
+func newScanner(rd io.Reader, opts ...ScannerOption) (*Scanner, error) {
 	o := scannerOpts{
-		// Allow enough overhead for the bzip block overhead of the coding tables
-		// before the content stats.
-		maxPreamble: 30 * 1024,
+		maxPreamble: defaultMaxPreamble,
 	}
 	for _, fn := range opts {
 		fn(&o)
 	}
+	err := o.validate()
+	if o.magic == nil {
+		o.magic = defaultBlockMagicTables()
+	}
 	bzs := &Scanner{
-		rd:          rd,
-		first:       true,
-		maxPreamble: o.maxPreamble,
+		rd:                    rd,
+		first:                 true,
+		newStream:             true,
+		maxPreamble:           o.maxPreamble,
+		maxBuffer:             o.maxBuffer,
+		ignoreTrailingGarbage: o.ignoreTrailingGarbage,
+		rejectEmptyStreams:    o.rejectEmptyStreams,
+		magic:                 o.magic,
+		readSize:              o.readSize,
+		headerlessLevel:       o.headerlessLevel,
+		tee:                   o.tee,
+		maxStreams:            o.maxStreams,
 	}
-	return bzs
+	return bzs, err
+}
+
+// Reset discards the scanner's state, including any error, and prepares it
+// to scan a new input, rd, with the options that it was created with. The
+// scanner's read buffer is reused rather than reallocated unless the new
+// input's header specifies a larger block size, and hence a larger buffer,
+// than any previously scanned input.
+func (sc *Scanner) Reset(rd io.Reader) {
+	sc.rd = rd
+	sc.eos, sc.err = false, nil
+	sc.block = CompressedBlock{}
+	sc.prevBitOffset = 0
+	sc.first, sc.done = true, false
+	sc.currentStreamBlockSize = 0
+	sc.consumed = 0
+	sc.streams, sc.newStream = nil, true
+	sc.trailingPadding = 0
 }
 
 func parseHeader(buf []byte) (int, error) {
@@ -95,13 +355,16 @@ func parseHeader(buf []byte) (int, error) {
 	//	.hundred_k_blocksize:8 = '1'..'9' block-size 100 kB-900 kB
 	//                           (uncompressed)
 	if !bytes.Equal(buf[0:2], bzip2.FileMagic) {
-		return -1, fmt.Errorf("wrong file magic: %x", buf[0:2])
+		return -1, classify(errKindBadMagic, fmt.Errorf("wrong file magic: %x", buf[0:2]))
+	}
+	if buf[2] == '0' {
+		return -1, classify(errKindBadVersion, bzip2.StructuralError("bzip1 format is not supported"))
 	}
 	if buf[2] != 'h' {
-		return -1, fmt.Errorf("wrong version: %c", buf[2])
+		return -1, classify(errKindBadVersion, fmt.Errorf("wrong version: %c", buf[2]))
 	}
-	if s := buf[3]; s < '0' || s > '9' {
-		return -1, fmt.Errorf("bad block size: %c", s)
+	if s := buf[3]; s < '1' || s > '9' {
+		return -1, classify(errKindBadLevel, fmt.Errorf("bad block size: %c", s))
 
 	}
 	return 100 * 1000 * int(buf[3]-'0'), nil
@@ -114,25 +377,115 @@ func (sc *Scanner) scanHeader() bool {
 	//                           '0' for //Bzip1 (deprecated)
 	//	.hundred_k_blocksize:8 = '1'..'9' block-size 100 kB-900 kB
 	//                           (uncompressed)
+	if level := sc.headerlessLevel; level != 0 {
+		// See ScanHeaderless.
+		if level < 1 || level > 9 {
+			sc.err = fmt.Errorf("bad block size: %v", level)
+			return false
+		}
+		sc.currentStreamBlockSize = 100 * 1000 * int(level)
+		return sc.initBuffer()
+	}
 	var header [4]byte
-	n, err := sc.rd.Read(header[:])
+	// Use io.ReadFull since the underlying reader may return
+	// fewer bytes than requested.
+	n, err := io.ReadFull(sc.rd, header[:])
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		sc.err = classify(errKindTruncated, fmt.Errorf("stream header is too small: %v", n))
+		return false
+	}
 	if err != nil {
 		sc.err = fmt.Errorf("failed to read stream header: %v", err)
 		return false
 	}
-	if n != 4 {
-		sc.err = fmt.Errorf("stream header is too small: %v", n)
+	sc.consumed += int64(n)
+	if !sc.writeTee(header[:n]) {
 		return false
 	}
 	sc.currentStreamBlockSize, sc.err = parseHeader(header[:])
 	if sc.err != nil {
 		return false
 	}
-	// Allow for maximum possible block size.
-	sc.brd = bufio.NewReaderSize(sc.rd, 9*100*1000+sc.maxPreamble)
+	return sc.initBuffer()
+}
+
+// initBuffer creates, or reuses, the read buffer for the first stream.
+func (sc *Scanner) initBuffer() bool {
+	lookahead, err := sc.lookahead()
+	if err != nil {
+		sc.err = err
+		return false
+	}
+	size := sc.bufferSize(lookahead)
+	if sc.brd != nil && sc.brd.Size() >= size {
+		// Reuse the buffer allocated for a previous input, see Reset.
+		sc.brd.Reset(sc.rd)
+		return true
+	}
+	sc.brd = bufio.NewReaderSize(sc.rd, size)
 	return true
 }
 
+// growBuffer replaces the read buffer with a larger one for the specified
+// lookahead. Any data already buffered is carried over to the new buffer,
+// which otherwise reads directly from the input, rather than wrapping the
+// existing buffer and hence copying all subsequent reads twice.
+func (sc *Scanner) growBuffer(lookahead int) {
+	buffered, _ := sc.brd.Peek(sc.brd.Buffered())
+	carried := make([]byte, len(buffered))
+	copy(carried, buffered)
+	sc.brd = bufio.NewReaderSize(io.MultiReader(bytes.NewReader(carried), sc.rd), sc.bufferSize(lookahead))
+}
+
+// bufferSize returns the size of the read buffer to use for the
+// specified lookahead, see ScanReadSize. The size never exceeds that
+// set via ScanMaxBuffer.
+func (sc *Scanner) bufferSize(lookahead int) int {
+	size := sc.readSize
+	if sc.maxBuffer > 0 && size > sc.maxBuffer {
+		size = sc.maxBuffer
+	}
+	if size > lookahead {
+		return size
+	}
+	return lookahead
+}
+
+// lookahead returns the number of bytes that must be buffered in order
+// to find the next block magic number for the current stream.
+func (sc *Scanner) lookahead() (int, error) {
+	size := sc.currentStreamBlockSize + sc.maxPreamble
+	if sc.maxBuffer <= 0 || size <= sc.maxBuffer {
+		return size, nil
+	}
+	if sc.maxBuffer < sc.currentStreamBlockSize {
+		return 0, fmt.Errorf("scanner buffer size of %v bytes is too small for a stream block size of %v bytes", sc.maxBuffer, sc.currentStreamBlockSize)
+	}
+	return sc.maxBuffer, nil
+}
+
+// growLookahead returns a larger lookahead to use when the next block
+// magic number cannot be found within the current one, it returns false
+// once the lookahead has reached the limit set via ScanMaxBuffer or, by
+// default, twice the size of the initial lookahead for the current
+// stream. The limit allows for valid, but pathological, blocks whose
+// coding tables, or incompressible data, exceed the block overhead
+// without allowing corrupt input to consume unbounded amounts of memory.
+func (sc *Scanner) growLookahead(lookahead int) (int, bool) {
+	limit := sc.maxBuffer
+	if limit <= 0 {
+		limit = 2 * (sc.currentStreamBlockSize + sc.maxPreamble)
+	}
+	if lookahead >= limit {
+		return lookahead, false
+	}
+	lookahead += lookahead / 4
+	if lookahead > limit {
+		lookahead = limit
+	}
+	return lookahead, true
+}
+
 func readCRC(block []byte, shift int) uint32 {
 	if len(block) < 4 {
 		return 0
@@ -147,6 +500,59 @@ func readCRC(block []byte, shift int) uint32 {
 
 // Scan returns true if there is a block to be returned.
 func (sc *Scanner) Scan(ctx context.Context) bool {
+	if !sc.scan(ctx) {
+		return false
+	}
+	sc.recordStream()
+	if sc.maxStreams > 0 && len(sc.streams) > sc.maxStreams {
+		sc.err = fmt.Errorf("input contains more than %v streams: %w", sc.maxStreams, ErrTooManyStreams)
+		return false
+	}
+	return true
+}
+
+// StreamInfo describes a single stream within the scanned input.
+// BlockCount is the number of blocks returned by Scan for the stream and
+// CRC is its stream CRC. Empty streams are reported with a zero Level,
+// BlockCount and CRC.
+type StreamInfo struct {
+	Level      BlockSizeLevel
+	BlockCount int
+	CRC        uint32
+}
+
+// StreamInfo returns information on each of the streams scanned so far,
+// in the order that they were encountered. The final entry pertains to a
+// stream whose end has not yet been reached if the scan is incomplete,
+// in which case its CRC is zero.
+func (sc *Scanner) StreamInfo() []StreamInfo {
+	return append([]StreamInfo(nil), sc.streams...)
+}
+
+// recordStream updates the stream information for the current block.
+func (sc *Scanner) recordStream() {
+	b := sc.block
+	if sc.newStream {
+		sc.streams = append(sc.streams, StreamInfo{Level: b.Level()})
+		sc.newStream = false
+	}
+	cur := &sc.streams[len(sc.streams)-1]
+	if b.SizeInBits > 0 {
+		cur.BlockCount++
+	} else {
+		cur.Level = 0
+	}
+	if !b.EOS {
+		return
+	}
+	cur.CRC = b.StreamCRC
+	for i := 0; i < b.emptyStreams; i++ {
+		sc.streams = append(sc.streams, StreamInfo{})
+	}
+	sc.newStream = true
+}
+
+func (sc *Scanner) scan(ctx context.Context) bool {
 	if sc.err != nil || sc.done {
 		return false
 	}
@@ -167,8 +573,17 @@ func (sc *Scanner) Scan(ctx context.Context) bool {
 
 	sc.eos = false
 	eof := false
-	lookahead := 9*100*1000 + sc.maxPreamble
-	buf, err := sc.brd.Peek(lookahead)
+	lookahead, err := sc.lookahead()
+	if err != nil {
+		sc.err = err
+		return false
+	}
+	if lookahead > sc.brd.Size() {
+		// A concatenated stream with a larger block size has been
+		// encountered.
+		sc.growBuffer(lookahead)
+	}
+	buf, err := sc.peek(ctx, lookahead)
 	if err != nil {
 		if err != io.EOF {
 			sc.err = err
@@ -182,49 +597,174 @@ func (sc *Scanner) Scan(ctx context.Context) bool {
 		// end of one. Therefore the first block must be handled specially.
 		// If this is the first block, and it starts with a block magic
 		// number, discard that block magic and search for the next one.
-		if bytes.HasPrefix(buf, blockMagic[:]) {
-			sc.brd.Discard(len(blockMagic))
-			buf = buf[len(blockMagic):]
+		if bytes.HasPrefix(buf, sc.magic.magic[:]) {
+			sc.discard(len(sc.magic.magic))
+			buf = buf[len(sc.magic.magic):]
 			sc.block.BitOffset = 0
 			sc.prevBitOffset = 0
 		}
 	}
 
-	// Look for the next block magic or eof.
-	byteOffset, bitOffset := bitstream.Scan(pretestBlockMagicLookup, firstBlockMagicLookup, secondBlockMagicLookup, buf)
+	// Look for the next block magic or eof, growing the lookahead if
+	// necessary to allow for blocks whose overhead exceeds that allowed
+	// for by ScanBlockOverhead.
+	byteOffset, bitOffset := bitstream.Scan(sc.magic.pretest, sc.magic.firstLookup, sc.magic.secondLookup, buf)
+	for byteOffset == -1 && !eof {
+		grown, ok := sc.growLookahead(lookahead)
+		if !ok {
+			break
+		}
+		lookahead = grown
+		if lookahead > sc.brd.Size() {
+			sc.growBuffer(lookahead)
+		}
+		if buf, err = sc.peek(ctx, lookahead); err != nil {
+			if err != io.EOF {
+				sc.err = err
+				return false
+			}
+			eof = true
+		}
+		byteOffset, bitOffset = bitstream.Scan(sc.magic.pretest, sc.magic.firstLookup, sc.magic.secondLookup, buf)
+	}
 	if byteOffset == -1 {
+		if sc.ignoreTrailingGarbage {
+			if trimmed, empty, ok := trimTrailingGarbage(buf, eof); ok {
+				if !sc.handleEOF(trimmed) {
+					return false
+				}
+				sc.setTrailingPadding(empty)
+				sc.block.emptyStreams = empty
+				sc.discard(len(trimmed) + empty*14)
+				return sc.checkEmptyStreams()
+			}
+		}
 		if !eof {
-			sc.err = fmt.Errorf("failed to find next block within expected max buffer size of %v", lookahead)
+			err := fmt.Errorf("failed to find next block within expected max buffer size of %v", lookahead)
+			if sc.levelMismatch != nil {
+				// The block follows a stream header for a larger
+				// level and hence may exceed the lookahead.
+				err = fmt.Errorf("%w: %v", sc.levelMismatch, err)
+			}
+			sc.err = classify(errKindCorrupt, err)
 			return false
 		}
-		buf, _ := trimTrailingEmptyFiles(buf)
+		trimmed, empty := trimTrailingEmptyFiles(buf)
 		// Note that if the stream is somehow corrupted and we don't find any
 		// empty files here then the stream checksum check will fail or the
 		// trailer won't be correctly located.
-		return sc.handleEOF(buf)
+		if !sc.handleEOF(trimmed) {
+			return false
+		}
+		sc.setTrailingPadding(empty)
+		sc.block.emptyStreams = empty
+		sc.discard(len(buf))
+		return sc.checkEmptyStreams()
 	}
 
+	var mismatch error
 	if bitOffset == 0 {
 		// If an EOS magic number was skipped, the bitoffset must be zero
 		// since the stream has ended.
 		if ok := sc.skippedEOS(buf, byteOffset, bitOffset); ok {
-			return true
+			return sc.checkEmptyStreams()
 		}
+		mismatch = sc.checkLevel(buf, byteOffset)
 	}
 	sz := byteOffset
 	if bitOffset > 0 {
 		sz++
 	}
 	sc.initBlockValues(false, buf, sz, (byteOffset*8)+bitOffset-sc.prevBitOffset, 0)
+	if mismatch != nil {
+		// Record the mismatch with the blocks either side of the
+		// header, it is reported only if they fail to decompress.
+		sc.block.levelMismatch = mismatch
+		sc.levelMismatch = mismatch
+	}
 	sc.prevBitOffset = bitOffset
 	// skip the magic # before starting the search for the next magic #.
-	sc.brd.Discard(byteOffset + len(blockMagic))
+	sc.discard(byteOffset + len(sc.magic.magic))
+	return true
+}
+
+// checkEmptyStreams returns false, and sets the scanner's error, if empty
+// streams are being rejected and the current block either is, or is
+// followed by, an empty stream.
+func (sc *Scanner) checkEmptyStreams() bool {
+	if !sc.rejectEmptyStreams {
+		return true
+	}
+	if n := sc.block.emptyStreams; n > 0 {
+		sc.err = fmt.Errorf("found %v empty stream(s) following the block at offset %v", n, sc.block.Offset)
+		return false
+	}
+	if sc.block.SizeInBits == 0 && !(sc.first && sc.done) {
+		sc.err = fmt.Errorf("found an empty stream at offset %v", sc.block.Offset)
+		return false
+	}
+	return true
+}
+
+// peek is like bufio.Reader.Peek except that it keeps retrying, until ctx
+// is done, when the underlying reader repeatedly returns no data and no
+// error, as may happen with slow network streams that deliver data in
+// small chunks.
+func (sc *Scanner) peek(ctx context.Context, n int) ([]byte, error) {
+	for {
+		buf, err := sc.brd.Peek(n)
+		if err != io.ErrNoProgress {
+			return buf, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// BytesConsumed returns the number of bytes of compressed data, including
+// stream headers and trailers, that the scanner has consumed from its
+// input so far. Since the scanner reads ahead of the blocks that it returns
+// this will generally be less than the number of bytes read from the
+// underlying reader. Once the scan is complete it will equal the size of
+// the input, excluding any trailing garbage ignored via
+// ScanIgnoreTrailingGarbage. It may be used to report progress when the
+// size of the input is not known.
+func (sc *Scanner) BytesConsumed() int64 {
+	return sc.consumed
+}
+
+// discard discards n bytes from the buffered input and keeps track of the
+// total number of bytes consumed so far.
+func (sc *Scanner) discard(n int) {
+	if sc.tee != nil {
+		// The data to be discarded has always been peeked and hence
+		// buffered.
+		buf, _ := sc.brd.Peek(n)
+		sc.writeTee(buf)
+	}
+	d, _ := sc.brd.Discard(n)
+	sc.consumed += int64(d)
+}
+
+// writeTee writes buf to the writer set via ScanTeeCompressed, if any,
+// recording any error as the scanner's error.
+func (sc *Scanner) writeTee(buf []byte) bool {
+	if sc.tee == nil {
+		return true
+	}
+	if _, err := sc.tee.Write(buf); err != nil {
+		if sc.err == nil {
+			sc.err = fmt.Errorf("failed to write compressed data: %w", err)
+		}
+		return false
+	}
 	return true
 }
 
 // Check for having skipped past an EOS block.
 func (sc *Scanner) skippedEOS(buf []byte, byteOffset, bitOffset int) bool {
-	newStreamBlockSize, prevStreamCRC, consumed, trailerOffset, ok := handleSkippedEOS(buf[:byteOffset], byteOffset)
+	newStreamBlockSize, prevStreamCRC, consumed, trailerOffset, empty, ok := handleSkippedEOS(buf[:byteOffset], byteOffset)
 	if !ok {
 		return false
 	}
@@ -240,16 +780,34 @@ func (sc *Scanner) skippedEOS(buf []byte, byteOffset, bitOffset int) bool {
 	// compressed block up to the EOS trailer and hence needs to take
 	// the trailer offset into account.
 	sc.initBlockValues(true, buf, szBytes, szBits, prevStreamCRC)
+	sc.block.emptyStreams = empty
 	sc.currentStreamBlockSize = newStreamBlockSize
 	sc.prevBitOffset = bitOffset
 
 	// skip the magic # before starting the search for the next magic #.
-	sc.brd.Discard(byteOffset + len(blockMagic))
+	sc.discard(byteOffset + len(sc.magic.magic))
 	return true
 }
 
+// checkLevel returns an error if the block magic at byteOffset is
+// immediately preceded by a stream header, that was not itself preceded by
+// an end of stream marker, and which implies a different level to that
+// of the current stream. The error is not fatal, see ErrLevelMismatch.
+func (sc *Scanner) checkLevel(buf []byte, byteOffset int) error {
+	if byteOffset < 4 {
+		return nil
+	}
+	size, err := parseHeader(buf[byteOffset-4 : byteOffset])
+	if err != nil || size == sc.currentStreamBlockSize {
+		return nil
+	}
+	return fmt.Errorf("stream header at offset %v specifies level %v within a stream of level %v: %w",
+		sc.consumed+int64(byteOffset)-4, size/(100*1000), sc.currentStreamBlockSize/(100*1000), ErrLevelMismatch)
+}
+
 func (sc *Scanner) initBlockValues(eos bool, buf []byte, sz, szInBits int, streamCRC uint32) {
 	sc.block = CompressedBlock{}
+	sc.block.Offset = sc.consumed
 	sc.block.EOS = eos
 	if sz > 0 {
 		sc.block.Data = make([]byte, sz)
@@ -260,6 +818,7 @@ func (sc *Scanner) initBlockValues(eos bool, buf []byte, sz, szInBits int, strea
 	sc.block.SizeInBits = szInBits
 	sc.block.StreamBlockSize = sc.currentStreamBlockSize
 	sc.block.StreamCRC = streamCRC
+	sc.block.levelMismatch, sc.levelMismatch = sc.levelMismatch, nil
 }
 
 // trimTrailingEmptyFiles removes a trailing run of 1 or more empty files; an empty
@@ -302,6 +861,65 @@ func trimEmptyFile(buf []byte) ([]byte, bool) {
 	return buf[:l-offset], true
 }
 
+// trimTrailingGarbage returns the prefix of buf that ends with the first
+// stream trailer that is not followed by the start of a new stream, less
+// any empty streams that precede that trailer, and the number of such
+// empty streams. It returns false if buf at eof already ends with a
+// trailer, or if no such trailer can be found.
+func trimTrailingGarbage(buf []byte, eof bool) ([]byte, int, bool) {
+	if eof {
+		trimmed, _ := trimTrailingEmptyFiles(buf)
+		if _, trailerSize, _ := bitstream.FindTrailingMagicAndCRC(trimmed, eosMagic[:]); trailerSize == 10 {
+			return buf, 0, false
+		}
+	}
+	start := 0
+	for {
+		byteOffset, bitOffset := bitstream.Scan(pretestEOSMagicLookup, firstEOSMagicLookup, secondEOSMagicLookup, buf[start:])
+		if byteOffset == -1 {
+			return buf, 0, false
+		}
+		byteOffset += start
+		// 6 bytes of magic and 4 of crc, plus padding if not byte aligned.
+		end := byteOffset + 10
+		if bitOffset > 0 {
+			end++
+		}
+		if end > len(buf) {
+			return buf, 0, false
+		}
+		_, trailerSize, _ := bitstream.FindTrailingMagicAndCRC(buf[:end], eosMagic[:])
+		if trailerSize == 10 && !bytes.HasPrefix(buf[end:], bzip2.FileMagic) {
+			trimmed, empty := trimTrailingEmptyFiles(buf[:end])
+			return trimmed, empty, true
+		}
+		start = byteOffset + 1
+	}
+}
+
+// truncated returns true if buf, which ends at eof but without a valid
+// stream trailer, does not contain a complete trailer anywhere and hence
+// the stream was truncated rather than corrupted.
+func truncated(buf []byte) bool {
+	start := 0
+	for {
+		byteOffset, bitOffset := bitstream.Scan(pretestEOSMagicLookup, firstEOSMagicLookup, secondEOSMagicLookup, buf[start:])
+		if byteOffset == -1 {
+			return true
+		}
+		byteOffset += start
+		// 6 bytes of magic and 4 of crc, plus padding if not byte aligned.
+		end := byteOffset + 10
+		if bitOffset > 0 {
+			end++
+		}
+		if end <= len(buf) {
+			return false
+		}
+		start = byteOffset + 1
+	}
+}
+
 // Check for having skipped past an EOS block.
 //
 // The stream format is:
@@ -320,7 +938,7 @@ func trimEmptyFile(buf []byte) ([]byte, bool) {
 // header followed by an EOS block with a zero CRC.
 //
 // ...EOS[<empty-file>]*<hdr><blockMagic>
-func handleSkippedEOS(buf []byte, byteOffset int) (newBlockSize int, prevCRC uint32, consumed, trailerOffset int, ok bool) {
+func handleSkippedEOS(buf []byte, byteOffset int) (newBlockSize int, prevCRC uint32, consumed, trailerOffset, empty int, ok bool) {
 	if byteOffset <= 4 {
 		return
 	}
@@ -329,7 +947,7 @@ func handleSkippedEOS(buf []byte, byteOffset int) (newBlockSize int, prevCRC uin
 	if err != nil {
 		return
 	}
-	trimmed, n := trimTrailingEmptyFiles(buf[:l-4])
+	trimmed, empty := trimTrailingEmptyFiles(buf[:l-4])
 
 	trailer, trailerSize, trailerOffset := bitstream.FindTrailingMagicAndCRC(trimmed, eosMagic[:])
 	if trailerSize != 10 {
@@ -338,7 +956,7 @@ func handleSkippedEOS(buf []byte, byteOffset int) (newBlockSize int, prevCRC uin
 
 	prevCRC = binary.BigEndian.Uint32(trailer)
 	// size of header, trailer, plus any empty files.
-	consumed = 4 + trailerSize + (n * 14)
+	consumed = 4 + trailerSize + (empty * 14)
 	if trailerOffset > 0 {
 		consumed++
 	}
@@ -349,7 +967,12 @@ func handleSkippedEOS(buf []byte, byteOffset int) (newBlockSize int, prevCRC uin
 func (sc *Scanner) handleEOF(buf []byte) bool {
 	trailer, trailerSize, trailerOffset := bitstream.FindTrailingMagicAndCRC(buf, eosMagic[:])
 	if trailerSize != 10 {
-		sc.err = fmt.Errorf("failed to find trailer")
+		if truncated(buf) {
+			sc.err = fmt.Errorf("failed to find trailer: %w", ErrTruncatedStream)
+			return false
+		}
+		// A complete trailer exists, but not at the end of the input.
+		sc.err = classify(errKindTrailingGarbage, fmt.Errorf("failed to find trailer"))
 		return false
 	}
 	szBytes := len(buf) - trailerSize
@@ -361,10 +984,29 @@ func (sc *Scanner) handleEOF(buf []byte) bool {
 		szBits -= sc.prevBitOffset
 	}
 	sc.initBlockValues(true, buf, szBytes, szBits, binary.BigEndian.Uint32(trailer))
+	if trailerOffset > 0 {
+		sc.trailingPadding = 8 - trailerOffset
+	}
 	sc.done = true
 	return true
 }
 
+// setTrailingPadding accounts for any empty streams that follow the
+// final trailer, since these are byte aligned and contain no padding.
+func (sc *Scanner) setTrailingPadding(emptyStreams int) {
+	if emptyStreams > 0 {
+		sc.trailingPadding = 0
+	}
+}
+
+// TrailingPaddingBits returns the number of padding bits, 0..7, that
+// follow the trailer of the final stream in the scanned input, ie. the
+// bits required to byte align the end of that stream. It returns zero
+// until the final block has been scanned.
+func (sc *Scanner) TrailingPaddingBits() int {
+	return sc.trailingPadding
+}
+
 // CompressedBlock represents a single bzip2 compressed block.
 type CompressedBlock struct {
 	// Buffer containing compressed data as a bitstream that starts at
@@ -377,6 +1019,30 @@ type CompressedBlock struct {
 
 	EOS       bool   // EOS has been detected.
 	StreamCRC uint32 // CRC
+
+	Offset int64 // Offset is the position of Data[0] in the scanned input.
+
+	emptyStreams  int   // number of empty streams that followed this block.
+	levelMismatch error // see ErrLevelMismatch.
+}
+
+// BlockSizeLevel is the bzip2 compression level, 1..9, that a stream was
+// created with. It determines the block size, in units of 100*1000 bytes,
+// used for that stream.
+type BlockSizeLevel int
+
+// Level returns the compression level of the stream that the block
+// belongs to.
+func (b CompressedBlock) Level() BlockSizeLevel {
+	return BlockSizeLevel(b.StreamBlockSize / (100 * 1000))
+}
+
+// StartBitOffset returns the offset, in bits from the start of the
+// scanned input, of the block magic number that precedes the block's
+// compressed data. It is the same offset as is reported for the block
+// via internal/bzip2's Stats.BlockStartOffsets.
+func (b CompressedBlock) StartBitOffset() int64 {
+	return b.Offset*8 + int64(b.BitOffset) - int64(len(blockMagic))*8
 }
 
 func (b CompressedBlock) String() string {
@@ -389,6 +1055,207 @@ func (b CompressedBlock) String() string {
 	return out.String()
 }
 
+// BlockInfo contains the metadata for a single compressed block in a form
+// that is suitable for marshaling, eg. as JSON.
+type BlockInfo struct {
+	Block      int    `json:"block"` // Block is the index of the block, starting at 1.
+	BitOffset  int    `json:"bit_offset"`
+	SizeInBits int    `json:"size_in_bits"`
+	CRC        uint32 `json:"crc"`
+	EOS        bool   `json:"eos"`
+	StreamCRC  uint32 `json:"stream_crc"`
+}
+
+// Info returns the metadata for the block as a BlockInfo, with block
+// being used as its index.
+func (b CompressedBlock) Info(block int) BlockInfo {
+	return BlockInfo{
+		Block:      block,
+		BitOffset:  b.BitOffset,
+		SizeInBits: b.SizeInBits,
+		CRC:        b.CRC,
+		EOS:        b.EOS,
+		StreamCRC:  b.StreamCRC,
+	}
+}
+
+// compressedBlockVersion is the version of the binary encoding used by
+// CompressedBlock.MarshalBinary.
+const compressedBlockVersion = 1
+
+const (
+	compressedBlockEOS = 1 << iota
+	compressedBlockData
+)
+
+// AppendBinary appends the binary encoding of the block to buf, as per
+// MarshalBinary, and returns the extended buffer. The block's compressed
+// data is only included if includeData is true, which allows for compact
+// indices of the blocks in a file to be persisted and the data to be read
+// separately, eg. via BlockLocation.ReadBlock. The encoding is stable.
+func (b CompressedBlock) AppendBinary(buf []byte, includeData bool) []byte {
+	buf = append(buf, compressedBlockVersion)
+	var flags byte
+	if b.EOS {
+		flags |= compressedBlockEOS
+	}
+	if includeData {
+		flags |= compressedBlockData
+	}
+	buf = append(buf, flags)
+	var tmp [binary.MaxVarintLen64]byte
+	putUvarint := func(v uint64) {
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], v)]...)
+	}
+	putUint32 := func(v uint32) {
+		binary.BigEndian.PutUint32(tmp[:], v)
+		buf = append(buf, tmp[:4]...)
+	}
+	putUvarint(uint64(b.BitOffset))
+	putUvarint(uint64(b.SizeInBits))
+	putUint32(b.CRC)
+	putUvarint(uint64(b.StreamBlockSize))
+	putUint32(b.StreamCRC)
+	buf = append(buf, tmp[:binary.PutVarint(tmp[:], b.Offset)]...)
+	putUvarint(uint64(b.emptyStreams))
+	if includeData {
+		putUvarint(uint64(len(b.Data)))
+		buf = append(buf, b.Data...)
+	}
+	return buf
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler. The encoding
+// includes the block's compressed data, use AppendBinary to omit it.
+func (b CompressedBlock) MarshalBinary() ([]byte, error) {
+	return b.AppendBinary(nil, true), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler for encodings
+// created by MarshalBinary or AppendBinary. Data is nil if the encoding
+// does not include the block's compressed data. Encodings of blocks that
+// could not have been returned by a Scanner, eg. with a BitOffset outside
+// of 0..7, are rejected.
+func (b *CompressedBlock) UnmarshalBinary(buf []byte) error {
+	dec := &blockDecoder{buf: buf}
+	if v := dec.byte(); dec.err == nil && v != compressedBlockVersion {
+		return fmt.Errorf("invalid compressed block encoding: unsupported version: %v", v)
+	}
+	flags := dec.byte()
+	var cb CompressedBlock
+	cb.EOS = flags&compressedBlockEOS != 0
+	cb.BitOffset = int(dec.uvarint())
+	cb.SizeInBits = int(dec.uvarint())
+	cb.CRC = dec.uint32()
+	cb.StreamBlockSize = int(dec.uvarint())
+	cb.StreamCRC = dec.uint32()
+	cb.Offset = dec.varint()
+	cb.emptyStreams = int(dec.uvarint())
+	if flags&compressedBlockData != 0 {
+		cb.Data = dec.bytes(dec.uvarint())
+	}
+	if dec.err == nil && len(dec.buf) > 0 {
+		dec.err = fmt.Errorf("%v trailing bytes", len(dec.buf))
+	}
+	if dec.err == nil {
+		dec.err = cb.validate(flags&compressedBlockData != 0)
+	}
+	if dec.err != nil {
+		return fmt.Errorf("invalid compressed block encoding: %v", dec.err)
+	}
+	*b = cb
+	return nil
+}
+
+// validate returns an error if the decoded fields of b are inconsistent
+// with any block that could have been returned by a Scanner and hence
+// would lead to out of range accesses when the block is decompressed.
+// The size of the compressed data is only checked if hasData is true.
+func (b *CompressedBlock) validate(hasData bool) error {
+	if b.BitOffset < 0 || b.BitOffset > 7 {
+		return fmt.Errorf("bit offset out of range: %v", b.BitOffset)
+	}
+	if b.SizeInBits < 0 || (hasData && b.SizeInBits > len(b.Data)*8-b.BitOffset) {
+		return fmt.Errorf("size in bits out of range: %v", b.SizeInBits)
+	}
+	if b.StreamBlockSize < 100*1000 || b.StreamBlockSize > 900*1000 || b.StreamBlockSize%(100*1000) != 0 {
+		return fmt.Errorf("invalid stream block size: %v", b.StreamBlockSize)
+	}
+	return nil
+}
+
+// blockDecoder decodes the fields of an encoded CompressedBlock, the
+// first error encountered is retained and all subsequent calls return
+// zero values.
+type blockDecoder struct {
+	buf []byte
+	err error
+}
+
+var errShortBlockEncoding = errors.New("too short")
+
+func (d *blockDecoder) byte() byte {
+	if d.err != nil || len(d.buf) < 1 {
+		d.fail(errShortBlockEncoding)
+		return 0
+	}
+	v := d.buf[0]
+	d.buf = d.buf[1:]
+	return v
+}
+
+func (d *blockDecoder) uint32() uint32 {
+	if d.err != nil || len(d.buf) < 4 {
+		d.fail(errShortBlockEncoding)
+		return 0
+	}
+	v := binary.BigEndian.Uint32(d.buf)
+	d.buf = d.buf[4:]
+	return v
+}
+
+func (d *blockDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.fail(errShortBlockEncoding)
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *blockDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.fail(errShortBlockEncoding)
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *blockDecoder) bytes(n uint64) []byte {
+	if d.err != nil || uint64(len(d.buf)) < n {
+		d.fail(errShortBlockEncoding)
+		return nil
+	}
+	v := append([]byte{}, d.buf[:n]...)
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *blockDecoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
 // Block returns the current block bzip2 compression block.
 func (sc *Scanner) Block() CompressedBlock {
 	return sc.block
@@ -398,3 +1265,12 @@ func (sc *Scanner) Block() CompressedBlock {
 func (sc *Scanner) Err() error {
 	return sc.err
 }
+
+// Done returns true if the scanner has reached the end of its input
+// without encountering an error, and hence distinguishes a scan that
+// completed from one that was stopped by an error, such as the context
+// being canceled, once Scan has returned false. Note that it is already
+// true when the final block is returned by Scan.
+func (sc *Scanner) Done() bool {
+	return sc.done && sc.err == nil
+}
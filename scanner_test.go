@@ -12,8 +12,10 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
+	"testing/iotest"
 
 	"github.com/cosnicolaou/pbzip2"
 	"github.com/cosnicolaou/pbzip2/internal"
@@ -103,8 +105,16 @@ func openBzipFile(t *testing.T, filename string) io.ReadCloser {
 
 func progress(n string, prgCh chan pbzip2.Progress) error {
 	next := uint64(1)
+	final := false
 	for p := range prgCh {
 		fmt.Printf("%#v\n", p)
+		if final {
+			return fmt.Errorf("%v: report after the final one %#v", n, p)
+		}
+		if p.Final {
+			final = true
+			continue
+		}
 		if p.Block != next {
 			return fmt.Errorf("%v: out of sequence block %#v", n, p)
 		}
@@ -171,7 +181,8 @@ func testScanFile(ctx context.Context, t *testing.T, rd io.Reader, stdlibData []
 
 	dc := pbzip2.NewDecompressor(ctx,
 		pbzip2.BZConcurrency(3),
-		pbzip2.BZSendUpdates(prgCh))
+		pbzip2.BZSendUpdates(prgCh),
+		pbzip2.BZProgressBlocking(true))
 
 	pwg.Add(1)
 	go func(n string) {
@@ -316,3 +327,619 @@ func BenchmarkScanner(b *testing.B) {
 		}
 	}
 }
+
+func TestScannerBufferSize(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name      string
+		opts      []pbzip2.ScannerOption
+		size      int
+		numBlocks int
+	}{
+		{"100KB1", nil, 100*1000 + 30*1024, 2},
+		{"900KB9", nil, 900*1000 + 30*1024, 2},
+		{"100KB1", []pbzip2.ScannerOption{pbzip2.ScanBlockOverhead(1024)}, 100*1000 + 1024, 2},
+		{"100KB1", []pbzip2.ScannerOption{pbzip2.ScanMaxBuffer(120 * 1000)}, 120 * 1000, 2},
+		{"900KB9", []pbzip2.ScannerOption{pbzip2.ScanMaxBuffer(920 * 1000)}, 920 * 1000, 2},
+	} {
+		rd := openBzipFile(t, bzip2Files[tc.name])
+		defer rd.Close()
+		sc := pbzip2.NewScanner(rd, tc.opts...)
+		n := 0
+		for sc.Scan(ctx) {
+			if got, want := pbzip2.ScannerBufferSize(sc), tc.size; got != want {
+				t.Errorf("%v: got %v, want %v", tc.name, got, want)
+			}
+			n++
+		}
+		if err := sc.Err(); err != nil {
+			t.Errorf("%v: %v", tc.name, err)
+		}
+		if got, want := n, tc.numBlocks; got != want {
+			t.Errorf("%v: got %v, want %v", tc.name, got, want)
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		max  int
+	}{
+		{"100KB1", 99 * 1000},
+		{"900KB9", 800 * 1000},
+	} {
+		rd := openBzipFile(t, bzip2Files[tc.name])
+		defer rd.Close()
+		sc := pbzip2.NewScanner(rd, pbzip2.ScanMaxBuffer(tc.max))
+		if sc.Scan(ctx) {
+			t.Errorf("%v: scan unexpectedly succeeded", tc.name)
+		}
+		if err := sc.Err(); err == nil || !strings.Contains(err.Error(), "is too small for a stream block size") {
+			t.Errorf("%v: missing or wrong error: %v", tc.name, err)
+		}
+	}
+}
+
+func TestScannerLookaheadGrowth(t *testing.T) {
+	ctx := context.Background()
+	// The blocks in 300KB1 are random data and hence their compressed
+	// size exceeds the uncompressed block size of 100KB.
+	compressed, _ := readFile(t, "300KB1")
+	want := scanBlocks(t, compressed)
+	sc := pbzip2.NewScanner(bytes.NewReader(compressed), pbzip2.ScanBlockOverhead(1))
+	var got []pbzip2.CompressedBlock
+	for sc.Scan(ctx) {
+		got = append(got, sc.Block())
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(got), len(want); got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range got {
+		if g, w := got[i], want[i]; g.CRC != w.CRC || g.SizeInBits != w.SizeInBits {
+			t.Errorf("block %v: got %v, want %v", i, g, w)
+		}
+	}
+	if got, want := pbzip2.ScannerBufferSize(sc), 100*1000+1; got <= want {
+		t.Errorf("got %v, want > %v", got, want)
+	}
+
+	// The buffer is grown repeatedly, both within and between streams,
+	// without losing any data that was already buffered.
+	concatenated, actual := concatFiles(t, "hello", "300KB1", "300KB5", "900KB9", "300KB1")
+	for _, readSize := range []int{0, 4096} {
+		out, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(concatenated),
+			pbzip2.ScannerOptions(pbzip2.ScanBlockOverhead(1), pbzip2.ScanReadSize(readSize))))
+		if err != nil {
+			t.Fatalf("%v: %v", readSize, err)
+		}
+		if !bytes.Equal(out, actual) {
+			t.Errorf("%v: got %v bytes, want %v bytes", readSize, len(out), len(actual))
+		}
+	}
+
+	// ScanMaxBuffer bounds the growth.
+	sc = pbzip2.NewScanner(bytes.NewReader(compressed), pbzip2.ScanBlockOverhead(1), pbzip2.ScanMaxBuffer(100*1000+100))
+	if sc.Scan(ctx) {
+		t.Errorf("scan unexpectedly succeeded")
+	}
+	if err := sc.Err(); err == nil || !strings.Contains(err.Error(), "failed to find next block within expected max buffer size of 100100") {
+		t.Errorf("missing or wrong error: %v", err)
+	}
+}
+
+// stallingReader returns a single byte per call to Read, with every
+// stallEvery bytes being preceded by more consecutive calls that return
+// no data, and no error, than bufio.Reader will tolerate.
+type stallingReader struct {
+	rd         io.Reader
+	n, stalled int
+	stallEvery int
+}
+
+func (sr *stallingReader) Read(buf []byte) (int, error) {
+	if sr.n%sr.stallEvery == 0 && sr.stalled < 200 {
+		sr.stalled++
+		return 0, nil
+	}
+	sr.stalled = 0
+	n, err := sr.rd.Read(buf[:1])
+	sr.n += n
+	return n, err
+}
+
+func TestTrickleReader(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range []string{"hello", "300KB1", "900KB9"} {
+		compressed, _ := readFile(t, name)
+		for i, rd := range []io.Reader{
+			iotest.OneByteReader(bytes.NewReader(compressed)),
+			&stallingReader{rd: bytes.NewReader(compressed), stallEvery: 50000},
+		} {
+			out, err := io.ReadAll(pbzip2.NewReader(ctx, rd))
+			if err != nil {
+				t.Errorf("%v: %v: %v", name, i, err)
+				continue
+			}
+			if got, want := out, bzip2Data[name]; !bytes.Equal(got, want) {
+				t.Errorf("%v: %v: got %v bytes, want %v bytes", name, i, len(got), len(want))
+			}
+		}
+	}
+}
+
+// chunkReader returns at most size bytes per call to Read and counts the
+// number of calls.
+type chunkReader struct {
+	rd    io.Reader
+	size  int
+	reads int
+}
+
+func (cr *chunkReader) Read(buf []byte) (int, error) {
+	cr.reads++
+	if cr.size > 0 && len(buf) > cr.size {
+		buf = buf[:cr.size]
+	}
+	return cr.rd.Read(buf)
+}
+
+func TestScanReadSize(t *testing.T) {
+	ctx := context.Background()
+	scan := func(rd io.Reader, opts ...pbzip2.ScannerOption) ([]pbzip2.CompressedBlock, error) {
+		var blocks []pbzip2.CompressedBlock
+		sc := pbzip2.NewScanner(rd, opts...)
+		for sc.Scan(ctx) {
+			blocks = append(blocks, sc.Block())
+		}
+		return blocks, sc.Err()
+	}
+	compressed, _ := concatFiles(t, "hello", "900KB1", "300KB5", "hello")
+	want, err := scan(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The header must be parsed correctly when the input returns fewer
+	// bytes than were requested.
+	got, err := scan(&chunkReader{rd: bytes.NewReader(compressed), size: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mismatched blocks for 2 byte reads")
+	}
+
+	reads := func(opts ...pbzip2.ScannerOption) int {
+		cr := &chunkReader{rd: bytes.NewReader(compressed)}
+		got, err := scan(cr, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: mismatched blocks", len(opts))
+		}
+		return cr.reads
+	}
+	small, large := reads(), reads(pbzip2.ScanReadSize(len(compressed)*2))
+	if large >= small {
+		t.Errorf("larger read size did not reduce the number of reads: %v >= %v", large, small)
+	}
+	// The read size is bounded by the maximum buffer size.
+	reads(pbzip2.ScanReadSize(len(compressed)*2), pbzip2.ScanMaxBuffer(1000*1000))
+}
+
+func TestScanHeaderShortReads(t *testing.T) {
+	ctx := context.Background()
+	compressed, _ := readFile(t, "hello")
+	for _, rd := range []io.Reader{
+		iotest.OneByteReader(bytes.NewReader(compressed)),
+		iotest.DataErrReader(iotest.OneByteReader(bytes.NewReader(compressed))),
+	} {
+		sc := pbzip2.NewScanner(rd)
+		n := 0
+		for sc.Scan(ctx) {
+			n++
+		}
+		if err := sc.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := n, 1; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		sc := pbzip2.NewScanner(iotest.OneByteReader(bytes.NewReader(compressed[:i])))
+		if sc.Scan(ctx) {
+			t.Errorf("%v: unexpected block", i)
+		}
+		if err := sc.Err(); err == nil || err.Error() != fmt.Sprintf("stream header is too small: %v", i) {
+			t.Errorf("%v: missing or unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestScanHeaderless(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name  string
+		level pbzip2.BlockSizeLevel
+	}{
+		{"hello", 9},
+		{"300KB1", 1},
+		{"300KB5", 5},
+		{"900KB9", 9},
+	} {
+		compressed, _ := readFile(t, tc.name)
+		want := scanBlocks(t, compressed)
+		var got []pbzip2.CompressedBlock
+		sc := pbzip2.NewScanner(bytes.NewReader(compressed[4:]), pbzip2.ScanHeaderless(tc.level))
+		for sc.Scan(ctx) {
+			got = append(got, sc.Block())
+		}
+		if err := sc.Err(); err != nil {
+			t.Fatalf("%v: %v", tc.name, err)
+		}
+		if got, want := len(got), len(want); got != want {
+			t.Fatalf("%v: got %v, want %v", tc.name, got, want)
+		}
+		for i := range got {
+			g, w := got[i], want[i]
+			if g.CRC != w.CRC || g.BitOffset != w.BitOffset || g.SizeInBits != w.SizeInBits || g.StreamBlockSize != w.StreamBlockSize || !bytes.Equal(g.Data, w.Data) {
+				t.Errorf("%v: block %v: got %v, want %v", tc.name, i, g, w)
+			}
+		}
+		dc := pbzip2.NewDecompressor(ctx)
+		go func() {
+			for _, b := range got {
+				if err := dc.Append(b); err != nil {
+					break
+				}
+			}
+			dc.Finish()
+		}()
+		out, err := io.ReadAll(dc)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.name, err)
+		}
+		if want := bzip2Data[tc.name]; !bytes.Equal(out, want) {
+			t.Errorf("%v: got %v bytes, want %v bytes", tc.name, len(out), len(want))
+		}
+	}
+
+	compressed, _ := readFile(t, "hello")
+	sc := pbzip2.NewScanner(bytes.NewReader(compressed[4:]), pbzip2.ScanHeaderless(10))
+	if sc.Scan(ctx) {
+		t.Errorf("unexpected block")
+	}
+	if err := sc.Err(); err == nil || err.Error() != "bad block size: 10" {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+}
+
+func TestCompressedBlockMarshal(t *testing.T) {
+	compressed, _ := concatFiles(t, "300KB1", "empty", "hello")
+	blocks := scanBlocks(t, compressed)
+	var out []byte
+	for i, block := range blocks {
+		buf, err := block.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got pbzip2.CompressedBlock
+		if err := got.UnmarshalBinary(buf); err != nil {
+			t.Fatalf("%v: %v", i, err)
+		}
+		if !reflect.DeepEqual(got, block) {
+			t.Errorf("%v: got %v, want %v", i, got, block)
+		}
+		data, err := io.ReadAll(bzip2.NewBlockReader(got.StreamBlockSize, got.Data, uint(got.BitOffset)))
+		if err != nil {
+			t.Fatalf("%v: %v", i, err)
+		}
+		out = append(out, data...)
+
+		// Without the compressed data.
+		metadata := block.AppendBinary(nil, false)
+		if len(metadata) >= len(buf) {
+			t.Errorf("%v: encoding without data is not smaller: %v >= %v", i, len(metadata), len(buf))
+		}
+		got = pbzip2.CompressedBlock{Data: []byte{1}}
+		if err := got.UnmarshalBinary(metadata); err != nil {
+			t.Fatalf("%v: %v", i, err)
+		}
+		want := block
+		want.Data = nil
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+	}
+	if got, want := out, append(bzip2Data["300KB1"], bzip2Data["hello"]...); !bytes.Equal(got, want) {
+		t.Errorf("got %v bytes, want %v bytes", len(got), len(want))
+	}
+
+	// Several blocks may be appended to the same buffer.
+	var index []byte
+	for _, block := range blocks {
+		index = block.AppendBinary(index, false)
+	}
+	if got, want := len(index), 0; got == want {
+		t.Errorf("empty index")
+	}
+
+	buf, _ := blocks[0].MarshalBinary()
+	var cb pbzip2.CompressedBlock
+	for i, tc := range []struct {
+		buf []byte
+		err string
+	}{
+		{nil, "invalid compressed block encoding: too short"},
+		{buf[:len(buf)-1], "invalid compressed block encoding: too short"},
+		{append(append([]byte{}, buf...), 0), "invalid compressed block encoding: 1 trailing bytes"},
+		{append([]byte{2}, buf[1:]...), "invalid compressed block encoding: unsupported version: 2"},
+	} {
+		if err := cb.UnmarshalBinary(tc.buf); err == nil || err.Error() != tc.err {
+			t.Errorf("%v: missing or unexpected error: %v", i, err)
+		}
+	}
+
+	// Encodings of blocks with inconsistent fields are rejected.
+	for i, tc := range []struct {
+		modify      func(*pbzip2.CompressedBlock)
+		includeData bool
+		err         string
+	}{
+		{func(b *pbzip2.CompressedBlock) { b.BitOffset = 8 }, true, "bit offset out of range: 8"},
+		{func(b *pbzip2.CompressedBlock) { b.BitOffset = -1 }, false, "bit offset out of range: -1"},
+		{func(b *pbzip2.CompressedBlock) { b.SizeInBits = len(b.Data)*8 - b.BitOffset + 1 }, true, "size in bits out of range: "},
+		{func(b *pbzip2.CompressedBlock) { b.SizeInBits = -1 }, false, "size in bits out of range: -1"},
+		{func(b *pbzip2.CompressedBlock) { b.StreamBlockSize = 0 }, true, "invalid stream block size: 0"},
+		{func(b *pbzip2.CompressedBlock) { b.StreamBlockSize = 150 * 1000 }, false, "invalid stream block size: 150000"},
+		{func(b *pbzip2.CompressedBlock) { b.StreamBlockSize = 1000 * 1000 }, true, "invalid stream block size: 1000000"},
+	} {
+		block := blocks[0]
+		block.Data = append([]byte{}, block.Data...)
+		tc.modify(&block)
+		err := cb.UnmarshalBinary(block.AppendBinary(nil, tc.includeData))
+		if err == nil || !strings.HasPrefix(err.Error(), "invalid compressed block encoding: "+tc.err) {
+			t.Errorf("%v: missing or unexpected error: %v", i, err)
+		}
+	}
+	// The size of the compressed data can only be checked when it is
+	// included.
+	block := blocks[0]
+	block.SizeInBits = len(block.Data)*8 + 1
+	if err := cb.UnmarshalBinary(block.AppendBinary(nil, false)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestStartBitOffset(t *testing.T) {
+	ctx := context.Background()
+	for _, names := range [][]string{
+		{"hello"},
+		{"300KB1"},
+		{"900KB9"},
+		{"300KB1", "hello", "900KB1", "300KB5"},
+	} {
+		compressed, _ := concatFiles(t, names...)
+		var (
+			offsets []uint
+			sizes   []uint
+		)
+		sc := pbzip2.NewScanner(bytes.NewReader(compressed))
+		for sc.Scan(ctx) {
+			block := sc.Block()
+			offsets = append(offsets, uint(block.StartBitOffset()))
+			sizes = append(sizes, uint(block.SizeInBits))
+		}
+		if err := sc.Err(); err != nil {
+			t.Fatalf("%v: %v", names, err)
+		}
+		rd := bzip2.NewReaderWithStats(bytes.NewReader(compressed))
+		if _, err := io.ReadAll(rd); err != nil {
+			t.Fatalf("%v: %v", names, err)
+		}
+		stats := bzip2.StreamStats(rd)
+		if got, want := offsets, stats.BlockStartOffsets; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", names, got, want)
+		}
+		if len(names) == 1 {
+			if got, want := sizes, stats.BlockSizes(); !reflect.DeepEqual(got, want) {
+				t.Errorf("%v: got %v, want %v", names, got, want)
+			}
+		}
+	}
+}
+
+func TestBytesConsumed(t *testing.T) {
+	ctx := context.Background()
+	for _, names := range [][]string{
+		{"hello"},
+		{"300KB1"},
+		{"900KB9"},
+		{"hello", "empty", "300KB1", "empty", "empty"},
+	} {
+		compressed, _ := concatFiles(t, names...)
+		sc := pbzip2.NewScanner(bytes.NewReader(compressed))
+		if got, want := sc.BytesConsumed(), int64(0); got != want {
+			t.Errorf("%v: got %v, want %v", names, got, want)
+		}
+		prev := int64(0)
+		for sc.Scan(ctx) {
+			block := sc.Block()
+			consumed := sc.BytesConsumed()
+			if consumed <= prev || consumed < block.Offset+int64(len(block.Data)) {
+				t.Errorf("%v: consumed %v, previous %v, block: %v", names, consumed, prev, block)
+			}
+			prev = consumed
+		}
+		if err := sc.Err(); err != nil {
+			t.Fatalf("%v: %v", names, err)
+		}
+		if got, want := sc.BytesConsumed(), int64(len(compressed)); got != want {
+			t.Errorf("%v: got %v, want %v", names, got, want)
+		}
+	}
+}
+
+func TestTrailingPaddingBits(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		names   []string
+		padding int
+	}{
+		{[]string{"empty"}, 0},
+		{[]string{"hello"}, 3},
+		{[]string{"300KB1"}, 1},
+		{[]string{"300KB5"}, 4},
+		{[]string{"900KB1"}, 2},
+		{[]string{"900KB9"}, 5},
+		{[]string{"900KB9", "hello"}, 3},
+		{[]string{"hello", "900KB9"}, 5},
+		// Empty streams are byte aligned.
+		{[]string{"hello", "empty"}, 0},
+	} {
+		compressed, _ := concatFiles(t, tc.names...)
+		sc := pbzip2.NewScanner(bytes.NewReader(compressed))
+		for sc.Scan(ctx) {
+			if !sc.Block().EOS {
+				if got, want := sc.TrailingPaddingBits(), 0; got != want {
+					t.Errorf("%v: got %v, want %v", tc.names, got, want)
+				}
+			}
+		}
+		if err := sc.Err(); err != nil {
+			t.Fatalf("%v: %v", tc.names, err)
+		}
+		padding := sc.TrailingPaddingBits()
+		if got, want := padding, tc.padding; got != want {
+			t.Errorf("%v: got %v, want %v", tc.names, got, want)
+		}
+		// Padding bits are always zero.
+		if last := compressed[len(compressed)-1]; last&(1<<padding-1) != 0 {
+			t.Errorf("%v: padding bits are not zero: %08b", tc.names, last)
+		}
+	}
+}
+
+func TestScannerReset(t *testing.T) {
+	ctx := context.Background()
+	scanAll := func(sc *pbzip2.Scanner) ([]pbzip2.CompressedBlock, int64, error) {
+		var blocks []pbzip2.CompressedBlock
+		for sc.Scan(ctx) {
+			blocks = append(blocks, sc.Block())
+		}
+		return blocks, sc.BytesConsumed(), sc.Err()
+	}
+	var sc *pbzip2.Scanner
+	for _, name := range []string{"hello", "300KB1", "corrupt", "empty", "900KB9", "hello", "300KB5"} {
+		var compressed []byte
+		if name == "corrupt" {
+			compressed = []byte("BZh9 not a bzip2 stream")
+		} else {
+			compressed, _ = readFile(t, name)
+		}
+		if sc == nil {
+			sc = pbzip2.NewScanner(bytes.NewReader(compressed))
+		} else {
+			sc.Reset(bytes.NewReader(compressed))
+		}
+		got, gotConsumed, gotErr := scanAll(sc)
+		want, wantConsumed, wantErr := scanAll(pbzip2.NewScanner(bytes.NewReader(compressed)))
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", name, got, want)
+		}
+		if gotConsumed != wantConsumed {
+			t.Errorf("%v: got %v, want %v", name, gotConsumed, wantConsumed)
+		}
+		if fmt.Sprint(gotErr) != fmt.Sprint(wantErr) {
+			t.Errorf("%v: got %v, want %v", name, gotErr, wantErr)
+		}
+		if name == "corrupt" && gotErr == nil {
+			t.Errorf("%v: expected an error", name)
+		}
+	}
+}
+
+func TestScannerDone(t *testing.T) {
+	ctx := context.Background()
+	compressed, _ := concatFiles(t, "hello", "300KB1", "empty")
+	truncated := compressed[:len(compressed)-100]
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	for i, tc := range []struct {
+		ctx        context.Context
+		compressed []byte
+		done       bool
+	}{
+		{ctx, compressed, true},
+		{ctx, []byte("BZh9 not a bzip2 stream"), false},
+		{ctx, truncated, false},
+		{canceled, compressed, false},
+	} {
+		sc := pbzip2.NewScanner(bytes.NewReader(tc.compressed))
+		if sc.Done() {
+			t.Errorf("%v: done before scanning", i)
+		}
+		for sc.Scan(tc.ctx) {
+		}
+		if got, want := sc.Done(), tc.done; got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+		if got, want := sc.Err() == nil, tc.done; got != want {
+			t.Errorf("%v: got %v, want %v: %v", i, got, want, sc.Err())
+		}
+		sc.Reset(bytes.NewReader(compressed))
+		if sc.Done() {
+			t.Errorf("%v: done after reset", i)
+		}
+	}
+}
+
+func BenchmarkScannerReset(b *testing.B) {
+	input, err := os.ReadFile("testdata/hello.bz2")
+	if err != nil {
+		b.Fatal(err)
+	}
+	scan := func(b *testing.B, sc *pbzip2.Scanner) {
+		for sc.Scan(context.Background()) {
+			sc.Block()
+		}
+		if sc.Err() != nil {
+			b.Fatal(sc.Err())
+		}
+	}
+	b.Run("new", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			scan(b, pbzip2.NewScanner(bytes.NewReader(input)))
+		}
+	})
+	b.Run("reset", func(b *testing.B) {
+		b.ReportAllocs()
+		sc := pbzip2.NewScanner(bytes.NewReader(input))
+		for i := 0; i < b.N; i++ {
+			sc.Reset(bytes.NewReader(input))
+			scan(b, sc)
+		}
+	})
+}
+
+func FuzzScanner(f *testing.F) {
+	for _, name := range []string{"empty", "hello", "hello_world", "100KB1"} {
+		data, err := os.ReadFile(filepath.Join("testdata", name+".bz2"))
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		sc := pbzip2.NewScanner(bytes.NewReader(data))
+		for sc.Scan(context.Background()) {
+			sc.Block()
+		}
+		sc.Err()
+	})
+}
@@ -0,0 +1,68 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"fmt"
+	"io"
+)
+
+//go:embed testdata/hello.bz2
+var selfTestInput []byte
+
+const (
+	selfTestOutput = "hello world\n"
+	selfTestCRC    = 0x4eece836
+)
+
+// SelfTest decompresses a small, embedded, bzip2 file and verifies its
+// output and CRCs. It is intended for use as a smoke test that confirms
+// that the package works as expected in a given build and environment.
+// Both the sequential and concurrent decompression paths are tested.
+func SelfTest() error {
+	ctx := context.Background()
+	sc := NewScanner(bytes.NewReader(selfTestInput))
+	var blocks []CompressedBlock
+	for sc.Scan(ctx) {
+		blocks = append(blocks, sc.Block())
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("self test: scan: %w", err)
+	}
+	if len(blocks) != 1 {
+		return fmt.Errorf("self test: scan: unexpected number of blocks: %v != 1", len(blocks))
+	}
+	if b := blocks[0]; !b.EOS || b.CRC != selfTestCRC || b.StreamCRC != selfTestCRC {
+		return fmt.Errorf("self test: scan: unexpected block or stream CRC: 0x%08x, 0x%08x != 0x%08x", b.CRC, b.StreamCRC, selfTestCRC)
+	}
+	// The sequential path, as used by NewReader for a single block.
+	out, err := io.ReadAll(NewReader(ctx, bytes.NewReader(selfTestInput)))
+	if err := selfTestCheck("sequential", out, err); err != nil {
+		return err
+	}
+	// The concurrent path.
+	dc := NewDecompressor(ctx, BZConcurrency(2))
+	go func() {
+		if err := dc.Append(blocks[0]); err != nil {
+			dc.Cancel(err)
+		}
+		dc.Finish()
+	}()
+	out, err = io.ReadAll(dc)
+	return selfTestCheck("concurrent", out, err)
+}
+
+func selfTestCheck(path string, out []byte, err error) error {
+	if err != nil {
+		return fmt.Errorf("self test: %v: %w", path, err)
+	}
+	if string(out) != selfTestOutput {
+		return fmt.Errorf("self test: %v: unexpected output: %q != %q", path, out, selfTestOutput)
+	}
+	return nil
+}
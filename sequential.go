@@ -0,0 +1,161 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// sequential decompresses its input one block at a time in the goroutine
+// that calls Read. It is used by NewReader when the concurrency is one or
+// when the input consists of a single block, since the goroutines, channels
+// and pipe used by the Decompressor offer no benefit in either case.
+// It otherwise behaves as the Decompressor does, ie. it verifies CRCs,
+// merges blocks split by a false positive match of the block magic
+// number and sends progress reports and diagnostics.
+type sequential struct {
+	sc      *Scanner
+	dc      *Decompressor
+	pending *CompressedBlock
+	order   uint64
+	out     []byte
+	err     error
+	// buf is the buffer that the block whose output is being read was
+	// decompressed into.
+	buf []byte
+}
+
+func newSequential(sc *Scanner, dc *Decompressor, first CompressedBlock) *sequential {
+	dc.started = time.Now()
+	return &sequential{sc: sc, dc: dc, pending: &first}
+}
+
+func (s *sequential) Read(ctx context.Context, buf []byte) (int, error) {
+	for len(s.out) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		s.err = s.next(ctx)
+	}
+	n := copy(buf, s.out)
+	s.out = s.out[n:]
+	if len(s.out) == 0 {
+		// Drop the reference to the block's output so that its
+		// buffer may be recycled.
+		s.out = nil
+		s.dc.releaseBuffer(s.buf)
+		s.buf = nil
+	}
+	return n, nil
+}
+
+// scan returns the next block, if any.
+func (s *sequential) scan(ctx context.Context) (CompressedBlock, bool) {
+	if s.pending != nil {
+		cb := *s.pending
+		s.pending = nil
+		return cb, true
+	}
+	if !s.sc.Scan(ctx) {
+		return CompressedBlock{}, false
+	}
+	return s.sc.Block(), true
+}
+
+// decompress decompresses the supplied block, subject to the
+// decompressor's concurrency pool, if any.
+func (s *sequential) decompress(ctx context.Context, block *blockDesc) error {
+	if pool := s.dc.pool; pool != nil {
+		wait := time.Now()
+		select {
+		case <-pool:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		s.dc.metrics.addPoolWait(time.Since(wait))
+		defer func() { pool <- struct{}{} }()
+	}
+	s.dc.decompress(ctx, block)
+	s.dc.metrics.addBlock()
+	return nil
+}
+
+// next decompresses the next block and makes its output available to
+// Read, any error it returns is returned by Read once that output has
+// been read. It returns io.EOF once all of the input has been
+// decompressed.
+func (s *sequential) next(ctx context.Context) error {
+	dc := s.dc
+	cb, ok := s.scan(ctx)
+	if !ok {
+		// As for the Decompressor, the final report is sent once all
+		// of the scanned blocks have been decompressed, even if the
+		// scanner subsequently failed.
+		dc.sendFinalProgress(ctx)
+		if err := s.sc.Err(); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+	s.order++
+	block := &blockDesc{CompressedBlock: cb, order: s.order}
+	if err := s.decompress(ctx, block); err != nil {
+		return err
+	}
+	merged := false
+	if block.err != nil {
+		// See Decompressor.tryMergeBlocks.
+		if errors.Is(block.err, context.DeadlineExceeded) {
+			return block.err
+		}
+		next, ok := s.scan(ctx)
+		if !ok {
+			return levelMismatch(block, block.err)
+		}
+		cb, err := mergeBlocks(dc.blockMagic, block.CompressedBlock, next)
+		if err != nil {
+			return levelMismatch(block, block.err)
+		}
+		mergedBlock := &blockDesc{CompressedBlock: cb, order: block.order}
+		if err := s.decompress(ctx, mergedBlock); err != nil {
+			return err
+		}
+		if mergedBlock.err != nil {
+			return levelMismatch(block, block.err)
+		}
+		s.order++
+		block, merged = mergedBlock, true
+	}
+	if err := dc.writeMirror(block); err != nil {
+		return err
+	}
+	// As for the Decompressor, the output of the block is returned
+	// before any stream CRC error.
+	s.out, s.buf = block.uncompressed, block.uncompressed
+	if pad := dc.padding(len(s.out)); len(pad) > 0 {
+		s.out = append(s.out, pad...)
+	}
+	if err := dc.handlePossibleEOS(block); err != nil {
+		return err
+	}
+	dc.sendBoundary(ctx, block)
+	dc.totalCompressed += int64(len(block.Data))
+	dc.totalDecompressed += int64(len(block.uncompressed))
+	dc.sendDiagnostics(ctx, block, merged)
+	dc.sendProgress(ctx, Progress{
+		Duration:   block.duration,
+		Block:      block.order,
+		CRC:        block.CRC,
+		Compressed: len(block.Data),
+		Size:       len(block.uncompressed),
+	})
+	return nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Source represents bzip2 data, such as a local file or a URL, that is
+// opened on demand. Implementations for other storage systems, such as
+// S3 or GCS, may be registered via RegisterSource. An implementation for
+// http and https URLs is provided by the httpsource package.
+type Source interface {
+	// Open returns a reader for the source's data and its size in bytes,
+	// or -1 if the size is not known. If the reader also implements
+	// io.ReaderAt it may be read concurrently, see NewReaderFromSource.
+	// If it implements io.Closer then the caller must close it.
+	Open(ctx context.Context) (io.Reader, int64, error)
+}
+
+// SourceFunc allows a function to be used as a Source.
+type SourceFunc func(ctx context.Context) (io.Reader, int64, error)
+
+// Open implements Source.
+func (fn SourceFunc) Open(ctx context.Context) (io.Reader, int64, error) {
+	return fn(ctx)
+}
+
+var sources = struct {
+	sync.Mutex
+	schemes map[string]func(name string) (Source, error)
+}{schemes: map[string]func(string) (Source, error){}}
+
+// RegisterSource registers a function that is used by NewSource to create
+// a Source for names with the specified URL scheme, eg. "s3" for names of
+// the form "s3://bucket/key". It allows for storage systems that are not
+// supported by this package, including http and https URLs (see the
+// httpsource package), to be used in the same way as local files.
+func RegisterSource(scheme string, fn func(name string) (Source, error)) {
+	sources.Lock()
+	defer sources.Unlock()
+	sources.schemes[scheme] = fn
+}
+
+// NewSource returns a Source for name, which may be a URL whose scheme was
+// registered via RegisterSource or a local filename. Note that the http
+// and https schemes are only supported if the httpsource package has been
+// imported.
+func NewSource(name string) (Source, error) {
+	idx := strings.Index(name, "://")
+	if idx < 0 {
+		return FileSource(name), nil
+	}
+	scheme := name[:idx]
+	sources.Lock()
+	fn := sources.schemes[scheme]
+	sources.Unlock()
+	if fn == nil {
+		return nil, fmt.Errorf("unsupported scheme: %v", scheme)
+	}
+	return fn(name)
+}
+
+// NewReaderFromSource opens src and returns a reader that decompresses
+// its data. If the reader returned by src.Open implements io.ReaderAt and
+// the size of the data is known then it is decompressed using
+// NewParallelReaderAt, otherwise NewReader is used. Closing the returned
+// reader also closes the reader returned by src.Open if it implements
+// io.Closer.
+func NewReaderFromSource(ctx context.Context, src Source, opts ...ReaderOption) (io.ReadCloser, error) {
+	rd, size, err := src.Open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var drd *reader
+	if ra, ok := rd.(io.ReaderAt); ok && size >= 0 {
+		drd = NewParallelReaderAt(ctx, ra, size, opts...).(*reader)
+	} else {
+		drd = NewReader(ctx, rd, opts...).(*reader)
+	}
+	drd.closer, _ = rd.(io.Closer)
+	return drd, nil
+}
+
+// FileSource returns a Source for the named local file. The reader
+// returned by its Open method is an *os.File, and the size is -1 for
+// anything other than a regular file.
+func FileSource(name string) Source {
+	return fileSource(name)
+}
+
+type fileSource string
+
+// Open implements Source.
+func (fs fileSource) Open(ctx context.Context) (io.Reader, int64, error) {
+	file, err := os.Open(string(fs))
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	if !info.Mode().IsRegular() {
+		return file, -1, nil
+	}
+	return file, info.Size(), nil
+}
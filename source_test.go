@@ -0,0 +1,88 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/cosnicolaou/pbzip2"
+)
+
+func readSource(ctx context.Context, t *testing.T, src pbzip2.Source) ([]byte, error) {
+	t.Helper()
+	rd, err := pbzip2.NewReaderFromSource(ctx, src,
+		pbzip2.DecompressionOptions(pbzip2.BZConcurrency(2)))
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	return io.ReadAll(rd)
+}
+
+func TestFileSource(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range []string{"empty", "hello", "300KB1", "900KB9"} {
+		filename := bzip2Files[name] + ".bz2"
+		src, err := pbzip2.NewSource(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compressed, _ := readFile(t, name)
+		rd, size, err := src.Open(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := rd.(io.ReaderAt); !ok {
+			t.Errorf("%v: not an io.ReaderAt", name)
+		}
+		if got, want := size, int64(len(compressed)); got != want {
+			t.Errorf("%v: got %v, want %v", name, got, want)
+		}
+		rd.(io.Closer).Close()
+
+		got, err := readSource(ctx, t, src)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if want := bzip2Data[name]; !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v bytes, want %v bytes", name, len(got), len(want))
+		}
+	}
+
+	if _, err := readSource(ctx, t, pbzip2.FileSource("does-not-exist.bz2")); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestRegisterSource(t *testing.T) {
+	ctx := context.Background()
+	compressed, _ := readFile(t, "300KB1")
+	for _, name := range []string{"mem://300KB1", "http://localhost/300KB1.bz2"} {
+		// http is only supported once the httpsource package is imported.
+		if _, err := pbzip2.NewSource(name); err == nil || !strings.Contains(err.Error(), "unsupported scheme: ") {
+			t.Errorf("%v: missing or unexpected error: %v", name, err)
+		}
+	}
+	pbzip2.RegisterSource("mem", func(name string) (pbzip2.Source, error) {
+		return pbzip2.SourceFunc(func(context.Context) (io.Reader, int64, error) {
+			return bytes.NewReader(compressed), int64(len(compressed)), nil
+		}), nil
+	})
+	src, err := pbzip2.NewSource("mem://300KB1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := readSource(ctx, t, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := bzip2Data["300KB1"]; !bytes.Equal(got, want) {
+		t.Errorf("got %v bytes, want %v bytes", len(got), len(want))
+	}
+}
@@ -15,13 +15,43 @@ func GetNumDecompressionGoRoutines() int64 {
 	return atomic.LoadInt64(&numDecompressionGoRoutines)
 }
 
+// DebugActiveReaders returns the number of readers, as returned by
+// NewReader and related functions, whose internal goroutine has yet to
+// exit. It can be used to verify that readers are fully torn down.
+func DebugActiveReaders() int {
+	return int(atomic.LoadInt64(&numActiveReaders))
+}
+
+// BZNoSequential forces NewReader to use the Decompressor, rather than
+// decompressing synchronously, for a concurrency of 1 or a single block.
+func BZNoSequential() DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.noSequential = true
+	}
+}
+
+func ScannerBufferSize(sc *Scanner) int {
+	return sc.brd.Size()
+}
+
+// SetCustomBlockMagic changes the package level block magic number used
+// by subsequently created scanners and decompressors.
+//
+// Deprecated: use ScanBlockMagic and BZBlockMagic instead.
 func SetCustomBlockMagic(magic [6]byte) {
 	pretestBlockMagicLookup, firstBlockMagicLookup, secondBlockMagicLookup = bitstream.Init(magic)
 	copy(blockMagic[:], magic[:])
 }
 
+// ResetBlockMagic restores the package level block magic number.
+//
+// Deprecated: use ScanBlockMagic and BZBlockMagic instead.
 func ResetBlockMagic() {
 	pretestBlockMagicLookup, firstBlockMagicLookup, secondBlockMagicLookup = bitstream.Init(bzip2.BlockMagic)
 	copy(blockMagic[:], bzip2.BlockMagic[:])
 	copy(eosMagic[:], bzip2.EOSMagic[:])
 }
+
+func MergeBlocksWithMagic(magic [6]byte, a, b CompressedBlock) (CompressedBlock, error) {
+	return mergeBlocks(magic, a, b)
+}
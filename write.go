@@ -0,0 +1,54 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/cosnicolaou/pbzip2/internal/bitstream"
+)
+
+// WriteStream writes the supplied blocks, as returned by Scanner.Block,
+// to w as a single, valid, bzip2 stream compressed at the specified
+// level. The compressed data of each block is copied verbatim and the
+// stream CRC is recomputed from the block CRCs, hence blocks may be
+// reordered, omitted or taken from different streams provided that none
+// of them were compressed at a higher level than the one specified, since
+// the level determines the maximum block size. The EOS status of each
+// block is ignored, as are blocks that contain no data, such as those
+// returned for empty streams.
+func WriteStream(w io.Writer, level BlockSizeLevel, blocks []CompressedBlock) error {
+	if level < 1 || level > 9 {
+		return fmt.Errorf("invalid block size level: %v", level)
+	}
+	size := 4 + 10
+	for _, b := range blocks {
+		size += len(b.Data) + len(blockMagic) + 1
+	}
+	bw := &bitstream.BitWriter{}
+	bw.Init([]byte{'B', 'Z', 'h', byte('0' + level)}, 32, size)
+	var streamCRC uint32
+	for i, b := range blocks {
+		if b.SizeInBits == 0 {
+			// The block returned by the scanner for an empty stream.
+			continue
+		}
+		if got := b.Level(); got > level {
+			return fmt.Errorf("block %v: mismatched block size level: %v != %v", i+1, got, level)
+		}
+		bw.Append(blockMagic[:], 0, len(blockMagic)*8)
+		bw.Append(b.Data, b.BitOffset, b.SizeInBits)
+		streamCRC = updateStreamCRC(streamCRC, b.CRC)
+	}
+	trailer := make([]byte, len(eosMagic)+4)
+	copy(trailer, eosMagic[:])
+	binary.BigEndian.PutUint32(trailer[len(eosMagic):], streamCRC)
+	bw.Append(trailer, 0, len(trailer)*8)
+	data, _ := bw.Data()
+	_, err := w.Write(data)
+	return err
+}
@@ -0,0 +1,92 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2_test
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/cosnicolaou/pbzip2"
+)
+
+func scanBlocks(t *testing.T, compressed []byte) []pbzip2.CompressedBlock {
+	var blocks []pbzip2.CompressedBlock
+	sc := pbzip2.NewScanner(bytes.NewReader(compressed))
+	for sc.Scan(context.Background()) {
+		blocks = append(blocks, sc.Block())
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return blocks
+}
+
+func TestWriteStream(t *testing.T) {
+	ctx := context.Background()
+	writeAndRead := func(level pbzip2.BlockSizeLevel, blocks []pbzip2.CompressedBlock) []byte {
+		var buf bytes.Buffer
+		if err := pbzip2.WriteStream(&buf, level, blocks); err != nil {
+			t.Fatal(err)
+		}
+		stdout, err := io.ReadAll(bzip2.NewReader(bytes.NewReader(buf.Bytes())))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(buf.Bytes())))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, stdout) {
+			t.Errorf("got %v bytes, stdlib got %v bytes", len(out), len(stdout))
+		}
+		return out
+	}
+
+	for _, name := range []string{"empty", "hello", "300KB1", "900KB9"} {
+		compressed, _ := readFile(t, name)
+		blocks := scanBlocks(t, compressed)
+		level := pbzip2.BlockSizeLevel(compressed[3] - '0')
+		if got, want := writeAndRead(level, blocks), bzip2Data[name]; !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v bytes, want %v bytes", name, len(got), len(want))
+		}
+	}
+
+	// Blocks may be reordered and taken from different streams.
+	first, _ := readFile(t, "300KB1")
+	second, _ := readFile(t, "100KB1")
+	blocks := scanBlocks(t, first)
+	blocks = append(blocks, scanBlocks(t, second)...)
+	var want []byte
+	reordered := make([]pbzip2.CompressedBlock, 0, len(blocks))
+	for i := len(blocks) - 1; i >= 0; i-- {
+		out, err := decompressBlock(blocks[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, out...)
+		reordered = append(reordered, blocks[i])
+	}
+	if got := writeAndRead(1, reordered); !bytes.Equal(got, want) {
+		t.Errorf("got %v bytes, want %v bytes", len(got), len(want))
+	}
+
+	// Blocks compressed at a lower level may be written to a stream
+	// with a higher level.
+	hello, _ := readFile(t, "hello")
+	if got, want := writeAndRead(9, append(scanBlocks(t, hello), reordered...)), append(bzip2Data["hello"], want...); !bytes.Equal(got, want) {
+		t.Errorf("got %v bytes, want %v bytes", len(got), len(want))
+	}
+	err := pbzip2.WriteStream(io.Discard, 1, append(blocks, scanBlocks(t, hello)...))
+	if err == nil || !strings.Contains(err.Error(), "mismatched block size level: 9 != 1") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+	if err := pbzip2.WriteStream(io.Discard, 0, nil); err == nil {
+		t.Errorf("expected an error for an invalid level")
+	}
+}